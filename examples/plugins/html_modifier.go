@@ -5,9 +5,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"golang.org/x/net/html"
 
@@ -17,10 +19,32 @@ import (
 )
 
 // HTMLModifier is an example plugin that modifies HTML content
-type HTMLModifier struct{}
+type HTMLModifier struct {
+	// options are swapped in whole on reload, while requests may be using them
+	options atomic.Pointer[htmlModifierOptions]
+}
+
+// htmlModifierOptions are the plugin's "options" in the XRP configuration
+type htmlModifierOptions struct {
+	// ProcessedBy is the value of the injected processed-by meta tag
+	ProcessedBy string `json:"processed_by"`
+}
+
+// Compile-time interface checks
+var (
+	_ xrpplugin.Plugin       = (*HTMLModifier)(nil)
+	_ xrpplugin.Configurable = (*HTMLModifier)(nil)
+)
 
-// Compile-time interface check
-var _ xrpplugin.Plugin = (*HTMLModifier)(nil)
+// Configure reads the plugin's options from the XRP configuration
+func (h *HTMLModifier) Configure(options json.RawMessage) error {
+	opts := &htmlModifierOptions{ProcessedBy: "xrp-html-modifier"}
+	if err := json.Unmarshal(options, opts); err != nil {
+		return err
+	}
+	h.options.Store(opts)
+	return nil
+}
 
 // ProcessHTMLTree adds a custom header to HTML pages
 func (h *HTMLModifier) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
@@ -36,7 +60,7 @@ func (h *HTMLModifier) ProcessHTMLTree(ctx context.Context, url *url.URL, node *
 		Data: "meta",
 		Attr: []html.Attribute{
 			{Key: "name", Val: "processed-by"},
-			{Key: "content", Val: "xrp-html-modifier"},
+			{Key: "content", Val: h.options.Load().ProcessedBy},
 		},
 	}
 
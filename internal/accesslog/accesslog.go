@@ -0,0 +1,272 @@
+// Package accesslog writes XRP's access log: one structured line per request.
+//
+// Each line records the usual request and response details along with XRP-specific
+// fields: upstream and total latency, the X-XRP-Cache result, the plugins that ran
+// and how long each took, whether the body bypassed processing for size, and the
+// request ID. Two formats are supported:
+//
+// - json: one JSON object per line
+// - combined: the Combined Log Format, then the XRP fields as key=value pairs
+//
+// Tools that parse the Combined Log Format can still read the leading fields of
+// combined lines.
+//
+// Logs go to stdout or to a file. Reopen closes and reopens the file, for use with
+// logrotate (XRP calls it on SIGUSR1).
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// Entry describes a finished request
+type Entry struct {
+	Time      time.Time
+	RequestID string
+	Method    string
+	Host      string
+	Path      string
+	Query     string
+	Proto     string
+	Status    int
+	Bytes     int64
+	ClientIP  string
+	Referer   string
+	UserAgent string
+	// UpstreamDuration is the time spent waiting for backend response headers;
+	// zero if the backend wasn't contacted
+	UpstreamDuration time.Duration
+	Duration         time.Duration
+	// Cache is the X-XRP-Cache result, if any
+	Cache      string
+	Plugins    []PluginTiming
+	SizeBypass bool
+}
+
+// PluginTiming records how long a plugin ran for a request
+type PluginTiming struct {
+	// Name identifies the plugin by its path and name
+	Name     string
+	Duration time.Duration
+}
+
+// Logger writes access log entries
+type Logger struct {
+	format string
+	path   string
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+// New returns a Logger for cfg, opening its file if it has one
+func New(cfg config.AccessLogConfig) (*Logger, error) {
+	l := &Logger{format: cfg.Format, path: cfg.Path, out: os.Stdout}
+	if l.format == "" {
+		l.format = config.AccessLogJSON
+	}
+	if l.path != "" {
+		if err := l.Reopen(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Log writes an entry. Write errors are reported to stderr rather than failing
+// the request.
+func (l *Logger) Log(e *Entry) {
+	var buf bytes.Buffer
+	if l.format == config.AccessLogCombined {
+		writeCombined(&buf, e)
+	} else {
+		writeJSON(&buf, e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "access log write failed: %v\n", err)
+	}
+}
+
+// Reopen closes and reopens the log file, so a rotated file is released. It does
+// nothing when logging to stdout.
+func (l *Logger) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.out = file
+	l.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Close closes the log file, if any
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.out = io.Discard
+	return err
+}
+
+// milliseconds converts d to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type jsonPluginTiming struct {
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+type jsonEntry struct {
+	Time       string             `json:"time"`
+	RequestID  string             `json:"request_id"`
+	Method     string             `json:"method"`
+	Host       string             `json:"host"`
+	Path       string             `json:"path"`
+	Query      string             `json:"query,omitempty"`
+	Proto      string             `json:"proto"`
+	Status     int                `json:"status"`
+	Bytes      int64              `json:"bytes"`
+	ClientIP   string             `json:"client_ip"`
+	Referer    string             `json:"referer,omitempty"`
+	UserAgent  string             `json:"user_agent,omitempty"`
+	UpstreamMS float64            `json:"upstream_ms"`
+	DurationMS float64            `json:"duration_ms"`
+	Cache      string             `json:"cache,omitempty"`
+	Plugins    []jsonPluginTiming `json:"plugins,omitempty"`
+	SizeBypass bool               `json:"size_bypass"`
+}
+
+func writeJSON(buf *bytes.Buffer, e *Entry) {
+	je := jsonEntry{
+		Time:       e.Time.UTC().Format(time.RFC3339Nano),
+		RequestID:  e.RequestID,
+		Method:     e.Method,
+		Host:       e.Host,
+		Path:       e.Path,
+		Query:      e.Query,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		ClientIP:   e.ClientIP,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		UpstreamMS: milliseconds(e.UpstreamDuration),
+		DurationMS: milliseconds(e.Duration),
+		Cache:      e.Cache,
+		SizeBypass: e.SizeBypass,
+	}
+	for _, plugin := range e.Plugins {
+		je.Plugins = append(je.Plugins, jsonPluginTiming{Name: plugin.Name, DurationMS: milliseconds(plugin.Duration)})
+	}
+
+	// Encoding a struct of plain fields can't fail
+	_ = json.NewEncoder(buf).Encode(je)
+}
+
+// writeCombined writes the Combined Log Format line
+//
+//	client - - [time] "request line" status bytes "referer" "user agent"
+//
+// followed by the XRP fields as key=value pairs
+func writeCombined(buf *bytes.Buffer, e *Entry) {
+	uri := e.Path
+	if e.Query != "" {
+		uri += "?" + e.Query
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s %s %s",
+		dash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(e.Method+" "+uri+" "+e.Proto),
+		e.Status,
+		size,
+		quote(e.Referer),
+		quote(e.UserAgent),
+	)
+
+	plugins := make([]string, 0, len(e.Plugins))
+	for _, plugin := range e.Plugins {
+		plugins = append(plugins, fmt.Sprintf("%s:%.3f", plugin.Name, milliseconds(plugin.Duration)))
+	}
+
+	fmt.Fprintf(buf, " host=%s request_id=%s cache=%s upstream_ms=%.3f duration_ms=%.3f plugins=%s size_bypass=%t\n",
+		dash(e.Host),
+		dash(e.RequestID),
+		dash(e.Cache),
+		milliseconds(e.UpstreamDuration),
+		milliseconds(e.Duration),
+		dash(strings.Join(plugins, ",")),
+		e.SizeBypass,
+	)
+}
+
+// dash returns s, or "-" if it is empty, as the Common Log Format does for
+// missing values
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "%20")
+}
+
+// quote returns s as a double-quoted log field, escaping quotes, backslashes, and
+// control characters; empty values are logged as "-"
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:             time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC),
+		RequestID:        "abc123",
+		Method:           "GET",
+		Host:             "example.com",
+		Path:             "/articles/one",
+		Query:            "page=2",
+		Proto:            "HTTP/1.1",
+		Status:           200,
+		Bytes:            1234,
+		ClientIP:         "192.0.2.1",
+		Referer:          "https://example.com/",
+		UserAgent:        `curl/8.0 "test"`,
+		UpstreamDuration: 12500 * time.Microsecond,
+		Duration:         20 * time.Millisecond,
+		Cache:            "MISS",
+		Plugins: []PluginTiming{
+			{Name: "HTMLModifierPlugin", Duration: 3 * time.Millisecond},
+		},
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	writeJSON(&buf, testEntry())
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"time":        "2024-03-01T12:30:45Z",
+		"request_id":  "abc123",
+		"host":        "example.com",
+		"path":        "/articles/one",
+		"query":       "page=2",
+		"status":      float64(200),
+		"bytes":       float64(1234),
+		"client_ip":   "192.0.2.1",
+		"upstream_ms": 12.5,
+		"duration_ms": float64(20),
+		"cache":       "MISS",
+		"size_bypass": false,
+	}
+	for key, value := range expected {
+		if decoded[key] != value {
+			t.Errorf("%s = %v, expected %v", key, decoded[key], value)
+		}
+	}
+
+	plugins, _ := decoded["plugins"].([]interface{})
+	if len(plugins) != 1 {
+		t.Fatalf("expected one plugin timing, got %v", decoded["plugins"])
+	}
+	plugin := plugins[0].(map[string]interface{})
+	if plugin["name"] != "HTMLModifierPlugin" || plugin["duration_ms"] != float64(3) {
+		t.Errorf("unexpected plugin timing %v", plugin)
+	}
+}
+
+func TestWriteCombined(t *testing.T) {
+	var buf bytes.Buffer
+	writeCombined(&buf, testEntry())
+
+	expected := `192.0.2.1 - - [01/Mar/2024:12:30:45 +0000] "GET /articles/one?page=2 HTTP/1.1" 200 1234 ` +
+		`"https://example.com/" "curl/8.0 \"test\"" host=example.com request_id=abc123 cache=MISS ` +
+		`upstream_ms=12.500 duration_ms=20.000 plugins=HTMLModifierPlugin:3.000 size_bypass=false` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected combined line:\n got: %s\nwant: %s", buf.String(), expected)
+	}
+
+	// Missing values are logged as "-"
+	buf.Reset()
+	writeCombined(&buf, &Entry{Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 304})
+	if !strings.Contains(buf.String(), `304 - "-" "-" host=- request_id=- cache=-`) {
+		t.Errorf("unexpected combined line for empty entry: %s", buf.String())
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger, err := New(config.AccessLogConfig{Format: config.AccessLogJSON, Path: path})
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	logger.Log(testEntry())
+
+	// Simulate logrotate moving the file away
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	logger.Log(testEntry())
+
+	for _, p := range []string{rotated, path} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 1 {
+			t.Errorf("expected 1 line in %s, got %d", filepath.Base(p), lines)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package admin provides XRP's authenticated admin HTTP API.
+//
+// The API is mounted under /admin/ on the health server and is enabled by setting
+// admin.token in the configuration. Every request must carry the token as a bearer
+// token:
+//
+//	Authorization: Bearer <token>
+//
+// Endpoints:
+//
+// - POST /admin/cache/purge purges cached entries. The JSON body selects what to purge,
+// and must set exactly one of: {"url": "/path?query"} (all Vary variants of a URL),
+// {"prefix": "/articles/"}, {"glob": "/articles/*/comments"}, {"tag": "article-123"}
+// (a Surrogate-Key or Cache-Tag value), or {"all": true}. URL, prefix, and glob purges
+// apply to every host unless "host" is also set (or the url is absolute). It responds
+// with {"purged": <number of entries removed>}.
+//
+// - GET /admin/cache/entry?url=/path?query[&host=example.com] returns metadata (host,
+// age, TTL, ETag, size, headers) for each cached variant of a URL, or 404 if nothing
+// is cached.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cdzombak/xrp/internal/cache"
+)
+
+// Cache is the set of cache operations the admin API exposes
+type Cache interface {
+	PurgeURL(ctx context.Context, u *url.URL) (int, error)
+	PurgePrefix(ctx context.Context, host, prefix string) (int, error)
+	PurgeGlob(ctx context.Context, host, pattern string) (int, error)
+	PurgeTag(ctx context.Context, tag string) (int, error)
+	PurgeAll(ctx context.Context) (int, error)
+	Inspect(ctx context.Context, u *url.URL) ([]cache.EntryInfo, error)
+}
+
+// Handler serves the admin API
+type Handler struct {
+	mu    sync.RWMutex
+	token string
+	cache func() Cache
+	mux   *http.ServeMux
+}
+
+// purgeRequest is the body of a purge request
+type purgeRequest struct {
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+	Glob   string `json:"glob"`
+	Tag    string `json:"tag"`
+	All    bool   `json:"all"`
+	Host   string `json:"host"`
+}
+
+// New creates an admin API handler. cacheFunc is called on every request so the
+// handler always uses the proxy's current cache, which may change on reload.
+func New(token string, cacheFunc func() Cache) *Handler {
+	h := &Handler{
+		token: token,
+		cache: cacheFunc,
+		mux:   http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("POST /admin/cache/purge", h.purgeHandler)
+	h.mux.HandleFunc("GET /admin/cache/entry", h.entryHandler)
+
+	return h
+}
+
+// UpdateToken replaces the bearer token, e.g. after a configuration reload.
+// An empty token disables the admin API.
+func (h *Handler) UpdateToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token = token
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	token := h.token
+	h.mu.RUnlock()
+
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="xrp-admin"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	selectors := 0
+	for _, set := range []bool{req.URL != "", req.Prefix != "", req.Glob != "", req.Tag != "", req.All} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		writeError(w, http.StatusBadRequest, "exactly one of url, prefix, glob, tag, or all must be set")
+		return
+	}
+
+	c := h.cache()
+	ctx := r.Context()
+	var purged int
+	var err error
+
+	switch {
+	case req.URL != "":
+		var u *url.URL
+		u, err = parseTargetURL(req.URL, req.Host)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		purged, err = c.PurgeURL(ctx, u)
+	case req.Prefix != "":
+		purged, err = c.PurgePrefix(ctx, req.Host, req.Prefix)
+	case req.Glob != "":
+		purged, err = c.PurgeGlob(ctx, req.Host, req.Glob)
+	case req.Tag != "":
+		purged, err = c.PurgeTag(ctx, req.Tag)
+	case req.All:
+		purged, err = c.PurgeAll(ctx)
+	}
+
+	if err != nil {
+		slog.Error("Cache purge failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "purge failed")
+		return
+	}
+
+	slog.Info("Purged cache entries", "url", req.URL, "prefix", req.Prefix, "glob", req.Glob,
+		"tag", req.Tag, "all", req.All, "host", req.Host, "purged", purged)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func (h *Handler) entryHandler(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		writeError(w, http.StatusBadRequest, "url parameter is required")
+		return
+	}
+	u, err := parseTargetURL(rawURL, r.URL.Query().Get("host"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := h.cache().Inspect(r.Context(), u)
+	if err != nil {
+		slog.Error("Cache inspection failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "inspection failed")
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "not cached")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"url": u.RequestURI(), "entries": entries})
+}
+
+// parseTargetURL accepts an absolute URL or a path with an optional query string.
+// A path is qualified with host, if given.
+func parseTargetURL(rawURL, host string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err == nil && u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("invalid url %q", rawURL)
+	}
+	if u.Host == "" {
+		u.Host = host
+	}
+	return u, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write admin response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cdzombak/xrp/internal/cache"
+)
+
+const testToken = "0123456789abcdef"
+
+// fakeCache records the purge calls it receives
+type fakeCache struct {
+	calls []string
+}
+
+func (f *fakeCache) PurgeURL(ctx context.Context, u *url.URL) (int, error) {
+	f.calls = append(f.calls, "url:"+u.Host+u.RequestURI())
+	return 2, nil
+}
+
+func (f *fakeCache) PurgePrefix(ctx context.Context, host, prefix string) (int, error) {
+	f.calls = append(f.calls, "prefix:"+host+prefix)
+	return 3, nil
+}
+
+func (f *fakeCache) PurgeGlob(ctx context.Context, host, pattern string) (int, error) {
+	f.calls = append(f.calls, "glob:"+host+pattern)
+	return 1, nil
+}
+
+func (f *fakeCache) PurgeTag(ctx context.Context, tag string) (int, error) {
+	f.calls = append(f.calls, "tag:"+tag)
+	return 4, nil
+}
+
+func (f *fakeCache) PurgeAll(ctx context.Context) (int, error) {
+	f.calls = append(f.calls, "all")
+	return 10, nil
+}
+
+func (f *fakeCache) Inspect(ctx context.Context, u *url.URL) ([]cache.EntryInfo, error) {
+	if u.Path != "/cached" {
+		return nil, nil
+	}
+	return []cache.EntryInfo{{Key: "xrp:cache:abc", StatusCode: 200, ETag: `"v1"`, Size: 42}}, nil
+}
+
+func newTestHandler(token string) (*Handler, *fakeCache) {
+	fc := &fakeCache{}
+	return New(token, func() Cache { return fc }), fc
+}
+
+func doRequest(h http.Handler, method, target, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAuthentication(t *testing.T) {
+	h, fc := newTestHandler(testToken)
+
+	if rec := doRequest(h, "POST", "/admin/cache/purge", `{"all":true}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "POST", "/admin/cache/purge", `{"all":true}`, "wrong-token-wrong-token"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong token, got %d", rec.Code)
+	}
+	if len(fc.calls) != 0 {
+		t.Error("expected no purge without valid token")
+	}
+
+	h.UpdateToken("")
+	if rec := doRequest(h, "POST", "/admin/cache/purge", `{"all":true}`, testToken); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when admin API is disabled, got %d", rec.Code)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		body     string
+		call     string
+		expected int
+	}{
+		{`{"url":"/article?id=1"}`, "url:/article?id=1", 2},
+		{`{"url":"https://example.com/article"}`, "url:example.com/article", 2},
+		{`{"url":"/article","host":"example.com"}`, "url:example.com/article", 2},
+		{`{"prefix":"/articles/"}`, "prefix:/articles/", 3},
+		{`{"prefix":"/articles/","host":"example.com"}`, "prefix:example.com/articles/", 3},
+		{`{"glob":"/articles/*"}`, "glob:/articles/*", 1},
+		{`{"glob":"/articles/*","host":"example.com"}`, "glob:example.com/articles/*", 1},
+		{`{"tag":"article-123"}`, "tag:article-123", 4},
+		{`{"all":true}`, "all", 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			h, fc := newTestHandler(testToken)
+			rec := doRequest(h, "POST", "/admin/cache/purge", tt.body, testToken)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var resp map[string]int
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp["purged"] != tt.expected {
+				t.Errorf("expected purged=%d, got %d", tt.expected, resp["purged"])
+			}
+			if len(fc.calls) != 1 || fc.calls[0] != tt.call {
+				t.Errorf("expected call %q, got %v", tt.call, fc.calls)
+			}
+		})
+	}
+}
+
+func TestPurgeInvalid(t *testing.T) {
+	h, fc := newTestHandler(testToken)
+
+	for _, body := range []string{`not json`, `{}`, `{"url":"/a","tag":"b"}`, `{"url":"relative"}`} {
+		if rec := doRequest(h, "POST", "/admin/cache/purge", body, testToken); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := doRequest(h, "GET", "/admin/cache/purge", "", testToken); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET purge, got %d", rec.Code)
+	}
+	if len(fc.calls) != 0 {
+		t.Errorf("expected no purges, got %v", fc.calls)
+	}
+}
+
+func TestEntry(t *testing.T) {
+	h, _ := newTestHandler(testToken)
+
+	rec := doRequest(h, "GET", "/admin/cache/entry?url=/cached", "", testToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp struct {
+		URL     string            `json:"url"`
+		Entries []cache.EntryInfo `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.URL != "/cached" || len(resp.Entries) != 1 || resp.Entries[0].ETag != `"v1"` {
+		t.Errorf("unexpected response: %s", rec.Body.String())
+	}
+
+	if rec := doRequest(h, "GET", "/admin/cache/entry?url=/missing", "", testToken); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for uncached URL, got %d", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/admin/cache/entry", "", testToken); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without url, got %d", rec.Code)
+	}
+}
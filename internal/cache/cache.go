@@ -1,25 +1,33 @@
-// Package cache provides Redis-based HTTP caching functionality for XRP.
+// Package cache provides HTTP caching functionality for XRP.
 //
-// This package implements RFC 7234 compliant HTTP caching with Redis as the
-// storage backend. It supports:
+// This package implements RFC 7234 compliant HTTP caching on top of a pluggable
+// Store: Redis, an in-process LRU, a directory on disk, or an in-memory tier in
+// front of Redis (see store.go). It supports:
 //
 // - HTTP cache header compliance (Cache-Control, ETag, Expires)
 // - Intelligent cache key generation based on URL, query params, and Vary headers
 // - Cookie-based cache exclusion via configurable denylist
 // - Authorization header exclusion (requests with Authorization headers are never cached)
 // - TTL calculation from HTTP headers with fallback defaults
+// - Serving stale entries per stale-while-revalidate and stale-if-error (see stale.go)
+// - Keeping expired entries with an ETag or Last-Modified validator for conditional revalidation
 // - JSON serialization of cache entries with metadata
+// - Purging by URL, path prefix or glob, surrogate key, or everything (see purge.go)
 //
 // Cache Key Generation:
 //
 // Cache keys are generated by combining:
-// - Request URL (scheme, host, path, sorted query parameters)
+// - Request Host (without port), path, and query, plus the scheme if cache.key_include_scheme is set
 // - Vary header values (if present in response)
 // - Request method (though only GET requests are typically cached)
 //
+// Each URL also has a primary key recording the response's Vary header list, so
+// lookups can compute the variant key for a request before the response is known
+// (see vary.go). Responses with Vary: * are never cached.
+//
 // Example usage:
 //
-//	cache, err := cache.New(redisConfig)
+//	cache, err := cache.Open(cfg)
 //	if err != nil {
 //	    log.Fatal(err)
 //	}
@@ -32,14 +40,16 @@
 //	// Store response in cache
 //	cache.Set(req, entry, config)
 //
-// The cache respects HTTP semantics including conditional requests,
-// cache directives, and proper TTL handling for optimal performance.
+// Get returns entries that are fresh, or expired but still usable (see Freshness);
+// callers decide how to serve them. The cache respects HTTP semantics including
+// cache directives and proper TTL handling for optimal performance.
 package cache
 
 import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -47,9 +57,13 @@ import (
 	"strings"
 	"time"
 
-	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+	"github.com/cdzombak/xrp/internal/tracing"
 )
 
 type Entry struct {
@@ -58,29 +72,70 @@ type Entry struct {
 	StatusCode int         `json:"status_code"`
 	Timestamp  time.Time   `json:"timestamp"`
 	ETag       string      `json:"etag,omitempty"`
-	Expires    *time.Time  `json:"expires,omitempty"`
-	MaxAge     *int        `json:"max_age,omitempty"`
+	// LastModified is the response's Last-Modified header, kept with ETag as a
+	// validator for conditional revalidation
+	LastModified string     `json:"last_modified,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxAge       *int       `json:"max_age,omitempty"`
+
+	// StaleWhileRevalidate and StaleIfError are the response's stale windows in
+	// seconds, if its Cache-Control header set them (see stale.go)
+	StaleWhileRevalidate *int `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         *int `json:"stale_if_error,omitempty"`
+
+	// Freshness and Key are set by Get
+	Freshness Freshness `json:"-"`
+	Key       string    `json:"-"`
 }
 
 type Cache struct {
-	client *redis.Client
+	store Store
 }
 
-func New(redisConfig config.RedisConfig) (*Cache, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     redisConfig.Addr,
-		Password: redisConfig.Password,
-		DB:       redisConfig.DB,
-	})
+// New returns a Cache keeping entries in store
+func New(store Store) *Cache {
+	if store.Health() == nil {
+		metrics.CacheAvailable.Set(1)
+	}
+	return &Cache{store: store}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Open returns a Cache using the store selected by cfg.CacheStore
+func Open(cfg *config.Config) (*Cache, error) {
+	store, err := openStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return New(store), nil
+}
 
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+func openStore(cfg *config.Config) (Store, error) {
+	storeConfig := cfg.CacheStore
+	maxBytes := int64(storeConfig.MaxSizeMB) * 1024 * 1024
+
+	switch storeConfig.Type {
+	case config.StoreMemory:
+		return NewMemoryStore(maxBytes), nil
+	case config.StoreFile:
+		return NewFileStore(storeConfig.Path)
+	case config.StoreTiered:
+		shared := NewRedisStore(cfg.Redis)
+		memoryTTL := time.Duration(storeConfig.MemoryTTLSeconds) * time.Second
+		return NewTieredStore(NewMemoryStore(maxBytes), shared, memoryTTL), nil
+	default:
+		return NewRedisStore(cfg.Redis), nil
 	}
+}
+
+// Health returns nil if the cache's store is usable, or why it isn't. While it
+// isn't, lookups miss and nothing is cached.
+func (c *Cache) Health() error {
+	return c.store.Health()
+}
 
-	return &Cache{client: client}, nil
+// Close releases the cache's store
+func (c *Cache) Close() error {
+	return c.store.Close()
 }
 
 func (c *Cache) Get(req *http.Request, cfg *config.Config) *Entry {
@@ -89,48 +144,80 @@ func (c *Cache) Get(req *http.Request, cfg *config.Config) *Entry {
 		return nil
 	}
 
-	// For cache retrieval, we don't have the response Vary header yet,
-	// so we generate a key without Vary consideration for lookup
-	key := c.generateKey(req, "")
+	ctx, span := tracing.Tracer().Start(req.Context(), "cache.get")
+	defer span.End()
+	span.SetAttributes(attribute.Bool("xrp.cache.hit", false))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	// Keep the request's trace, but don't cut the lookup short if the client goes away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Second)
 	defer cancel()
 
-	data, err := c.client.Get(ctx, key).Result()
+	key, err := c.key(ctx, req, cfg)
+	if err != nil {
+		return nil
+	}
+
+	data, err := c.store.Get(ctx, key)
 	if err != nil {
-		if err == redis.Nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnavailable) {
 			// Cache miss - this is expected
 			return nil
 		}
-		// Log other Redis errors but don't fail the request
-		slog.Error("Redis get error", "error", err, "key", key)
+		// Log other store errors but don't fail the request
+		slog.Error("Cache get error", "error", err, "key", key)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil
 	}
 
 	var entry Entry
-	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+	if err := json.Unmarshal(data, &entry); err != nil {
 		slog.Error("Failed to unmarshal cache entry", "error", err, "key", key)
 		// Delete corrupted cache entry
 		go c.delete(key)
 		return nil
 	}
 
-	if c.isExpired(&entry) {
+	freshness, ok := c.freshness(&entry, cfg)
+	if !ok {
 		go c.delete(key)
 		return nil
 	}
+	entry.Freshness = freshness
+	entry.Key = key
+	span.SetAttributes(attribute.Bool("xrp.cache.hit", true))
 
-	if etag := req.Header.Get("If-None-Match"); etag != "" && etag == entry.ETag {
-		return &Entry{
-			StatusCode: http.StatusNotModified,
-			Headers:    make(http.Header),
-		}
+	return &entry
+}
+
+// Key returns the key a response to req would be cached under, or "" if it can't
+// be determined
+func (c *Cache) Key(req *http.Request, cfg *config.Config) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key, err := c.key(ctx, req, cfg)
+	if err != nil {
+		return ""
 	}
+	return key
+}
 
-	return &entry
+func (c *Cache) key(ctx context.Context, req *http.Request, cfg *config.Config) (string, error) {
+	// The response isn't known yet, so look up the Vary header list recorded
+	// for this URL to find the variant matching the request
+	vary, err := c.lookupVary(ctx, req, cfg.Route)
+	if err != nil {
+		if errors.Is(err, ErrUnavailable) {
+			return "", err
+		}
+		slog.Error("Cache get error", "error", err, "key", varyKey(req.Host, cfg.Route, req.URL))
+		return "", err
+	}
+	return c.generateKey(req, vary, cfg), nil
 }
 
-func (c *Cache) Set(req *http.Request, entry *Entry, cfg *config.Config) error {
+func (c *Cache) Set(req *http.Request, entry *Entry, cfg *config.Config) (err error) {
 	if !c.IsCacheable(&http.Response{
 		StatusCode: entry.StatusCode,
 		Header:     entry.Headers,
@@ -142,6 +229,7 @@ func (c *Cache) Set(req *http.Request, entry *Entry, cfg *config.Config) error {
 	// Parse cache control headers to populate entry fields
 	if cacheControl := entry.Headers.Get("Cache-Control"); cacheControl != "" {
 		entry.MaxAge = parseMaxAge(cacheControl)
+		parseStaleDirectives(entry, cacheControl)
 	}
 
 	if expiresHeader := entry.Headers.Get("Expires"); expiresHeader != "" {
@@ -152,20 +240,47 @@ func (c *Cache) Set(req *http.Request, entry *Entry, cfg *config.Config) error {
 		entry.ETag = etag
 	}
 
-	// Use the Vary header from the response to generate the cache key
-	varyHeader := entry.Headers.Get("Vary")
-	key := c.generateKey(req, varyHeader)
+	if lastModified := entry.Headers.Get("Last-Modified"); lastModified != "" {
+		entry.LastModified = lastModified
+	}
+
+	// Store the entry under the variant key for the response's Vary header
+	vary := normalizeVary(entry.Headers)
+	key := c.generateKey(req, vary, cfg)
 
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("failed to marshal cache entry: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, span := tracing.Tracer().Start(req.Context(), "cache.set",
+		trace.WithAttributes(attribute.Int("xrp.cache.entry_bytes", len(data))))
+	defer func() {
+		if err != nil && !errors.Is(err, ErrUnavailable) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Second)
 	defer cancel()
 
-	ttl := c.calculateTTL(entry)
-	return c.client.Set(ctx, key, data, ttl).Err()
+	// Keep the entry until it can no longer be served stale or revalidated
+	ttl := c.calculateTTL(entry) + retention(entry, cfg)
+	if err := c.store.Set(ctx, key, data, ttl); err != nil {
+		return err
+	}
+
+	if err := c.storeVary(ctx, req, cfg.Route, vary, ttl); err != nil {
+		return fmt.Errorf("failed to store Vary header list: %w", err)
+	}
+
+	// Index the entry so it can be purged by URL or surrogate key
+	if err := c.index(ctx, req, cfg.Route, key, entry.Headers, ttl); err != nil {
+		return fmt.Errorf("failed to index cache entry: %w", err)
+	}
+	return nil
 }
 
 func (c *Cache) IsCacheable(resp *http.Response) bool {
@@ -191,17 +306,30 @@ func (c *Cache) IsCacheable(resp *http.Response) bool {
 		return false
 	}
 
+	// Vary: * means the response can't be matched to future requests
+	if varyIsWildcard(resp.Header) {
+		return false
+	}
+
 	return true
 }
 
-func (c *Cache) generateKey(req *http.Request, varyHeader string) string {
-	keyParts := []string{req.URL.Path, req.URL.RawQuery}
+func (c *Cache) generateKey(req *http.Request, varyHeader string, cfg *config.Config) string {
+	keyParts := []string{normalizeHost(req.Host), req.URL.Path, req.URL.RawQuery}
+	if cfg.Cache.KeyIncludeScheme {
+		keyParts = append([]string{requestScheme(req)}, keyParts...)
+	}
+	// Requests for the same URL may match different routes, by method or header,
+	// and be processed differently
+	if cfg.Route != "" {
+		keyParts = append(keyParts, "route:"+cfg.Route)
+	}
 
 	if varyHeader != "" {
 		varyHeaders := strings.Split(varyHeader, ",")
 		for _, header := range varyHeaders {
 			header = strings.TrimSpace(header)
-			if value := req.Header.Get(header); value != "" {
+			if value := normalizeHeaderValue(req.Header.Values(header)); value != "" {
 				keyParts = append(keyParts, header+":"+value)
 			}
 		}
@@ -212,22 +340,36 @@ func (c *Cache) generateKey(req *http.Request, varyHeader string) string {
 	return fmt.Sprintf("xrp:cache:%x", hash)
 }
 
+// requestScheme returns the scheme the client used to make req
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func (c *Cache) isExpired(entry *Entry) bool {
-	now := time.Now()
+	return time.Now().After(c.expiresAt(entry))
+}
 
-	if entry.Expires != nil && now.After(*entry.Expires) {
-		return true
+// expiresAt returns when entry becomes stale: the earliest of its Expires time,
+// its max-age, and the default TTL
+func (c *Cache) expiresAt(entry *Entry) time.Time {
+	defaultTTL := 1 * time.Hour
+	expiry := entry.Timestamp.Add(defaultTTL)
+
+	if entry.Expires != nil && entry.Expires.Before(expiry) {
+		expiry = *entry.Expires
 	}
 
 	if entry.MaxAge != nil {
 		maxAgeExpiry := entry.Timestamp.Add(time.Duration(*entry.MaxAge) * time.Second)
-		if now.After(maxAgeExpiry) {
-			return true
+		if maxAgeExpiry.Before(expiry) {
+			expiry = maxAgeExpiry
 		}
 	}
 
-	defaultTTL := 1 * time.Hour
-	return now.After(entry.Timestamp.Add(defaultTTL))
+	return expiry
 }
 
 func (c *Cache) calculateTTL(entry *Entry) time.Duration {
@@ -253,15 +395,22 @@ func (c *Cache) calculateTTL(entry *Entry) time.Duration {
 func (c *Cache) delete(key string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	c.client.Del(ctx, key)
+	if _, err := c.store.Delete(ctx, key); err != nil && !errors.Is(err, ErrUnavailable) {
+		slog.Error("Cache delete error", "error", err, "key", key)
+	}
 }
 
 func parseMaxAge(cacheControl string) *int {
+	return parseDirectiveSeconds(cacheControl, "max-age")
+}
+
+// parseDirectiveSeconds returns the value of a Cache-Control directive like max-age=60
+func parseDirectiveSeconds(cacheControl, directive string) *int {
 	parts := strings.Split(cacheControl, ",")
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "max-age=") {
-			if value, err := strconv.Atoi(part[8:]); err == nil {
+		if value, ok := strings.CutPrefix(part, directive+"="); ok {
+			if value, err := strconv.Atoi(value); err == nil {
 				return &value
 			}
 		}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"net/url"
 	"testing"
@@ -72,7 +73,7 @@ func TestGenerateKey(t *testing.T) {
 		URL:    &url.URL{Path: "/test", RawQuery: "param=value"},
 		Header: make(http.Header),
 	}
-	baseKey := cache.generateKey(baseReq, "")
+	baseKey := cache.generateKey(baseReq, "", &config.Config{})
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -81,7 +82,7 @@ func TestGenerateKey(t *testing.T) {
 				Header: make(http.Header),
 			}
 			// Pass the vary header as parameter instead of setting it on request
-			key := cache.generateKey(req, tt.vary)
+			key := cache.generateKey(req, tt.vary, &config.Config{})
 
 			if tt.expected && key == baseKey {
 				t.Error("expected different keys but got same")
@@ -93,6 +94,37 @@ func TestGenerateKey(t *testing.T) {
 	}
 }
 
+func TestGenerateKeyHostAndScheme(t *testing.T) {
+	cache := &Cache{}
+
+	newReq := func(host string, secure bool) *http.Request {
+		req := &http.Request{Host: host, URL: &url.URL{Path: "/test"}, Header: make(http.Header)}
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		return req
+	}
+
+	defaults := &config.Config{}
+	withScheme := &config.Config{Cache: config.CacheConfig{KeyIncludeScheme: true}}
+
+	if cache.generateKey(newReq("a.example.com", false), "", defaults) == cache.generateKey(newReq("b.example.com", false), "", defaults) {
+		t.Error("expected different hosts to get different keys")
+	}
+	if cache.generateKey(newReq("Example.com:8080", false), "", defaults) != cache.generateKey(newReq("example.com", false), "", defaults) {
+		t.Error("expected host case and port to be ignored")
+	}
+	if cache.generateKey(newReq("example.com", true), "", defaults) != cache.generateKey(newReq("example.com", false), "", defaults) {
+		t.Error("expected scheme to be ignored by default")
+	}
+	if cache.generateKey(newReq("example.com", true), "", withScheme) == cache.generateKey(newReq("example.com", false), "", withScheme) {
+		t.Error("expected scheme to be part of the key when enabled")
+	}
+	if cache.generateKey(newReq("example.com", false), "", &config.Config{Route: "amp"}) == cache.generateKey(newReq("example.com", false), "", defaults) {
+		t.Error("expected the matched route to be part of the key")
+	}
+}
+
 func TestIsCacheable(t *testing.T) {
 	cache := &Cache{}
 
@@ -401,15 +433,17 @@ func TestCacheIntegration(t *testing.T) {
 		DB:       1, // Use a different DB for testing
 	}
 
-	cache, err := New(redisConfig)
-	if err != nil {
+	store := NewRedisStore(redisConfig)
+	if store.Health() != nil {
+		store.Close()
 		t.Skip("Redis not available, skipping integration test")
 	}
+	cache := New(store)
 
 	// Clean up test data
 	defer func() {
 		ctx := context.Background()
-		cache.client.FlushDB(ctx)
+		store.client.FlushDB(ctx)
 	}()
 
 	req := &http.Request{
@@ -429,7 +463,7 @@ func TestCacheIntegration(t *testing.T) {
 	cfg := &config.Config{}
 
 	// Test Set and Get
-	err = cache.Set(req, entry, cfg)
+	err := cache.Set(req, entry, cfg)
 	if err != nil {
 		t.Fatalf("failed to set cache entry: %v", err)
 	}
@@ -0,0 +1,361 @@
+// This file implements FileStore, which keeps cached entries on disk so they survive
+// restarts without an external service. Each key is a file named by the SHA-256 hash
+// of the key, holding a JSON header line (the key, its expiry, and any set members)
+// followed by the raw value. Files are replaced atomically by renaming, and expired
+// files are removed when read and by a periodic sweep.
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileSweepInterval is how often FileStore removes expired files
+const fileSweepInterval = 5 * time.Minute
+
+// fileTempPrefix marks files being written, which sweeps and scans skip
+const fileTempPrefix = ".tmp-"
+
+// FileStore is a Store that keeps each key in a file under a directory
+type FileStore struct {
+	dir  string
+	mu   sync.RWMutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileHeader is the first line of each file
+type fileHeader struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Members []string  `json:"members,omitempty"`
+	IsSet   bool      `json:"is_set,omitempty"`
+}
+
+// NewFileStore returns a FileStore writing to dir, creating it if needed, and
+// starts sweeping it for expired files
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	s := &FileStore{
+		dir:  dir,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.sweepLoop()
+	return s, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	header, value, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if header.IsSet {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *FileStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, _, err := s.read(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(fileHeader{Key: key, Expires: time.Now().Add(ttl)}, value)
+}
+
+func (s *FileStore) SetExtending(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	header, _, err := s.read(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil && header.Expires.After(expires) {
+		expires = header.Expires
+	}
+	return s.write(fileHeader{Key: key, Expires: expires}, value)
+}
+
+func (s *FileStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, _, err := s.read(key)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	return true, s.write(fileHeader{Key: key, Expires: time.Now().Add(ttl)}, value)
+}
+
+func (s *FileStore) Delete(ctx context.Context, keys ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		_, _, err := s.read(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, fmt.Errorf("failed to delete cache file: %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (s *FileStore) DeleteIfEqual(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header, current, err := s.read(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if header.IsSet || !bytes.Equal(current, value) {
+		return nil
+	}
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete cache file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) AddMember(ctx context.Context, setKeys []string, member string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	for _, key := range setKeys {
+		header, _, err := s.read(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err != nil || !header.IsSet {
+			header = fileHeader{Key: key, IsSet: true, Expires: expires}
+		}
+		if !slices.Contains(header.Members, member) {
+			header.Members = append(header.Members, member)
+		}
+		if expires.After(header.Expires) {
+			header.Expires = expires
+		}
+		if err := s.write(header, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Members(ctx context.Context, key string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	header, _, err := s.read(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return header.Members, nil
+}
+
+// Keys reads the header of every file, so it is slow for large caches; it's only
+// used to purge and inspect entries
+func (s *FileStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	err := s.walk(func(header fileHeader) error {
+		if matchGlob(pattern, header.Key) {
+			keys = append(keys, header.Key)
+		}
+		return ctx.Err()
+	})
+	return keys, err
+}
+
+func (s *FileStore) Health() error {
+	return nil
+}
+
+// Close stops sweeping for expired files
+func (s *FileStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// path returns the file holding key, sharded into subdirectories by hash prefix
+func (s *FileStore) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// read returns the header and value stored at key, or ErrNotFound if it is missing
+// or expired. Expired files are removed.
+func (s *FileStore) read(key string) (fileHeader, []byte, error) {
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileHeader{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return fileHeader{}, nil, fmt.Errorf("failed to read cache file: %w", err)
+	}
+
+	line, value, _ := bytes.Cut(data, []byte("\n"))
+	var header fileHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Key != key {
+		// Corrupt, or a hash collision; either way the key isn't stored
+		return fileHeader{}, nil, ErrNotFound
+	}
+	if time.Now().After(header.Expires) {
+		os.Remove(path)
+		return fileHeader{}, nil, ErrNotFound
+	}
+	return header, value, nil
+}
+
+// write atomically replaces the file for header.Key
+func (s *FileStore) write(header fileHeader, value []byte) error {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache file header: %w", err)
+	}
+
+	path := s.path(header.Key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), fileTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.Write(line)
+	w.WriteByte('\n')
+	w.Write(value)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	return nil
+}
+
+// walk calls fn with the header of every unexpired file, removing expired files
+func (s *FileStore) walk(fn func(header fileHeader) error) error {
+	now := time.Now()
+	return filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), fileTempPrefix) {
+			return nil
+		}
+
+		header, err := readFileHeader(path)
+		if err != nil {
+			return nil
+		}
+		if now.After(header.Expires) {
+			os.Remove(path)
+			return nil
+		}
+		return fn(header)
+	})
+}
+
+// readFileHeader reads just the header line of a file
+func readFileHeader(path string) (fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fileHeader{}, err
+	}
+	var header fileHeader
+	err = json.Unmarshal(line, &header)
+	return header, err
+}
+
+// sweepLoop periodically removes expired files until Close is called
+func (s *FileStore) sweepLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(fileSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.walk(func(fileHeader) error { return nil })
+			s.mu.Unlock()
+			if err != nil {
+				slog.Error("Failed to sweep file cache", "error", err, "dir", s.dir)
+			}
+		}
+	}
+}
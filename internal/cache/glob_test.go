@@ -0,0 +1,35 @@
+package cache
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		s        string
+		expected bool
+	}{
+		{"*", "", true},
+		{"*", "anything/at/all", true},
+		{"xrp:cache:url:/articles/*#*", "xrp:cache:url:/articles/one/two#example.com", true},
+		{"xrp:cache:url:/articles/*#*", "xrp:cache:url:/about#example.com", false},
+		{"/articles/tw?", "/articles/two", true},
+		{"/articles/tw?", "/articles/tw", false},
+		{"/a[bc]d", "/acd", true},
+		{"/a[^bc]d", "/acd", false},
+		{"/a[^bc]d", "/axd", true},
+		{"/[a-c]", "/b", true},
+		{"/[a-c]", "/d", false},
+		{`/a\*b`, "/a*b", true},
+		{`/a\*b`, "/axb", false},
+		{`/x\?*#*`, "/x?page=2#host", true},
+		{"/[abc", "/[abc", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.expected {
+			t.Errorf("matchGlob(%q, %q) = %v, expected %v", tt.pattern, tt.s, got, tt.expected)
+		}
+	}
+}
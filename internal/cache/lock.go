@@ -0,0 +1,72 @@
+// This file implements the cache locks used to coalesce cache misses across XRP
+// instances sharing a store. The instance holding an entry's lock fetches it from the backend; other
+// instances wait for the lock to be released and then read the entry from the cache.
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const lockKeyPrefix = keyPrefix + "lock:"
+
+// lockPollInterval is how often Lock checks whether another instance released a lock
+const lockPollInterval = 25 * time.Millisecond
+
+func lockKey(key string) string {
+	return lockKeyPrefix + strings.TrimPrefix(key, keyPrefix)
+}
+
+// Lock acquires the lock on cache key, held for at most ttl. If another instance
+// holds the lock, Lock waits until it is released or ctx is done, and returns
+// waited true without acquiring it. Otherwise the caller must call unlock once the
+// entry has been cached.
+func (c *Cache) Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), waited bool, err error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, false, fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	lock := lockKey(key)
+
+	acquired, err := c.store.SetIfAbsent(ctx, lock, []byte(token), ttl)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire cache lock: %w", err)
+	}
+	if acquired {
+		return func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			// Only delete the lock if it still holds our token, so an instance
+			// whose lock expired can't release another instance's lock
+			if err := c.store.DeleteIfEqual(ctx, lock, []byte(token)); err != nil {
+				slog.Error("Cache unlock error", "error", err, "key", lock)
+			}
+		}, false, nil
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, true, nil
+		case <-ticker.C:
+			held, err := c.store.Exists(ctx, lock)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, true, nil
+				}
+				return nil, true, fmt.Errorf("failed to check cache lock: %w", err)
+			}
+			if !held {
+				return nil, true, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+
+	unlock, waited, err := c.Lock(ctx, "xrp:cache:abc", time.Minute)
+	if err != nil || waited {
+		t.Fatalf("expected to acquire lock, got waited=%v err=%v", waited, err)
+	}
+	if !mr.Exists("xrp:cache:lock:abc") {
+		t.Fatal("expected lock key in Redis")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlock()
+	}()
+
+	start := time.Now()
+	_, waited, err = c.Lock(ctx, "xrp:cache:abc", time.Minute)
+	if err != nil || !waited {
+		t.Fatalf("expected to wait for lock, got waited=%v err=%v", waited, err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected to wait until the lock was released")
+	}
+	if mr.Exists("xrp:cache:lock:abc") {
+		t.Error("expected lock to be released")
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	if _, _, err := c.Lock(context.Background(), "xrp:cache:abc", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, waited, err := c.Lock(ctx, "xrp:cache:abc", time.Minute)
+	if err != nil || !waited {
+		t.Errorf("expected to give up waiting without error, got waited=%v err=%v", waited, err)
+	}
+}
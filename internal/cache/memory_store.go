@@ -0,0 +1,230 @@
+// This file implements MemoryStore, an in-process LRU store bounded by size. It
+// needs no external services, but its contents are lost on restart and aren't
+// shared between XRP instances.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryItemOverhead approximates the bookkeeping memory used by each stored key
+const memoryItemOverhead = 128
+
+// MemoryStore is a Store that keeps keys in memory, evicting the least recently
+// used keys once their total size exceeds a limit
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // of *memoryItem, most recently used first
+	items    map[string]*list.Element
+}
+
+// memoryItem is a key holding either a value or a set of members
+type memoryItem struct {
+	key     string
+	value   []byte
+	members map[string]struct{}
+	expires time.Time
+	size    int64
+}
+
+// NewMemoryStore returns a MemoryStore holding at most maxBytes of keys and values
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Size returns the approximate number of bytes held by the store
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.lookup(key)
+	if item == nil || item.members != nil {
+		return nil, ErrNotFound
+	}
+	return item.value, nil
+}
+
+func (s *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookup(key) != nil, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store(&memoryItem{key: key, value: value, expires: time.Now().Add(ttl)})
+	return nil
+}
+
+func (s *MemoryStore) SetExtending(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if item := s.lookup(key); item != nil && item.expires.After(expires) {
+		expires = item.expires
+	}
+	s.store(&memoryItem{key: key, value: value, expires: expires})
+	return nil
+}
+
+func (s *MemoryStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lookup(key) != nil {
+		return false, nil
+	}
+	s.store(&memoryItem{key: key, value: value, expires: time.Now().Add(ttl)})
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, keys ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if s.lookup(key) != nil {
+			s.remove(s.items[key])
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) DeleteIfEqual(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item := s.lookup(key); item != nil && item.members == nil && string(item.value) == string(value) {
+		s.remove(s.items[key])
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddMember(ctx context.Context, setKeys []string, member string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	for _, key := range setKeys {
+		item := s.lookup(key)
+		if item == nil || item.members == nil {
+			item = &memoryItem{key: key, members: make(map[string]struct{}), expires: expires}
+		} else {
+			s.remove(s.items[key])
+		}
+		item.members[member] = struct{}{}
+		if expires.After(item.expires) {
+			item.expires = expires
+		}
+		s.store(item)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Members(ctx context.Context, key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.lookup(key)
+	if item == nil || item.members == nil {
+		return nil, nil
+	}
+	members := make([]string, 0, len(item.members))
+	for member := range item.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *MemoryStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, elem := range s.items {
+		if now.After(elem.Value.(*memoryItem).expires) {
+			s.remove(elem)
+			continue
+		}
+		if matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Health() error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// lookup returns the unexpired item at key, marking it recently used. The caller
+// must hold s.mu.
+func (s *MemoryStore) lookup(key string) *memoryItem {
+	elem, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*memoryItem)
+	if time.Now().After(item.expires) {
+		s.remove(elem)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return item
+}
+
+// store adds item, replacing any item with the same key, then evicts the least
+// recently used items until the store fits its size limit. Items too large to fit
+// at all aren't stored. The caller must hold s.mu.
+func (s *MemoryStore) store(item *memoryItem) {
+	if elem, ok := s.items[item.key]; ok {
+		s.remove(elem)
+	}
+
+	item.size = int64(memoryItemOverhead + len(item.key) + len(item.value))
+	for member := range item.members {
+		item.size += int64(len(member))
+	}
+	if item.size > s.maxBytes {
+		return
+	}
+
+	s.items[item.key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove deletes an item. The caller must hold s.mu.
+func (s *MemoryStore) remove(elem *list.Element) {
+	item := s.lru.Remove(elem).(*memoryItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
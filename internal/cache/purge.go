@@ -0,0 +1,299 @@
+// This file implements cache purging and inspection for the admin API.
+//
+// Every cached entry is recorded in store sets that index it by URL (host, path,
+// query, and route, covering all Vary variants and schemes) and by each surrogate key from its
+// Surrogate-Key or Cache-Tag response headers. Index sets live in the same xrp:cache:
+// namespace and expire no earlier than the longest-lived entry they reference.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	keyPrefix      = "xrp:cache:"
+	urlIndexPrefix = keyPrefix + "url:"
+	tagIndexPrefix = keyPrefix + "tag:"
+)
+
+// EntryInfo describes a cached entry without its body
+type EntryInfo struct {
+	Key  string `json:"key"`
+	Host string `json:"host"`
+	// Route names the route the entry was cached for, if any
+	Route      string    `json:"route,omitempty"`
+	StatusCode int       `json:"status_code"`
+	CachedAt   time.Time `json:"cached_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+	// TTLSeconds is how long the entry stays fresh; it is negative once the entry
+	// has expired but is still kept to be served stale or revalidated
+	TTLSeconds int64       `json:"ttl_seconds"`
+	ETag       string      `json:"etag,omitempty"`
+	Size       int         `json:"size"`
+	Headers    http.Header `json:"headers"`
+}
+
+// normalizeHost lowercases a host and strips its port and any trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// urlKeySuffix identifies a URL requested through a route in index and Vary keys:
+// its escaped path and query, then "#" and the host, then "|" and the route name,
+// which is empty if no route matched. Escaping keeps "#" out of the path, so the
+// host and route can be matched separately when scanning.
+func urlKeySuffix(host, route string, u *url.URL) string {
+	suffix := u.EscapedPath()
+	if u.RawQuery != "" {
+		suffix += "?" + u.RawQuery
+	}
+	return suffix + "#" + normalizeHost(host) + "|" + route
+}
+
+// urlIndexKey returns the key of the set indexing all variants of a URL on a host,
+// requested through a route
+func urlIndexKey(host, route string, u *url.URL) string {
+	return urlIndexPrefix + urlKeySuffix(host, route, u)
+}
+
+func tagIndexKey(tag string) string {
+	return tagIndexPrefix + tag
+}
+
+// hostPattern returns the glob matching the host and route part of index keys, for
+// every route; an empty host matches every host
+func hostPattern(host string) string {
+	if host == "" {
+		return "*"
+	}
+	return escapeGlob(normalizeHost(host)) + "|*"
+}
+
+// surrogateKeys returns the surrogate keys from the Surrogate-Key (space-separated)
+// and Cache-Tag (comma-separated) response headers
+func surrogateKeys(header http.Header) []string {
+	var tags []string
+	for _, value := range header.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(value)...)
+	}
+	for _, value := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// index records a stored entry in the URL and surrogate key indexes
+func (c *Cache) index(ctx context.Context, req *http.Request, route, key string, header http.Header, ttl time.Duration) error {
+	indexKeys := []string{urlIndexKey(req.Host, route, req.URL)}
+	for _, tag := range surrogateKeys(header) {
+		indexKeys = append(indexKeys, tagIndexKey(tag))
+	}
+
+	return c.store.AddMember(ctx, indexKeys, key, ttl)
+}
+
+// PurgeURL removes every cached variant of the URL's path and query, whatever route
+// it was cached for. If u has no host, the URL is purged on every host.
+func (c *Cache) PurgeURL(ctx context.Context, u *url.URL) (int, error) {
+	indexKeys, err := c.urlIndexKeys(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.purgeURLIndexes(ctx, indexKeys)
+}
+
+// PurgePrefix removes every cached entry on host whose path starts with prefix.
+// An empty host matches every host.
+func (c *Cache) PurgePrefix(ctx context.Context, host, prefix string) (int, error) {
+	// Index keys hold escaped paths, so the prefix must be escaped the same way
+	escapedPrefix := (&url.URL{Path: prefix}).EscapedPath()
+	indexKeys, err := c.scanKeys(ctx, urlIndexPrefix+escapeGlob(escapedPrefix)+"*#"+hostPattern(host))
+	if err != nil {
+		return 0, err
+	}
+	return c.purgeURLIndexes(ctx, indexKeys)
+}
+
+// PurgeGlob removes every cached entry on host whose escaped path matches pattern,
+// using Redis glob syntax (*, ?, [abc]). Entries with a query string match if their
+// path matches. An empty host matches every host.
+func (c *Cache) PurgeGlob(ctx context.Context, host, pattern string) (int, error) {
+	indexKeys, err := c.scanKeys(ctx, urlIndexPrefix+pattern+"#"+hostPattern(host))
+	if err != nil {
+		return 0, err
+	}
+	withQuery, err := c.scanKeys(ctx, urlIndexPrefix+pattern+`\?*#`+hostPattern(host))
+	if err != nil {
+		return 0, err
+	}
+	return c.purgeURLIndexes(ctx, append(indexKeys, withQuery...))
+}
+
+// PurgeTag removes every cached entry carrying the given surrogate key
+func (c *Cache) PurgeTag(ctx context.Context, tag string) (int, error) {
+	return c.purgeIndexes(ctx, []string{tagIndexKey(tag)})
+}
+
+// PurgeAll removes everything in the xrp:cache: namespace
+func (c *Cache) PurgeAll(ctx context.Context) (int, error) {
+	keys, err := c.scanKeys(ctx, keyPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, urlIndexPrefix) && !strings.HasPrefix(key, tagIndexPrefix) &&
+			!strings.HasPrefix(key, varyKeyPrefix) && !strings.HasPrefix(key, lockKeyPrefix) {
+			purged++
+		}
+	}
+	if err := c.deleteKeys(ctx, keys); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// Inspect returns metadata for every cached variant of the URL's path and query,
+// for every route. If u has no host, variants on every host are returned.
+func (c *Cache) Inspect(ctx context.Context, u *url.URL) ([]EntryInfo, error) {
+	indexKeys, err := c.urlIndexKeys(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []EntryInfo{}
+	for _, indexKey := range indexKeys {
+		host, route, _ := strings.Cut(indexKey[strings.LastIndex(indexKey, "#")+1:], "|")
+
+		keys, err := c.store.Members(ctx, indexKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read URL index: %w", err)
+		}
+
+		for _, key := range keys {
+			data, err := c.store.Get(ctx, key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read cache entry: %w", err)
+			}
+
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				continue
+			}
+
+			infos = append(infos, EntryInfo{
+				Key:        key,
+				Host:       host,
+				Route:      route,
+				StatusCode: entry.StatusCode,
+				CachedAt:   entry.Timestamp,
+				AgeSeconds: int64(time.Since(entry.Timestamp).Seconds()),
+				TTLSeconds: int64(time.Until(c.expiresAt(&entry)).Seconds()),
+				ETag:       entry.ETag,
+				Size:       len(entry.Body),
+				Headers:    entry.Headers,
+			})
+		}
+	}
+	return infos, nil
+}
+
+// urlIndexKeys returns the URL index keys for u on its host, or on every host if
+// u has no host, for every route
+func (c *Cache) urlIndexKeys(ctx context.Context, u *url.URL) ([]string, error) {
+	pattern := urlKeySuffix("", "", u)
+	return c.scanKeys(ctx, urlIndexPrefix+escapeGlob(strings.TrimSuffix(pattern, "#|"))+"#"+hostPattern(u.Host))
+}
+
+// purgeIndexes deletes every entry referenced by the given index sets, along with
+// the sets themselves. It returns the number of entries deleted.
+func (c *Cache) purgeIndexes(ctx context.Context, indexKeys []string) (int, error) {
+	var entryKeys []string
+	for _, indexKey := range indexKeys {
+		members, err := c.store.Members(ctx, indexKey)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read cache index: %w", err)
+		}
+		for _, member := range members {
+			if !slices.Contains(entryKeys, member) {
+				entryKeys = append(entryKeys, member)
+			}
+		}
+	}
+
+	purged, err := c.store.Delete(ctx, entryKeys...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete cache entries: %w", err)
+	}
+
+	if err := c.deleteKeys(ctx, indexKeys); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// purgeURLIndexes purges the entries referenced by URL index sets, and forgets
+// the URLs' recorded Vary header lists
+func (c *Cache) purgeURLIndexes(ctx context.Context, indexKeys []string) (int, error) {
+	purged, err := c.purgeIndexes(ctx, indexKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	varyKeys := make([]string, 0, len(indexKeys))
+	for _, indexKey := range indexKeys {
+		varyKeys = append(varyKeys, varyKeyPrefix+strings.TrimPrefix(indexKey, urlIndexPrefix))
+	}
+	return purged, c.deleteKeys(ctx, varyKeys)
+}
+
+// scanKeys returns all keys matching a Redis glob pattern
+func (c *Cache) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	keys, err := c.store.Keys(ctx, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan cache keys: %w", err)
+	}
+	return keys, nil
+}
+
+// deleteKeys deletes keys
+func (c *Cache) deleteKeys(ctx context.Context, keys []string) error {
+	if _, err := c.store.Delete(ctx, keys...); err != nil {
+		return fmt.Errorf("failed to delete cache keys: %w", err)
+	}
+	return nil
+}
+
+// escapeGlob escapes Redis glob metacharacters so s matches literally
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,334 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func newTestCache(t *testing.T) (*Cache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s := NewRedisStore(config.RedisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { s.Close() })
+	return New(s), mr
+}
+
+// store caches a 200 response for rawURL with the given extra response headers
+func store(t *testing.T, c *Cache, rawURL string, reqHeader, respHeader http.Header) {
+	t.Helper()
+	u, _ := url.Parse(rawURL)
+	req := &http.Request{Method: "GET", Host: u.Host, URL: u, Header: reqHeader}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	headers := respHeader.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("Content-Type", "text/html")
+
+	entry := &Entry{Body: []byte("body of " + rawURL), Headers: headers, StatusCode: 200, Timestamp: time.Now()}
+	if err := c.Set(req, entry, &config.Config{}); err != nil {
+		t.Fatalf("failed to cache %s: %v", rawURL, err)
+	}
+}
+
+func cached(c *Cache, rawURL string) bool {
+	u, _ := url.Parse(rawURL)
+	return c.Get(&http.Request{Method: "GET", Host: u.Host, URL: u, Header: make(http.Header)}, &config.Config{}) != nil
+}
+
+func TestPurgeURL(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/article", nil, nil)
+	store(t, c, "/article", http.Header{"Accept-Language": {"fr"}}, http.Header{"Vary": {"Accept-Language"}})
+	store(t, c, "/article?page=2", nil, nil)
+	store(t, c, "/other", nil, nil)
+
+	purged, err := c.PurgeURL(ctx, &url.URL{Path: "/article"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected both variants to be purged, got %d", purged)
+	}
+	if cached(c, "/article") {
+		t.Error("expected /article to be purged")
+	}
+	if !cached(c, "/article?page=2") || !cached(c, "/other") {
+		t.Error("expected other URLs to remain cached")
+	}
+	if mr.Exists(urlIndexKey("", "", &url.URL{Path: "/article"})) {
+		t.Error("expected URL index to be removed")
+	}
+}
+
+func TestPurgeURLHost(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "http://a.example.com/article", nil, nil)
+	store(t, c, "http://b.example.com/article", nil, nil)
+
+	purged, err := c.PurgeURL(ctx, &url.URL{Host: "a.example.com", Path: "/article"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || cached(c, "http://a.example.com/article") {
+		t.Errorf("expected only a.example.com to be purged, purged %d", purged)
+	}
+	if !cached(c, "http://b.example.com/article") {
+		t.Error("expected b.example.com to remain cached")
+	}
+
+	store(t, c, "http://a.example.com/article", nil, nil)
+	purged, err = c.PurgeURL(ctx, &url.URL{Path: "/article"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected a URL without a host to be purged on every host, purged %d", purged)
+	}
+}
+
+func TestPurgePrefixHost(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "http://a.example.com/blog/one", nil, nil)
+	store(t, c, "http://b.example.com/blog/one", nil, nil)
+
+	purged, err := c.PurgePrefix(ctx, "B.example.com", "/blog/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || cached(c, "http://b.example.com/blog/one") {
+		t.Errorf("expected only b.example.com to be purged, purged %d", purged)
+	}
+	if !cached(c, "http://a.example.com/blog/one") {
+		t.Error("expected a.example.com to remain cached")
+	}
+}
+
+func TestPurgePrefixAndGlob(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/articles/one", nil, nil)
+	store(t, c, "/articles/two?ref=home", nil, nil)
+	store(t, c, "/articles/two/comments", nil, nil)
+	store(t, c, "/about", nil, nil)
+
+	purged, err := c.PurgeGlob(ctx, "", "/articles/*/comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || cached(c, "/articles/two/comments") {
+		t.Errorf("expected glob to purge only the comments page, purged %d", purged)
+	}
+
+	purged, err = c.PurgeGlob(ctx, "", "/articles/tw?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || cached(c, "/articles/two?ref=home") {
+		t.Errorf("expected glob to match paths with a query string, purged %d", purged)
+	}
+
+	purged, err = c.PurgePrefix(ctx, "", "/articles/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 || cached(c, "/articles/one") {
+		t.Errorf("expected prefix purge to remove /articles/one, purged %d", purged)
+	}
+	if !cached(c, "/about") {
+		t.Error("expected /about to remain cached")
+	}
+}
+
+func TestPurgePrefixEscaped(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/caf%C3%A9/menu", http.Header{"Accept-Language": {"fr"}}, http.Header{"Vary": {"Accept-Language"}})
+	store(t, c, "/a%20b/c", nil, nil)
+	store(t, c, "/cafe/menu", nil, nil)
+
+	for _, prefix := range []string{"/café/", "/a b/"} {
+		purged, err := c.PurgePrefix(ctx, "", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 1 {
+			t.Errorf("expected prefix %q to purge 1 entry, purged %d", prefix, purged)
+		}
+	}
+	if !cached(c, "/cafe/menu") {
+		t.Error("expected /cafe/menu to remain cached")
+	}
+	if mr.Exists(varyKey("", "", &url.URL{Path: "/café/menu"})) {
+		t.Error("expected the purged URL's Vary key to be removed")
+	}
+}
+
+func TestPurgeGlobVaryKeys(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/articles/one", http.Header{"Accept-Language": {"fr"}}, http.Header{"Vary": {"Accept-Language"}})
+	if !mr.Exists(varyKey("", "", &url.URL{Path: "/articles/one"})) {
+		t.Fatal("expected a Vary key to be recorded")
+	}
+
+	if _, err := c.PurgeGlob(ctx, "", "/articles/*"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(varyKey("", "", &url.URL{Path: "/articles/one"})) {
+		t.Error("expected the purged URL's Vary key to be removed")
+	}
+}
+
+func TestPurgeTag(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/a", nil, http.Header{"Surrogate-Key": {"article-1 homepage"}})
+	store(t, c, "/b", nil, http.Header{"Cache-Tag": {"article-2, homepage"}})
+	store(t, c, "/c", nil, http.Header{"Surrogate-Key": {"article-3"}})
+
+	purged, err := c.PurgeTag(ctx, "homepage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 || cached(c, "/a") || cached(c, "/b") {
+		t.Errorf("expected tagged entries to be purged, purged %d", purged)
+	}
+	if !cached(c, "/c") {
+		t.Error("expected untagged entry to remain cached")
+	}
+}
+
+func TestPurgeAll(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/a", nil, http.Header{"Surrogate-Key": {"x"}})
+	store(t, c, "/b", nil, nil)
+	if err := mr.Set("unrelated", "keep"); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := c.PurgeAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 entries purged, got %d", purged)
+	}
+	if keys := mr.Keys(); !slices.Equal(keys, []string{"unrelated"}) {
+		t.Errorf("expected only keys outside the cache namespace to remain, got %v", keys)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	store(t, c, "/page", nil, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=600"}})
+
+	infos, err := c.Inspect(ctx, &url.URL{Path: "/page"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(infos))
+	}
+	info := infos[0]
+	if info.ETag != `"v1"` || info.StatusCode != 200 || info.Size != len("body of /page") {
+		t.Errorf("unexpected entry info: %+v", info)
+	}
+	if info.TTLSeconds <= 0 || info.TTLSeconds > 600 {
+		t.Errorf("expected TTL from max-age, got %d", info.TTLSeconds)
+	}
+	if info.Headers.Get("Content-Type") != "text/html" {
+		t.Error("expected entry headers")
+	}
+
+	infos, err = c.Inspect(ctx, &url.URL{Path: "/missing"})
+	if err != nil || len(infos) != 0 {
+		t.Errorf("expected no entries for uncached URL, got %v, %v", infos, err)
+	}
+}
+
+// TestRoutes tests that routes on the same URL keep their own Vary header lists,
+// and that purges and inspection cover every route
+func TestRoutes(t *testing.T) {
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+
+	u, _ := url.Parse("http://example.com/page")
+	newReq := func(lang string) *http.Request {
+		return &http.Request{Method: "GET", Host: u.Host, URL: u, Header: http.Header{"Accept-Language": {lang}}}
+	}
+	amp := &config.Config{Route: "amp"}
+	plain := &config.Config{}
+
+	set := func(cfg *config.Config, lang string, header http.Header) {
+		header.Set("Content-Type", "text/html")
+		entry := &Entry{Body: []byte(cfg.Route + " " + lang), Headers: header, StatusCode: 200, Timestamp: time.Now()}
+		if err := c.Set(newReq(lang), entry, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set(amp, "fr", http.Header{"Vary": {"Accept-Language"}})
+	set(plain, "fr", http.Header{})
+
+	// Storing the route without Vary doesn't clobber the other route's Vary list
+	if entry := c.Get(newReq("fr"), amp); entry == nil || string(entry.Body) != "amp fr" {
+		t.Errorf("expected the amp route's French variant, got %v", entry)
+	}
+	if entry := c.Get(newReq("de"), amp); entry != nil {
+		t.Errorf("expected no amp variant for another language, got %q", entry.Body)
+	}
+	if entry := c.Get(newReq("de"), plain); entry == nil || string(entry.Body) != " fr" {
+		t.Errorf("expected the plain route's single variant, got %v", entry)
+	}
+
+	infos, err := c.Inspect(ctx, &url.URL{Host: "example.com", Path: "/page"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for _, info := range infos {
+		routes = append(routes, info.Route)
+	}
+	slices.Sort(routes)
+	if !slices.Equal(routes, []string{"", "amp"}) {
+		t.Errorf("expected entries for both routes, got %v", routes)
+	}
+
+	purged, err := c.PurgeURL(ctx, &url.URL{Host: "example.com", Path: "/page"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected both routes' entries to be purged, purged %d", purged)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := escapeGlob(`/a*b?[c]\`); got != `/a\*b\?\[c\]\\` {
+		t.Errorf("unexpected escape: %s", got)
+	}
+}
@@ -0,0 +1,323 @@
+// This file implements RedisStore, which keeps cached entries in a Redis server
+// shared by every XRP instance pointed at it.
+//
+// RedisStore never fails XRP because Redis is down. A circuit breaker opens after
+// several consecutive failed operations (or a failed connection at startup); while it
+// is open, operations fail immediately with ErrUnavailable instead of waiting for a
+// timeout, and a background loop pings Redis with exponential backoff, closing the
+// breaker once Redis answers.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+const (
+	// breakerThreshold is how many consecutive failed operations open the breaker
+	breakerThreshold = 3
+	// connectTimeout bounds the initial connection attempt and each reconnect ping
+	connectTimeout = 2 * time.Second
+	// reconnectMinBackoff and reconnectMaxBackoff bound the delay between pings
+	// while the breaker is open
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// setExtendingScript stores ARGV[1] at KEYS[1] with an expiry of ARGV[2] milliseconds,
+// or the key's current expiry if that is later
+var setExtendingScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local current = redis.call("PTTL", KEYS[1])
+if current > ttl then
+	ttl = current
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+return 0
+`)
+
+// addMemberScript adds ARGV[1] to each set in KEYS, extending the set's expiry to
+// ARGV[2] milliseconds if it would otherwise expire sooner
+var addMemberScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+for _, key in ipairs(KEYS) do
+	redis.call("SADD", key, ARGV[1])
+	if redis.call("PTTL", key) < ttl then
+		redis.call("PEXPIRE", key, ttl)
+	end
+end
+return 0
+`)
+
+// deleteIfEqualScript deletes KEYS[1] if it still holds ARGV[1]
+var deleteIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisStore is a Store backed by a Redis server
+type RedisStore struct {
+	client *redis.Client
+
+	mu       sync.Mutex
+	failures int   // consecutive failed operations
+	open     bool  // whether the breaker is open
+	lastErr  error // why the breaker opened, or the last failed ping
+	since    time.Time
+
+	stop      chan struct{}
+	stopOnce  sync.Once
+	reconnect sync.WaitGroup
+}
+
+// NewRedisStore returns a RedisStore for the Redis server described by redisConfig.
+// If Redis can't be reached, the store starts out unavailable and keeps trying to
+// connect in the background.
+func NewRedisStore(redisConfig config.RedisConfig) *RedisStore {
+	s := &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     redisConfig.Addr,
+			Password: redisConfig.Password,
+			DB:       redisConfig.DB,
+		}),
+		since: time.Now(),
+		stop:  make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		slog.Warn("Redis unavailable, caching disabled until it can be reached", "addr", redisConfig.Addr, "error", err)
+		s.trip(fmt.Errorf("failed to connect to Redis: %w", err))
+	}
+	return s
+}
+
+// Health returns nil if Redis is reachable, or why it isn't
+func (s *RedisStore) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.open {
+		return nil
+	}
+	return fmt.Errorf("unavailable since %s: %w", s.since.UTC().Format(time.RFC3339), s.lastErr)
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.do(ctx, "get", func() (err error) {
+		data, err = s.client.Get(ctx, key).Bytes()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *RedisStore) Exists(ctx context.Context, key string) (bool, error) {
+	var n int64
+	err := s.do(ctx, "exists", func() (err error) {
+		n, err = s.client.Exists(ctx, key).Result()
+		return err
+	})
+	return n > 0, err
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.do(ctx, "set", func() error {
+		return s.client.Set(ctx, key, value, ttl).Err()
+	})
+}
+
+func (s *RedisStore) SetExtending(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.do(ctx, "set", func() error {
+		return setExtendingScript.Run(ctx, s.client, []string{key}, value, ttl.Milliseconds()).Err()
+	})
+}
+
+func (s *RedisStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	var stored bool
+	err := s.do(ctx, "lock", func() (err error) {
+		stored, err = s.client.SetNX(ctx, key, value, ttl).Result()
+		return err
+	})
+	return stored, err
+}
+
+// Delete deletes keys in batches
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) (int, error) {
+	const batchSize = 100
+	deleted := 0
+	for start := 0; start < len(keys); start += batchSize {
+		end := min(start+batchSize, len(keys))
+		var n int64
+		err := s.do(ctx, "delete", func() (err error) {
+			n, err = s.client.Del(ctx, keys[start:end]...).Result()
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int(n)
+	}
+	return deleted, nil
+}
+
+func (s *RedisStore) DeleteIfEqual(ctx context.Context, key string, value []byte) error {
+	return s.do(ctx, "unlock", func() error {
+		return deleteIfEqualScript.Run(ctx, s.client, []string{key}, value).Err()
+	})
+}
+
+func (s *RedisStore) AddMember(ctx context.Context, setKeys []string, member string, ttl time.Duration) error {
+	return s.do(ctx, "index", func() error {
+		return addMemberScript.Run(ctx, s.client, setKeys, member, ttl.Milliseconds()).Err()
+	})
+}
+
+func (s *RedisStore) Members(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := s.do(ctx, "smembers", func() (err error) {
+		members, err = s.client.SMembers(ctx, key).Result()
+		return err
+	})
+	return members, err
+}
+
+func (s *RedisStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	err := s.do(ctx, "scan", func() error {
+		iter := s.client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	})
+	return keys, err
+}
+
+// Close stops reconnecting and closes the Redis client
+func (s *RedisStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.reconnect.Wait()
+	return s.client.Close()
+}
+
+// do runs a Redis operation through the circuit breaker, failing fast with
+// ErrUnavailable while it is open
+func (s *RedisStore) do(ctx context.Context, operation string, fn func() error) error {
+	s.mu.Lock()
+	open := s.open
+	s.mu.Unlock()
+	if open {
+		return ErrUnavailable
+	}
+
+	err := fn()
+	switch {
+	case err == nil, errors.Is(err, redis.Nil):
+		s.succeed()
+	case isRedisReply(err):
+		// Redis answered, so it's reachable even though the command failed
+		metrics.RedisErrorsTotal.WithLabelValues(operation).Inc()
+		s.succeed()
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		// The caller gave up; that says nothing about Redis
+	default:
+		metrics.RedisErrorsTotal.WithLabelValues(operation).Inc()
+		s.fail(err)
+	}
+	return err
+}
+
+// isRedisReply reports whether err is an error reply from the Redis server
+func isRedisReply(err error) bool {
+	var replyErr redis.Error
+	return errors.As(err, &replyErr)
+}
+
+func (s *RedisStore) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+}
+
+// fail records a failed operation, opening the breaker after breakerThreshold
+// consecutive failures
+func (s *RedisStore) fail(err error) {
+	s.mu.Lock()
+	s.failures++
+	trip := !s.open && s.failures >= breakerThreshold
+	s.mu.Unlock()
+
+	if trip {
+		slog.Error("Redis unavailable, caching disabled until it recovers", "error", err)
+		s.trip(err)
+	}
+}
+
+// trip opens the breaker and starts reconnecting in the background
+func (s *RedisStore) trip(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.open {
+		return
+	}
+	s.open = true
+	s.lastErr = err
+	s.since = time.Now()
+	metrics.CacheAvailable.Set(0)
+
+	s.reconnect.Add(1)
+	go s.reconnectLoop()
+}
+
+// reconnectLoop pings Redis with exponential backoff until it answers, then closes
+// the breaker
+func (s *RedisStore) reconnectLoop() {
+	defer s.reconnect.Done()
+
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		err := s.client.Ping(ctx).Err()
+		cancel()
+
+		s.mu.Lock()
+		if err == nil {
+			s.open = false
+			s.failures = 0
+			s.lastErr = nil
+			s.since = time.Now()
+			metrics.CacheAvailable.Set(1)
+			s.mu.Unlock()
+			slog.Info("Redis connection restored, caching re-enabled")
+			return
+		}
+		s.lastErr = err
+		s.mu.Unlock()
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
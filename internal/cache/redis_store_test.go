@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestRedisStoreBreaker(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s := NewRedisStore(config.RedisConfig{Addr: mr.Addr()})
+	defer s.Close()
+
+	if err := s.Health(); err != nil {
+		t.Fatalf("expected healthy store, got %v", err)
+	}
+
+	mr.Close()
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err := s.Get(ctx, "key"); err == nil || errors.Is(err, ErrUnavailable) {
+			t.Fatalf("expected connection error before the breaker opens, got %v", err)
+		}
+	}
+	if s.Health() == nil {
+		t.Fatal("expected breaker to open after repeated failures")
+	}
+
+	start := time.Now()
+	if _, err := s.Get(ctx, "key"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable while the breaker is open, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("expected open breaker to fail fast, took %v", elapsed)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("failed to restart Redis: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Health() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected store to reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := s.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+		t.Errorf("expected Set to succeed after reconnecting, got %v", err)
+	}
+}
+
+func TestRedisStoreUnavailableAtStartup(t *testing.T) {
+	s := NewRedisStore(config.RedisConfig{Addr: "127.0.0.1:1"})
+	defer s.Close()
+
+	if s.Health() == nil {
+		t.Fatal("expected unreachable Redis to be reported")
+	}
+	if _, err := s.Get(context.Background(), "key"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+
+	// Get treats an unavailable store as a miss
+	c := New(s)
+	if cached(c, "http://example.com/page") {
+		t.Error("expected miss")
+	}
+}
@@ -0,0 +1,109 @@
+// This file implements serving stale entries (RFC 5861). An entry past its expiry
+// may still be served for its stale-while-revalidate window, while the caller refreshes
+// it in the background, and for its stale-if-error window when the backend fails.
+// Windows come from the response's Cache-Control header, falling back to the cache
+// configuration, and entries are kept in Redis until both windows have passed.
+//
+// Entries with an ETag or Last-Modified validator are kept for revalidationRetention
+// beyond that, so the caller can revalidate them with a conditional request and reuse
+// the processed body if the backend responds 304 Not Modified.
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// Freshness describes how a cached entry may be used
+type Freshness int
+
+const (
+	// Fresh entries are served as cache hits
+	Fresh Freshness = iota
+	// Stale entries are past expiry but within their stale-while-revalidate window;
+	// they are served while a background request refreshes them
+	Stale
+	// StaleIfError entries are past their stale-while-revalidate window but within
+	// their stale-if-error window; they are served only if the backend fails
+	StaleIfError
+	// Expired entries are past their stale windows but have a validator; they may
+	// only be revalidated with a conditional request
+	Expired
+)
+
+// revalidationRetention is how long expired entries with a validator are kept
+const revalidationRetention = 24 * time.Hour
+
+// freshness reports how entry may be used, or false if it is too stale to use at all
+func (c *Cache) freshness(entry *Entry, cfg *config.Config) (Freshness, bool) {
+	now := time.Now()
+	expiry := c.expiresAt(entry)
+	if !now.After(expiry) {
+		return Fresh, true
+	}
+
+	whileRevalidate, ifError := staleWindows(entry, cfg)
+	switch {
+	case !now.After(expiry.Add(whileRevalidate)):
+		return Stale, true
+	case !now.After(expiry.Add(ifError)):
+		return StaleIfError, true
+	case hasValidator(entry):
+		return Expired, true
+	default:
+		return Fresh, false
+	}
+}
+
+// retention returns how long past expiry entry must be kept in Redis
+func retention(entry *Entry, cfg *config.Config) time.Duration {
+	whileRevalidate, ifError := staleWindows(entry, cfg)
+	keep := max(whileRevalidate, ifError)
+	if hasValidator(entry) {
+		keep = max(keep, revalidationRetention)
+	}
+	return keep
+}
+
+// hasValidator reports whether entry can be revalidated with a conditional request
+func hasValidator(entry *Entry) bool {
+	return entry.ETag != "" || entry.LastModified != ""
+}
+
+// staleWindows returns how long past expiry entry may be served while revalidating
+// and when the backend fails
+func staleWindows(entry *Entry, cfg *config.Config) (whileRevalidate, ifError time.Duration) {
+	whileRevalidateSeconds := cfg.Cache.StaleWhileRevalidate
+	if entry.StaleWhileRevalidate != nil {
+		whileRevalidateSeconds = *entry.StaleWhileRevalidate
+	}
+	ifErrorSeconds := cfg.Cache.StaleIfError
+	if entry.StaleIfError != nil {
+		ifErrorSeconds = *entry.StaleIfError
+	}
+	return time.Duration(whileRevalidateSeconds) * time.Second, time.Duration(ifErrorSeconds) * time.Second
+}
+
+// parseStaleDirectives populates entry's stale windows from a Cache-Control header.
+// must-revalidate and proxy-revalidate forbid serving the response stale at all.
+func parseStaleDirectives(entry *Entry, cacheControl string) {
+	if hasDirective(cacheControl, "must-revalidate") || hasDirective(cacheControl, "proxy-revalidate") {
+		zero := 0
+		entry.StaleWhileRevalidate = &zero
+		entry.StaleIfError = &zero
+		return
+	}
+	entry.StaleWhileRevalidate = parseDirectiveSeconds(cacheControl, "stale-while-revalidate")
+	entry.StaleIfError = parseDirectiveSeconds(cacheControl, "stale-if-error")
+}
+
+func hasDirective(cacheControl, directive string) bool {
+	for _, part := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), directive) {
+			return true
+		}
+	}
+	return false
+}
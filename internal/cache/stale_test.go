@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestFreshness(t *testing.T) {
+	c := &Cache{}
+	intPtr := func(v int) *int { return &v }
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		entry    *Entry
+		cfg      config.CacheConfig
+		expected Freshness
+		usable   bool
+	}{
+		{
+			name:     "fresh",
+			entry:    &Entry{Timestamp: now, MaxAge: intPtr(60)},
+			expected: Fresh,
+			usable:   true,
+		},
+		{
+			name:   "expired without stale windows",
+			entry:  &Entry{Timestamp: now.Add(-2 * time.Minute), MaxAge: intPtr(60)},
+			usable: false,
+		},
+		{
+			name:     "within stale-while-revalidate",
+			entry:    &Entry{Timestamp: now.Add(-2 * time.Minute), MaxAge: intPtr(60), StaleWhileRevalidate: intPtr(120)},
+			expected: Stale,
+			usable:   true,
+		},
+		{
+			name:     "within stale-if-error only",
+			entry:    &Entry{Timestamp: now.Add(-5 * time.Minute), MaxAge: intPtr(60), StaleWhileRevalidate: intPtr(120), StaleIfError: intPtr(600)},
+			expected: StaleIfError,
+			usable:   true,
+		},
+		{
+			name:     "expired with validator",
+			entry:    &Entry{Timestamp: now.Add(-2 * time.Minute), MaxAge: intPtr(60), ETag: `"v1"`},
+			expected: Expired,
+			usable:   true,
+		},
+		{
+			name:     "configured default window",
+			entry:    &Entry{Timestamp: now.Add(-2 * time.Minute), MaxAge: intPtr(60)},
+			cfg:      config.CacheConfig{StaleIfError: 300},
+			expected: StaleIfError,
+			usable:   true,
+		},
+		{
+			name:   "directive overrides configured window",
+			entry:  &Entry{Timestamp: now.Add(-2 * time.Minute), MaxAge: intPtr(60), StaleIfError: intPtr(0)},
+			cfg:    config.CacheConfig{StaleIfError: 300},
+			usable: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			freshness, usable := c.freshness(tt.entry, &config.Config{Cache: tt.cfg})
+			if usable != tt.usable || (usable && freshness != tt.expected) {
+				t.Errorf("expected (%v, %v), got (%v, %v)", tt.expected, tt.usable, freshness, usable)
+			}
+		})
+	}
+}
+
+func TestParseStaleDirectives(t *testing.T) {
+	entry := &Entry{}
+	parseStaleDirectives(entry, "max-age=60, stale-while-revalidate=30, stale-if-error=86400")
+	if entry.StaleWhileRevalidate == nil || *entry.StaleWhileRevalidate != 30 {
+		t.Errorf("expected stale-while-revalidate=30, got %v", entry.StaleWhileRevalidate)
+	}
+	if entry.StaleIfError == nil || *entry.StaleIfError != 86400 {
+		t.Errorf("expected stale-if-error=86400, got %v", entry.StaleIfError)
+	}
+
+	entry = &Entry{}
+	parseStaleDirectives(entry, "max-age=60, stale-if-error=86400, must-revalidate")
+	if entry.StaleWhileRevalidate == nil || *entry.StaleWhileRevalidate != 0 || entry.StaleIfError == nil || *entry.StaleIfError != 0 {
+		t.Error("expected must-revalidate to disable stale windows")
+	}
+}
+
+func TestGetStaleEntry(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	store(t, c, "/stale", nil, http.Header{"Cache-Control": {"max-age=0, stale-while-revalidate=60"}})
+	entry := c.Get(&http.Request{Method: "GET", URL: &url.URL{Path: "/stale"}, Header: make(http.Header)}, &config.Config{})
+	if entry == nil || entry.Freshness != Stale || entry.Key == "" {
+		t.Fatalf("expected stale entry with key, got %+v", entry)
+	}
+
+	store(t, c, "/expired", nil, http.Header{"Cache-Control": {"max-age=0"}})
+	if entry := c.Get(&http.Request{Method: "GET", URL: &url.URL{Path: "/expired"}, Header: make(http.Header)}, &config.Config{}); entry != nil {
+		t.Errorf("expected expired entry to be ignored, got %+v", entry)
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Get for missing or expired keys
+var ErrNotFound = errors.New("cache: key not found")
+
+// ErrUnavailable is returned by stores that can't currently reach their backend.
+// Cache treats it as a miss, so XRP keeps proxying without caching.
+var ErrUnavailable = errors.New("cache: store unavailable")
+
+// Store is the storage behind a Cache. Keys hold either a value or a set of members
+// (the URL and surrogate key indexes); every key expires after its TTL. Cache decides
+// what to store and under which keys, so a Store only has to provide these primitives.
+//
+// Implementations: RedisStore (shared by XRP instances), MemoryStore (a size-bounded
+// in-process LRU), FileStore (a directory on disk), and TieredStore (a MemoryStore in
+// front of another store).
+type Store interface {
+	// Get returns the value stored at key, or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value at key, expiring after ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Exists reports whether key holds a value or set. Unlike Get, it always
+	// consults the authoritative store, so it sees other instances' changes.
+	Exists(ctx context.Context, key string) (bool, error)
+	// SetExtending stores value at key, expiring after ttl or when the key's
+	// current value would have expired, whichever is later
+	SetExtending(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetIfAbsent stores value at key, expiring after ttl, unless key exists.
+	// It reports whether value was stored.
+	SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete deletes keys, returning how many of them existed
+	Delete(ctx context.Context, keys ...string) (int, error)
+	// DeleteIfEqual deletes key if it holds value
+	DeleteIfEqual(ctx context.Context, key string, value []byte) error
+	// AddMember adds member to the set at each of setKeys, extending each set's
+	// expiry to ttl if it would otherwise expire sooner
+	AddMember(ctx context.Context, setKeys []string, member string, ttl time.Duration) error
+	// Members returns the members of the set at key, or nil if there is none
+	Members(ctx context.Context, key string) ([]string, error)
+	// Keys returns every key matching a Redis glob pattern (see matchGlob)
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	// Health returns nil if the store is usable, or why it isn't
+	Health() error
+	// Close releases the store's resources
+	Close() error
+}
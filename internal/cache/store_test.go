@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// testStores returns a fresh instance of each Store implementation
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	redisStore := NewRedisStore(config.RedisConfig{Addr: miniredis.RunT(t).Addr()})
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	tieredShared := NewRedisStore(config.RedisConfig{Addr: miniredis.RunT(t).Addr()})
+
+	stores := map[string]Store{
+		"redis":  redisStore,
+		"memory": NewMemoryStore(1 << 20),
+		"file":   fileStore,
+		"tiered": NewTieredStore(NewMemoryStore(1<<20), tieredShared, time.Minute),
+	}
+	t.Cleanup(func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	})
+	return stores
+}
+
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(missing) error = %v, expected ErrNotFound", err)
+			}
+
+			if err := s.Set(ctx, "a", []byte("one"), time.Minute); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+			if value, err := s.Get(ctx, "a"); err != nil || string(value) != "one" {
+				t.Errorf("Get(a) = %q, %v; expected \"one\"", value, err)
+			}
+
+			if err := s.SetExtending(ctx, "a", []byte("two"), time.Second); err != nil {
+				t.Fatalf("SetExtending failed: %v", err)
+			}
+			if value, err := s.Get(ctx, "a"); err != nil || string(value) != "two" {
+				t.Errorf("Get(a) = %q, %v; expected \"two\"", value, err)
+			}
+
+			stored, err := s.SetIfAbsent(ctx, "lock", []byte("token"), time.Minute)
+			if err != nil || !stored {
+				t.Errorf("SetIfAbsent(lock) = %v, %v; expected true", stored, err)
+			}
+			stored, err = s.SetIfAbsent(ctx, "lock", []byte("other"), time.Minute)
+			if err != nil || stored {
+				t.Errorf("second SetIfAbsent(lock) = %v, %v; expected false", stored, err)
+			}
+			if err := s.DeleteIfEqual(ctx, "lock", []byte("other")); err != nil {
+				t.Fatalf("DeleteIfEqual failed: %v", err)
+			}
+			if held, err := s.Exists(ctx, "lock"); err != nil || !held {
+				t.Errorf("lock deleted despite holding a different value")
+			}
+			if err := s.DeleteIfEqual(ctx, "lock", []byte("token")); err != nil {
+				t.Fatalf("DeleteIfEqual failed: %v", err)
+			}
+			if held, err := s.Exists(ctx, "lock"); err != nil || held {
+				t.Errorf("lock not deleted")
+			}
+
+			if err := s.AddMember(ctx, []string{"set:1", "set:2"}, "a", time.Minute); err != nil {
+				t.Fatalf("AddMember failed: %v", err)
+			}
+			if err := s.AddMember(ctx, []string{"set:1"}, "b", time.Minute); err != nil {
+				t.Fatalf("AddMember failed: %v", err)
+			}
+			members, err := s.Members(ctx, "set:1")
+			slices.Sort(members)
+			if err != nil || !slices.Equal(members, []string{"a", "b"}) {
+				t.Errorf("Members(set:1) = %v, %v; expected [a b]", members, err)
+			}
+			if members, err := s.Members(ctx, "set:missing"); err != nil || len(members) != 0 {
+				t.Errorf("Members(set:missing) = %v, %v; expected none", members, err)
+			}
+
+			keys, err := s.Keys(ctx, "set:*")
+			slices.Sort(keys)
+			if err != nil || !slices.Equal(keys, []string{"set:1", "set:2"}) {
+				t.Errorf("Keys(set:*) = %v, %v; expected [set:1 set:2]", keys, err)
+			}
+
+			deleted, err := s.Delete(ctx, "a", "set:1", "missing")
+			if err != nil || deleted != 2 {
+				t.Errorf("Delete = %d, %v; expected 2", deleted, err)
+			}
+			if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("a not deleted")
+			}
+		})
+	}
+}
+
+func TestStoresExpiry(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]Store{"memory": NewMemoryStore(1 << 20)}
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	defer fileStore.Close()
+	stores["file"] = fileStore
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			s.Set(ctx, "short", []byte("value"), 20*time.Millisecond)
+			s.AddMember(ctx, []string{"set"}, "short", 20*time.Millisecond)
+			time.Sleep(40 * time.Millisecond)
+
+			if _, err := s.Get(ctx, "short"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expired value still stored")
+			}
+			if members, _ := s.Members(ctx, "set"); len(members) != 0 {
+				t.Errorf("expired set still stored: %v", members)
+			}
+			if keys, _ := s.Keys(ctx, "*"); len(keys) != 0 {
+				t.Errorf("Keys returned expired keys: %v", keys)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	value := make([]byte, 1000)
+	s := NewMemoryStore(3 * (memoryItemOverhead + 1 + 1000))
+
+	s.Set(ctx, "a", value, time.Minute)
+	s.Set(ctx, "b", value, time.Minute)
+	s.Set(ctx, "c", value, time.Minute)
+	// Reading a makes b the least recently used
+	s.Get(ctx, "a")
+	s.Set(ctx, "d", value, time.Minute)
+
+	if _, err := s.Get(ctx, "b"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected least recently used key to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, err := s.Get(ctx, key); err != nil {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+	if s.Size() > 3*(memoryItemOverhead+1+1000) {
+		t.Errorf("store size %d exceeds its limit", s.Size())
+	}
+
+	// Values larger than the whole store aren't stored
+	s.Set(ctx, "huge", make([]byte, 10000), time.Minute)
+	if _, err := s.Get(ctx, "huge"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected oversized value not to be stored")
+	}
+	if _, err := s.Get(ctx, "a"); err != nil {
+		t.Error("oversized value evicted existing keys")
+	}
+}
+
+func TestTieredStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	shared := NewRedisStore(config.RedisConfig{Addr: mr.Addr()})
+	memory := NewMemoryStore(1 << 20)
+	s := NewTieredStore(memory, shared, time.Minute)
+	defer s.Close()
+
+	// Values written elsewhere are read through and kept in memory
+	mr.Set("remote", "value")
+	if value, err := s.Get(ctx, "remote"); err != nil || string(value) != "value" {
+		t.Fatalf("Get(remote) = %q, %v", value, err)
+	}
+	mr.Del("remote")
+	if value, err := s.Get(ctx, "remote"); err != nil || string(value) != "value" {
+		t.Errorf("expected remote value to be served from memory, got %q, %v", value, err)
+	}
+
+	// Deletes remove both tiers
+	s.Set(ctx, "local", []byte("value"), time.Hour)
+	if !mr.Exists("local") {
+		t.Error("expected Set to write to the shared store")
+	}
+	if ttl := mr.TTL("local"); ttl != time.Hour {
+		t.Errorf("shared TTL = %v, expected 1h", ttl)
+	}
+	s.Delete(ctx, "local")
+	if _, err := memory.Get(ctx, "local"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected Delete to remove the memory tier")
+	}
+}
+
+// TestCacheWithStores checks caching, Vary, and purging against every store
+func TestCacheWithStores(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			c := New(s)
+			store(t, c, "http://example.com/articles/one", nil, http.Header{"Surrogate-Key": {"articles"}})
+			store(t, c, "http://example.com/articles/two", http.Header{"Accept-Language": {"fr"}},
+				http.Header{"Vary": {"Accept-Language"}})
+			store(t, c, "http://example.com/about", nil, nil)
+
+			if !cached(c, "http://example.com/articles/one") || !cached(c, "http://example.com/about") {
+				t.Fatal("expected entries to be cached")
+			}
+
+			ctx := context.Background()
+			if purged, err := c.PurgeTag(ctx, "articles"); err != nil || purged != 1 {
+				t.Errorf("PurgeTag = %d, %v; expected 1", purged, err)
+			}
+			if purged, err := c.PurgeGlob(ctx, "", "/articles/*"); err != nil || purged != 1 {
+				t.Errorf("PurgeGlob = %d, %v; expected 1", purged, err)
+			}
+			if cached(c, "http://example.com/articles/one") {
+				t.Error("expected purged entry to be gone")
+			}
+			if !cached(c, "http://example.com/about") {
+				t.Error("expected unrelated entry to be kept")
+			}
+			if purged, err := c.PurgeAll(ctx); err != nil || purged != 1 {
+				t.Errorf("PurgeAll = %d, %v; expected 1", purged, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// This file implements TieredStore, which puts a MemoryStore in front of a shared
+// store (usually Redis) so hot entries are served without a network round trip.
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TieredStore is a Store that reads through a local MemoryStore to a shared store.
+// Values are kept in memory for at most memoryTTL, which bounds how long an instance
+// may keep serving an entry another instance has purged or replaced. Sets and locks
+// live only in the shared store, so purges and coalescing see every instance's entries.
+type TieredStore struct {
+	memory    *MemoryStore
+	shared    Store
+	memoryTTL time.Duration
+}
+
+// NewTieredStore returns a TieredStore caching values from shared in memory for at
+// most memoryTTL
+func NewTieredStore(memory *MemoryStore, shared Store, memoryTTL time.Duration) *TieredStore {
+	return &TieredStore{memory: memory, shared: shared, memoryTTL: memoryTTL}
+}
+
+func (s *TieredStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if value, err := s.memory.Get(ctx, key); err == nil {
+		return value, nil
+	}
+
+	value, err := s.shared.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.memory.Set(ctx, key, value, s.memoryTTL)
+	return value, nil
+}
+
+func (s *TieredStore) Exists(ctx context.Context, key string) (bool, error) {
+	return s.shared.Exists(ctx, key)
+}
+
+func (s *TieredStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.shared.Set(ctx, key, value, ttl); err != nil {
+		s.memory.Delete(ctx, key)
+		return err
+	}
+	return s.memory.Set(ctx, key, value, min(ttl, s.memoryTTL))
+}
+
+func (s *TieredStore) SetExtending(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.shared.SetExtending(ctx, key, value, ttl); err != nil {
+		s.memory.Delete(ctx, key)
+		return err
+	}
+	return s.memory.Set(ctx, key, value, min(ttl, s.memoryTTL))
+}
+
+func (s *TieredStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.shared.SetIfAbsent(ctx, key, value, ttl)
+}
+
+func (s *TieredStore) Delete(ctx context.Context, keys ...string) (int, error) {
+	s.memory.Delete(ctx, keys...)
+	return s.shared.Delete(ctx, keys...)
+}
+
+func (s *TieredStore) DeleteIfEqual(ctx context.Context, key string, value []byte) error {
+	return s.shared.DeleteIfEqual(ctx, key, value)
+}
+
+func (s *TieredStore) AddMember(ctx context.Context, setKeys []string, member string, ttl time.Duration) error {
+	return s.shared.AddMember(ctx, setKeys, member, ttl)
+}
+
+func (s *TieredStore) Members(ctx context.Context, key string) ([]string, error) {
+	return s.shared.Members(ctx, key)
+}
+
+func (s *TieredStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return s.shared.Keys(ctx, pattern)
+}
+
+// Health reports the shared store's health. While it is unavailable, values
+// already in memory are still served.
+func (s *TieredStore) Health() error {
+	return s.shared.Health()
+}
+
+func (s *TieredStore) Close() error {
+	return errors.Join(s.memory.Close(), s.shared.Close())
+}
@@ -0,0 +1,86 @@
+// This file implements Vary support. Responses are stored under a variant key derived
+// from the request headers named in the response's Vary header. Because lookups happen
+// before the response is known, each URL also has a primary key recording its Vary
+// header list; Get reads it first to compute the variant key for the incoming request.
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const varyKeyPrefix = keyPrefix + "vary:"
+
+// varyKey returns the primary key holding the Vary header list for a URL on a host,
+// requested through a route. Routes on the same URL may get different responses,
+// so each keeps its own list.
+func varyKey(host, route string, u *url.URL) string {
+	return varyKeyPrefix + urlKeySuffix(host, route, u)
+}
+
+// varyIsWildcard reports whether a Vary header value contains "*", meaning the
+// response varies on something outside the request headers and can't be cached
+func varyIsWildcard(header http.Header) bool {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeVary returns the canonical, sorted, de-duplicated list of header names a
+// response varies on, joined with commas. Accept-Encoding is omitted: XRP stores
+// identity-encoded bodies and negotiates the encoding for each client itself, so a
+// single entry serves every Accept-Encoding.
+func normalizeVary(header http.Header) string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "Accept-Encoding" || slices.Contains(names, name) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// normalizeHeaderValue joins all values of a request header, trimming the whitespace
+// around list separators so equivalent values produce the same variant key
+func normalizeHeaderValue(values []string) string {
+	var parts []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// lookupVary returns the Vary header list recorded for the request's URL and route,
+// or "" if none is recorded
+func (c *Cache) lookupVary(ctx context.Context, req *http.Request, route string) (string, error) {
+	vary, err := c.store.Get(ctx, varyKey(req.Host, route, req.URL))
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return string(vary), err
+}
+
+// storeVary records the Vary header list for the request's URL and route, keeping
+// it for as long as any of the URL's variants
+func (c *Cache) storeVary(ctx context.Context, req *http.Request, route, vary string, ttl time.Duration) error {
+	return c.store.SetExtending(ctx, varyKey(req.Host, route, req.URL), []byte(vary), ttl)
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestNormalizeVary(t *testing.T) {
+	tests := []struct {
+		vary     []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"accept-language"}, "Accept-Language"},
+		{[]string{"User-Agent, Accept-Language"}, "Accept-Language,User-Agent"},
+		{[]string{"Accept-Encoding"}, ""},
+		{[]string{"Accept-Encoding, Accept-Language", "accept-language"}, "Accept-Language"},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{"Vary": tt.vary}
+		if got := normalizeVary(header); got != tt.expected {
+			t.Errorf("normalizeVary(%v) = %q, expected %q", tt.vary, got, tt.expected)
+		}
+	}
+}
+
+func TestIsCacheableVaryWildcard(t *testing.T) {
+	c := &Cache{}
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Vary": {"Accept-Language, *"}},
+		Request:    &http.Request{Method: "GET", Header: make(http.Header)},
+	}
+	if c.IsCacheable(resp) {
+		t.Error("expected Vary: * response not to be cacheable")
+	}
+}
+
+func varyRequest(path string, header http.Header) *http.Request {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Request{Method: "GET", URL: &url.URL{Path: path}, Header: header}
+}
+
+func storeVariant(t *testing.T, c *Cache, req *http.Request, body, vary string) {
+	t.Helper()
+	entry := &Entry{
+		Body:       []byte(body),
+		Headers:    http.Header{"Content-Type": {"text/html"}, "Vary": {vary}},
+		StatusCode: 200,
+		Timestamp:  time.Now(),
+	}
+	if err := c.Set(req, entry, &config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetVaryVariants(t *testing.T) {
+	c, _ := newTestCache(t)
+	cfg := &config.Config{}
+
+	storeVariant(t, c, varyRequest("/page", http.Header{"Accept-Language": {"fr"}}), "bonjour", "Accept-Language")
+	storeVariant(t, c, varyRequest("/page", http.Header{"Accept-Language": {"en"}}), "hello", "Accept-Language")
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string // "" for a cache miss
+	}{
+		{"french", http.Header{"Accept-Language": {"fr"}}, "bonjour"},
+		{"english", http.Header{"Accept-Language": {"en"}}, "hello"},
+		{"german is a miss", http.Header{"Accept-Language": {"de"}}, ""},
+		{"no language is a miss", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := c.Get(varyRequest("/page", tt.header), cfg)
+			switch {
+			case tt.expected == "" && entry != nil:
+				t.Errorf("expected miss, got %q", entry.Body)
+			case tt.expected != "" && entry == nil:
+				t.Errorf("expected %q, got miss", tt.expected)
+			case tt.expected != "" && string(entry.Body) != tt.expected:
+				t.Errorf("expected %q, got %q", tt.expected, entry.Body)
+			}
+		})
+	}
+}
+
+func TestGetVaryIgnoresAcceptEncoding(t *testing.T) {
+	c, _ := newTestCache(t)
+	cfg := &config.Config{}
+
+	storeVariant(t, c, varyRequest("/page", http.Header{"Accept-Encoding": {"gzip"}, "Accept-Language": {"fr, en"}}),
+		"bonjour", "Accept-Encoding, Accept-Language")
+
+	entry := c.Get(varyRequest("/page", http.Header{"Accept-Encoding": {"br"}, "Accept-Language": {"fr,en"}}), cfg)
+	if entry == nil || string(entry.Body) != "bonjour" {
+		t.Error("expected a hit regardless of Accept-Encoding and list whitespace")
+	}
+}
+
+func TestSetVaryWildcardNotStored(t *testing.T) {
+	c, mr := newTestCache(t)
+
+	storeVariant(t, c, varyRequest("/page", nil), "random", "*")
+
+	if c.Get(varyRequest("/page", nil), &config.Config{}) != nil {
+		t.Error("expected Vary: * response not to be cached")
+	}
+	if len(mr.Keys()) != 0 {
+		t.Errorf("expected nothing stored, got %v", mr.Keys())
+	}
+}
@@ -0,0 +1,226 @@
+// Package certs provides the certificates XRP serves when it terminates TLS.
+//
+// Certificates come from the files listed in tls.certificates, and from an ACME
+// CA (Let's Encrypt by default) for the hosts listed in tls.acme.hosts. Each TLS
+// handshake gets a certificate by the server name the client asked for (SNI):
+// - A certificate file covering the name, exact names taking precedence over wildcards
+// - An ACME certificate, if the name is an ACME host
+// - Otherwise the first certificate file
+//
+// Certificate files are reread by Update, on SIGHUP, so renewed certificates are
+// served without a restart. ACME certificates are renewed automatically and kept
+// in tls.acme.cache_dir; ACME challenges are answered over TLS-ALPN on the proxy
+// listener, and over HTTP by HTTPHandler.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// Manager selects certificates for TLS handshakes
+type Manager struct {
+	state atomic.Pointer[state]
+}
+
+// state is a loaded set of certificates, replaced as a whole by Update
+type state struct {
+	certificates []*tls.Certificate
+	// byName maps each name certificates are valid for, including wildcards
+	// like "*.example.com", to the first certificate listing it
+	byName map[string]*tls.Certificate
+
+	acmeConfig config.ACMEConfig
+	// acme is nil when ACME is disabled
+	acme *autocert.Manager
+}
+
+// New loads the certificates of cfg
+func New(cfg config.TLSConfig) (*Manager, error) {
+	m := &Manager{}
+	if err := m.Update(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Update loads the certificates of cfg, replacing the current ones. On error the
+// current certificates are kept. ACME state is kept if the ACME account settings
+// are unchanged.
+func (m *Manager) Update(cfg config.TLSConfig) error {
+	s := &state{byName: make(map[string]*tls.Certificate), acmeConfig: cfg.ACME}
+
+	for _, certConfig := range cfg.Certificates {
+		cert, err := tls.LoadX509KeyPair(certConfig.CertFile, certConfig.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", certConfig.CertFile, err)
+		}
+		s.certificates = append(s.certificates, &cert)
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, seen := s.byName[name]; !seen {
+				s.byName[name] = &cert
+			}
+		}
+	}
+
+	if len(cfg.ACME.Hosts) > 0 {
+		previous := m.state.Load()
+		if previous != nil && previous.acme != nil && sameACMEAccount(previous.acmeConfig, cfg.ACME) {
+			s.acme = previous.acme
+		} else {
+			acmeManager, err := m.newACMEManager(cfg.ACME)
+			if err != nil {
+				return err
+			}
+			s.acme = acmeManager
+		}
+	}
+
+	m.state.Store(s)
+	slog.Info("Loaded TLS certificates", "files", len(s.certificates), "acme_hosts", len(cfg.ACME.Hosts))
+	return nil
+}
+
+// sameACMEAccount reports whether a and b can share an autocert.Manager. Host
+// lists may differ, since the host policy reads the current one.
+func sameACMEAccount(a, b config.ACMEConfig) bool {
+	return a.Email == b.Email && a.DirectoryURL == b.DirectoryURL &&
+		a.CACertFile == b.CACertFile && a.CacheDir == b.CacheDir
+}
+
+func (m *Manager) newACMEManager(cfg config.ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA certificate: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: m.hostPolicy,
+		Email:      cfg.Email,
+		Client:     client,
+	}, nil
+}
+
+// hostPolicy allows ACME certificates for the configured hosts only
+func (m *Manager) hostPolicy(_ context.Context, host string) error {
+	if !m.state.Load().isACMEHost(host) {
+		return fmt.Errorf("host %q is not in tls.acme.hosts", host)
+	}
+	return nil
+}
+
+func (s *state) isACMEHost(host string) bool {
+	return s.acme != nil && slices.ContainsFunc(s.acmeConfig.Hosts, func(h string) bool {
+		return strings.EqualFold(h, host)
+	})
+}
+
+// GetCertificate returns the certificate for a TLS handshake; see tls.Config
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s := m.state.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	// TLS-ALPN-01 challenges are answered with a certificate made for them
+	if s.acme != nil && slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return s.acme.GetCertificate(hello)
+	}
+
+	if cert := s.lookup(name); cert != nil {
+		return cert, nil
+	}
+	if s.isACMEHost(name) {
+		return s.acme.GetCertificate(hello)
+	}
+	if len(s.certificates) > 0 {
+		return s.certificates[0], nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// lookup returns the certificate file covering name, if any
+func (s *state) lookup(name string) *tls.Certificate {
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return s.byName["*"+name[i:]]
+	}
+	return nil
+}
+
+// Configure sets up server to serve TLS with the manager's certificates
+func (m *Manager) Configure(server *http.Server, cfg config.TLSConfig) {
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.MinVersion == config.TLSVersion13 {
+		minVersion = tls.VersionTLS13
+	}
+
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(!cfg.DisableHTTP2)
+
+	nextProtos := []string{"http/1.1", acme.ALPNProto}
+	if !cfg.DisableHTTP2 {
+		nextProtos = append([]string{"h2"}, nextProtos...)
+	}
+	server.TLSConfig = &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     minVersion,
+		NextProtos:     nextProtos,
+	}
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges, and redirects other requests to
+// HTTPS on httpsPort
+func (m *Manager) HTTPHandler(httpsPort string) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := m.state.Load(); s.acme != nil {
+			s.acme.HTTPHandler(redirect).ServeHTTP(w, r)
+			return
+		}
+		redirect.ServeHTTP(w, r)
+	})
+}
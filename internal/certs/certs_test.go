@@ -0,0 +1,236 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// writeCertificate writes a self-signed certificate for names to dir
+func writeCertificate(t *testing.T, dir, file string, names ...string) config.CertificateConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certConfig := config.CertificateConfig{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	if err := os.WriteFile(certConfig.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certConfig.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certConfig
+}
+
+// servedName returns the first DNS name of the certificate served for serverName
+func servedName(t *testing.T, m *Manager, serverName string) string {
+	t.Helper()
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q) failed: %v", serverName, err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(config.TLSConfig{Certificates: []config.CertificateConfig{
+		writeCertificate(t, dir, "default", "default.example"),
+		writeCertificate(t, dir, "wildcard", "*.example.com", "example.com"),
+		writeCertificate(t, dir, "blog", "blog.example.com"),
+	}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	tests := map[string]string{
+		"blog.example.com":  "blog.example.com",
+		"BLOG.example.com.": "blog.example.com",
+		"shop.example.com":  "*.example.com",
+		"example.com":       "*.example.com",
+		"a.b.example.com":   "default.example",
+		"other.org":         "default.example",
+		"":                  "default.example",
+	}
+	for serverName, want := range tests {
+		if got := servedName(t, m, serverName); got != want {
+			t.Errorf("expected %s for %q, got %s", want, serverName, got)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	certConfig := writeCertificate(t, dir, "site", "old.example.com")
+	m, err := New(config.TLSConfig{Certificates: []config.CertificateConfig{certConfig}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A renewed certificate is picked up on update
+	writeCertificate(t, dir, "site", "new.example.com")
+	if err := m.Update(config.TLSConfig{Certificates: []config.CertificateConfig{certConfig}}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got := servedName(t, m, "new.example.com"); got != "new.example.com" {
+		t.Errorf("expected renewed certificate, got %s", got)
+	}
+
+	// A broken certificate fails the update and keeps the current one
+	if err := os.WriteFile(certConfig.KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(config.TLSConfig{Certificates: []config.CertificateConfig{certConfig}}); err == nil {
+		t.Error("expected error loading a broken key")
+	}
+	if got := servedName(t, m, "new.example.com"); got != "new.example.com" {
+		t.Errorf("expected current certificate to be kept, got %s", got)
+	}
+}
+
+func TestACME(t *testing.T) {
+	dir := t.TempDir()
+	acmeConfig := config.ACMEConfig{
+		Hosts:        []string{"acme.example.com"},
+		DirectoryURL: "https://localhost:14000/dir",
+		CacheDir:     filepath.Join(dir, "acme"),
+	}
+	m, err := New(config.TLSConfig{
+		Certificates: []config.CertificateConfig{writeCertificate(t, dir, "file", "file.example.com")},
+		ACME:         acmeConfig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.state.Load()
+	if s.acme == nil || s.acme.Client.DirectoryURL != acmeConfig.DirectoryURL {
+		t.Fatal("expected ACME manager for the configured directory")
+	}
+	if err := m.hostPolicy(t.Context(), "ACME.example.com"); err != nil {
+		t.Errorf("expected ACME host to be allowed: %v", err)
+	}
+	if err := m.hostPolicy(t.Context(), "file.example.com"); err == nil {
+		t.Error("expected host outside tls.acme.hosts to be refused")
+	}
+	if got := servedName(t, m, "file.example.com"); got != "file.example.com" {
+		t.Errorf("expected certificate file to take precedence, got %s", got)
+	}
+
+	// The ACME account is kept when only the hosts change
+	acmeConfig.Hosts = []string{"acme.example.com", "www.example.com"}
+	if err := m.Update(config.TLSConfig{ACME: acmeConfig}); err != nil {
+		t.Fatal(err)
+	}
+	if m.state.Load().acme != s.acme {
+		t.Error("expected ACME manager to be kept")
+	}
+	if err := m.hostPolicy(t.Context(), "www.example.com"); err != nil {
+		t.Errorf("expected new ACME host to be allowed: %v", err)
+	}
+
+	// A CA certificate that can't be read fails the update
+	acmeConfig.CACertFile = filepath.Join(dir, "missing.pem")
+	if err := m.Update(config.TLSConfig{ACME: acmeConfig}); err == nil {
+		t.Error("expected error for missing ACME CA certificate")
+	}
+}
+
+// TestConfigure tests that a configured server serves HTTP/2 with the right certificate
+func TestConfigure(t *testing.T) {
+	dir := t.TempDir()
+	certConfig := writeCertificate(t, dir, "site", "localhost")
+	tlsConfig := config.TLSConfig{Certificates: []config.CertificateConfig{certConfig}, MinVersion: config.TLSVersion12}
+	m, err := New(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})}
+	m.Configure(server, tlsConfig)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	defer server.Close()
+
+	pemData, _ := os.ReadFile(certConfig.CertFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemData)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}, ForceAttemptHTTP2: true}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	resp, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2, got %s", body)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m := &Manager{}
+	m.state.Store(&state{})
+
+	tests := []struct {
+		port, host, want string
+	}{
+		{"443", "example.com", "https://example.com/a?b=1"},
+		{"443", "example.com:80", "https://example.com/a?b=1"},
+		{"8443", "example.com:8080", "https://example.com:8443/a?b=1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/a?b=1", nil)
+		req.Host = tt.host
+		recorder := httptest.NewRecorder()
+		m.HTTPHandler(tt.port).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != tt.want {
+			t.Errorf("expected redirect to %s, got %d %s", tt.want, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
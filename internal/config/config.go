@@ -2,12 +2,28 @@
 //
 // It supports JSON-based configuration files with the following features:
 // - Backend URL validation (must be HTTP/HTTPS)
+// - Lists of upstreams per backend, with load balancing, health checks, and retries (see upstreams.go)
+// - Backend connection tuning and TLS: private CAs, client certificates, and SNI
+// - Host header and forwarding header policy, with trusted proxies (see forwarding.go)
+// - Cache store selection (Redis, in-memory LRU, filesystem, or memory in front of Redis)
 // - Redis connection configuration
 // - MIME type and plugin mapping with validation
 // - Plugin naming convention enforcement (must end with "Plugin")
-// - Plugin file validation (must be .so files)
+// - Plugin file validation (Go plugins must be .so files)
+// - Out-of-process plugins (exec subprocesses or Unix sockets)
+// - Per-plugin options objects, passed to plugins that implement xrpplugin.Configurable
 // - Cookie denylist for cache exclusion
 // - Response size limits
+// - Response body buffering: spilling large bodies to disk and a global memory budget
+// - Per-MIME-type error handling policies (on_error)
+// - Per-plugin timeouts and automatic disabling of repeatedly failing plugins
+// - Token-authenticated admin API for cache purging and inspection
+// - Structured access log in JSON or Combined Log Format
+// - OpenTelemetry tracing, exported over OTLP or to a file
+// - TLS termination with SNI certificate selection, HTTP/2, and ACME certificates
+// - Multiple sites (virtual hosts), each with its own backend, plugins, and cache settings
+// - Routes selecting plugin chains and caching by path, host, method, query, or header (see routes.go)
+// - Response header rules: set, append, remove, and regex replace, with placeholders (see headers.go)
 //
 // Configuration files are validated on load and can be hot-reloaded via SIGHUP signal.
 // Invalid configurations are rejected while keeping the current configuration active.
@@ -15,7 +31,8 @@
 // Example configuration:
 //
 //	{
-//	  "backend_url": "http://localhost:8081",
+//	  "backend_url": ["http://app1:8080", "http://app2:8080"],
+//	  "load_balancing": {"policy": "least_conn", "health_check": {"path": "/healthz"}},
 //	  "redis": {
 //	    "addr": "localhost:6379",
 //	    "password": "",
@@ -24,21 +41,39 @@
 //	  "mime_types": [
 //	    {
 //	      "mime_type": "text/html",
+//	      "on_error": "passthrough",
 //	      "plugins": [
 //	        {
 //	          "path": "./plugins/html_modifier.so",
-//	          "name": "HTMLModifierPlugin"
+//	          "name": "HTMLModifierPlugin",
+//	          "options": {"banner_text": "Hello"}
+//	        },
+//	        {
+//	          "type": "exec",
+//	          "path": "./plugins/remote_modifier",
+//	          "name": "RemoteModifierPlugin",
+//	          "timeout_ms": 2000
 //	        }
 //	      ]
 //	    }
 //	  ],
 //	  "cookie_denylist": ["session"],
 //	  "max_response_size_mb": 10,
-//	  "health_port": 8081
+//	  "health_port": 8081,
+//	  "admin": {"token": "change-me-to-a-long-random-string"},
+//	  "sites": [
+//	    {
+//	      "hosts": ["blog.example.com", "*.blog.example.com"],
+//	      "backend_url": "http://localhost:8082",
+//	      "cache": {"key_include_scheme": true}
+//	    }
+//	  ]
 //	}
 package config
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -62,23 +97,316 @@ type RedisConfig struct {
 	DB       int    `json:"db"`
 }
 
+// Plugin types for PluginConfig.Type
+const (
+	// PluginTypeGo loads a Go plugin (.so) into the XRP process
+	PluginTypeGo = "go"
+	// PluginTypeExec launches the plugin as a subprocess, talking to it over stdin/stdout
+	PluginTypeExec = "exec"
+	// PluginTypeSocket connects to a plugin listening on a Unix socket
+	PluginTypeSocket = "socket"
+)
+
+var validPluginTypes = []string{PluginTypeGo, PluginTypeExec, PluginTypeSocket}
+
 type PluginConfig struct {
-	Path string `json:"path"`
-	Name string `json:"name"`
+	Path    string          `json:"path"`
+	Name    string          `json:"name"`
+	Options json.RawMessage `json:"options,omitempty"`
+
+	// Type selects how the plugin is run; see the PluginType constants (default: go)
+	Type string `json:"type,omitempty"`
+	// Args are extra command-line arguments for exec plugins
+	Args []string `json:"args,omitempty"`
+	// TimeoutMS bounds each call to the plugin (default: 5000 for exec and socket
+	// plugins, unlimited for Go plugins)
+	TimeoutMS int `json:"timeout_ms,omitempty"`
+	// Concurrency is how many documents an exec or socket plugin may process at
+	// once, each over its own process or connection (default: 4)
+	Concurrency int `json:"concurrency,omitempty"`
+	// MaxConsecutiveFailures disables the plugin after this many failures in a row,
+	// until the configuration is reloaded (default: 0, never disable)
+	MaxConsecutiveFailures int `json:"max_consecutive_failures,omitempty"`
+}
+
+// IsRemote reports whether the plugin runs outside the XRP process
+func (pc PluginConfig) IsRemote() bool {
+	return pc.Type == PluginTypeExec || pc.Type == PluginTypeSocket
 }
 
+// ID identifies the plugin by its path and name. Names alone aren't unique: plugins
+// loaded from different files commonly all export GetPlugin.
+func (pc PluginConfig) ID() string {
+	return pc.Path + "/" + pc.Name
+}
+
+// Error handling policies for MimeTypeConfig.OnError
+const (
+	// OnErrorPassthrough serves the original upstream response when parsing or a plugin fails
+	OnErrorPassthrough = "passthrough"
+	// OnErrorFail returns an error to the client (502 Bad Gateway) when parsing or a plugin fails
+	OnErrorFail = "fail"
+	// OnErrorSkipPlugin skips a failing plugin and continues with the rest of the chain;
+	// parse and render failures are handled as passthrough
+	OnErrorSkipPlugin = "skip_plugin"
+)
+
+var validOnErrorPolicies = []string{OnErrorPassthrough, OnErrorFail, OnErrorSkipPlugin}
+
+// Processing modes for MimeTypeConfig.Processing
+const (
+	// ProcessingTree parses each document into a tree, runs plugins on it, and
+	// renders it back, within max_response_size_mb
+	ProcessingTree = "tree"
+	// ProcessingStream rewrites HTML documents as they stream through, with plugins
+	// implementing xrpplugin.StreamingPlugin, whatever their size
+	ProcessingStream = "stream"
+)
+
+var validProcessingModes = []string{ProcessingTree, ProcessingStream}
+
 type MimeTypeConfig struct {
 	MimeType string         `json:"mime_type"`
 	Plugins  []PluginConfig `json:"plugins"`
+	OnError  string         `json:"on_error"`
+	// Processing selects how documents are processed; see the Processing constants
+	// (default: tree)
+	Processing string `json:"processing,omitempty"`
+}
+
+// AdminConfig configures the admin API served on the health port
+type AdminConfig struct {
+	// Token is the bearer token admin API requests must present. The admin API
+	// is disabled when it is empty.
+	Token string `json:"token"`
+}
+
+// minAdminTokenLength guards against trivially guessable admin tokens
+const minAdminTokenLength = 16
+
+// Defaults for the response size limit and the memory budget, which are
+// checked against each other before defaults are set
+const (
+	defaultMaxResponseSizeMB = 10
+	defaultMemoryBudgetMB    = 256
+)
+
+// CacheConfig configures response caching
+type CacheConfig struct {
+	// Disabled turns off caching
+	Disabled bool `json:"disabled"`
+	// KeyIncludeScheme adds the request scheme to cache keys, for sites that serve
+	// different content over HTTP and HTTPS. The Host is always part of the key.
+	KeyIncludeScheme bool `json:"key_include_scheme"`
+	// StaleWhileRevalidate is how many seconds past expiry a cached response may be
+	// served while it is refreshed in the background, for responses without a
+	// stale-while-revalidate Cache-Control directive (default: 0)
+	StaleWhileRevalidate int `json:"stale_while_revalidate"`
+	// StaleIfError is how many seconds past expiry a cached response may be served
+	// when the backend fails, for responses without a stale-if-error Cache-Control
+	// directive (default: 0)
+	StaleIfError int `json:"stale_if_error"`
+	// Coalesce collapses concurrent cache misses for the same entry
+	Coalesce CoalesceConfig `json:"coalesce"`
+}
+
+// CoalesceConfig configures request coalescing. While one request for a missing or
+// expired cache entry is fetched and processed, other requests for the same entry
+// wait for it and are then served from the cache.
+type CoalesceConfig struct {
+	Enabled bool `json:"enabled"`
+	// TimeoutMS bounds how long a request waits for another to fill the cache
+	// before going to the backend itself (default: 5000)
+	TimeoutMS int `json:"timeout_ms"`
+	// Distributed coordinates through cache store locks, so requests also wait
+	// for fetches by other XRP instances sharing the store (Redis or tiered)
+	Distributed bool `json:"distributed"`
+}
+
+// Cache store types for StoreConfig.Type
+const (
+	// StoreRedis keeps cached responses in Redis, shared by every XRP instance using it
+	StoreRedis = "redis"
+	// StoreMemory keeps cached responses in a size-bounded in-process LRU
+	StoreMemory = "memory"
+	// StoreFile keeps cached responses in files under a directory
+	StoreFile = "file"
+	// StoreTiered keeps recently used responses in memory in front of Redis
+	StoreTiered = "tiered"
+)
+
+var validStoreTypes = []string{StoreRedis, StoreMemory, StoreFile, StoreTiered}
+
+// StoreConfig selects where cached responses are stored
+type StoreConfig struct {
+	// Type is one of the Store constants (default: redis)
+	Type string `json:"type"`
+	// MaxSizeMB bounds the memory store, and the memory tier of the tiered
+	// store (default: 64)
+	MaxSizeMB int `json:"max_size_mb"`
+	// Path is the directory the file store writes to
+	Path string `json:"path"`
+	// MemoryTTLSeconds bounds how long the tiered store keeps a response in
+	// memory, and so how long an instance may serve a response purged or replaced
+	// by another instance (default: 30)
+	MemoryTTLSeconds int `json:"memory_ttl_seconds"`
+}
+
+// UsesRedis reports whether the store needs a Redis server
+func (sc StoreConfig) UsesRedis() bool {
+	return sc.Type == "" || sc.Type == StoreRedis || sc.Type == StoreTiered
+}
+
+// Access log formats for AccessLogConfig.Format
+const (
+	// AccessLogJSON writes one JSON object per request
+	AccessLogJSON = "json"
+	// AccessLogCombined writes the Combined Log Format, followed by XRP's fields
+	AccessLogCombined = "combined"
+)
+
+var validAccessLogFormats = []string{AccessLogJSON, AccessLogCombined}
+
+// AccessLogConfig configures the per-request access log
+type AccessLogConfig struct {
+	// Enabled turns on the access log
+	Enabled bool `json:"enabled"`
+	// Format is one of the AccessLog constants (default: json)
+	Format string `json:"format"`
+	// Path is the file to append to; stdout if empty. The file is reopened on
+	// SIGUSR1, for log rotation.
+	Path string `json:"path"`
+}
+
+// Trace exporters for TracingConfig.Exporter
+const (
+	// TraceExporterOTLP sends spans to an OTLP/HTTP collector
+	TraceExporterOTLP = "otlp"
+	// TraceExporterFile writes spans to a file as JSON, one per line
+	TraceExporterFile = "file"
+)
+
+var validTraceExporters = []string{TraceExporterOTLP, TraceExporterFile}
+
+// TracingConfig configures OpenTelemetry tracing. Changes take effect on restart.
+type TracingConfig struct {
+	// Enabled turns on tracing
+	Enabled bool `json:"enabled"`
+	// Exporter is one of the TraceExporter constants (default: otlp)
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP collector's host:port. If empty, the standard
+	// OTEL_EXPORTER_OTLP_* environment variables apply (default: localhost:4318).
+	Endpoint string `json:"endpoint"`
+	// Insecure sends spans to the OTLP collector over plain HTTP
+	Insecure bool `json:"insecure"`
+	// Path is the file the file exporter writes to
+	Path string `json:"path"`
+	// SampleRatio is the fraction of traces started by XRP to record; requests
+	// arriving with a traceparent follow the caller's sampling decision (default: 1)
+	SampleRatio float64 `json:"sample_ratio"`
+	// ServiceName identifies XRP in traces (default: xrp)
+	ServiceName string `json:"service_name"`
+}
+
+// TLS versions for TLSConfig.MinVersion
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+var validTLSVersions = []string{TLSVersion12, TLSVersion13}
+
+// TLSConfig configures TLS termination on the proxy listener. Enabling or
+// disabling TLS, and changing redirect_addr, take effect on restart; certificates
+// are reloaded on SIGHUP.
+type TLSConfig struct {
+	// Enabled serves HTTPS, with HTTP/2, on the proxy listener
+	Enabled bool `json:"enabled"`
+	// Certificates lists certificate files; each connection gets the one matching
+	// the server name the client asked for (SNI)
+	Certificates []CertificateConfig `json:"certificates"`
+	// ACME obtains certificates from an ACME CA, such as Let's Encrypt
+	ACME ACMEConfig `json:"acme"`
+	// RedirectAddr is an address to serve plain HTTP on, redirecting requests to
+	// HTTPS and answering ACME HTTP-01 challenges (e.g. ":80")
+	RedirectAddr string `json:"redirect_addr"`
+	// MinVersion is one of the TLSVersion constants (default: 1.2)
+	MinVersion string `json:"min_version"`
+	// DisableHTTP2 serves HTTP/1.1 only
+	DisableHTTP2 bool `json:"disable_http2"`
+}
+
+// CertificateConfig is a PEM certificate chain and its private key
+type CertificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// ACMEConfig configures ACME certificate issuance. Certificates are obtained when
+// a client first asks for one of Hosts, and renewed before they expire.
+type ACMEConfig struct {
+	// Hosts lists the host names to obtain certificates for; ACME is disabled
+	// when it is empty
+	Hosts []string `json:"hosts"`
+	// Email is the contact address for the ACME account
+	Email string `json:"email"`
+	// DirectoryURL is the ACME CA's directory (default: Let's Encrypt production)
+	DirectoryURL string `json:"directory_url"`
+	// CACertFile is a PEM file of CA certificates to trust for the directory, for
+	// test CAs like Pebble
+	CACertFile string `json:"ca_cert_file"`
+	// CacheDir is where the account key and certificates are kept across restarts
+	CacheDir string `json:"cache_dir"`
+}
+
+// BufferingConfig controls how response bodies are held while XRP processes them.
+// It applies to the whole process, not per site.
+type BufferingConfig struct {
+	// SpillThresholdKB is how much of a body is kept in memory; the rest is
+	// written to a temporary file (default: 1024)
+	SpillThresholdKB int `json:"spill_threshold_kb"`
+	// SpillDir is where temporary files are created (default: the OS temp directory)
+	SpillDir string `json:"spill_dir"`
+	// MemoryBudgetMB bounds the memory used by response bodies across all
+	// concurrent requests (default: 256)
+	MemoryBudgetMB int `json:"memory_budget_mb"`
+	// BudgetWaitMS is how long a response waits for memory budget to free up
+	// (default: 5000)
+	BudgetWaitMS int `json:"budget_wait_ms"`
 }
 
 type Config struct {
-	BackendURL         string           `json:"backend_url"`
-	Redis              RedisConfig      `json:"redis"`
-	MimeTypes          []MimeTypeConfig `json:"mime_types"`
-	CookieDenylist     []string         `json:"cookie_denylist"`
-	MaxResponseSizeMB  int              `json:"max_response_size_mb"`
-	HealthPort         int              `json:"health_port"`
+	BackendURL        string           `json:"backend_url"`
+	CacheStore        StoreConfig      `json:"cache_store"`
+	Redis             RedisConfig      `json:"redis"`
+	MimeTypes         []MimeTypeConfig `json:"mime_types"`
+	CookieDenylist    []string         `json:"cookie_denylist"`
+	MaxResponseSizeMB int              `json:"max_response_size_mb"`
+	HealthPort        int              `json:"health_port"`
+	Admin             AdminConfig      `json:"admin"`
+	AccessLog         AccessLogConfig  `json:"access_log"`
+	Tracing           TracingConfig    `json:"tracing"`
+	TLS               TLSConfig        `json:"tls"`
+	Buffering         BufferingConfig  `json:"buffering"`
+	Cache             CacheConfig      `json:"cache"`
+	Sites             []SiteConfig     `json:"sites"`
+
+	// Upstreams lists the upstreams to balance requests over when backend_url is
+	// a list; BackendURL is then the first of them
+	Upstreams     []string            `json:"-"`
+	LoadBalancing LoadBalancingConfig `json:"load_balancing"`
+	Transport     TransportConfig     `json:"transport"`
+	UpstreamTLS   UpstreamTLSConfig   `json:"upstream_tls"`
+	Forwarding    ForwardingConfig    `json:"forwarding"`
+	Routes        []RouteConfig       `json:"routes"`
+
+	// ResponseHeaders changes the headers of responses sent to clients, fresh or
+	// cached
+	ResponseHeaders []HeaderRuleConfig `json:"response_headers"`
+
+	// Route names the route a configuration returned by ResolveRoute was
+	// resolved for; it is empty if no route matched
+	Route string `json:"-"`
 }
 
 func Load(filename string) (*Config, error) {
@@ -102,20 +430,54 @@ func Load(filename string) (*Config, error) {
 }
 
 func validateConfig(config *Config) error {
-	if config.BackendURL == "" {
+	// A top-level backend is optional when sites are configured; it then serves
+	// requests for hosts that no site matches
+	if config.BackendURL == "" && len(config.Sites) == 0 {
 		return fmt.Errorf("backend_url is required")
 	}
+	if config.BackendURL != "" {
+		if err := validateBackendURL(config.BackendURL); err != nil {
+			return err
+		}
+	}
+	if err := validateUpstreams(config.Upstreams); err != nil {
+		return err
+	}
+	if err := validateLoadBalancingConfig(config.LoadBalancing); err != nil {
+		return err
+	}
+	if err := validateTransportConfig(config.Transport); err != nil {
+		return err
+	}
+	if err := validateUpstreamTLSConfig(config.UpstreamTLS); err != nil {
+		return err
+	}
+	if err := validateForwardingConfig(&config.Forwarding); err != nil {
+		return err
+	}
 
-	// Validate backend URL format
-	if _, err := url.Parse(config.BackendURL); err != nil {
-		return fmt.Errorf("backend_url must be a valid HTTP/HTTPS URL: %w", err)
+	if config.AccessLog.Format != "" && !slices.Contains(validAccessLogFormats, config.AccessLog.Format) {
+		return fmt.Errorf("invalid access_log.format '%s', must be one of: %s",
+			config.AccessLog.Format, strings.Join(validAccessLogFormats, ", "))
 	}
-	parsedURL, _ := url.Parse(config.BackendURL)
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return fmt.Errorf("backend_url must be a valid HTTP/HTTPS URL")
+
+	if err := validateTracingConfig(config.Tracing); err != nil {
+		return err
+	}
+
+	if err := validateStoreConfig(config.CacheStore); err != nil {
+		return err
+	}
+
+	if err := validateTLSConfig(config.TLS); err != nil {
+		return err
+	}
+
+	if config.Buffering.SpillThresholdKB < 0 || config.Buffering.MemoryBudgetMB < 0 || config.Buffering.BudgetWaitMS < 0 {
+		return fmt.Errorf("buffering.spill_threshold_kb, memory_budget_mb, and budget_wait_ms must not be negative")
 	}
 
-	if config.Redis.Addr == "" {
+	if config.CacheStore.UsesRedis() && config.Redis.Addr == "" {
 		return fmt.Errorf("redis.addr is required")
 	}
 
@@ -123,18 +485,160 @@ func validateConfig(config *Config) error {
 	if config.MaxResponseSizeMB < 0 {
 		return fmt.Errorf("max_response_size_mb must be positive")
 	}
+	// A response within the size limit must fit in the memory budget, or it could
+	// never be processed
+	maxResponseSizeMB := cmp.Or(config.MaxResponseSizeMB, defaultMaxResponseSizeMB)
+	memoryBudgetMB := cmp.Or(config.Buffering.MemoryBudgetMB, defaultMemoryBudgetMB)
+	if maxResponseSizeMB > memoryBudgetMB {
+		return fmt.Errorf("max_response_size_mb (%d) must not exceed buffering.memory_budget_mb (%d)",
+			maxResponseSizeMB, memoryBudgetMB)
+	}
 
 	// Validate health port
 	if config.HealthPort < 0 || config.HealthPort > 65535 {
 		return fmt.Errorf("health_port must be between 0 and 65535")
 	}
 
-	for i, mimeConfig := range config.MimeTypes {
+	if config.Admin.Token != "" && len(config.Admin.Token) < minAdminTokenLength {
+		return fmt.Errorf("admin.token must be at least %d characters", minAdminTokenLength)
+	}
+
+	if err := validateCacheConfig(config.Cache); err != nil {
+		return err
+	}
+
+	pluginOptions := make(map[string]json.RawMessage)
+
+	if err := validateMimeTypes(config.MimeTypes, pluginOptions); err != nil {
+		return err
+	}
+	if err := validateRoutes(config.Routes, pluginOptions); err != nil {
+		return err
+	}
+	if err := validateHeaderRules(config.ResponseHeaders); err != nil {
+		return err
+	}
+
+	return validateSites(config.Sites, pluginOptions)
+}
+
+// validateBackendURL ensures a backend URL is an absolute HTTP/HTTPS URL
+func validateBackendURL(backendURL string) error {
+	parsedURL, err := url.Parse(backendURL)
+	if err != nil {
+		return fmt.Errorf("backend_url must be a valid HTTP/HTTPS URL: %w", err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("backend_url must be a valid HTTP/HTTPS URL")
+	}
+	return nil
+}
+
+func validateTracingConfig(tracing TracingConfig) error {
+	if tracing.Exporter != "" && !slices.Contains(validTraceExporters, tracing.Exporter) {
+		return fmt.Errorf("invalid tracing.exporter '%s', must be one of: %s",
+			tracing.Exporter, strings.Join(validTraceExporters, ", "))
+	}
+	if tracing.Exporter == TraceExporterFile && tracing.Path == "" {
+		return fmt.Errorf("tracing.path is required for the file exporter")
+	}
+	if tracing.SampleRatio < 0 || tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func validateTLSConfig(tlsConfig TLSConfig) error {
+	if tlsConfig.MinVersion != "" && !slices.Contains(validTLSVersions, tlsConfig.MinVersion) {
+		return fmt.Errorf("invalid tls.min_version '%s', must be one of: %s",
+			tlsConfig.MinVersion, strings.Join(validTLSVersions, ", "))
+	}
+	if !tlsConfig.Enabled {
+		return nil
+	}
+
+	if len(tlsConfig.Certificates) == 0 && len(tlsConfig.ACME.Hosts) == 0 {
+		return fmt.Errorf("tls requires certificates or acme.hosts")
+	}
+	for i, cert := range tlsConfig.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("tls.certificates[%d]: cert_file and key_file are required", i)
+		}
+	}
+
+	acme := tlsConfig.ACME
+	if len(acme.Hosts) == 0 {
+		return nil
+	}
+	if acme.CacheDir == "" {
+		return fmt.Errorf("tls.acme.cache_dir is required")
+	}
+	for _, host := range acme.Hosts {
+		if host == "" || strings.Contains(host, "*") {
+			return fmt.Errorf("tls.acme: invalid host '%s', wildcards are not supported", host)
+		}
+	}
+	if acme.DirectoryURL != "" {
+		if parsedURL, err := url.Parse(acme.DirectoryURL); err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return fmt.Errorf("tls.acme.directory_url must be a valid HTTP/HTTPS URL")
+		}
+	}
+	return nil
+}
+
+func validateStoreConfig(store StoreConfig) error {
+	if store.Type != "" && !slices.Contains(validStoreTypes, store.Type) {
+		return fmt.Errorf("invalid cache_store.type '%s', must be one of: %s", store.Type, strings.Join(validStoreTypes, ", "))
+	}
+	if store.Type == StoreFile && store.Path == "" {
+		return fmt.Errorf("cache_store.path is required for the file store")
+	}
+	if store.MaxSizeMB < 0 {
+		return fmt.Errorf("cache_store.max_size_mb must be positive")
+	}
+	if store.MemoryTTLSeconds < 0 {
+		return fmt.Errorf("cache_store.memory_ttl_seconds must be positive")
+	}
+	return nil
+}
+
+func validateCacheConfig(cache CacheConfig) error {
+	if cache.StaleWhileRevalidate < 0 {
+		return fmt.Errorf("cache.stale_while_revalidate must be positive")
+	}
+	if cache.StaleIfError < 0 {
+		return fmt.Errorf("cache.stale_if_error must be positive")
+	}
+	if cache.Coalesce.TimeoutMS < 0 {
+		return fmt.Errorf("cache.coalesce.timeout_ms must be positive")
+	}
+	return nil
+}
+
+// validateMimeTypes validates MIME type and plugin configuration. pluginOptions
+// collects each plugin's options across the whole configuration, since a plugin
+// is loaded once no matter how many MIME types or sites use it.
+func validateMimeTypes(mimeTypes []MimeTypeConfig, pluginOptions map[string]json.RawMessage) error {
+	for i, mimeConfig := range mimeTypes {
 		if !slices.Contains(validHTMLXMLMimeTypes, mimeConfig.MimeType) {
 			return fmt.Errorf("mime_types[%d]: invalid MIME type '%s', must be one of: %s",
 				i, mimeConfig.MimeType, strings.Join(validHTMLXMLMimeTypes, ", "))
 		}
 
+		if mimeConfig.OnError != "" && !slices.Contains(validOnErrorPolicies, mimeConfig.OnError) {
+			return fmt.Errorf("mime_types[%d]: invalid on_error policy '%s', must be one of: %s",
+				i, mimeConfig.OnError, strings.Join(validOnErrorPolicies, ", "))
+		}
+
+		if mimeConfig.Processing != "" && !slices.Contains(validProcessingModes, mimeConfig.Processing) {
+			return fmt.Errorf("mime_types[%d]: invalid processing mode '%s', must be one of: %s",
+				i, mimeConfig.Processing, strings.Join(validProcessingModes, ", "))
+		}
+		streaming := mimeConfig.Processing == ProcessingStream
+		if streaming && mimeConfig.MimeType != "text/html" && mimeConfig.MimeType != "application/xhtml+xml" {
+			return fmt.Errorf("mime_types[%d]: stream processing is only supported for HTML", i)
+		}
+
 		if len(mimeConfig.Plugins) == 0 {
 			return fmt.Errorf("mime_types[%d]: at least one plugin must be specified", i)
 		}
@@ -152,23 +656,175 @@ func validateConfig(config *Config) error {
 				return fmt.Errorf("mime_types[%d].plugins[%d]: plugin name '%s' should end with 'Plugin'", i, j, plugin.Name)
 			}
 
-			// Validate plugin file extension  
-			if !strings.HasSuffix(plugin.Path, ".so") {
+			if plugin.Type != "" && !slices.Contains(validPluginTypes, plugin.Type) {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: invalid plugin type '%s', must be one of: %s",
+					i, j, plugin.Type, strings.Join(validPluginTypes, ", "))
+			}
+
+			// Validate plugin file extension
+			if !plugin.IsRemote() && !strings.HasSuffix(plugin.Path, ".so") {
 				return fmt.Errorf("mime_types[%d].plugins[%d]: plugin path '%s' must end with '.so'", i, j, plugin.Path)
 			}
+
+			if streaming && plugin.IsRemote() {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: stream processing requires Go plugins", i, j)
+			}
+
+			if plugin.Type != PluginTypeExec && len(plugin.Args) > 0 {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: args are only supported for exec plugins", i, j)
+			}
+
+			if plugin.TimeoutMS < 0 {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: timeout_ms must be positive", i, j)
+			}
+
+			if plugin.Concurrency < 0 {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: concurrency must be positive", i, j)
+			}
+			if !plugin.IsRemote() && plugin.Concurrency > 0 {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: concurrency is only supported for exec and socket plugins", i, j)
+			}
+
+			if plugin.MaxConsecutiveFailures < 0 {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: max_consecutive_failures must be positive", i, j)
+			}
+
+			if err := validatePluginOptions(plugin.Options); err != nil {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: %w", i, j, err)
+			}
+
+			// A plugin is loaded once, so every reference to it must agree on its options
+			key := plugin.Path + "/" + plugin.Name
+			if existing, seen := pluginOptions[key]; seen && !optionsEqual(existing, plugin.Options) {
+				return fmt.Errorf("mime_types[%d].plugins[%d]: plugin '%s' is configured elsewhere with different options", i, j, plugin.Name)
+			}
+			pluginOptions[key] = plugin.Options
 		}
 	}
 
 	return nil
 }
 
+// validatePluginOptions ensures a plugin's options, if present, are a JSON object
+func validatePluginOptions(options json.RawMessage) error {
+	if len(options) == 0 {
+		return nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(options, &obj); err != nil || obj == nil {
+		return fmt.Errorf("options must be a JSON object")
+	}
+	return nil
+}
+
+// optionsEqual compares two options objects, ignoring insignificant whitespace
+func optionsEqual(a, b json.RawMessage) bool {
+	var compactA, compactB bytes.Buffer
+	if len(a) > 0 {
+		if err := json.Compact(&compactA, a); err != nil {
+			return false
+		}
+	}
+	if len(b) > 0 {
+		if err := json.Compact(&compactB, b); err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
 func setDefaults(config *Config) {
 	if config.MaxResponseSizeMB == 0 {
-		config.MaxResponseSizeMB = 10
+		config.MaxResponseSizeMB = defaultMaxResponseSizeMB
 	}
 	if config.HealthPort == 0 {
 		config.HealthPort = 8081
 	}
+	if config.AccessLog.Format == "" {
+		config.AccessLog.Format = AccessLogJSON
+	}
+	if config.Tracing.Exporter == "" {
+		config.Tracing.Exporter = TraceExporterOTLP
+	}
+	if config.Tracing.SampleRatio == 0 {
+		config.Tracing.SampleRatio = 1
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "xrp"
+	}
+	if config.TLS.MinVersion == "" {
+		config.TLS.MinVersion = TLSVersion12
+	}
+	if config.Buffering.SpillThresholdKB == 0 {
+		config.Buffering.SpillThresholdKB = 1024
+	}
+	if config.Buffering.MemoryBudgetMB == 0 {
+		config.Buffering.MemoryBudgetMB = defaultMemoryBudgetMB
+	}
+	if config.Buffering.BudgetWaitMS == 0 {
+		config.Buffering.BudgetWaitMS = 5000
+	}
+	if config.CacheStore.Type == "" {
+		config.CacheStore.Type = StoreRedis
+	}
+	if config.CacheStore.MaxSizeMB == 0 {
+		config.CacheStore.MaxSizeMB = 64
+	}
+	if config.CacheStore.MemoryTTLSeconds == 0 {
+		config.CacheStore.MemoryTTLSeconds = 30
+	}
+	setMimeTypeDefaults(config.MimeTypes)
+	setRouteDefaults(config.Routes)
+	setCacheDefaults(&config.Cache)
+	setLoadBalancingDefaults(&config.LoadBalancing)
+	setTransportDefaults(&config.Transport)
+	setForwardingDefaults(&config.Forwarding)
+	for i := range config.Sites {
+		setMimeTypeDefaults(config.Sites[i].MimeTypes)
+		setRouteDefaults(config.Sites[i].Routes)
+		if config.Sites[i].Cache != nil {
+			setCacheDefaults(config.Sites[i].Cache)
+		}
+		if config.Sites[i].LoadBalancing != nil {
+			setLoadBalancingDefaults(config.Sites[i].LoadBalancing)
+		}
+		if config.Sites[i].Transport != nil {
+			setTransportDefaults(config.Sites[i].Transport)
+		}
+		if config.Sites[i].Forwarding != nil {
+			setForwardingDefaults(config.Sites[i].Forwarding)
+		}
+	}
+}
+
+func setCacheDefaults(cache *CacheConfig) {
+	if cache.Coalesce.TimeoutMS == 0 {
+		cache.Coalesce.TimeoutMS = 5000
+	}
+}
+
+func setMimeTypeDefaults(mimeTypes []MimeTypeConfig) {
+	for i := range mimeTypes {
+		if mimeTypes[i].OnError == "" {
+			mimeTypes[i].OnError = OnErrorPassthrough
+		}
+		if mimeTypes[i].Processing == "" {
+			mimeTypes[i].Processing = ProcessingTree
+		}
+		for j := range mimeTypes[i].Plugins {
+			plugin := &mimeTypes[i].Plugins[j]
+			if plugin.Type == "" {
+				plugin.Type = PluginTypeGo
+			}
+			if plugin.IsRemote() && plugin.TimeoutMS == 0 {
+				plugin.TimeoutMS = 5000
+			}
+			if plugin.IsRemote() && plugin.Concurrency == 0 {
+				plugin.Concurrency = 4
+			}
+		}
+	}
 }
 
 func (c *Config) IsHTMLXMLMimeType(mimeType string) bool {
@@ -187,4 +843,26 @@ func (c *Config) GetPluginsForMimeType(mimeType string) []PluginConfig {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// GetOnErrorPolicyForMimeType returns the error handling policy for the given MIME type.
+// It defaults to OnErrorPassthrough when the MIME type has no explicit policy.
+func (c *Config) GetOnErrorPolicyForMimeType(mimeType string) string {
+	for _, mt := range c.MimeTypes {
+		if mt.MimeType == mimeType && mt.OnError != "" {
+			return mt.OnError
+		}
+	}
+	return OnErrorPassthrough
+}
+
+// GetProcessingModeForMimeType returns the processing mode for the given MIME type.
+// It defaults to ProcessingTree when the MIME type has no explicit mode.
+func (c *Config) GetProcessingModeForMimeType(mimeType string) string {
+	for _, mt := range c.MimeTypes {
+		if mt.MimeType == mimeType && mt.Processing != "" {
+			return mt.Processing
+		}
+	}
+	return ProcessingTree
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
 	"testing"
@@ -266,6 +267,157 @@ func TestValidateConfig(t *testing.T) {
 			expectError: true,
 			errorMsg:    "health_port must be between 0 and 65535",
 		},
+		{
+			name: "invalid on_error policy",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						OnError:  "ignore",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "invalid on_error policy 'ignore'",
+		},
+		{
+			name: "invalid processing mode",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType:   "text/html",
+						Processing: "lazy",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "invalid processing mode 'lazy'",
+		},
+		{
+			name: "stream processing for XML",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType:   "text/xml",
+						Processing: ProcessingStream,
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "stream processing is only supported for HTML",
+		},
+		{
+			name: "stream processing with remote plugin",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType:   "text/html",
+						Processing: ProcessingStream,
+						Plugins: []PluginConfig{
+							{Path: "/usr/local/bin/plugin", Name: "MyPlugin", Type: PluginTypeExec},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "stream processing requires Go plugins",
+		},
+		{
+			name: "valid on_error policy",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						OnError:  OnErrorSkipPlugin,
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "plugin options must be an object",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Options: json.RawMessage(`["a"]`)},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "options must be a JSON object",
+		},
+		{
+			name: "conflicting plugin options",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Options: json.RawMessage(`{"a": 1}`)},
+						},
+					},
+					{
+						MimeType: "application/xhtml+xml",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Options: json.RawMessage(`{"a": 2}`)},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "configured elsewhere with different options",
+		},
+		{
+			name: "matching plugin options",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Options: json.RawMessage(`{"a": 1}`)},
+						},
+					},
+					{
+						MimeType: "application/xhtml+xml",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Options: json.RawMessage(`{"a":1}`)},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
 		{
 			name: "valid health port zero (random)",
 			config: &Config{
@@ -283,6 +435,321 @@ func TestValidateConfig(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "valid exec plugin",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Type: "exec", Path: "./plugins/remote-plugin", Name: "MyPlugin", Args: []string{"--verbose"}, TimeoutMS: 1000},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "valid socket plugin",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Type: "socket", Path: "/run/xrp/plugin.sock", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid plugin type",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Type: "wasm", Path: "./plugins/plugin.wasm", Name: "MyPlugin"},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "invalid plugin type",
+		},
+		{
+			name: "go plugin with args",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Args: []string{"--verbose"}},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "args are only supported for exec plugins",
+		},
+		{
+			name: "negative timeout",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Type: "exec", Path: "./plugins/remote-plugin", Name: "MyPlugin", TimeoutMS: -1},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "timeout_ms must be positive",
+		},
+		{
+			name: "concurrency for Go plugin",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				MimeTypes: []MimeTypeConfig{
+					{
+						MimeType: "text/html",
+						Plugins: []PluginConfig{
+							{Path: "./plugins/plugin.so", Name: "MyPlugin", Concurrency: 2},
+						},
+					},
+				},
+			},
+			expectError: true,
+			errorMsg:    "concurrency is only supported for exec and socket plugins",
+		},
+		{
+			name: "sites without top-level backend",
+			config: &Config{
+				Redis: RedisConfig{Addr: "localhost:6379"},
+				Sites: []SiteConfig{
+					{Hosts: []string{"example.com", "*.example.com"}, BackendURL: "http://localhost:8082"},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "site without backend",
+			config: &Config{
+				Redis: RedisConfig{Addr: "localhost:6379"},
+				Sites: []SiteConfig{{Hosts: []string{"example.com"}}},
+			},
+			expectError: true,
+			errorMsg:    "sites[0]: backend_url is required",
+		},
+		{
+			name: "duplicate site host",
+			config: &Config{
+				Redis: RedisConfig{Addr: "localhost:6379"},
+				Sites: []SiteConfig{
+					{Hosts: []string{"example.com"}, BackendURL: "http://localhost:8082"},
+					{Hosts: []string{"Example.com"}, BackendURL: "http://localhost:8083"},
+				},
+			},
+			expectError: true,
+			errorMsg:    "already used by sites[0]",
+		},
+		{
+			name: "invalid site wildcard",
+			config: &Config{
+				Redis: RedisConfig{Addr: "localhost:6379"},
+				Sites: []SiteConfig{{Hosts: []string{"www.*.com"}, BackendURL: "http://localhost:8082"}},
+			},
+			expectError: true,
+			errorMsg:    "invalid host",
+		},
+		{
+			name: "negative stale window",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				Cache:      CacheConfig{StaleIfError: -1},
+			},
+			expectError: true,
+			errorMsg:    "cache.stale_if_error must be positive",
+		},
+		{
+			name: "memory store without redis",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				CacheStore: StoreConfig{Type: StoreMemory},
+			},
+			expectError: false,
+		},
+		{
+			name: "tiered store without redis",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				CacheStore: StoreConfig{Type: StoreTiered},
+			},
+			expectError: true,
+			errorMsg:    "redis.addr is required",
+		},
+		{
+			name: "file store without path",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				CacheStore: StoreConfig{Type: StoreFile},
+			},
+			expectError: true,
+			errorMsg:    "cache_store.path is required",
+		},
+		{
+			name: "invalid store type",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				CacheStore: StoreConfig{Type: "memcached"},
+			},
+			expectError: true,
+			errorMsg:    "invalid cache_store.type",
+		},
+		{
+			name: "negative memory budget",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				Buffering:  BufferingConfig{MemoryBudgetMB: -1},
+			},
+			expectError: true,
+			errorMsg:    "must not be negative",
+		},
+		{
+			name: "max response size over memory budget",
+			config: &Config{
+				BackendURL:        "http://localhost:8081",
+				Redis:             RedisConfig{Addr: "localhost:6379"},
+				MaxResponseSizeMB: 64,
+				Buffering:         BufferingConfig{MemoryBudgetMB: 32},
+			},
+			expectError: true,
+			errorMsg:    "max_response_size_mb (64) must not exceed buffering.memory_budget_mb (32)",
+		},
+		{
+			name: "max response size over default memory budget",
+			config: &Config{
+				BackendURL:        "http://localhost:8081",
+				Redis:             RedisConfig{Addr: "localhost:6379"},
+				MaxResponseSizeMB: 512,
+			},
+			expectError: true,
+			errorMsg:    "must not exceed buffering.memory_budget_mb (256)",
+		},
+		{
+			name: "file trace exporter without path",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				Tracing:    TracingConfig{Enabled: true, Exporter: TraceExporterFile},
+			},
+			expectError: true,
+			errorMsg:    "tracing.path is required",
+		},
+		{
+			name: "trace sample ratio out of range",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				Tracing:    TracingConfig{Enabled: true, SampleRatio: 1.5},
+			},
+			expectError: true,
+			errorMsg:    "tracing.sample_ratio must be between 0 and 1",
+		},
+		{
+			name: "short admin token",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				Admin:      AdminConfig{Token: "secret"},
+			},
+			expectError: true,
+			errorMsg:    "admin.token must be at least 16 characters",
+		},
+		{
+			name: "TLS with certificate files and ACME",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS: TLSConfig{
+					Enabled:      true,
+					Certificates: []CertificateConfig{{CertFile: "cert.pem", KeyFile: "key.pem"}},
+					ACME: ACMEConfig{
+						Hosts:        []string{"www.example.com"},
+						DirectoryURL: "https://localhost:14000/dir",
+						CacheDir:     "/var/lib/xrp/acme",
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "TLS without certificates",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS:        TLSConfig{Enabled: true},
+			},
+			expectError: true,
+			errorMsg:    "tls requires certificates or acme.hosts",
+		},
+		{
+			name: "TLS certificate without key",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS:        TLSConfig{Enabled: true, Certificates: []CertificateConfig{{CertFile: "cert.pem"}}},
+			},
+			expectError: true,
+			errorMsg:    "tls.certificates[0]: cert_file and key_file are required",
+		},
+		{
+			name: "ACME without cache dir",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS:        TLSConfig{Enabled: true, ACME: ACMEConfig{Hosts: []string{"www.example.com"}}},
+			},
+			expectError: true,
+			errorMsg:    "tls.acme.cache_dir is required",
+		},
+		{
+			name: "ACME wildcard host",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS: TLSConfig{Enabled: true, ACME: ACMEConfig{
+					Hosts: []string{"*.example.com"}, CacheDir: "/var/lib/xrp/acme"}},
+			},
+			expectError: true,
+			errorMsg:    "wildcards are not supported",
+		},
+		{
+			name: "invalid TLS version",
+			config: &Config{
+				BackendURL: "http://localhost:8081",
+				Redis:      RedisConfig{Addr: "localhost:6379"},
+				TLS:        TLSConfig{MinVersion: "1.0"},
+			},
+			expectError: true,
+			errorMsg:    "invalid tls.min_version '1.0'",
+		},
 	}
 
 	for _, tt := range tests {
@@ -342,4 +809,84 @@ func TestSetDefaults(t *testing.T) {
 	if config.HealthPort != 8081 {
 		t.Errorf("expected HealthPort to be 8081, got %d", config.HealthPort)
 	}
-}
\ No newline at end of file
+	if config.Buffering.SpillThresholdKB != 1024 || config.Buffering.MemoryBudgetMB != 256 || config.Buffering.BudgetWaitMS != 5000 {
+		t.Errorf("unexpected buffering defaults: %+v", config.Buffering)
+	}
+	if config.Tracing.Exporter != TraceExporterOTLP || config.Tracing.SampleRatio != 1 || config.Tracing.ServiceName != "xrp" {
+		t.Errorf("unexpected tracing defaults: %+v", config.Tracing)
+	}
+}
+
+func TestSetDefaults_Cache(t *testing.T) {
+	config := &Config{
+		Sites: []SiteConfig{
+			{Hosts: []string{"a.com"}, Cache: &CacheConfig{Coalesce: CoalesceConfig{Enabled: true}}},
+			{Hosts: []string{"b.com"}},
+		},
+	}
+	setDefaults(config)
+
+	if config.Cache.Coalesce.TimeoutMS != 5000 {
+		t.Errorf("expected coalesce timeout to default to 5000, got %d", config.Cache.Coalesce.TimeoutMS)
+	}
+	if config.Sites[0].Cache.Coalesce.TimeoutMS != 5000 {
+		t.Errorf("expected site coalesce timeout to default to 5000, got %d", config.Sites[0].Cache.Coalesce.TimeoutMS)
+	}
+	if config.CacheStore.Type != StoreRedis {
+		t.Errorf("expected cache store to default to redis, got %q", config.CacheStore.Type)
+	}
+	if config.CacheStore.MaxSizeMB != 64 || config.CacheStore.MemoryTTLSeconds != 30 {
+		t.Errorf("unexpected cache store defaults: %+v", config.CacheStore)
+	}
+}
+
+func TestSetDefaults_PluginTypes(t *testing.T) {
+	config := &Config{
+		MimeTypes: []MimeTypeConfig{
+			{
+				MimeType: "text/html",
+				Plugins: []PluginConfig{
+					{Path: "./plugins/plugin.so", Name: "GoPlugin"},
+					{Type: PluginTypeExec, Path: "./plugins/remote-plugin", Name: "ExecPlugin"},
+					{Type: PluginTypeSocket, Path: "/run/xrp/plugin.sock", Name: "SocketPlugin", TimeoutMS: 250},
+				},
+			},
+		},
+	}
+	setDefaults(config)
+
+	plugins := config.MimeTypes[0].Plugins
+	if plugins[0].Type != PluginTypeGo || plugins[0].TimeoutMS != 0 || plugins[0].Concurrency != 0 {
+		t.Errorf("expected Go plugin defaults, got type %q timeout %d concurrency %d", plugins[0].Type, plugins[0].TimeoutMS, plugins[0].Concurrency)
+	}
+	if plugins[1].TimeoutMS != 5000 || plugins[1].Concurrency != 4 {
+		t.Errorf("expected exec plugin timeout to default to 5000 and concurrency to 4, got %d and %d", plugins[1].TimeoutMS, plugins[1].Concurrency)
+	}
+	if plugins[2].TimeoutMS != 250 {
+		t.Errorf("expected explicit timeout to be kept, got %d", plugins[2].TimeoutMS)
+	}
+}
+
+func TestGetOnErrorPolicyForMimeType(t *testing.T) {
+	config := &Config{
+		MimeTypes: []MimeTypeConfig{
+			{MimeType: "text/html", OnError: OnErrorFail},
+			{MimeType: "application/xml"},
+		},
+	}
+
+	if policy := config.GetOnErrorPolicyForMimeType("text/html"); policy != OnErrorFail {
+		t.Errorf("expected %s, got %s", OnErrorFail, policy)
+	}
+	if policy := config.GetOnErrorPolicyForMimeType("application/xml"); policy != OnErrorPassthrough {
+		t.Errorf("expected %s for unset policy, got %s", OnErrorPassthrough, policy)
+	}
+	if policy := config.GetOnErrorPolicyForMimeType("text/xml"); policy != OnErrorPassthrough {
+		t.Errorf("expected %s for unknown MIME type, got %s", OnErrorPassthrough, policy)
+	}
+
+	setDefaults(config)
+	if config.MimeTypes[1].OnError != OnErrorPassthrough {
+		t.Errorf("expected setDefaults to fill on_error, got %q", config.MimeTypes[1].OnError)
+	}
+}
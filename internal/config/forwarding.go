@@ -0,0 +1,118 @@
+// This file implements the forwarding configuration: the Host header sent to
+// backends, which proxies in front of XRP are trusted to report the client, and
+// which forwarding headers XRP adds and strips.
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Host header policies for ForwardingConfig.Host, besides a literal host name
+const (
+	// HostPreserve sends the client's Host header
+	HostPreserve = "preserve"
+	// HostBackend sends the host of the upstream the request is sent to
+	HostBackend = "backend"
+)
+
+// ForwardingConfig configures what backends are told about the requests XRP
+// forwards to them
+type ForwardingConfig struct {
+	// Host is the Host header sent to backends: "preserve", "backend", or a host
+	// name to send instead (default: preserve)
+	Host string `json:"host"`
+	// TrustedProxies lists the addresses or CIDR ranges of proxies in front of
+	// XRP. Their X-Forwarded-* and Forwarded headers are passed on, and the client
+	// address they report in X-Forwarded-For is logged and used as the client IP;
+	// other clients' forwarding headers are replaced.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// DisableXForwarded stops XRP from sending X-Forwarded-For, X-Forwarded-Proto,
+	// and X-Forwarded-Host
+	DisableXForwarded bool `json:"disable_x_forwarded"`
+	// Forwarded sends an RFC 7239 Forwarded header
+	Forwarded bool `json:"forwarded"`
+	// StripHeaders lists request headers removed before requests are sent to
+	// backends, besides the hop-by-hop headers that are always removed
+	StripHeaders []string `json:"strip_headers"`
+
+	// trustedProxies is TrustedProxies, parsed when the configuration is validated
+	trustedProxies []netip.Prefix
+}
+
+// TrustsProxy reports whether addr is one of the trusted proxies
+func (f ForwardingConfig) TrustsProxy(addr netip.Addr) bool {
+	prefixes := f.trustedProxies
+	if prefixes == nil {
+		prefixes = parseProxies(f.TrustedProxies)
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxies parses the trusted proxies that are valid
+func parseProxies(proxies []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if prefix, err := parseProxy(proxy); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// parseProxy parses a trusted proxy, which is an address or a CIDR range
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// validateForwardingConfig validates forwarding and parses its trusted proxies
+func validateForwardingConfig(forwarding *ForwardingConfig) error {
+	if host := forwarding.Host; host != "" && host != HostPreserve && host != HostBackend &&
+		strings.ContainsAny(host, " \t/?#@") {
+		return fmt.Errorf("invalid forwarding.host '%s', must be %s, %s, or a host name",
+			host, HostPreserve, HostBackend)
+	}
+	forwarding.trustedProxies = make([]netip.Prefix, 0, len(forwarding.TrustedProxies))
+	for _, proxy := range forwarding.TrustedProxies {
+		prefix, err := parseProxy(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid forwarding.trusted_proxies entry '%s', must be an IP address or CIDR range", proxy)
+		}
+		forwarding.trustedProxies = append(forwarding.trustedProxies, prefix)
+	}
+	for _, header := range forwarding.StripHeaders {
+		if header == "" || strings.ContainsAny(header, " \t:") {
+			return fmt.Errorf("invalid forwarding.strip_headers entry '%s'", header)
+		}
+		if strings.EqualFold(header, "Host") {
+			return fmt.Errorf("forwarding.strip_headers can't remove Host; set forwarding.host instead")
+		}
+	}
+	return nil
+}
+
+func setForwardingDefaults(forwarding *ForwardingConfig) {
+	if forwarding.Host == "" {
+		forwarding.Host = HostPreserve
+	}
+	for i, header := range forwarding.StripHeaders {
+		forwarding.StripHeaders[i] = http.CanonicalHeaderKey(header)
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestValidateForwardingConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarding ForwardingConfig
+		errorMsg   string
+	}{
+		{
+			name: "valid",
+			forwarding: ForwardingConfig{
+				Host:           "app.internal:8080",
+				TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"},
+				Forwarded:      true,
+				StripHeaders:   []string{"X-Internal-Token"},
+			},
+		},
+		{name: "backend host", forwarding: ForwardingConfig{Host: HostBackend}},
+		{
+			name:       "invalid host",
+			forwarding: ForwardingConfig{Host: "http://app"},
+			errorMsg:   "invalid forwarding.host 'http://app'",
+		},
+		{
+			name:       "invalid trusted proxy",
+			forwarding: ForwardingConfig{TrustedProxies: []string{"10.0.0.0/33"}},
+			errorMsg:   "invalid forwarding.trusted_proxies entry '10.0.0.0/33'",
+		},
+		{
+			name:       "invalid strip header",
+			forwarding: ForwardingConfig{StripHeaders: []string{"X-Bad:"}},
+			errorMsg:   "invalid forwarding.strip_headers entry",
+		},
+		{
+			name:       "strip Host",
+			forwarding: ForwardingConfig{StripHeaders: []string{"host"}},
+			errorMsg:   "can't remove Host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateForwardingConfig(&tt.forwarding)
+			if tt.errorMsg == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("expected error containing %q, got %v", tt.errorMsg, err)
+			}
+		})
+	}
+
+	// Site settings are validated too
+	cfg := &Config{
+		CacheStore: StoreConfig{Type: StoreMemory},
+		Sites: []SiteConfig{{
+			Hosts:      []string{"a.com"},
+			BackendURL: "http://a:8080",
+			Forwarding: &ForwardingConfig{TrustedProxies: []string{"proxy"}},
+		}},
+	}
+	if err := validateConfig(cfg); err == nil || !strings.HasPrefix(err.Error(), "sites[0].invalid forwarding") {
+		t.Errorf("expected site forwarding error, got %v", err)
+	}
+}
+
+func TestTrustsProxy(t *testing.T) {
+	forwarding := ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}}
+	tests := map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"192.0.2.1":        true,
+		"192.0.2.2":        false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"198.51.100.7":     false,
+		"::ffff:192.0.2.1": true,
+	}
+	for addr, want := range tests {
+		if got := forwarding.TrustsProxy(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("TrustsProxy(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	// Validation parses the trusted proxies once, for every request to use
+	if err := validateForwardingConfig(&forwarding); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(forwarding.trustedProxies) != 3 {
+		t.Fatalf("expected 3 parsed trusted proxies, got %v", forwarding.trustedProxies)
+	}
+	for addr, want := range tests {
+		if got := forwarding.TrustsProxy(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("TrustsProxy(%s) = %v after validation, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestSetDefaults_Forwarding(t *testing.T) {
+	cfg := &Config{
+		Forwarding: ForwardingConfig{StripHeaders: []string{"x-internal-token"}},
+		Sites:      []SiteConfig{{Forwarding: &ForwardingConfig{Host: "app.internal"}}},
+	}
+	setDefaults(cfg)
+
+	if cfg.Forwarding.Host != HostPreserve || cfg.Forwarding.StripHeaders[0] != "X-Internal-Token" {
+		t.Errorf("unexpected defaults: %+v", cfg.Forwarding)
+	}
+	if cfg.Sites[0].Forwarding.Host != "app.internal" {
+		t.Errorf("expected site host to be kept, got %q", cfg.Sites[0].Forwarding.Host)
+	}
+}
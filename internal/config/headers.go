@@ -0,0 +1,179 @@
+// This file implements response header rules, which set, append, remove, or
+// rewrite the headers of the responses XRP sends to clients, such as to add
+// security headers or strip headers that reveal the backend.
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Header rule actions
+const (
+	// HeaderActionSet replaces the header's values with the rule's value
+	HeaderActionSet = "set"
+	// HeaderActionAppend adds the rule's value to the header's values
+	HeaderActionAppend = "append"
+	// HeaderActionRemove removes the header
+	HeaderActionRemove = "remove"
+	// HeaderActionReplace replaces matches of the rule's pattern in each of the
+	// header's values
+	HeaderActionReplace = "replace"
+)
+
+var validHeaderActions = []string{HeaderActionSet, HeaderActionAppend, HeaderActionRemove, HeaderActionReplace}
+
+// Placeholders header rule values may contain, as {name}
+const (
+	// PlaceholderRequestID is the request ID, as sent to the backend in X-Request-Id
+	PlaceholderRequestID = "request_id"
+	// PlaceholderCacheStatus is the X-XRP-Cache value, or "" if there is none
+	PlaceholderCacheStatus = "cache_status"
+	// PlaceholderRoute is the name of the route the request matched, or ""
+	PlaceholderRoute = "route"
+	// PlaceholderVersion is the XRP version
+	PlaceholderVersion = "version"
+)
+
+var validPlaceholders = []string{PlaceholderRequestID, PlaceholderCacheStatus, PlaceholderRoute, PlaceholderVersion}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// managedHeaders are set by XRP to match the body it sends, so rules can't change them
+var managedHeaders = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding"}
+
+// HeaderRuleConfig changes one header of responses sent to clients
+type HeaderRuleConfig struct {
+	// Action is set, append, remove, or replace
+	Action string `json:"action"`
+	// Header names the response header
+	Header string `json:"header"`
+	// Value is the value set or appended, or the replacement for matches of
+	// Pattern, which may refer to its submatches as $1 or ${1}. It may contain
+	// placeholders such as {request_id}.
+	Value string `json:"value"`
+	// Pattern is the regular expression replaced by Value (RE2 syntax)
+	Pattern string `json:"pattern"`
+	// MimeTypes limits the rule to responses with these MIME types
+	MimeTypes []string `json:"mime_types"`
+
+	// pattern is Pattern, compiled when the configuration is validated
+	pattern *regexp.Regexp
+}
+
+// AppliesTo reports whether the rule applies to responses with mimeType
+func (r *HeaderRuleConfig) AppliesTo(mimeType string) bool {
+	return len(r.MimeTypes) == 0 || slices.ContainsFunc(r.MimeTypes, func(mt string) bool {
+		return strings.EqualFold(mt, mimeType)
+	})
+}
+
+// Apply applies the rule to header, substituting vars for the placeholders in
+// its value
+func (r *HeaderRuleConfig) Apply(header http.Header, vars map[string]string) {
+	switch r.Action {
+	case HeaderActionSet:
+		header.Set(r.Header, expandPlaceholders(r.Value, vars, false))
+	case HeaderActionAppend:
+		header.Add(r.Header, expandPlaceholders(r.Value, vars, false))
+	case HeaderActionRemove:
+		header.Del(r.Header)
+	case HeaderActionReplace:
+		pattern := r.pattern
+		if pattern == nil {
+			var err error
+			if pattern, err = regexp.Compile(r.Pattern); err != nil {
+				return
+			}
+		}
+		replacement := expandPlaceholders(r.Value, vars, true)
+
+		// Values the pattern replaces entirely are dropped
+		var values []string
+		for _, value := range header.Values(r.Header) {
+			if value = pattern.ReplaceAllString(value, replacement); value != "" {
+				values = append(values, value)
+			}
+		}
+		header.Del(r.Header)
+		for _, value := range values {
+			header.Add(r.Header, value)
+		}
+	}
+}
+
+// expandPlaceholders substitutes vars for the placeholders in value. If value is
+// a regular expression replacement, '$' in the substituted values is escaped.
+func expandPlaceholders(value string, vars map[string]string, isReplacement bool) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	return placeholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if !slices.Contains(validPlaceholders, name) {
+			return placeholder
+		}
+		if isReplacement {
+			return strings.ReplaceAll(vars[name], "$", "$$")
+		}
+		return vars[name]
+	})
+}
+
+// validateHeaderRules validates rules and compiles their patterns
+func validateHeaderRules(rules []HeaderRuleConfig) error {
+	for i := range rules {
+		rule := &rules[i]
+		if !slices.Contains(validHeaderActions, rule.Action) {
+			return fmt.Errorf("response_headers[%d]: invalid action '%s', must be one of: %s",
+				i, rule.Action, strings.Join(validHeaderActions, ", "))
+		}
+		if rule.Header == "" || strings.ContainsAny(rule.Header, " \t:") {
+			return fmt.Errorf("response_headers[%d]: invalid header name '%s'", i, rule.Header)
+		}
+		if slices.ContainsFunc(managedHeaders, func(name string) bool { return strings.EqualFold(name, rule.Header) }) {
+			return fmt.Errorf("response_headers[%d]: %s is managed by XRP and can't be changed", i, http.CanonicalHeaderKey(rule.Header))
+		}
+
+		switch rule.Action {
+		case HeaderActionSet, HeaderActionAppend:
+			if rule.Value == "" {
+				return fmt.Errorf("response_headers[%d]: value is required for %s", i, rule.Action)
+			}
+		case HeaderActionRemove:
+			if rule.Value != "" {
+				return fmt.Errorf("response_headers[%d]: value can't be used with remove", i)
+			}
+		case HeaderActionReplace:
+			if rule.Pattern == "" {
+				return fmt.Errorf("response_headers[%d]: pattern is required for replace", i)
+			}
+		}
+		if rule.Pattern != "" {
+			if rule.Action != HeaderActionReplace {
+				return fmt.Errorf("response_headers[%d]: pattern can only be used with replace", i)
+			}
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("response_headers[%d]: invalid pattern: %w", i, err)
+			}
+			rule.pattern = pattern
+		}
+
+		for _, match := range placeholderPattern.FindAllStringSubmatch(rule.Value, -1) {
+			if !slices.Contains(validPlaceholders, match[1]) {
+				return fmt.Errorf("response_headers[%d]: invalid placeholder '%s', must be one of: {%s}",
+					i, match[0], strings.Join(validPlaceholders, "}, {"))
+			}
+		}
+		for _, mimeType := range rule.MimeTypes {
+			if mimeType == "" || strings.ContainsAny(mimeType, " \t;") {
+				return fmt.Errorf("response_headers[%d]: invalid MIME type '%s'", i, mimeType)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateHeaderRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     HeaderRuleConfig
+		errorMsg string
+	}{
+		{name: "set", rule: HeaderRuleConfig{Action: HeaderActionSet, Header: "Strict-Transport-Security", Value: "max-age=63072000"}},
+		{name: "append placeholder", rule: HeaderRuleConfig{Action: HeaderActionAppend, Header: "X-Served", Value: "{cache_status}; {request_id}"}},
+		{name: "remove", rule: HeaderRuleConfig{Action: HeaderActionRemove, Header: "X-Powered-By", MimeTypes: []string{"text/html"}}},
+		{name: "replace", rule: HeaderRuleConfig{Action: HeaderActionReplace, Header: "Server", Pattern: `/(\d+)`, Value: "-${1}"}},
+		{
+			name:     "invalid action",
+			rule:     HeaderRuleConfig{Action: "add", Header: "X-A", Value: "1"},
+			errorMsg: "response_headers[0]: invalid action 'add', must be one of: set, append, remove, replace",
+		},
+		{
+			name:     "invalid header",
+			rule:     HeaderRuleConfig{Action: HeaderActionRemove, Header: "X Bad"},
+			errorMsg: "invalid header name 'X Bad'",
+		},
+		{
+			name:     "managed header",
+			rule:     HeaderRuleConfig{Action: HeaderActionSet, Header: "content-length", Value: "0"},
+			errorMsg: "Content-Length is managed by XRP",
+		},
+		{
+			name:     "set without value",
+			rule:     HeaderRuleConfig{Action: HeaderActionSet, Header: "X-A"},
+			errorMsg: "value is required for set",
+		},
+		{
+			name:     "remove with value",
+			rule:     HeaderRuleConfig{Action: HeaderActionRemove, Header: "X-A", Value: "1"},
+			errorMsg: "value can't be used with remove",
+		},
+		{
+			name:     "replace without pattern",
+			rule:     HeaderRuleConfig{Action: HeaderActionReplace, Header: "X-A"},
+			errorMsg: "pattern is required for replace",
+		},
+		{
+			name:     "pattern without replace",
+			rule:     HeaderRuleConfig{Action: HeaderActionSet, Header: "X-A", Value: "1", Pattern: "a"},
+			errorMsg: "pattern can only be used with replace",
+		},
+		{
+			name:     "invalid pattern",
+			rule:     HeaderRuleConfig{Action: HeaderActionReplace, Header: "X-A", Pattern: "(["},
+			errorMsg: "invalid pattern",
+		},
+		{
+			name:     "unknown placeholder",
+			rule:     HeaderRuleConfig{Action: HeaderActionSet, Header: "X-A", Value: "{client_ip}"},
+			errorMsg: "invalid placeholder '{client_ip}'",
+		},
+		{
+			name:     "invalid MIME type",
+			rule:     HeaderRuleConfig{Action: HeaderActionRemove, Header: "X-A", MimeTypes: []string{"text/html; charset=utf-8"}},
+			errorMsg: "invalid MIME type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHeaderRules([]HeaderRuleConfig{tt.rule})
+			if tt.errorMsg == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("expected error containing %q, got %v", tt.errorMsg, err)
+			}
+		})
+	}
+
+	// Site and route rules are validated too
+	cfg := &Config{
+		CacheStore: StoreConfig{Type: StoreMemory},
+		Sites: []SiteConfig{{
+			Hosts:      []string{"a.com"},
+			BackendURL: "http://a:8080",
+			Routes: []RouteConfig{{
+				ResponseHeaders: []HeaderRuleConfig{{Action: HeaderActionRemove, Header: "Transfer-Encoding"}},
+			}},
+		}},
+	}
+	if err := validateConfig(cfg); err == nil || !strings.HasPrefix(err.Error(), "sites[0].routes[0].response_headers[0]") {
+		t.Errorf("expected site route header rule error, got %v", err)
+	}
+}
+
+func TestHeaderRuleApply(t *testing.T) {
+	vars := map[string]string{PlaceholderRequestID: "abc$1", PlaceholderCacheStatus: "HIT"}
+
+	tests := []struct {
+		name   string
+		rule   HeaderRuleConfig
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "set",
+			rule:   HeaderRuleConfig{Action: HeaderActionSet, Header: "X-Cache-Status", Value: "{cache_status}"},
+			header: http.Header{"X-Cache-Status": {"MISS", "MISS"}},
+			want:   http.Header{"X-Cache-Status": {"HIT"}},
+		},
+		{
+			name:   "append",
+			rule:   HeaderRuleConfig{Action: HeaderActionAppend, Header: "Vary", Value: "Accept-Language"},
+			header: http.Header{"Vary": {"Accept-Encoding"}},
+			want:   http.Header{"Vary": {"Accept-Encoding", "Accept-Language"}},
+		},
+		{
+			name:   "remove",
+			rule:   HeaderRuleConfig{Action: HeaderActionRemove, Header: "x-powered-by"},
+			header: http.Header{"X-Powered-By": {"PHP/8.3"}, "Server": {"nginx"}},
+			want:   http.Header{"Server": {"nginx"}},
+		},
+		{
+			name:   "replace",
+			rule:   HeaderRuleConfig{Action: HeaderActionReplace, Header: "Link", Pattern: `http://backend:8080`, Value: "https://example.com"},
+			header: http.Header{"Link": {"<http://backend:8080/a.css>; rel=preload", "<https://cdn.example.com/b.js>; rel=preload"}},
+			want:   http.Header{"Link": {"<https://example.com/a.css>; rel=preload", "<https://cdn.example.com/b.js>; rel=preload"}},
+		},
+		{
+			name:   "replace with submatches and placeholders",
+			rule:   HeaderRuleConfig{Action: HeaderActionReplace, Header: "X-Trace", Pattern: `^(\w+)$`, Value: "${1}-{request_id}"},
+			header: http.Header{"X-Trace": {"upstream"}},
+			want:   http.Header{"X-Trace": {"upstream-abc$1"}},
+		},
+		{
+			name:   "replace drops emptied values",
+			rule:   HeaderRuleConfig{Action: HeaderActionReplace, Header: "Set-Cookie", Pattern: `^debug=.*`},
+			header: http.Header{"Set-Cookie": {"debug=1", "session=2"}},
+			want:   http.Header{"Set-Cookie": {"session=2"}},
+		},
+		{
+			name:   "replace missing header",
+			rule:   HeaderRuleConfig{Action: HeaderActionReplace, Header: "Server", Pattern: `/.*`},
+			header: http.Header{},
+			want:   http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Apply(tt.header, vars)
+			if !reflect.DeepEqual(tt.header, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, tt.header)
+			}
+		})
+	}
+}
+
+func TestHeaderRuleAppliesTo(t *testing.T) {
+	rule := HeaderRuleConfig{MimeTypes: []string{"text/html", "application/XHTML+xml"}}
+	if !rule.AppliesTo("text/html") || !rule.AppliesTo("application/xhtml+xml") || rule.AppliesTo("image/png") {
+		t.Error("unexpected MIME type matching")
+	}
+	if !(&HeaderRuleConfig{}).AppliesTo("image/png") {
+		t.Error("expected a rule without MIME types to apply to every response")
+	}
+}
+
+func TestResolveRoute_ResponseHeaders(t *testing.T) {
+	siteRules := make([]HeaderRuleConfig, 1, 4)
+	siteRules[0] = HeaderRuleConfig{Action: HeaderActionRemove, Header: "X-Powered-By"}
+	routeRule := HeaderRuleConfig{Action: HeaderActionSet, Header: "Cache-Control", Value: "no-store"}
+	cfg := &Config{
+		ResponseHeaders: siteRules,
+		Routes: []RouteConfig{
+			{PathPrefix: "/admin/", ResponseHeaders: []HeaderRuleConfig{routeRule}},
+			{PathPrefix: "/amp/", NoCache: true},
+		},
+	}
+
+	admin := cfg.ResolveRoute(httptest.NewRequest("GET", "/admin/", nil))
+	if !reflect.DeepEqual(admin.ResponseHeaders, []HeaderRuleConfig{siteRules[0], routeRule}) {
+		t.Errorf("expected route rules after the site's, got %+v", admin.ResponseHeaders)
+	}
+	// The site's rules have room to grow, which the route's rules must not take
+	if spare := siteRules[:2][1]; len(cfg.ResponseHeaders) != 1 || spare.Header != "" {
+		t.Error("expected resolving a route to leave the site's rules unchanged")
+	}
+
+	amp := cfg.ResolveRoute(httptest.NewRequest("GET", "/amp/", nil))
+	if len(amp.ResponseHeaders) != 1 {
+		t.Errorf("expected the site's rules for routes without their own, got %+v", amp.ResponseHeaders)
+	}
+}
@@ -0,0 +1,209 @@
+// This file implements routes: ordered rules that select how requests are
+// processed and cached by their path, host, method, query, and headers, instead
+// of by MIME type alone.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RouteConfig selects the plugin chains and caching of the requests it matches.
+// Routes are tried in order, and the first whose conditions all match applies;
+// a route without conditions matches every request.
+type RouteConfig struct {
+	// Name identifies the route in cache keys (default: its index in routes)
+	Name string `json:"name"`
+
+	// PathPrefix matches request paths starting with it
+	PathPrefix string `json:"path_prefix"`
+	// PathRegex matches request paths it matches (RE2 syntax, unanchored)
+	PathRegex string `json:"path_regex"`
+	// Hosts lists host names or wildcards, as for sites
+	Hosts []string `json:"hosts"`
+	// Methods lists request methods
+	Methods []string `json:"methods"`
+	// Query maps query parameters to the value they must have, or to "" if any
+	// value will do
+	Query map[string]string `json:"query"`
+	// Headers maps request headers to the value they must have, or to "" if any
+	// value will do
+	Headers map[string]string `json:"headers"`
+
+	// MimeTypes replaces the MIME types, and so the plugin chains, for matching
+	// requests
+	MimeTypes []MimeTypeConfig `json:"mime_types"`
+	// NoProcessing runs no plugins on matching responses
+	NoProcessing bool `json:"no_processing"`
+	// NoCache neither serves matching requests from the cache nor caches them
+	NoCache bool `json:"no_cache"`
+	// ResponseHeaders are applied to responses to matching requests, after the
+	// site's response header rules
+	ResponseHeaders []HeaderRuleConfig `json:"response_headers"`
+
+	// pathRegex is PathRegex, compiled when the configuration is validated
+	pathRegex *regexp.Regexp
+}
+
+// ResolveRoute returns the configuration for req: c, as returned by ResolveSite,
+// with the settings of the first route matching req applied. The route's name is
+// recorded in Route. If no route matches, c is returned.
+func (c *Config) ResolveRoute(req *http.Request) *Config {
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if !route.matches(req) {
+			continue
+		}
+
+		resolved := *c
+		resolved.Route = route.Name
+		if resolved.Route == "" {
+			resolved.Route = strconv.Itoa(i)
+		}
+		if route.MimeTypes != nil {
+			resolved.MimeTypes = route.MimeTypes
+		}
+		if route.NoProcessing {
+			resolved.MimeTypes = withoutPlugins(resolved.MimeTypes)
+		}
+		if route.NoCache {
+			resolved.Cache.Disabled = true
+		}
+		if route.ResponseHeaders != nil {
+			resolved.ResponseHeaders = slices.Concat(c.ResponseHeaders, route.ResponseHeaders)
+		}
+		return &resolved
+	}
+	return c
+}
+
+func (r *RouteConfig) matches(req *http.Request) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.PathRegex != "" {
+		pathRegex := r.pathRegex
+		if pathRegex == nil {
+			var err error
+			if pathRegex, err = regexp.Compile(r.PathRegex); err != nil {
+				return false
+			}
+		}
+		if !pathRegex.MatchString(req.URL.Path) {
+			return false
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		host := normalizeHost(req.Host)
+		matched := false
+		for _, pattern := range r.Hosts {
+			if matchHost(strings.ToLower(pattern), host) >= 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Methods) > 0 && !slices.ContainsFunc(r.Methods, func(method string) bool {
+		return strings.EqualFold(method, req.Method)
+	}) {
+		return false
+	}
+
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range r.Query {
+			if !query.Has(name) || (value != "" && query.Get(name) != value) {
+				return false
+			}
+		}
+	}
+	for name, value := range r.Headers {
+		values := req.Header.Values(name)
+		if len(values) == 0 || (value != "" && values[0] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutPlugins returns a copy of mimeTypes with no plugins
+func withoutPlugins(mimeTypes []MimeTypeConfig) []MimeTypeConfig {
+	stripped := make([]MimeTypeConfig, len(mimeTypes))
+	for i, mt := range mimeTypes {
+		mt.Plugins = nil
+		stripped[i] = mt
+	}
+	return stripped
+}
+
+// validateRoutes validates routes and compiles their path regexes
+func validateRoutes(routes []RouteConfig, pluginOptions map[string]json.RawMessage) error {
+	seenNames := make(map[string]int)
+	for i := range routes {
+		route := &routes[i]
+		if route.Name != "" {
+			if other, seen := seenNames[route.Name]; seen {
+				return fmt.Errorf("routes[%d]: name '%s' is already used by routes[%d]", i, route.Name, other)
+			}
+			seenNames[route.Name] = i
+		}
+
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("routes[%d]: path_prefix must start with '/'", i)
+		}
+		if route.PathRegex != "" {
+			pathRegex, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return fmt.Errorf("routes[%d]: invalid path_regex: %w", i, err)
+			}
+			route.pathRegex = pathRegex
+		}
+		for _, host := range route.Hosts {
+			if !isValidHostPattern(strings.ToLower(host)) {
+				return fmt.Errorf("routes[%d]: invalid host '%s', wildcards must be '*' or start with '*.'", i, host)
+			}
+		}
+		for _, method := range route.Methods {
+			if method == "" || strings.ContainsAny(method, " \t") {
+				return fmt.Errorf("routes[%d]: invalid method '%s'", i, method)
+			}
+		}
+		for name := range route.Query {
+			if name == "" {
+				return fmt.Errorf("routes[%d]: query parameter names must not be empty", i)
+			}
+		}
+		for name := range route.Headers {
+			if name == "" || strings.ContainsAny(name, " \t:") {
+				return fmt.Errorf("routes[%d]: invalid header name '%s'", i, name)
+			}
+		}
+
+		if route.NoProcessing && route.MimeTypes != nil {
+			return fmt.Errorf("routes[%d]: mime_types and no_processing can't be used together", i)
+		}
+		if err := validateMimeTypes(route.MimeTypes, pluginOptions); err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+		if err := validateHeaderRules(route.ResponseHeaders); err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+	}
+	return nil
+}
+
+func setRouteDefaults(routes []RouteConfig) {
+	for i := range routes {
+		setMimeTypeDefaults(routes[i].MimeTypes)
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveRoute(t *testing.T) {
+	html := []MimeTypeConfig{{MimeType: "text/html", Plugins: []PluginConfig{{Path: "./html.so", Name: "HTMLPlugin"}}}}
+	amp := []MimeTypeConfig{{MimeType: "text/html", Plugins: []PluginConfig{{Path: "./amp.so", Name: "AMPPlugin"}}}}
+	feed := []MimeTypeConfig{{MimeType: "application/rss+xml", Plugins: []PluginConfig{{Path: "./feed.so", Name: "FeedPlugin"}}}}
+
+	cfg := &Config{
+		MimeTypes: html,
+		Routes: []RouteConfig{
+			{Name: "amp", PathPrefix: "/amp/", MimeTypes: amp},
+			{Name: "admin", PathPrefix: "/admin/", NoProcessing: true, NoCache: true},
+			{Name: "feed", PathRegex: `\.rss$`, MimeTypes: feed},
+			{Name: "api", Hosts: []string{"*.api.example.com"}, Methods: []string{"get"}, NoCache: true},
+			{Name: "preview", Query: map[string]string{"preview": "true"}, NoCache: true},
+			{Headers: map[string]string{"X-Debug": ""}, NoProcessing: true},
+		},
+	}
+
+	tests := []struct {
+		name, method, target string
+		headers              map[string]string
+		wantRoute            string
+		wantPlugin           string
+		wantNoCache          bool
+	}{
+		{name: "no route", target: "http://example.com/page", wantPlugin: "HTMLPlugin"},
+		{name: "path prefix", target: "http://example.com/amp/story", wantRoute: "amp", wantPlugin: "AMPPlugin"},
+		{name: "first match wins", target: "http://example.com/amp/feed.rss", wantRoute: "amp", wantPlugin: "AMPPlugin"},
+		{name: "bypass", target: "http://example.com/admin/posts", wantRoute: "admin", wantNoCache: true},
+		{name: "path regex", target: "http://example.com/blog/index.rss", wantRoute: "feed", wantPlugin: "FeedPlugin"},
+		{name: "host and method", target: "http://v1.api.example.com:8080/users", wantRoute: "api", wantPlugin: "HTMLPlugin", wantNoCache: true},
+		{name: "method mismatch", method: "POST", target: "http://v1.api.example.com/users", wantPlugin: "HTMLPlugin"},
+		{name: "query value", target: "http://example.com/page?preview=true", wantRoute: "preview", wantPlugin: "HTMLPlugin", wantNoCache: true},
+		{name: "query value mismatch", target: "http://example.com/page?preview=false", wantPlugin: "HTMLPlugin"},
+		{name: "header presence", target: "http://example.com/page", headers: map[string]string{"X-Debug": "1"}, wantRoute: "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			resolved := cfg.ResolveRoute(req)
+			if resolved.Route != tt.wantRoute {
+				t.Errorf("expected route %q, got %q", tt.wantRoute, resolved.Route)
+			}
+			var plugin string
+			for _, mt := range resolved.MimeTypes {
+				for _, p := range mt.Plugins {
+					plugin = p.Name
+				}
+			}
+			if plugin != tt.wantPlugin {
+				t.Errorf("expected plugin %q, got %q", tt.wantPlugin, plugin)
+			}
+			if resolved.Cache.Disabled != tt.wantNoCache {
+				t.Errorf("expected cache disabled %v, got %v", tt.wantNoCache, resolved.Cache.Disabled)
+			}
+		})
+	}
+
+	if cfg.MimeTypes[0].Plugins == nil || cfg.Cache.Disabled {
+		t.Error("expected resolving a route to leave the configuration unchanged")
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	plugins := []PluginConfig{{Path: "./amp.so", Name: "AMPPlugin"}}
+
+	tests := []struct {
+		name     string
+		routes   []RouteConfig
+		errorMsg string
+	}{
+		{
+			name: "valid",
+			routes: []RouteConfig{
+				{Name: "amp", PathPrefix: "/amp/", MimeTypes: []MimeTypeConfig{{MimeType: "text/html", Plugins: plugins}}},
+				{PathRegex: `\.rss$`, Hosts: []string{"*.example.com"}, Methods: []string{"GET"}, NoCache: true},
+			},
+		},
+		{
+			name:     "duplicate name",
+			routes:   []RouteConfig{{Name: "a"}, {Name: "a"}},
+			errorMsg: "routes[1]: name 'a' is already used by routes[0]",
+		},
+		{
+			name:     "relative path prefix",
+			routes:   []RouteConfig{{PathPrefix: "amp/"}},
+			errorMsg: "path_prefix must start with '/'",
+		},
+		{
+			name:     "invalid regex",
+			routes:   []RouteConfig{{PathRegex: "(["}},
+			errorMsg: "routes[0]: invalid path_regex",
+		},
+		{
+			name:     "invalid host",
+			routes:   []RouteConfig{{Hosts: []string{"a.*.com"}}},
+			errorMsg: "routes[0]: invalid host 'a.*.com'",
+		},
+		{
+			name:     "invalid header",
+			routes:   []RouteConfig{{Headers: map[string]string{"X Bad": ""}}},
+			errorMsg: "invalid header name 'X Bad'",
+		},
+		{
+			name:     "plugins without processing",
+			routes:   []RouteConfig{{NoProcessing: true, MimeTypes: []MimeTypeConfig{{MimeType: "text/html", Plugins: plugins}}}},
+			errorMsg: "mime_types and no_processing can't be used together",
+		},
+		{
+			name:     "invalid MIME type",
+			routes:   []RouteConfig{{MimeTypes: []MimeTypeConfig{{MimeType: "image/png", Plugins: plugins}}}},
+			errorMsg: "routes[0].mime_types[0]: invalid MIME type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRoutes(tt.routes, make(map[string]json.RawMessage))
+			if tt.errorMsg == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("expected error containing %q, got %v", tt.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestLoad_Routes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(filename, []byte(`{
+		"backend_url": "http://localhost:8080",
+		"cache_store": {"type": "memory"},
+		"routes": [{"path_prefix": "/amp/", "mime_types": [{"mime_type": "text/html", "plugins": [{"path": "./amp.so", "name": "AMPPlugin"}]}]}],
+		"sites": [{"hosts": ["blog.example.com"], "backend_url": "http://localhost:8082",
+		           "routes": [{"path_regex": "^/feed", "no_processing": true}]}]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	route := cfg.Routes[0].MimeTypes[0]
+	if route.OnError != OnErrorPassthrough || route.Plugins[0].Type != PluginTypeGo {
+		t.Errorf("expected route MIME type defaults, got %+v", route)
+	}
+	if len(cfg.AllMimeTypes()) != 1 {
+		t.Errorf("expected route plugins to be loaded, got %v", cfg.AllMimeTypes())
+	}
+
+	site := cfg.ResolveSite("blog.example.com")
+	if resolved := site.ResolveRoute(httptest.NewRequest("GET", "/feed.xml", nil)); resolved.Route != "0" {
+		t.Errorf("expected site route to replace the top-level routes, got %q", resolved.Route)
+	}
+	if resolved := site.ResolveRoute(httptest.NewRequest("GET", "/amp/story", nil)); resolved.Route != "" {
+		t.Errorf("expected top-level route not to apply to the site, got %q", resolved.Route)
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SiteConfig configures one virtual host. Requests whose Host header matches one of
+// Hosts are proxied to the site's backend and processed with the site's plugins.
+// MIME types, cookie denylist, cache, load balancing, transport, upstream TLS,
+// forwarding, routes, and response header rules left unset are inherited from the
+// top-level configuration.
+type SiteConfig struct {
+	// Hosts lists exact host names (e.g. "blog.example.com") or wildcards
+	// ("*.example.com" matches any subdomain; "*" matches any host)
+	Hosts          []string         `json:"hosts"`
+	BackendURL     string           `json:"backend_url"`
+	MimeTypes      []MimeTypeConfig `json:"mime_types"`
+	CookieDenylist []string         `json:"cookie_denylist"`
+	Cache          *CacheConfig     `json:"cache"`
+
+	// Upstreams lists the site's upstreams when backend_url is a list, as for
+	// Config.Upstreams
+	Upstreams     []string             `json:"-"`
+	LoadBalancing *LoadBalancingConfig `json:"load_balancing"`
+	Transport     *TransportConfig     `json:"transport"`
+	UpstreamTLS   *UpstreamTLSConfig   `json:"upstream_tls"`
+	Forwarding    *ForwardingConfig    `json:"forwarding"`
+	Routes        []RouteConfig        `json:"routes"`
+
+	ResponseHeaders []HeaderRuleConfig `json:"response_headers"`
+}
+
+// ResolveSite returns the effective configuration for requests to host: the
+// top-level configuration overlaid with the matching site's settings. Exact host
+// matches take precedence over wildcards, and longer wildcards over shorter ones.
+// If no site matches, the top-level configuration is returned if it has a backend;
+// otherwise ResolveSite returns nil.
+func (c *Config) ResolveSite(host string) *Config {
+	host = normalizeHost(host)
+
+	var best *SiteConfig
+	bestScore := -1
+	for i := range c.Sites {
+		for _, pattern := range c.Sites[i].Hosts {
+			if score := matchHost(strings.ToLower(pattern), host); score > bestScore {
+				best, bestScore = &c.Sites[i], score
+			}
+		}
+	}
+
+	if best == nil {
+		if c.BackendURL == "" {
+			return nil
+		}
+		return c
+	}
+	return c.overlaySite(best)
+}
+
+// overlaySite returns the top-level configuration overlaid with sc's settings
+func (c *Config) overlaySite(sc *SiteConfig) *Config {
+	site := *c
+	site.Sites = nil
+	site.BackendURL = sc.BackendURL
+	site.Upstreams = sc.Upstreams
+	if sc.LoadBalancing != nil {
+		site.LoadBalancing = *sc.LoadBalancing
+	}
+	if sc.Transport != nil {
+		site.Transport = *sc.Transport
+	}
+	if sc.UpstreamTLS != nil {
+		site.UpstreamTLS = *sc.UpstreamTLS
+	}
+	if sc.Forwarding != nil {
+		site.Forwarding = *sc.Forwarding
+	}
+	if sc.Routes != nil {
+		site.Routes = sc.Routes
+	}
+	if sc.ResponseHeaders != nil {
+		site.ResponseHeaders = sc.ResponseHeaders
+	}
+	if sc.MimeTypes != nil {
+		site.MimeTypes = sc.MimeTypes
+	}
+	if sc.CookieDenylist != nil {
+		site.CookieDenylist = sc.CookieDenylist
+	}
+	if sc.Cache != nil {
+		site.Cache = *sc.Cache
+	}
+	return &site
+}
+
+// AllMimeTypes returns the MIME type configurations of the top level, every site,
+// and their routes
+func (c *Config) AllMimeTypes() []MimeTypeConfig {
+	mimeTypes := append([]MimeTypeConfig(nil), c.MimeTypes...)
+	for _, route := range c.Routes {
+		mimeTypes = append(mimeTypes, route.MimeTypes...)
+	}
+	for _, site := range c.Sites {
+		mimeTypes = append(mimeTypes, site.MimeTypes...)
+		for _, route := range site.Routes {
+			mimeTypes = append(mimeTypes, route.MimeTypes...)
+		}
+	}
+	return mimeTypes
+}
+
+// normalizeHost lowercases a Host header and strips its port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHost scores how specifically pattern matches host: -1 for no match, 0 for
+// the "*" catch-all, the pattern length for a wildcard, and higher than any wildcard
+// for an exact match
+func matchHost(pattern, host string) int {
+	switch {
+	case pattern == host:
+		return 1 << 16
+	case pattern == "*":
+		return 0
+	case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+		return len(pattern)
+	default:
+		return -1
+	}
+}
+
+// isValidHostPattern reports whether host is a host name, a "*." wildcard, or "*"
+func isValidHostPattern(host string) bool {
+	return host != "" && !strings.Contains(host[1:], "*") &&
+		(!strings.HasPrefix(host, "*") || host == "*" || strings.HasPrefix(host, "*."))
+}
+
+func validateSites(sites []SiteConfig, pluginOptions map[string]json.RawMessage) error {
+	seenHosts := make(map[string]int)
+
+	for i, site := range sites {
+		if len(site.Hosts) == 0 {
+			return fmt.Errorf("sites[%d]: at least one host must be specified", i)
+		}
+		for _, host := range site.Hosts {
+			host = strings.ToLower(host)
+			if !isValidHostPattern(host) {
+				return fmt.Errorf("sites[%d]: invalid host '%s', wildcards must be '*' or start with '*.'", i, host)
+			}
+			if other, seen := seenHosts[host]; seen {
+				return fmt.Errorf("sites[%d]: host '%s' is already used by sites[%d]", i, host, other)
+			}
+			seenHosts[host] = i
+		}
+
+		if site.BackendURL == "" {
+			return fmt.Errorf("sites[%d]: backend_url is required", i)
+		}
+		if err := validateBackendURL(site.BackendURL); err != nil {
+			return fmt.Errorf("sites[%d].%w", i, err)
+		}
+		if err := validateUpstreams(site.Upstreams); err != nil {
+			return fmt.Errorf("sites[%d].%w", i, err)
+		}
+
+		if site.LoadBalancing != nil {
+			if err := validateLoadBalancingConfig(*site.LoadBalancing); err != nil {
+				return fmt.Errorf("sites[%d].%w", i, err)
+			}
+		}
+		if site.Transport != nil {
+			if err := validateTransportConfig(*site.Transport); err != nil {
+				return fmt.Errorf("sites[%d].%w", i, err)
+			}
+		}
+		if site.UpstreamTLS != nil {
+			if err := validateUpstreamTLSConfig(*site.UpstreamTLS); err != nil {
+				return fmt.Errorf("sites[%d].%w", i, err)
+			}
+		}
+		if site.Forwarding != nil {
+			if err := validateForwardingConfig(site.Forwarding); err != nil {
+				return fmt.Errorf("sites[%d].%w", i, err)
+			}
+		}
+
+		if err := validateMimeTypes(site.MimeTypes, pluginOptions); err != nil {
+			return fmt.Errorf("sites[%d].%w", i, err)
+		}
+		if err := validateRoutes(site.Routes, pluginOptions); err != nil {
+			return fmt.Errorf("sites[%d].%w", i, err)
+		}
+		if err := validateHeaderRules(site.ResponseHeaders); err != nil {
+			return fmt.Errorf("sites[%d].%w", i, err)
+		}
+
+		if site.Cache != nil {
+			if err := validateCacheConfig(*site.Cache); err != nil {
+				return fmt.Errorf("sites[%d].%w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
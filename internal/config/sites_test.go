@@ -0,0 +1,107 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolveSite(t *testing.T) {
+	cfg := &Config{
+		BackendURL:        "http://default:8080",
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []MimeTypeConfig{{MimeType: "text/html"}},
+		CookieDenylist:    []string{"session"},
+		Sites: []SiteConfig{
+			{Hosts: []string{"*.example.com"}, BackendURL: "http://wildcard:8080"},
+			{Hosts: []string{"blog.example.com"}, BackendURL: "http://blog:8080",
+				MimeTypes: []MimeTypeConfig{{MimeType: "application/rss+xml"}},
+				Cache:     &CacheConfig{Disabled: true}},
+			{Hosts: []string{"*.static.example.com"}, BackendURL: "http://static:8080"},
+		},
+	}
+
+	tests := []struct {
+		host    string
+		backend string
+	}{
+		{"blog.example.com", "http://blog:8080"},
+		{"BLOG.example.com:8443", "http://blog:8080"},
+		{"blog.example.com.", "http://blog:8080"},
+		{"shop.example.com", "http://wildcard:8080"},
+		{"img.static.example.com", "http://static:8080"},
+		{"example.org", "http://default:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			site := cfg.ResolveSite(tt.host)
+			if site == nil || site.BackendURL != tt.backend {
+				t.Fatalf("expected backend %s, got %+v", tt.backend, site)
+			}
+		})
+	}
+
+	blog := cfg.ResolveSite("blog.example.com")
+	if !blog.IsHTMLXMLMimeType("application/rss+xml") || blog.IsHTMLXMLMimeType("text/html") {
+		t.Error("expected site MIME types to replace the top-level ones")
+	}
+	if !blog.Cache.Disabled {
+		t.Error("expected site cache settings")
+	}
+	if len(blog.CookieDenylist) != 1 || blog.MaxResponseSizeMB != 10 {
+		t.Error("expected unset site settings to be inherited")
+	}
+	if blog.Sites != nil {
+		t.Error("expected resolved site to have no sites")
+	}
+
+	if shop := cfg.ResolveSite("shop.example.com"); !shop.IsHTMLXMLMimeType("text/html") || shop.Cache.Disabled {
+		t.Error("expected site without overrides to inherit top-level MIME types and cache settings")
+	}
+}
+
+func TestResolveSiteWithoutDefault(t *testing.T) {
+	cfg := &Config{
+		Sites: []SiteConfig{{Hosts: []string{"example.com"}, BackendURL: "http://example:8080"}},
+	}
+
+	if site := cfg.ResolveSite("other.com"); site != nil {
+		t.Errorf("expected no site for unknown host, got %+v", site)
+	}
+
+	cfg.Sites = append(cfg.Sites, SiteConfig{Hosts: []string{"*"}, BackendURL: "http://catchall:8080"})
+	if site := cfg.ResolveSite("other.com"); site == nil || site.BackendURL != "http://catchall:8080" {
+		t.Errorf("expected catch-all site, got %+v", site)
+	}
+	if site := cfg.ResolveSite("example.com"); site.BackendURL != "http://example:8080" {
+		t.Errorf("expected exact host to beat catch-all, got %s", site.BackendURL)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	cfg := &Config{
+		BackendURL: "http://a:8080",
+		Sites: []SiteConfig{
+			{Hosts: []string{"b.com"}, BackendURL: "http://b:8080", Upstreams: []string{"http://b:8080", "http://b2:8080"}},
+			{Hosts: []string{"c.com"}, BackendURL: "http://a:8080"},
+			{Hosts: []string{"d.com"}, BackendURL: "http://a:8080", LoadBalancing: &LoadBalancingConfig{Policy: BalanceLeastConn}},
+		},
+	}
+
+	backends := cfg.Backends()
+	if len(backends) != 3 {
+		t.Fatalf("unexpected backends: %+v", backends)
+	}
+	if !slices.Equal(backends[0].URLs, []string{"http://a:8080"}) {
+		t.Errorf("expected top-level backend first, got %v", backends[0].URLs)
+	}
+	if !slices.Equal(backends[1].URLs, []string{"http://b:8080", "http://b2:8080"}) {
+		t.Errorf("expected site upstreams, got %v", backends[1].URLs)
+	}
+	if backends[2].LoadBalancing.Policy != BalanceLeastConn {
+		t.Error("expected a backend with different load balancing settings to be distinct")
+	}
+
+	if site := cfg.ResolveSite("b.com"); !site.Backend().Equal(backends[1]) {
+		t.Errorf("expected resolved site's backend, got %+v", site.Backend())
+	}
+}
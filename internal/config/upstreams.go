@@ -0,0 +1,373 @@
+// This file implements upstream configuration: backend_url given as a list of
+// upstreams, the load_balancing settings for spreading requests over them, and
+// the transport and upstream_tls settings for connecting to them.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Load balancing policies for LoadBalancingConfig.Policy
+const (
+	// BalanceRoundRobin sends requests to each upstream in turn
+	BalanceRoundRobin = "round_robin"
+	// BalanceLeastConn sends each request to the upstream with the fewest requests in flight
+	BalanceLeastConn = "least_conn"
+	// BalanceConsistentHash sends requests with the same hash key to the same upstream,
+	// moving as few keys as possible when an upstream is left out
+	BalanceConsistentHash = "consistent_hash"
+)
+
+var validBalancePolicies = []string{BalanceRoundRobin, BalanceLeastConn, BalanceConsistentHash}
+
+// MaxFailsDisabled is the LoadBalancingConfig.MaxFails that turns passive ejection
+// off, since zero means the default
+const MaxFailsDisabled = -1
+
+// Hash keys for LoadBalancingConfig.HashKey, besides "header:<name>" and "cookie:<name>"
+const (
+	// HashKeyClientIP hashes the client's IP address
+	HashKeyClientIP = "client_ip"
+	// HashKeyURL hashes the request path and query
+	HashKeyURL = "url"
+)
+
+// LoadBalancingConfig configures how requests are spread over a backend_url list,
+// and how failing upstreams are left out
+type LoadBalancingConfig struct {
+	// Policy is one of the Balance constants (default: round_robin)
+	Policy string `json:"policy"`
+	// HashKey is what consistent_hash hashes: "client_ip", "url", "header:<name>",
+	// or "cookie:<name>" (default: client_ip)
+	HashKey string `json:"hash_key"`
+	// MaxFails ejects an upstream after this many requests in a row fail with a
+	// connection error or a 502, 503, or 504 response. MaxFailsDisabled turns
+	// passive ejection off. (default: 3)
+	MaxFails int `json:"max_fails"`
+	// FailTimeoutMS is how long an ejected upstream is left out before requests
+	// are sent to it again (default: 10000)
+	FailTimeoutMS int `json:"fail_timeout_ms"`
+	// Retries is how many other upstreams an idempotent request without a body is
+	// retried on after a connection error (default: 2)
+	Retries int `json:"retries"`
+	// HealthCheck configures active health checks
+	HealthCheck HealthCheckConfig `json:"health_check"`
+}
+
+// HealthCheckConfig configures active health checks. Each upstream is requested
+// every interval, and left out while it fails them.
+type HealthCheckConfig struct {
+	// Path enables health checks. An upstream passes a check if GET Path responds
+	// with a 2xx or 3xx status.
+	Path string `json:"path"`
+	// IntervalMS is the time between checks (default: 5000)
+	IntervalMS int `json:"interval_ms"`
+	// TimeoutMS bounds each check (default: 2000)
+	TimeoutMS int `json:"timeout_ms"`
+	// UnhealthyThreshold is how many checks in a row an upstream must fail to be
+	// left out (default: 2)
+	UnhealthyThreshold int `json:"unhealthy_threshold"`
+	// HealthyThreshold is how many checks in a row a left out upstream must pass
+	// to be used again (default: 2)
+	HealthyThreshold int `json:"healthy_threshold"`
+}
+
+// HTTP/2 modes for TransportConfig.HTTP2
+const (
+	// HTTP2Auto uses HTTP/2 with https backends that offer it
+	HTTP2Auto = "auto"
+	// HTTP2Off uses HTTP/1.1 only
+	HTTP2Off = "off"
+	// HTTP2Cleartext uses HTTP/2 with every backend, without TLS (h2c) for http
+	// backends, which must support it
+	HTTP2Cleartext = "h2c"
+)
+
+var validHTTP2Modes = []string{HTTP2Auto, HTTP2Off, HTTP2Cleartext}
+
+// TransportConfig tunes the connections XRP makes to backends
+type TransportConfig struct {
+	// DialTimeoutMS bounds connecting to an upstream (default: 30000)
+	DialTimeoutMS int `json:"dial_timeout_ms"`
+	// TLSHandshakeTimeoutMS bounds the TLS handshake with an upstream (default: 10000)
+	TLSHandshakeTimeoutMS int `json:"tls_handshake_timeout_ms"`
+	// ResponseHeaderTimeoutMS bounds waiting for response headers once a request
+	// is sent (default: 0, unlimited)
+	ResponseHeaderTimeoutMS int `json:"response_header_timeout_ms"`
+	// KeepAliveMS is the interval between TCP keep-alive probes (default: 30000)
+	KeepAliveMS int `json:"keep_alive_ms"`
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+	// MaxIdleConns bounds idle connections across all of a backend's upstreams (default: 100)
+	MaxIdleConns int `json:"max_idle_conns"`
+	// MaxIdleConnsPerHost bounds idle connections to each upstream (default: 32)
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	// MaxConnsPerHost bounds connections to each upstream, in use or idle
+	// (default: 0, unlimited)
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+	// IdleConnTimeoutMS is how long an idle connection is kept open (default: 90000)
+	IdleConnTimeoutMS int `json:"idle_conn_timeout_ms"`
+	// HTTP2 is one of the HTTP2 constants (default: auto)
+	HTTP2 string `json:"http2"`
+}
+
+// UpstreamTLSConfig configures TLS connections to https backends. Its files are
+// reread on every configuration reload.
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM file of CA certificates to trust, besides the system's
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are a client certificate to present, for mutual TLS
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName is sent as SNI and expected in upstream certificates, instead of
+	// the host name of the backend URL
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify accepts any upstream certificate. It is meant for testing
+	// only, since it makes connections open to interception.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// Backend is where a site's requests are proxied: one or more upstream URLs, how
+// requests are balanced over them, and how XRP connects to them
+type Backend struct {
+	URLs          []string
+	LoadBalancing LoadBalancingConfig
+	Transport     TransportConfig
+	TLS           UpstreamTLSConfig
+}
+
+// Equal reports whether b and other are the same backend
+func (b Backend) Equal(other Backend) bool {
+	return slices.Equal(b.URLs, other.URLs) && b.LoadBalancing == other.LoadBalancing &&
+		b.Transport == other.Transport && b.TLS == other.TLS
+}
+
+// Backend returns the backend of a configuration returned by ResolveSite
+func (c *Config) Backend() Backend {
+	urls := c.Upstreams
+	if len(urls) == 0 {
+		urls = []string{c.BackendURL}
+	}
+	return Backend{URLs: urls, LoadBalancing: c.LoadBalancing, Transport: c.Transport, TLS: c.UpstreamTLS}
+}
+
+// Backends returns every distinct backend in the configuration
+func (c *Config) Backends() []Backend {
+	var backends []Backend
+	add := func(backend Backend) {
+		if !slices.ContainsFunc(backends, backend.Equal) {
+			backends = append(backends, backend)
+		}
+	}
+
+	if c.BackendURL != "" {
+		add(c.Backend())
+	}
+	for i := range c.Sites {
+		add(c.overlaySite(&c.Sites[i]).Backend())
+	}
+	return backends
+}
+
+// backendURLs decodes backend_url, which is either a URL or a list of them
+type backendURLs []string
+
+func (b *backendURLs) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*b = backendURLs{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("backend_url must be a URL or a list of URLs")
+	}
+	*b = list
+	return nil
+}
+
+// split returns the first URL, for BackendURL, and the whole list if there is more
+// than one, for Upstreams
+func (b backendURLs) split() (string, []string) {
+	switch len(b) {
+	case 0:
+		return "", nil
+	case 1:
+		return b[0], nil
+	default:
+		return b[0], b
+	}
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	aux := struct {
+		*plain
+		BackendURL backendURLs `json:"backend_url"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.BackendURL, c.Upstreams = aux.BackendURL.split()
+	return nil
+}
+
+func (s *SiteConfig) UnmarshalJSON(data []byte) error {
+	type plain SiteConfig
+	aux := struct {
+		*plain
+		BackendURL backendURLs `json:"backend_url"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	s.BackendURL, s.Upstreams = aux.BackendURL.split()
+	return nil
+}
+
+// validateUpstreams ensures every upstream in a backend_url list is a valid
+// backend URL, and that they differ only in scheme, host, and port, since request
+// paths are mapped onto each upstream the same way
+func validateUpstreams(upstreams []string) error {
+	var first *url.URL
+	for i, upstream := range upstreams {
+		if err := validateBackendURL(upstream); err != nil {
+			return err
+		}
+		parsedURL, _ := url.Parse(upstream)
+		if i == 0 {
+			first = parsedURL
+			continue
+		}
+		if parsedURL.Path != first.Path || parsedURL.RawQuery != first.RawQuery {
+			return fmt.Errorf("backend_url upstreams must differ only in scheme, host, and port")
+		}
+		if slices.Contains(upstreams[:i], upstream) {
+			return fmt.Errorf("backend_url lists upstream '%s' more than once", upstream)
+		}
+	}
+	return nil
+}
+
+func validateLoadBalancingConfig(lb LoadBalancingConfig) error {
+	if lb.Policy != "" && !slices.Contains(validBalancePolicies, lb.Policy) {
+		return fmt.Errorf("invalid load_balancing.policy '%s', must be one of: %s",
+			lb.Policy, strings.Join(validBalancePolicies, ", "))
+	}
+
+	switch name, isPrefixed := hashKeyName(lb.HashKey); {
+	case isPrefixed && name == "":
+		return fmt.Errorf("load_balancing.hash_key '%s' is missing a header or cookie name", lb.HashKey)
+	case !isPrefixed && lb.HashKey != "" && lb.HashKey != HashKeyClientIP && lb.HashKey != HashKeyURL:
+		return fmt.Errorf("invalid load_balancing.hash_key '%s', must be one of: %s, %s, header:<name>, cookie:<name>",
+			lb.HashKey, HashKeyClientIP, HashKeyURL)
+	}
+
+	if lb.MaxFails < MaxFailsDisabled {
+		return fmt.Errorf("load_balancing.max_fails must not be negative, except %d to disable passive ejection", MaxFailsDisabled)
+	}
+	if lb.FailTimeoutMS < 0 || lb.Retries < 0 {
+		return fmt.Errorf("load_balancing.fail_timeout_ms and retries must not be negative")
+	}
+
+	hc := lb.HealthCheck
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("load_balancing.health_check.path must start with '/'")
+	}
+	if hc.IntervalMS < 0 || hc.TimeoutMS < 0 || hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+		return fmt.Errorf("load_balancing.health_check intervals, timeouts, and thresholds must not be negative")
+	}
+	return nil
+}
+
+func validateTransportConfig(transport TransportConfig) error {
+	if transport.HTTP2 != "" && !slices.Contains(validHTTP2Modes, transport.HTTP2) {
+		return fmt.Errorf("invalid transport.http2 '%s', must be one of: %s",
+			transport.HTTP2, strings.Join(validHTTP2Modes, ", "))
+	}
+	if transport.DialTimeoutMS < 0 || transport.TLSHandshakeTimeoutMS < 0 || transport.ResponseHeaderTimeoutMS < 0 ||
+		transport.KeepAliveMS < 0 || transport.IdleConnTimeoutMS < 0 {
+		return fmt.Errorf("transport timeouts must not be negative")
+	}
+	if transport.MaxIdleConns < 0 || transport.MaxIdleConnsPerHost < 0 || transport.MaxConnsPerHost < 0 {
+		return fmt.Errorf("transport connection limits must not be negative")
+	}
+	return nil
+}
+
+func validateUpstreamTLSConfig(upstreamTLS UpstreamTLSConfig) error {
+	if (upstreamTLS.CertFile == "") != (upstreamTLS.KeyFile == "") {
+		return fmt.Errorf("upstream_tls.cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// hashKeyName returns the header or cookie name of a "header:" or "cookie:" hash
+// key, and whether the key has one of those prefixes
+func hashKeyName(hashKey string) (string, bool) {
+	for _, prefix := range []string{"header:", "cookie:"} {
+		if name, found := strings.CutPrefix(hashKey, prefix); found {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func setLoadBalancingDefaults(lb *LoadBalancingConfig) {
+	if lb.Policy == "" {
+		lb.Policy = BalanceRoundRobin
+	}
+	if lb.Policy == BalanceConsistentHash && lb.HashKey == "" {
+		lb.HashKey = HashKeyClientIP
+	}
+	if lb.MaxFails == 0 {
+		lb.MaxFails = 3
+	}
+	if lb.FailTimeoutMS == 0 {
+		lb.FailTimeoutMS = 10000
+	}
+	if lb.Retries == 0 {
+		lb.Retries = 2
+	}
+	if lb.HealthCheck.IntervalMS == 0 {
+		lb.HealthCheck.IntervalMS = 5000
+	}
+	if lb.HealthCheck.TimeoutMS == 0 {
+		lb.HealthCheck.TimeoutMS = 2000
+	}
+	if lb.HealthCheck.UnhealthyThreshold == 0 {
+		lb.HealthCheck.UnhealthyThreshold = 2
+	}
+	if lb.HealthCheck.HealthyThreshold == 0 {
+		lb.HealthCheck.HealthyThreshold = 2
+	}
+}
+
+func setTransportDefaults(transport *TransportConfig) {
+	if transport.DialTimeoutMS == 0 {
+		transport.DialTimeoutMS = 30000
+	}
+	if transport.TLSHandshakeTimeoutMS == 0 {
+		transport.TLSHandshakeTimeoutMS = 10000
+	}
+	if transport.KeepAliveMS == 0 {
+		transport.KeepAliveMS = 30000
+	}
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = 100
+	}
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = 32
+	}
+	if transport.IdleConnTimeoutMS == 0 {
+		transport.IdleConnTimeoutMS = 90000
+	}
+	if transport.HTTP2 == "" {
+		transport.HTTP2 = HTTP2Auto
+	}
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBackendURLList(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"backend_url": ["http://app1:8080", "http://app2:8080"],
+		"max_response_size_mb": 5,
+		"sites": [
+			{"hosts": ["a.com"], "backend_url": "http://a:8080"},
+			{"hosts": ["b.com"], "backend_url": ["http://b1:8080", "http://b2:8080"],
+			 "load_balancing": {"policy": "consistent_hash", "hash_key": "cookie:session"}}
+		]
+	}`), &cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.BackendURL != "http://app1:8080" || !slices.Equal(cfg.Upstreams, []string{"http://app1:8080", "http://app2:8080"}) {
+		t.Errorf("unexpected top-level backend %q, upstreams %v", cfg.BackendURL, cfg.Upstreams)
+	}
+	if cfg.MaxResponseSizeMB != 5 {
+		t.Error("expected other fields to be decoded")
+	}
+	if cfg.Sites[0].BackendURL != "http://a:8080" || cfg.Sites[0].Upstreams != nil {
+		t.Errorf("expected single backend URL, got %q, %v", cfg.Sites[0].BackendURL, cfg.Sites[0].Upstreams)
+	}
+	if len(cfg.Sites[1].Upstreams) != 2 || cfg.Sites[1].LoadBalancing.HashKey != "cookie:session" {
+		t.Errorf("unexpected site upstreams %v", cfg.Sites[1].Upstreams)
+	}
+
+	if err := json.Unmarshal([]byte(`{"backend_url": 8080}`), &cfg); err == nil {
+		t.Error("expected error for a backend_url that is neither a URL nor a list")
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstreams     []string
+		loadBalancing LoadBalancingConfig
+		transport     TransportConfig
+		upstreamTLS   UpstreamTLSConfig
+		errorMsg      string
+	}{
+		{
+			name:      "valid list",
+			upstreams: []string{"http://app1:8080/app", "https://app2/app"},
+			loadBalancing: LoadBalancingConfig{
+				Policy:      BalanceConsistentHash,
+				HashKey:     "header:X-User",
+				HealthCheck: HealthCheckConfig{Path: "/healthz"},
+			},
+		},
+		{
+			name:      "invalid upstream",
+			upstreams: []string{"http://app1:8080", "ftp://app2"},
+			errorMsg:  "backend_url must be a valid HTTP/HTTPS URL",
+		},
+		{
+			name:      "different paths",
+			upstreams: []string{"http://app1:8080/app", "http://app2:8080/other"},
+			errorMsg:  "must differ only in scheme, host, and port",
+		},
+		{
+			name:      "duplicate upstream",
+			upstreams: []string{"http://app1:8080", "http://app1:8080"},
+			errorMsg:  "more than once",
+		},
+		{
+			name:          "invalid policy",
+			loadBalancing: LoadBalancingConfig{Policy: "random"},
+			errorMsg:      "invalid load_balancing.policy 'random'",
+		},
+		{
+			name:          "invalid hash key",
+			loadBalancing: LoadBalancingConfig{HashKey: "query"},
+			errorMsg:      "invalid load_balancing.hash_key 'query'",
+		},
+		{
+			name:          "hash key without name",
+			loadBalancing: LoadBalancingConfig{HashKey: "cookie:"},
+			errorMsg:      "missing a header or cookie name",
+		},
+		{
+			name:          "negative max fails",
+			loadBalancing: LoadBalancingConfig{MaxFails: -2},
+			errorMsg:      "except -1 to disable passive ejection",
+		},
+		{
+			name:          "negative retries",
+			loadBalancing: LoadBalancingConfig{Retries: -1},
+			errorMsg:      "must not be negative",
+		},
+		{
+			name:          "relative health check path",
+			loadBalancing: LoadBalancingConfig{HealthCheck: HealthCheckConfig{Path: "healthz"}},
+			errorMsg:      "must start with '/'",
+		},
+		{
+			name:        "transport and upstream TLS",
+			transport:   TransportConfig{DialTimeoutMS: 1000, MaxConnsPerHost: 10, HTTP2: HTTP2Cleartext},
+			upstreamTLS: UpstreamTLSConfig{CAFile: "/ca.pem", CertFile: "/client.pem", KeyFile: "/client.key", ServerName: "app.internal"},
+		},
+		{
+			name:      "invalid http2 mode",
+			transport: TransportConfig{HTTP2: "always"},
+			errorMsg:  "invalid transport.http2 'always'",
+		},
+		{
+			name:      "negative timeout",
+			transport: TransportConfig{ResponseHeaderTimeoutMS: -1},
+			errorMsg:  "transport timeouts must not be negative",
+		},
+		{
+			name:      "negative connection limit",
+			transport: TransportConfig{MaxIdleConnsPerHost: -1},
+			errorMsg:  "transport connection limits must not be negative",
+		},
+		{
+			name:        "client certificate without key",
+			upstreamTLS: UpstreamTLSConfig{CertFile: "/client.pem"},
+			errorMsg:    "cert_file and key_file must be set together",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				BackendURL:    "http://app1:8080",
+				Upstreams:     tt.upstreams,
+				LoadBalancing: tt.loadBalancing,
+				Transport:     tt.transport,
+				UpstreamTLS:   tt.upstreamTLS,
+				CacheStore:    StoreConfig{Type: StoreMemory},
+			}
+			err := validateConfig(cfg)
+			if tt.errorMsg == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+				t.Errorf("expected error containing %q, got %v", tt.errorMsg, err)
+			}
+		})
+	}
+
+	// Site settings are validated too
+	cfg := &Config{
+		CacheStore: StoreConfig{Type: StoreMemory},
+		Sites: []SiteConfig{{
+			Hosts:         []string{"a.com"},
+			BackendURL:    "http://a:8080",
+			LoadBalancing: &LoadBalancingConfig{Policy: "random"},
+		}},
+	}
+	if err := validateConfig(cfg); err == nil || !strings.HasPrefix(err.Error(), "sites[0].invalid load_balancing.policy") {
+		t.Errorf("expected site load balancing error, got %v", err)
+	}
+	cfg.Sites[0].LoadBalancing = nil
+	cfg.Sites[0].UpstreamTLS = &UpstreamTLSConfig{KeyFile: "/client.key"}
+	if err := validateConfig(cfg); err == nil || !strings.HasPrefix(err.Error(), "sites[0].upstream_tls") {
+		t.Errorf("expected site upstream TLS error, got %v", err)
+	}
+}
+
+func TestSetDefaults_LoadBalancing(t *testing.T) {
+	cfg := &Config{
+		LoadBalancing: LoadBalancingConfig{Policy: BalanceConsistentHash, Retries: 1},
+		Sites:         []SiteConfig{{LoadBalancing: &LoadBalancingConfig{}}, {LoadBalancing: &LoadBalancingConfig{MaxFails: MaxFailsDisabled}}},
+	}
+	setDefaults(cfg)
+
+	lb := cfg.LoadBalancing
+	if lb.HashKey != HashKeyClientIP || lb.MaxFails != 3 || lb.FailTimeoutMS != 10000 || lb.Retries != 1 {
+		t.Errorf("unexpected defaults: %+v", lb)
+	}
+	if lb.HealthCheck.IntervalMS != 5000 || lb.HealthCheck.TimeoutMS != 2000 ||
+		lb.HealthCheck.UnhealthyThreshold != 2 || lb.HealthCheck.HealthyThreshold != 2 {
+		t.Errorf("unexpected health check defaults: %+v", lb.HealthCheck)
+	}
+	if site := cfg.Sites[0].LoadBalancing; site.Policy != BalanceRoundRobin || site.HashKey != "" {
+		t.Errorf("unexpected site defaults: %+v", site)
+	}
+	if site := cfg.Sites[1].LoadBalancing; site.MaxFails != MaxFailsDisabled {
+		t.Errorf("expected passive ejection to stay disabled, got max_fails %d", site.MaxFails)
+	}
+}
+
+func TestSetDefaults_Transport(t *testing.T) {
+	cfg := &Config{
+		BackendURL:  "https://app:8443",
+		Transport:   TransportConfig{MaxIdleConnsPerHost: 8},
+		UpstreamTLS: UpstreamTLSConfig{CAFile: "/ca.pem"},
+		Sites: []SiteConfig{
+			{Hosts: []string{"a.com"}, BackendURL: "https://app:8443"},
+			{Hosts: []string{"b.com"}, BackendURL: "https://app:8443", Transport: &TransportConfig{HTTP2: HTTP2Off}},
+		},
+	}
+	setDefaults(cfg)
+
+	transport := cfg.Transport
+	if transport.DialTimeoutMS != 30000 || transport.TLSHandshakeTimeoutMS != 10000 || transport.KeepAliveMS != 30000 ||
+		transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != 8 || transport.IdleConnTimeoutMS != 90000 ||
+		transport.ResponseHeaderTimeoutMS != 0 || transport.HTTP2 != HTTP2Auto {
+		t.Errorf("unexpected defaults: %+v", transport)
+	}
+
+	// Sites inherit transport and upstream TLS settings they don't override
+	backends := cfg.Backends()
+	if len(backends) != 2 {
+		t.Fatalf("expected sites with different transports to have different backends, got %d", len(backends))
+	}
+	if backends[1].Transport.HTTP2 != HTTP2Off || backends[1].Transport.MaxIdleConnsPerHost != 32 ||
+		backends[1].TLS.CAFile != "/ca.pem" {
+		t.Errorf("unexpected site backend: %+v", backends[1])
+	}
+}
@@ -3,6 +3,9 @@
 // The health server runs on a separate port from the main proxy and provides:
 // - GET /health endpoint that returns 102 Processing during startup
 // - Returns 200 OK with body "ok" when the proxy is fully ready
+// - Returns 200 OK with body "degraded" and the reasons when a check fails (see AddCheck)
+// - GET /metrics endpoint exposing Prometheus metrics (see package metrics)
+// - Additional handlers registered with Handle, such as the admin API
 //
 // This enables external monitoring systems to determine when XRP is ready
 // to handle traffic, particularly useful for container orchestration and
@@ -14,14 +17,31 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cdzombak/xrp/internal/metrics"
 )
 
+// Check reports the health of a non-critical dependency, returning nil if it is
+// healthy or why it isn't
+type Check func() error
+
 // Server provides health check endpoints for XRP
 type Server struct {
 	server *http.Server
+	mux    *http.ServeMux
 	ready  *int32 // atomic flag for readiness state
+
+	checksMu sync.Mutex
+	checks   []namedCheck
+}
+
+type namedCheck struct {
+	name  string
+	check Check
 }
 
 // New creates a new health server on the specified port
@@ -34,14 +54,44 @@ func New(port int) *Server {
 			Addr:    ":" + strconv.Itoa(port),
 			Handler: mux,
 		},
+		mux:   mux,
 		ready: &ready,
 	}
 
 	mux.HandleFunc("/health", s.healthHandler)
+	mux.Handle("/metrics", metrics.Handler())
 
 	return s
 }
 
+// Handle registers an additional handler on the health server, such as the admin API
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// AddCheck registers a check whose failure is reported by /health without making
+// XRP unready, since XRP keeps serving traffic while the dependency is down
+func (s *Server) AddCheck(name string, check Check) {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	s.checks = append(s.checks, namedCheck{name: name, check: check})
+}
+
+// failingChecks returns a line describing each failing check
+func (s *Server) failingChecks() []string {
+	s.checksMu.Lock()
+	checks := s.checks
+	s.checksMu.Unlock()
+
+	var failures []string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failures = append(failures, c.name+": "+err.Error())
+		}
+	}
+	return failures
+}
+
 // Start begins listening for health check requests
 func (s *Server) Start() error {
 	slog.Info("Starting health server", "addr", s.server.Addr)
@@ -77,8 +127,12 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
 	if atomic.LoadInt32(s.ready) == 1 {
+		body := "ok"
+		if failures := s.failingChecks(); len(failures) > 0 {
+			body = "degraded\n" + strings.Join(failures, "\n")
+		}
 		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("ok"))
+		_, err := w.Write([]byte(body))
 		if err != nil {
 			slog.Error("Failed to write health response", "error", err)
 		}
@@ -89,4 +143,4 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 			slog.Error("Failed to write health response", "error", err)
 		}
 	}
-}
\ No newline at end of file
+}
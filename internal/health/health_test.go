@@ -1,8 +1,10 @@
 package health
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -190,4 +192,52 @@ func TestHealthServer_Integration(t *testing.T) {
 	case <-time.After(time.Second):
 		t.Error("Server did not stop within timeout")
 	}
-}
\ No newline at end of file
+}
+// TestMetricsEndpoint tests the Prometheus metrics endpoint is served alongside /health
+func TestMetricsEndpoint(t *testing.T) {
+	server := New(8081)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	recorder := httptest.NewRecorder()
+
+	server.server.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if !strings.Contains(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected text exposition format, got %q", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "go_goroutines") {
+		t.Error("expected runtime metrics in output")
+	}
+}
+
+// TestHealthHandler_Degraded tests failing checks are reported without making XRP unready
+func TestHealthHandler_Degraded(t *testing.T) {
+	server := New(8081)
+	server.MarkReady()
+
+	var cacheErr error
+	server.AddCheck("cache", func() error { return cacheErr })
+
+	check := func() (int, string) {
+		req := httptest.NewRequest("GET", "/health", nil)
+		recorder := httptest.NewRecorder()
+		server.healthHandler(recorder, req)
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, body := check(); code != http.StatusOK || body != "ok" {
+		t.Errorf("expected 200 ok, got %d %q", code, body)
+	}
+
+	cacheErr = errors.New("redis unavailable")
+	code, body := check()
+	if code != http.StatusOK {
+		t.Errorf("expected status 200 while degraded, got %d", code)
+	}
+	if body != "degraded\ncache: redis unavailable" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
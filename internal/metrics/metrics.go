@@ -0,0 +1,177 @@
+// Package metrics defines XRP's Prometheus metrics.
+//
+// All metrics are registered on Registry, which the health server exposes at
+// GET /metrics in the Prometheus text exposition format. Metrics are package-level
+// so any component can record them without threading a collector through every
+// constructor.
+//
+// Exported metrics:
+//
+// - xrp_requests_total{status, mime_type}: requests served, by status code and MIME type
+// - xrp_cache_results_total{result}: X-XRP-Cache results (HIT, MISS, BYPASS, STALE, REVALIDATED)
+// - xrp_coalesced_requests_total: cache misses that waited for a concurrent fetch of the same entry
+// - xrp_upstream_request_duration_seconds: backend round-trip latency
+// - xrp_upstream_available{upstream}: 1 if an upstream is in rotation, 0 while it is ejected or failing health checks
+// - xrp_upstream_retries_total: requests retried on another upstream after a connection error
+// - xrp_plugin_duration_seconds{plugin}: plugin execution time, by plugin path and name
+// - xrp_plugin_errors_total{plugin, reason}: plugin failures (error, panic, timeout)
+// - xrp_parse_duration_seconds{document_type} and xrp_render_duration_seconds{document_type}
+// - xrp_size_bypass_total: responses streamed through unprocessed because they were too large
+// - xrp_buffer_memory_bytes: response body memory in use, out of buffering.memory_budget_mb
+// - xrp_buffer_spills_total: response bodies spilled to a temporary file
+// - xrp_buffer_budget_exhausted_total: responses that gave up waiting for memory budget
+// - xrp_redis_errors_total{operation}: failed Redis operations
+// - xrp_cache_available: 1 if the cache store is usable, 0 during an outage
+// - xrp_config_reloads_total{result}: configuration reloads (success, failure)
+//
+// The standard Go runtime and process collectors are registered as well.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "xrp"
+
+// Registry holds all XRP metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	RequestsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests served, by HTTP status code and response MIME type.",
+	}, []string{"status", "mime_type"})
+
+	CacheResultsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_results_total",
+		Help:      "Processed responses by X-XRP-Cache result.",
+	}, []string{"result"})
+
+	CoalescedRequestsTotal = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Cache misses that waited for a concurrent fetch of the same entry.",
+	})
+
+	UpstreamDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until response headers are received from the backend.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	UpstreamAvailable = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_available",
+		Help:      "1 if an upstream is in rotation, 0 while it is ejected after failures or failing health checks.",
+	}, []string{"upstream"})
+
+	UpstreamRetriesTotal = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Requests retried on another upstream after a connection error.",
+	})
+
+	PluginDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "plugin_duration_seconds",
+		Help:      "Plugin execution time, by plugin path and name.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"plugin"})
+
+	PluginErrorsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "plugin_errors_total",
+		Help:      "Plugin failures, by plugin path and name and reason (error, panic, timeout).",
+	}, []string{"plugin", "reason"})
+
+	ParseDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "parse_duration_seconds",
+		Help:      "Time spent parsing response bodies.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"document_type"})
+
+	RenderDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "render_duration_seconds",
+		Help:      "Time spent rendering processed documents.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"document_type"})
+
+	SizeBypassTotal = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "size_bypass_total",
+		Help:      "Responses streamed through unprocessed because they exceeded max_response_size_mb.",
+	})
+
+	BufferMemoryBytes = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_memory_bytes",
+		Help:      "Memory reserved for response bodies being buffered or processed.",
+	})
+
+	BufferSpillsTotal = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_spills_total",
+		Help:      "Response bodies spilled to a temporary file.",
+	})
+
+	BufferBudgetExhaustedTotal = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_budget_exhausted_total",
+		Help:      "Responses left unprocessed after waiting too long for memory budget.",
+	})
+
+	RedisErrorsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed Redis operations, by operation.",
+	}, []string{"operation"})
+
+	CacheAvailable = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_available",
+		Help:      "1 if the cache store is usable, 0 while it is unreachable and caching is bypassed.",
+	})
+
+	ConfigReloadsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads, by result (success, failure).",
+	}, []string{"result"})
+)
+
+// Plugin error reasons for PluginErrorsTotal
+const (
+	PluginErrorError   = "error"
+	PluginErrorPanic   = "panic"
+	PluginErrorTimeout = "timeout"
+)
+
+// Config reload results for ConfigReloadsTotal
+const (
+	ReloadSuccess = "success"
+	ReloadFailure = "failure"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves all XRP metrics in the Prometheus text exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	RequestsTotal.WithLabelValues("200", "text/html").Inc()
+	CacheResultsTotal.WithLabelValues("HIT").Inc()
+	PluginDuration.WithLabelValues("ExamplePlugin").Observe(0.01)
+	ConfigReloadsTotal.WithLabelValues(ReloadSuccess).Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`xrp_requests_total{mime_type="text/html",status="200"}`,
+		`xrp_cache_results_total{result="HIT"}`,
+		`xrp_plugin_duration_seconds_bucket{plugin="ExamplePlugin",le="0.025"}`,
+		`xrp_config_reloads_total{result="success"}`,
+		`# TYPE xrp_upstream_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected metrics output to contain %s", expected)
+		}
+	}
+}
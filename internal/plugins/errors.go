@@ -0,0 +1,34 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PanicError reports a panic recovered while a plugin was processing a document
+type PanicError struct {
+	Plugin string
+	Value  any
+	Stack  []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("plugin %s panicked: %v", e.Plugin, e.Value)
+}
+
+// TimeoutError reports a plugin that did not finish before its deadline.
+// The plugin may still be running, so the document it was given must be discarded.
+type TimeoutError struct {
+	Plugin  string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("plugin %s timed out after %s", e.Plugin, e.Timeout)
+}
+
+// Unwrap allows errors.Is(err, context.DeadlineExceeded)
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
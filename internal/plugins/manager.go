@@ -5,6 +5,8 @@
 //
 // - Secure plugin file validation (permissions, paths, symlinks)
 // - Simple GetPlugin() function-based plugin loading
+// - Both the original Plugin interface and the context-aware PluginV2 interface
+// - Streaming HTML plugins implementing StreamingPlugin, alone or alongside either
 // - Plugin lifecycle management and hot-reloading
 // - Thread-safe plugin registry and retrieval
 // - Comprehensive security controls and sandboxing
@@ -15,7 +17,8 @@
 // 2. Plugin loading: Load shared library and look up GetPlugin() function
 // 3. Instance creation: Call GetPlugin() to get a fresh plugin instance
 // 4. Interface validation: Ensure plugin implements required methods
-// 5. Registration: Store plugin for efficient retrieval during request processing
+// 5. Configuration: Pass the plugin's options to it if it implements xrpplugin.Configurable
+// 6. Registration: Store plugin for efficient retrieval during request processing
 //
 // Example plugin implementation:
 //
@@ -30,14 +33,18 @@ package plugins
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"plugin"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/html"
 
@@ -47,24 +54,147 @@ import (
 	xrpPlugin "github.com/cdzombak/xrp/pkg/xrpplugin"
 )
 
+// LoadedPlugin is a plugin instance ready for request processing.
+// Plugins implementing the original xrpplugin.Plugin interface are adapted
+// to xrpplugin.PluginV2 so the proxy only deals with one interface.
 type LoadedPlugin struct {
-	plugin xrpPlugin.Plugin
-	path   string
-	name   string
+	// plugin is nil for plugins that only implement xrpplugin.StreamingPlugin
+	plugin    xrpPlugin.PluginV2
+	streaming xrpPlugin.StreamingPlugin // nil unless the plugin can stream
+	instance  any                       // the value returned by the plugin's GetPlugin function
+	path      string
+	name      string
+	// options are the options the plugin was last configured with
+	options json.RawMessage
+
+	// failures counts consecutive processing failures; see RecordFailure
+	failures atomic.Int64
+	disabled atomic.Bool
 }
 
-func (lp *LoadedPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
-	if htmlPlugin, ok := lp.plugin.(xrpPlugin.HTMLPlugin); ok {
-		return htmlPlugin.ProcessHTMLTree(ctx, url, node)
+// newLoadedPlugin wraps a plugin instance, which must implement at least one of
+// xrpplugin.PluginV2, xrpplugin.Plugin, and xrpplugin.StreamingPlugin.
+func newLoadedPlugin(path, name string, instance any) (*LoadedPlugin, error) {
+	var v2 xrpPlugin.PluginV2
+	switch p := instance.(type) {
+	case xrpPlugin.PluginV2:
+		v2 = p
+	case xrpPlugin.Plugin:
+		v2 = xrpPlugin.AdaptPlugin(p)
+	}
+	streaming, _ := instance.(xrpPlugin.StreamingPlugin)
+	if v2 == nil && streaming == nil {
+		return nil, fmt.Errorf("plugin %s does not implement xrpplugin.Plugin, xrpplugin.PluginV2, or xrpplugin.StreamingPlugin", name)
 	}
-	return lp.plugin.ProcessHTMLTree(ctx, url, node)
+
+	return &LoadedPlugin{
+		plugin:    v2,
+		streaming: streaming,
+		instance:  instance,
+		path:      path,
+		name:      name,
+	}, nil
 }
 
-func (lp *LoadedPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
-	if xmlPlugin, ok := lp.plugin.(xrpPlugin.XMLPlugin); ok {
-		return xmlPlugin.ProcessXMLTree(ctx, url, doc)
+// canReuse reports whether this plugin instance can serve pluginConfig after a reload
+func (lp *LoadedPlugin) canReuse(pluginConfig config.PluginConfig) bool {
+	rp, isRemote := lp.instance.(*remotePlugin)
+	if isRemote != pluginConfig.IsRemote() {
+		return false
+	}
+	return !isRemote || rp.sameProcess(pluginConfig)
+}
+
+// close releases resources held by the plugin, such as a remote plugin process.
+// In-process Go plugins can't be unloaded, so this is a no-op for them.
+func (lp *LoadedPlugin) close() {
+	if closer, ok := lp.instance.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Failed to close plugin", "path", lp.path, "name", lp.name, "error", err)
+		}
+	}
+}
+
+// RecordSuccess resets the plugin's consecutive failure count
+func (lp *LoadedPlugin) RecordSuccess() {
+	lp.failures.Store(0)
+}
+
+// RecordFailure counts a processing failure and disables the plugin once it has
+// failed maxFailures times in a row. A maxFailures of 0 never disables the plugin.
+// It reports whether this failure disabled the plugin.
+func (lp *LoadedPlugin) RecordFailure(maxFailures int) bool {
+	failures := lp.failures.Add(1)
+	if maxFailures <= 0 || failures < int64(maxFailures) {
+		return false
+	}
+	return lp.disabled.CompareAndSwap(false, true)
+}
+
+// Disabled reports whether the plugin has been disabled after repeated failures.
+// Disabled plugins are re-enabled when the configuration is reloaded.
+func (lp *LoadedPlugin) Disabled() bool {
+	return lp.disabled.Load()
+}
+
+// resetFailures re-enables the plugin and clears its failure count
+func (lp *LoadedPlugin) resetFailures() {
+	lp.failures.Store(0)
+	lp.disabled.Store(false)
+}
+
+// Streaming reports whether the plugin implements xrpplugin.StreamingPlugin
+func (lp *LoadedPlugin) Streaming() bool {
+	return lp.streaming != nil
+}
+
+// checkProcessing reports an error if the plugin can't process documents in the
+// given processing mode
+func (lp *LoadedPlugin) checkProcessing(mode string) error {
+	if mode == config.ProcessingStream && lp.streaming == nil {
+		return fmt.Errorf("plugin %s does not implement xrpplugin.StreamingPlugin, required for stream processing", lp.name)
+	}
+	if mode != config.ProcessingStream && lp.plugin == nil {
+		return fmt.Errorf("plugin %s only implements xrpplugin.StreamingPlugin, which requires stream processing", lp.name)
 	}
-	return lp.plugin.ProcessXMLTree(ctx, url, doc)
+	return nil
+}
+
+// ProcessHTML runs the plugin against an HTML tree with the full processing context
+func (lp *LoadedPlugin) ProcessHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, node *html.Node) error {
+	if err := lp.checkProcessing(config.ProcessingTree); err != nil {
+		return err
+	}
+	return lp.plugin.ProcessHTML(ctx, pctx, node)
+}
+
+// ProcessXML runs the plugin against an XML document with the full processing context
+func (lp *LoadedPlugin) ProcessXML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, doc *etree.Document) error {
+	if err := lp.checkProcessing(config.ProcessingTree); err != nil {
+		return err
+	}
+	return lp.plugin.ProcessXML(ctx, pctx, doc)
+}
+
+// RewriteHTML registers the plugin's handlers for rewriting a streamed HTML response
+func (lp *LoadedPlugin) RewriteHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, rw *xrpPlugin.HTMLRewriter) error {
+	if err := lp.checkProcessing(config.ProcessingStream); err != nil {
+		return err
+	}
+	return lp.streaming.RewriteHTML(ctx, pctx, rw)
+}
+
+func (lp *LoadedPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	return lp.ProcessHTML(ctx, urlOnlyContext(url), node)
+}
+
+func (lp *LoadedPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return lp.ProcessXML(ctx, urlOnlyContext(url), doc)
+}
+
+// urlOnlyContext builds a ProcessingContext carrying only a request URL
+func urlOnlyContext(u *url.URL) *xrpPlugin.ProcessingContext {
+	return xrpPlugin.NewProcessingContext(&http.Request{URL: u}, "", 0, nil)
 }
 
 type Manager struct {
@@ -78,36 +208,122 @@ func New() (*Manager, error) {
 	}, nil
 }
 
-func (m *Manager) LoadPlugins(cfg *config.Config) error {
+func (m *Manager) LoadPlugins(cfg *config.Config) (err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	newPlugins := make(map[string]*LoadedPlugin)
 
-	for _, mimeTypeConfig := range cfg.MimeTypes {
+	// Plugins kept from the previous load are reconfigured once everything else
+	// has loaded, so a failed load leaves them as they were
+	type reconfiguration struct {
+		plugin  *LoadedPlugin
+		options json.RawMessage
+	}
+	var reused []reconfiguration
+
+	// Stop any remote plugins started for this load if it fails
+	var started []*LoadedPlugin
+	defer func() {
+		if err != nil {
+			for _, lp := range started {
+				lp.close()
+			}
+		}
+	}()
+
+	for _, mimeTypeConfig := range cfg.AllMimeTypes() {
 		for _, pluginConfig := range mimeTypeConfig.Plugins {
-			key := pluginConfig.Path + "/" + pluginConfig.Name
+			key := pluginConfig.ID()
+
+			if loaded, ok := newPlugins[key]; ok {
+				// A plugin shared by several MIME types must suit each of them
+				if err := loaded.checkProcessing(mimeTypeConfig.Processing); err != nil {
+					return fmt.Errorf("failed to load plugin %s: %w", key, err)
+				}
+				continue
+			}
 
-			if existing, exists := m.plugins[key]; exists {
+			if existing, exists := m.plugins[key]; exists && existing.canReuse(pluginConfig) {
+				if err := existing.checkProcessing(mimeTypeConfig.Processing); err != nil {
+					return fmt.Errorf("failed to load plugin %s: %w", key, err)
+				}
+				reused = append(reused, reconfiguration{plugin: existing, options: pluginConfig.Options})
 				newPlugins[key] = existing
 				continue
 			}
 
-			loadedPlugin, err := m.loadPlugin(pluginConfig.Path, pluginConfig.Name, mimeTypeConfig.MimeType)
+			var loadedPlugin *LoadedPlugin
+			var err error
+			if pluginConfig.IsRemote() {
+				loadedPlugin, err = m.loadRemotePlugin(pluginConfig)
+			} else {
+				loadedPlugin, err = m.loadPlugin(pluginConfig.Path, pluginConfig.Name, mimeTypeConfig.MimeType, pluginConfig.Options)
+			}
 			if err != nil {
 				return fmt.Errorf("failed to load plugin %s: %w", key, err)
 			}
 
+			started = append(started, loadedPlugin)
+			if err := loadedPlugin.checkProcessing(mimeTypeConfig.Processing); err != nil {
+				return fmt.Errorf("failed to load plugin %s: %w", key, err)
+			}
 			newPlugins[key] = loadedPlugin
 			slog.Info("Loaded plugin", "path", pluginConfig.Path, "name", pluginConfig.Name)
 		}
 	}
 
+	// Deliver the (possibly changed) options again. If a plugin rejects its new
+	// options, those already reconfigured get their previous options back.
+	for i, r := range reused {
+		if err := configurePlugin(r.plugin.instance, r.options); err != nil {
+			for _, done := range reused[:i] {
+				if restoreErr := configurePlugin(done.plugin.instance, done.plugin.options); restoreErr != nil {
+					slog.Error("Failed to restore plugin options", "path", done.plugin.path, "name", done.plugin.name, "error", restoreErr)
+				}
+			}
+			return fmt.Errorf("failed to reconfigure plugin %s/%s: %w", r.plugin.path, r.plugin.name, err)
+		}
+	}
+	for _, r := range reused {
+		r.plugin.options = r.options
+		r.plugin.resetFailures()
+	}
+
+	// Stop plugins that were removed or replaced
+	for key, lp := range m.plugins {
+		if newPlugins[key] != lp {
+			lp.close()
+		}
+	}
+
 	m.plugins = newPlugins
 	return nil
 }
 
-func (m *Manager) loadPlugin(path, name, mimeType string) (*LoadedPlugin, error) {
+// loadRemotePlugin starts an out-of-process plugin and delivers its options
+func (m *Manager) loadRemotePlugin(pluginConfig config.PluginConfig) (*LoadedPlugin, error) {
+	if pluginConfig.Type == config.PluginTypeExec {
+		if err := m.validatePluginSecurity(pluginConfig.Path); err != nil {
+			return nil, fmt.Errorf("plugin security validation failed: %w", err)
+		}
+	}
+
+	rp := newRemotePlugin(pluginConfig)
+	if err := configurePlugin(rp, pluginConfig.Options); err != nil {
+		_ = rp.Close()
+		return nil, err
+	}
+
+	loadedPlugin, err := newLoadedPlugin(pluginConfig.Path, pluginConfig.Name, rp)
+	if err != nil {
+		return nil, err
+	}
+	loadedPlugin.options = pluginConfig.Options
+	return loadedPlugin, nil
+}
+
+func (m *Manager) loadPlugin(path, name, mimeType string, options json.RawMessage) (*LoadedPlugin, error) {
 	// Validate plugin security first
 	if err := m.validatePluginSecurity(path); err != nil {
 		return nil, fmt.Errorf("plugin security validation failed: %w", err)
@@ -124,33 +340,66 @@ func (m *Manager) loadPlugin(path, name, mimeType string) (*LoadedPlugin, error)
 		return nil, fmt.Errorf("failed to find function '%s' in plugin: %w", name, err)
 	}
 
-	// Expect the symbol to be a GetPlugin function
-	getPluginFunc, ok := symbol.(func() xrpPlugin.Plugin)
-	if !ok {
-		return nil, fmt.Errorf("symbol '%s' is not a valid GetPlugin function, expected func() xrpplugin.Plugin", name)
+	// Expect the symbol to be a GetPlugin function returning either plugin interface
+	var pluginInstance any
+	switch getPluginFunc := symbol.(type) {
+	case func() xrpPlugin.PluginV2:
+		if instance := getPluginFunc(); instance != nil {
+			pluginInstance = instance
+		}
+	case func() xrpPlugin.Plugin:
+		if instance := getPluginFunc(); instance != nil {
+			pluginInstance = instance
+		}
+	case func() xrpPlugin.StreamingPlugin:
+		if instance := getPluginFunc(); instance != nil {
+			pluginInstance = instance
+		}
+	default:
+		return nil, fmt.Errorf("symbol '%s' is not a valid GetPlugin function, expected func() xrpplugin.Plugin, func() xrpplugin.PluginV2, or func() xrpplugin.StreamingPlugin", name)
 	}
-
-	// Call the function to get the plugin instance
-	pluginInstance := getPluginFunc()
 	if pluginInstance == nil {
 		return nil, fmt.Errorf("GetPlugin() function returned nil")
 	}
 
+	loadedPlugin, err := newLoadedPlugin(path, name, pluginInstance)
+	if err != nil {
+		return nil, err
+	}
+
 	// Simple validation - just ensure the plugin implements the interface
-	if err := m.validatePlugin(pluginInstance, mimeType); err != nil {
+	if err := m.validatePlugin(loadedPlugin.plugin, mimeType); err != nil {
 		return nil, fmt.Errorf("plugin validation failed: %w", err)
 	}
 
+	if err := configurePlugin(pluginInstance, options); err != nil {
+		return nil, err
+	}
+	loadedPlugin.options = options
+
 	slog.Info("Successfully loaded plugin", "path", path, "name", name)
 
-	return &LoadedPlugin{
-		plugin: pluginInstance,
-		path:   path,
-		name:   name,
-	}, nil
+	return loadedPlugin, nil
+}
+
+// configurePlugin passes options to plugins that implement xrpplugin.Configurable.
+// Plugins without options receive an empty JSON object.
+func configurePlugin(p any, options json.RawMessage) error {
+	configurable, ok := p.(xrpPlugin.Configurable)
+	if !ok {
+		return nil
+	}
+
+	if len(options) == 0 {
+		options = json.RawMessage("{}")
+	}
+	if err := configurable.Configure(options); err != nil {
+		return fmt.Errorf("plugin configuration failed: %w", err)
+	}
+	return nil
 }
 
-func (m *Manager) validatePlugin(p xrpPlugin.Plugin, mimeType string) error {
+func (m *Manager) validatePlugin(p xrpPlugin.PluginV2, mimeType string) error {
 	// Plugin validation passed - methods exist and have correct signatures
 	// We don't call the methods with nil values as this can cause panics
 	slog.Info("Plugin validation successful", "mimeType", mimeType)
@@ -231,3 +480,31 @@ func (m *Manager) GetPlugin(path, name string) *LoadedPlugin {
 	key := path + "/" + name
 	return m.plugins[key]
 }
+
+// Register adds an already-instantiated plugin under the given path and name.
+// The plugin must implement xrpplugin.Plugin, xrpplugin.PluginV2, or xrpplugin.StreamingPlugin.
+// It is intended for in-process plugins that are not loaded from a shared object,
+// such as those used in tests. Registered plugins are replaced on the next LoadPlugins.
+func (m *Manager) Register(path, name string, instance any) error {
+	loadedPlugin, err := newLoadedPlugin(path, name, instance)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.plugins[path+"/"+name] = loadedPlugin
+	return nil
+}
+
+// Close stops all remote plugins. The manager must not be used afterward.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, lp := range m.plugins {
+		lp.close()
+	}
+	m.plugins = make(map[string]*LoadedPlugin)
+}
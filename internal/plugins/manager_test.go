@@ -2,6 +2,9 @@ package plugins
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -12,6 +15,7 @@ import (
 
 	"github.com/beevik/etree"
 
+	"github.com/cdzombak/xrp/internal/config"
 	xrpPlugin "github.com/cdzombak/xrp/pkg/xrpplugin"
 )
 
@@ -83,7 +87,7 @@ func TestValidatePlugin(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := manager.validatePlugin(tt.plugin, tt.mimeType)
+			err := manager.validatePlugin(xrpPlugin.AdaptPlugin(tt.plugin), tt.mimeType)
 			if tt.expectError && err == nil {
 				t.Error("expected error but got none")
 			}
@@ -121,7 +125,7 @@ func TestGetPlugin(t *testing.T) {
 
 	// Add a mock plugin directly to test retrieval
 	mockPlugin := &LoadedPlugin{
-		plugin: &MockFullPlugin{},
+		plugin: xrpPlugin.AdaptPlugin(&MockFullPlugin{}),
 		path:   "/path/to/plugin.so",
 		name:   "TestPlugin",
 	}
@@ -137,6 +141,27 @@ func TestGetPlugin(t *testing.T) {
 	}
 }
 
+func TestRegister(t *testing.T) {
+	manager, _ := New()
+	mockPlugin := &MockFullPlugin{}
+
+	if err := manager.Register("builtin", "TestPlugin", mockPlugin); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plugin := manager.GetPlugin("builtin", "TestPlugin")
+	if plugin == nil {
+		t.Fatal("expected registered plugin but got nil")
+	}
+	if plugin.instance != mockPlugin {
+		t.Error("got different plugin than registered")
+	}
+
+	if err := manager.Register("builtin", "NotAPlugin", "nope"); err == nil {
+		t.Error("expected error registering a value that is not a plugin")
+	}
+}
+
 func TestLoadedPluginMethods(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -174,7 +199,7 @@ func TestLoadedPluginMethods(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			loadedPlugin := &LoadedPlugin{
-				plugin: tt.plugin,
+				plugin: xrpPlugin.AdaptPlugin(tt.plugin),
 				name:   "TestPlugin",
 			}
 
@@ -225,7 +250,7 @@ func TestPluginReceivesURL(t *testing.T) {
 
 	urlCapturingPlugin := &URLCapturingPlugin{}
 	loadedPlugin := &LoadedPlugin{
-		plugin: urlCapturingPlugin,
+		plugin: xrpPlugin.AdaptPlugin(urlCapturingPlugin),
 		name:   "URLTestPlugin",
 	}
 
@@ -447,3 +472,280 @@ func TestSimplifiedPluginLoading(t *testing.T) {
 		})
 	}
 }
+
+// MockConfigurablePlugin records the options it was configured with
+type MockConfigurablePlugin struct {
+	MockFullPlugin
+	Options  json.RawMessage
+	Calls    int
+	FailWith error
+}
+
+func (m *MockConfigurablePlugin) Configure(options json.RawMessage) error {
+	m.Calls++
+	m.Options = options
+	return m.FailWith
+}
+
+func TestConfigurePlugin(t *testing.T) {
+	// Plugins that don't implement Configurable are left alone
+	if err := configurePlugin(&MockFullPlugin{}, json.RawMessage(`{"a":1}`)); err != nil {
+		t.Errorf("unexpected error for non-configurable plugin: %v", err)
+	}
+
+	p := &MockConfigurablePlugin{}
+	if err := configurePlugin(p, json.RawMessage(`{"banner":"hi"}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(p.Options) != `{"banner":"hi"}` {
+		t.Errorf("expected options to be delivered, got %s", p.Options)
+	}
+
+	// Missing options are delivered as an empty object
+	if err := configurePlugin(p, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(p.Options) != "{}" {
+		t.Errorf("expected empty object, got %s", p.Options)
+	}
+
+	p.FailWith = errors.New("bad option")
+	err := configurePlugin(p, json.RawMessage(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "bad option") {
+		t.Errorf("expected configuration error, got %v", err)
+	}
+}
+
+func TestLoadPluginsReconfiguresExisting(t *testing.T) {
+	existing := &MockConfigurablePlugin{}
+	manager := &Manager{
+		plugins: map[string]*LoadedPlugin{
+			"./plugins/test.so/TestPlugin": {
+				plugin:   xrpPlugin.AdaptPlugin(existing),
+				instance: existing,
+				path:     "./plugins/test.so",
+				name:     "TestPlugin",
+			},
+		},
+	}
+
+	pluginConfig := config.PluginConfig{
+		Path:    "./plugins/test.so",
+		Name:    "TestPlugin",
+		Options: json.RawMessage(`{"version":2}`),
+	}
+	cfg := &config.Config{
+		MimeTypes: []config.MimeTypeConfig{
+			{MimeType: "text/html", Plugins: []config.PluginConfig{pluginConfig}},
+			{MimeType: "application/xhtml+xml", Plugins: []config.PluginConfig{pluginConfig}},
+		},
+	}
+
+	if err := manager.LoadPlugins(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if existing.Calls != 1 {
+		t.Errorf("expected Configure to be called once, got %d", existing.Calls)
+	}
+	if string(existing.Options) != `{"version":2}` {
+		t.Errorf("expected new options on reload, got %s", existing.Options)
+	}
+
+	// A Configure error fails the reload and keeps the previous plugin set
+	existing.FailWith = errors.New("invalid version")
+	if err := manager.LoadPlugins(cfg); err == nil {
+		t.Error("expected reload to fail when Configure fails")
+	}
+	if manager.GetPlugin("./plugins/test.so", "TestPlugin") == nil {
+		t.Error("expected previous plugin to remain loaded after failed reload")
+	}
+}
+
+// TestLoadPluginsFailedReload tests that a failed reload leaves reused plugins
+// with their previous options and failure state
+func TestLoadPluginsFailedReload(t *testing.T) {
+	first := &MockConfigurablePlugin{Options: json.RawMessage(`{"version":1}`)}
+	second := &MockConfigurablePlugin{Options: json.RawMessage(`{"version":1}`)}
+	manager := &Manager{plugins: make(map[string]*LoadedPlugin)}
+	for name, instance := range map[string]*MockConfigurablePlugin{"First": first, "Second": second} {
+		lp, err := newLoadedPlugin("./plugins/test.so", name, instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lp.options = instance.Options
+		manager.plugins[lp.path+"/"+name] = lp
+	}
+	disabled := manager.GetPlugin("./plugins/test.so", "First")
+	disabled.RecordFailure(1)
+
+	newOptions := json.RawMessage(`{"version":2}`)
+	cfg := &config.Config{
+		MimeTypes: []config.MimeTypeConfig{{MimeType: "text/html", Plugins: []config.PluginConfig{
+			{Path: "./plugins/test.so", Name: "First", Options: newOptions},
+			{Path: "./plugins/test.so", Name: "Second", Options: newOptions},
+			{Path: "./plugins/missing.so", Name: "GetPlugin"},
+		}}},
+	}
+
+	// A plugin that fails to load fails the reload before anything is reconfigured
+	if err := manager.LoadPlugins(cfg); err == nil {
+		t.Fatal("expected reload to fail when a plugin can't be loaded")
+	}
+	if first.Calls != 0 || second.Calls != 0 {
+		t.Errorf("expected reused plugins not to be reconfigured, got %d and %d calls", first.Calls, second.Calls)
+	}
+	if !disabled.Disabled() {
+		t.Error("expected disabled plugin to stay disabled after failed reload")
+	}
+
+	// A plugin that rejects its options restores those reconfigured before it
+	cfg.MimeTypes[0].Plugins = cfg.MimeTypes[0].Plugins[:2]
+	second.FailWith = errors.New("invalid version")
+	if err := manager.LoadPlugins(cfg); err == nil {
+		t.Fatal("expected reload to fail when Configure fails")
+	}
+	if first.Calls != 2 || string(first.Options) != `{"version":1}` {
+		t.Errorf("expected previous options to be restored, got %s after %d calls", first.Options, first.Calls)
+	}
+	if !disabled.Disabled() {
+		t.Error("expected disabled plugin to stay disabled after failed reload")
+	}
+
+	second.FailWith = nil
+	if err := manager.LoadPlugins(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(first.Options) != `{"version":2}` || string(second.Options) != `{"version":2}` || disabled.Disabled() {
+		t.Error("expected a successful reload to reconfigure and re-enable plugins")
+	}
+}
+
+// MockV2Plugin records the processing context it receives and sets a response header
+type MockV2Plugin struct {
+	Context *xrpPlugin.ProcessingContext
+}
+
+func (m *MockV2Plugin) ProcessHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, node *html.Node) error {
+	m.Context = pctx
+	pctx.ResponseHeader().Set("X-Bucket", "b")
+	return nil
+}
+
+func (m *MockV2Plugin) ProcessXML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, doc *etree.Document) error {
+	m.Context = pctx
+	return nil
+}
+
+func TestNewLoadedPlugin(t *testing.T) {
+	v2 := &MockV2Plugin{}
+	loaded, err := newLoadedPlugin("builtin", "V2Plugin", v2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded.plugin != v2 {
+		t.Error("expected PluginV2 to be used directly")
+	}
+
+	loaded, err = newLoadedPlugin("builtin", "V1Plugin", &MockFullPlugin{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := loaded.plugin.(interface{ Unwrap() xrpPlugin.Plugin }); !ok {
+		t.Error("expected Plugin to be wrapped in an adapter")
+	}
+
+	if _, err := newLoadedPlugin("builtin", "Invalid", struct{}{}); err == nil {
+		t.Error("expected error for value implementing neither interface")
+	}
+}
+
+// MockStreamingPlugin only implements StreamingPlugin
+type MockStreamingPlugin struct{}
+
+func (m *MockStreamingPlugin) RewriteHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, rw *xrpPlugin.HTMLRewriter) error {
+	return rw.OnElement("p", func(el *xrpPlugin.Element) error { return nil })
+}
+
+func TestLoadedStreamingPlugin(t *testing.T) {
+	loaded, err := newLoadedPlugin("builtin", "StreamPlugin", &MockStreamingPlugin{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !loaded.Streaming() {
+		t.Error("expected plugin to be detected as streaming")
+	}
+	if err := loaded.RewriteHTML(context.Background(), nil, xrpPlugin.NewHTMLRewriter()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := loaded.ProcessHTML(context.Background(), nil, nil); err == nil {
+		t.Error("expected streaming-only plugin to refuse tree processing")
+	}
+	if err := loaded.checkProcessing(config.ProcessingTree); err == nil {
+		t.Error("expected streaming-only plugin to be rejected for tree processing")
+	}
+
+	tree, _ := newLoadedPlugin("builtin", "TreePlugin", &MockFullPlugin{})
+	if tree.Streaming() {
+		t.Error("expected tree plugin not to be streaming")
+	}
+	if err := tree.checkProcessing(config.ProcessingStream); err == nil {
+		t.Error("expected tree plugin to be rejected for stream processing")
+	}
+}
+
+func TestLoadedPluginProcessingContext(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.com/page?x=1", nil)
+	req.AddCookie(&http.Cookie{Name: "ab", Value: "b"})
+	responseHeader := make(http.Header)
+	pctx := xrpPlugin.NewProcessingContext(req, "192.0.2.1", 200, responseHeader)
+
+	// PluginV2 receives the full context and may set response headers
+	v2 := &MockV2Plugin{}
+	loaded, _ := newLoadedPlugin("builtin", "V2Plugin", v2)
+	if err := loaded.ProcessHTML(context.Background(), pctx, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v2.Context.ClientIP() != "192.0.2.1" {
+		t.Errorf("expected client IP to be passed, got %q", v2.Context.ClientIP())
+	}
+	if responseHeader.Get("X-Bucket") != "b" {
+		t.Error("expected plugin header change to reach the response header map")
+	}
+
+	// Plugin receives the request URL through the adapter
+	v1 := &URLCapturingPlugin{}
+	loaded, _ = newLoadedPlugin("builtin", "V1Plugin", v1)
+	if err := loaded.ProcessHTML(context.Background(), pctx, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v1.CapturedURL == nil || v1.CapturedURL.String() != "https://example.com/page?x=1" {
+		t.Errorf("expected adapted plugin to receive request URL, got %v", v1.CapturedURL)
+	}
+}
+
+func TestLoadedPluginFailureTracking(t *testing.T) {
+	lp, err := newLoadedPlugin("builtin", "FlakyPlugin", &MockFullPlugin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lp.RecordFailure(0) || lp.RecordFailure(0) || lp.Disabled() {
+		t.Error("expected a limit of 0 to never disable the plugin")
+	}
+
+	lp.RecordSuccess()
+	if lp.RecordFailure(2) {
+		t.Error("expected the first failure after a success not to disable the plugin")
+	}
+	if !lp.RecordFailure(2) || !lp.Disabled() {
+		t.Error("expected the second consecutive failure to disable the plugin")
+	}
+	if lp.RecordFailure(2) {
+		t.Error("expected RecordFailure to report disabling only once")
+	}
+
+	lp.resetFailures()
+	if lp.Disabled() {
+		t.Error("expected reset to re-enable the plugin")
+	}
+}
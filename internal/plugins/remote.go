@@ -0,0 +1,446 @@
+// This file implements out-of-process plugins. Remote plugins run as a subprocess
+// (exec) or behind a Unix socket (socket) and speak the xrpremote protocol. Several
+// calls may run at once, each over its own process or connection. Each call is
+// bounded by a timeout; a plugin process that crashes, hangs, or misbehaves is
+// killed and transparently restarted on the next call.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
+
+	"github.com/cdzombak/xrp/internal/config"
+	xrpPlugin "github.com/cdzombak/xrp/pkg/xrpplugin"
+	"github.com/cdzombak/xrp/pkg/xrpremote"
+)
+
+// remotePlugin is an xrpplugin.PluginV2 backed by an out-of-process plugin. It
+// keeps up to concurrency connections (processes, for exec plugins), started as
+// calls need them; each call has a connection to itself.
+type remotePlugin struct {
+	config  config.PluginConfig
+	kind    string
+	path    string
+	name    string
+	args    []string
+	timeout time.Duration
+
+	// slots is a semaphore bounding the calls in progress, and with them the
+	// connections, so callers waiting for one can give up when their context is done
+	slots chan struct{}
+	// idle holds the connections not in use
+	idle chan *remoteConn
+
+	mu sync.Mutex
+	// options are sent to each connection before its first call. version counts
+	// changes to them, so connections configured earlier are brought up to date.
+	options json.RawMessage
+	version uint64
+	closed  bool
+}
+
+// remoteConn is a live connection to a plugin process or socket. It is used by one
+// call at a time.
+type remoteConn struct {
+	cmd *exec.Cmd // nil for socket plugins
+	// closers close the connection's stdin and stdout, or its socket
+	closers []io.Closer
+	encoder *json.Encoder
+	replies chan remoteReply
+	// done is closed to stop the reader goroutine, which closes readerDone on exit
+	done       chan struct{}
+	readerDone chan struct{}
+	nextID     uint64
+	// configured is set once the connection has been sent the options of version
+	configured bool
+	version    uint64
+	closed     bool
+}
+
+type remoteReply struct {
+	resp *xrpremote.Response
+	err  error
+}
+
+func newRemotePlugin(pluginConfig config.PluginConfig) *remotePlugin {
+	timeout := time.Duration(pluginConfig.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	concurrency := pluginConfig.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	return &remotePlugin{
+		config:  pluginConfig,
+		kind:    pluginConfig.Type,
+		path:    pluginConfig.Path,
+		name:    pluginConfig.Name,
+		args:    pluginConfig.Args,
+		timeout: timeout,
+		slots:   make(chan struct{}, concurrency),
+		idle:    make(chan *remoteConn, concurrency),
+	}
+}
+
+// acquire takes an idle connection, or starts one if none is idle, giving up when
+// ctx is done. The connection has been sent the plugin's current options.
+func (rp *remotePlugin) acquire(ctx context.Context) (*remoteConn, error) {
+	select {
+	case rp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		<-rp.slots
+		return nil, err
+	}
+
+	rp.mu.Lock()
+	closed, options, version := rp.closed, rp.options, rp.version
+	rp.mu.Unlock()
+	if closed {
+		<-rp.slots
+		return nil, fmt.Errorf("remote plugin %s: closed", rp.name)
+	}
+
+	var conn *remoteConn
+	select {
+	case conn = <-rp.idle:
+	default:
+		var err error
+		if conn, err = rp.connect(); err != nil {
+			<-rp.slots
+			return nil, err
+		}
+	}
+
+	if !conn.configured || conn.version != version {
+		if len(options) == 0 {
+			options = json.RawMessage("{}")
+		}
+		if _, err := rp.roundTrip(ctx, conn, &xrpremote.Request{Type: xrpremote.TypeConfigure, Options: options}); err != nil {
+			// A plugin that rejected its options is in an unknown state
+			rp.disconnect(conn)
+			rp.release(conn)
+			return nil, fmt.Errorf("plugin configuration failed: %w", err)
+		}
+		conn.configured, conn.version = true, version
+	}
+	return conn, nil
+}
+
+// release makes conn idle again, unless it was closed or the plugin was, and frees
+// its slot. Connections are made idle before their slot is freed, so a caller
+// that takes the slot finds them.
+func (rp *remotePlugin) release(conn *remoteConn) {
+	rp.mu.Lock()
+	if rp.closed {
+		rp.disconnect(conn)
+	} else if !conn.closed {
+		rp.idle <- conn
+	}
+	rp.mu.Unlock()
+	<-rp.slots
+}
+
+// sameProcess reports whether pluginConfig can be served by this plugin's process;
+// only options may differ
+func (rp *remotePlugin) sameProcess(pluginConfig config.PluginConfig) bool {
+	return rp.config.Type == pluginConfig.Type &&
+		rp.config.TimeoutMS == pluginConfig.TimeoutMS &&
+		rp.config.Concurrency == pluginConfig.Concurrency &&
+		slices.Equal(rp.config.Args, pluginConfig.Args)
+}
+
+// Configure stores the plugin's options and delivers them over one connection,
+// starting the plugin if needed; other connections receive them before their next
+// call. If the plugin rejects them, the previous options are kept.
+// Options are re-sent automatically whenever the plugin is restarted.
+func (rp *remotePlugin) Configure(options json.RawMessage) error {
+	rp.mu.Lock()
+	previous := rp.options
+	rp.options = options
+	rp.version++
+	rp.mu.Unlock()
+
+	conn, err := rp.acquire(context.Background())
+	if err != nil {
+		rp.mu.Lock()
+		rp.options = previous
+		rp.version++
+		rp.mu.Unlock()
+		return err
+	}
+	rp.release(conn)
+	return nil
+}
+
+func (rp *remotePlugin) ProcessHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, node *html.Node) error {
+	var buf bytes.Buffer
+	if err := html.Render(&buf, node); err != nil {
+		return fmt.Errorf("failed to render HTML for remote plugin: %w", err)
+	}
+
+	document, err := rp.process(ctx, pctx, xrpremote.DocumentHTML, buf.String())
+	if err != nil {
+		return err
+	}
+
+	newDoc, err := html.Parse(bytes.NewReader([]byte(document)))
+	if err != nil {
+		return fmt.Errorf("failed to parse HTML from remote plugin: %w", err)
+	}
+
+	// Replace the tree's contents in place
+	for child := node.FirstChild; child != nil; child = node.FirstChild {
+		node.RemoveChild(child)
+	}
+	for child := newDoc.FirstChild; child != nil; child = newDoc.FirstChild {
+		newDoc.RemoveChild(child)
+		node.AppendChild(child)
+	}
+	return nil
+}
+
+func (rp *remotePlugin) ProcessXML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, doc *etree.Document) error {
+	input, err := doc.WriteToString()
+	if err != nil {
+		return fmt.Errorf("failed to serialize XML for remote plugin: %w", err)
+	}
+
+	document, err := rp.process(ctx, pctx, xrpremote.DocumentXML, input)
+	if err != nil {
+		return err
+	}
+
+	newDoc := etree.NewDocument()
+	if err := newDoc.ReadFromString(document); err != nil {
+		return fmt.Errorf("failed to parse XML from remote plugin: %w", err)
+	}
+
+	// Replace the document's contents in place
+	for len(doc.Child) > 0 {
+		doc.RemoveChildAt(0)
+	}
+	for _, token := range append([]etree.Token(nil), newDoc.Child...) {
+		doc.AddChild(token)
+	}
+	return nil
+}
+
+func (rp *remotePlugin) process(ctx context.Context, pctx *xrpPlugin.ProcessingContext, documentType, document string) (string, error) {
+	req := &xrpremote.Request{
+		Type:         xrpremote.TypeProcess,
+		DocumentType: documentType,
+		Document:     document,
+		Request: &xrpremote.RequestMetadata{
+			Method:   pctx.Method(),
+			URL:      pctx.URL().String(),
+			Host:     pctx.Host(),
+			Header:   pctx.RequestHeaders(),
+			ClientIP: pctx.ClientIP(),
+		},
+		StatusCode:     pctx.StatusCode(),
+		ResponseHeader: pctx.ResponseHeader(),
+	}
+
+	conn, err := rp.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer rp.release(conn)
+
+	resp, err := rp.roundTrip(ctx, conn, req)
+	if err != nil {
+		return "", err
+	}
+
+	// A plugin that returns a header map returns the complete map; mirror it onto the
+	// live response headers. Without one, the headers are left as they were.
+	if resp.ResponseHeader != nil {
+		responseHeader := pctx.ResponseHeader()
+		for key := range responseHeader {
+			if _, ok := resp.ResponseHeader[key]; !ok {
+				delete(responseHeader, key)
+			}
+		}
+		for key, values := range resp.ResponseHeader {
+			responseHeader[key] = values
+		}
+	}
+
+	return resp.Document, nil
+}
+
+// connect starts a plugin process (or dials the plugin's socket)
+func (rp *remotePlugin) connect() (*remoteConn, error) {
+	conn := &remoteConn{
+		replies:    make(chan remoteReply),
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+	}
+	var reader io.Reader
+
+	switch rp.kind {
+	case config.PluginTypeExec:
+		cmd := exec.Command(rp.path, rp.args...)
+		cmd.Stderr = os.Stderr
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+		}
+		// XRP owns the stdout pipe rather than using cmd.StdoutPipe, so the reader
+		// goroutine may still be reading it when the process is waited for
+		stdout, stdoutWriter, err := os.Pipe()
+		if err != nil {
+			_ = stdin.Close()
+			return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+		}
+		cmd.Stdout = stdoutWriter
+		err = cmd.Start()
+		_ = stdoutWriter.Close()
+		if err != nil {
+			_ = stdin.Close()
+			_ = stdout.Close()
+			return nil, fmt.Errorf("failed to start plugin process: %w", err)
+		}
+
+		conn.cmd = cmd
+		conn.closers = []io.Closer{stdin, stdout}
+		conn.encoder = json.NewEncoder(stdin)
+		reader = stdout
+	case config.PluginTypeSocket:
+		netConn, err := net.DialTimeout("unix", rp.path, rp.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to plugin socket: %w", err)
+		}
+
+		conn.closers = []io.Closer{netConn}
+		conn.encoder = json.NewEncoder(netConn)
+		reader = netConn
+	default:
+		return nil, fmt.Errorf("unsupported remote plugin type %q", rp.kind)
+	}
+
+	// Replies are read by a dedicated goroutine so calls can time out
+	go func() {
+		defer close(conn.readerDone)
+		decoder := json.NewDecoder(reader)
+		for {
+			var reply remoteReply
+			var resp xrpremote.Response
+			if err := decoder.Decode(&resp); err != nil {
+				reply.err = err
+			} else {
+				reply.resp = &resp
+			}
+
+			select {
+			case conn.replies <- reply:
+			case <-conn.done:
+				return
+			}
+			if reply.err != nil {
+				return
+			}
+		}
+	}()
+
+	slog.Info("Started remote plugin", "type", rp.kind, "path", rp.path, "name", rp.name)
+	return conn, nil
+}
+
+// roundTrip sends a request over conn and waits for its reply, until the plugin's
+// timeout or until ctx is done. Transport failures, timeouts, and cancellations
+// close the connection, so the plugin is restarted when a connection is next needed.
+func (rp *remotePlugin) roundTrip(ctx context.Context, conn *remoteConn, req *xrpremote.Request) (*xrpremote.Response, error) {
+	conn.nextID++
+	req.ID = conn.nextID
+
+	if err := conn.encoder.Encode(req); err != nil {
+		rp.disconnect(conn)
+		return nil, fmt.Errorf("remote plugin %s: failed to send request: %w", rp.name, err)
+	}
+
+	timer := time.NewTimer(rp.timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-conn.replies:
+		if reply.err != nil {
+			rp.disconnect(conn)
+			return nil, fmt.Errorf("remote plugin %s: connection lost", rp.name)
+		}
+		if reply.resp.ID != req.ID {
+			rp.disconnect(conn)
+			return nil, fmt.Errorf("remote plugin %s: protocol error: expected reply %d, got %d", rp.name, req.ID, reply.resp.ID)
+		}
+		if reply.resp.Error != "" {
+			return nil, errors.New(reply.resp.Error)
+		}
+		return reply.resp, nil
+	case <-timer.C:
+		rp.disconnect(conn)
+		return nil, fmt.Errorf("remote plugin %s: timed out after %s", rp.name, rp.timeout)
+	case <-ctx.Done():
+		// The reply can't be told apart from the next call's, so the connection goes
+		rp.disconnect(conn)
+		return nil, fmt.Errorf("remote plugin %s: %w", rp.name, ctx.Err())
+	}
+}
+
+// disconnect kills the plugin process or closes its socket
+func (rp *remotePlugin) disconnect(conn *remoteConn) {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+
+	// Closing the connection stops the reader goroutine before the process is
+	// waited for
+	close(conn.done)
+	for _, closer := range conn.closers {
+		_ = closer.Close()
+	}
+	<-conn.readerDone
+	if conn.cmd != nil {
+		_ = conn.cmd.Process.Kill()
+		_ = conn.cmd.Wait()
+	}
+	slog.Info("Stopped remote plugin", "type", rp.kind, "path", rp.path, "name", rp.name)
+}
+
+// Close stops the plugin's idle processes or connections. Those in use are stopped
+// when their calls finish.
+func (rp *remotePlugin) Close() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	rp.closed = true
+	for {
+		select {
+		case conn := <-rp.idle:
+			rp.disconnect(conn)
+		default:
+			return nil
+		}
+	}
+}
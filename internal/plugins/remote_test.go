@@ -0,0 +1,457 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
+
+	"github.com/cdzombak/xrp/internal/config"
+	xrpPlugin "github.com/cdzombak/xrp/pkg/xrpplugin"
+	"github.com/cdzombak/xrp/pkg/xrpremote"
+)
+
+// helperRemotePlugin is served by the test binary itself when re-executed as a plugin process
+type helperRemotePlugin struct {
+	Greeting string `json:"greeting"`
+}
+
+func (h *helperRemotePlugin) Configure(options json.RawMessage) error {
+	if err := json.Unmarshal(options, h); err != nil {
+		return err
+	}
+	if h.Greeting == "invalid" {
+		return errors.New("invalid greeting")
+	}
+	return nil
+}
+
+func (h *helperRemotePlugin) ProcessHTML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, node *html.Node) error {
+	switch pctx.URL().Path {
+	case "/slow":
+		time.Sleep(2 * time.Second)
+	case "/crash":
+		os.Exit(3)
+	case "/fail":
+		return errors.New("plugin refused")
+	}
+
+	pctx.ResponseHeader().Set("X-Remote", "yes")
+	pctx.ResponseHeader().Del("X-Remove-Me")
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: h.Greeting + " " + pctx.ClientIP()})
+	return nil
+}
+
+func (h *helperRemotePlugin) ProcessXML(ctx context.Context, pctx *xrpPlugin.ProcessingContext, doc *etree.Document) error {
+	doc.Root().CreateAttr("greeting", h.Greeting)
+	return nil
+}
+
+// TestHelperRemotePlugin is not a real test; it runs the helper plugin when the
+// test binary is launched as an exec plugin.
+func TestHelperRemotePlugin(t *testing.T) {
+	if os.Getenv("XRP_WANT_HELPER_PLUGIN") != "1" {
+		return
+	}
+	if err := xrpremote.Serve(&helperRemotePlugin{}); err != nil {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func newHelperExecPlugin(t *testing.T, timeoutMS int) *remotePlugin {
+	t.Helper()
+	t.Setenv("XRP_WANT_HELPER_PLUGIN", "1")
+
+	rp := newRemotePlugin(config.PluginConfig{
+		Type:      config.PluginTypeExec,
+		Path:      os.Args[0],
+		Name:      "HelperPlugin",
+		Args:      []string{"-test.run=^TestHelperRemotePlugin$"},
+		TimeoutMS: timeoutMS,
+	})
+	t.Cleanup(func() { _ = rp.Close() })
+	return rp
+}
+
+// idleConns returns the plugin's idle connections, leaving them idle
+func idleConns(rp *remotePlugin) []*remoteConn {
+	var conns []*remoteConn
+	for len(rp.idle) > 0 {
+		conns = append(conns, <-rp.idle)
+	}
+	for _, conn := range conns {
+		rp.idle <- conn
+	}
+	return conns
+}
+
+func newTestContext(path string) *xrpPlugin.ProcessingContext {
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: path}, Header: make(http.Header)}
+	header := make(http.Header)
+	header.Set("X-Remove-Me", "1")
+	return xrpPlugin.NewProcessingContext(req, "203.0.113.9", 200, header)
+}
+
+func TestRemotePluginExec_ProcessHTML(t *testing.T) {
+	rp := newHelperExecPlugin(t, 5000)
+	if err := rp.Configure(json.RawMessage(`{"greeting":"hello"}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	node, _ := html.Parse(strings.NewReader("<html><body><p>hi</p></body></html>"))
+	pctx := newTestContext("/page")
+	if err := rp.ProcessHTML(context.Background(), pctx, node); err != nil {
+		t.Fatalf("ProcessHTML failed: %v", err)
+	}
+
+	var buf strings.Builder
+	_ = html.Render(&buf, node)
+	if !strings.Contains(buf.String(), "<!--hello 203.0.113.9-->") || !strings.Contains(buf.String(), "<p>hi</p>") {
+		t.Errorf("expected tree to be replaced with remote output, got %s", buf.String())
+	}
+	if pctx.ResponseHeader().Get("X-Remote") != "yes" {
+		t.Error("expected header set by remote plugin")
+	}
+	if pctx.ResponseHeader().Get("X-Remove-Me") != "" {
+		t.Error("expected header removed by remote plugin to be deleted")
+	}
+
+	// Plugin errors are returned without restarting the process
+	conns := idleConns(rp)
+	if err := rp.ProcessHTML(context.Background(), newTestContext("/fail"), node); err == nil || err.Error() != "plugin refused" {
+		t.Errorf("expected plugin error, got %v", err)
+	}
+	if after := idleConns(rp); len(conns) != 1 || len(after) != 1 || after[0] != conns[0] {
+		t.Error("expected plugin process to survive a plugin error")
+	}
+}
+
+func TestRemotePluginExec_ProcessXML(t *testing.T) {
+	rp := newHelperExecPlugin(t, 5000)
+	if err := rp.Configure(json.RawMessage(`{"greeting":"hi"}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	_ = doc.ReadFromString(`<rss><channel/></rss>`)
+	if err := rp.ProcessXML(context.Background(), newTestContext("/feed"), doc); err != nil {
+		t.Fatalf("ProcessXML failed: %v", err)
+	}
+
+	if doc.Root() == nil || doc.Root().SelectAttrValue("greeting", "") != "hi" {
+		output, _ := doc.WriteToString()
+		t.Errorf("expected XML to be replaced with remote output, got %s", output)
+	}
+}
+
+func TestRemotePluginExec_ConfigureError(t *testing.T) {
+	rp := newHelperExecPlugin(t, 5000)
+	err := rp.Configure(json.RawMessage(`{"greeting":"invalid"}`))
+	if err == nil || !strings.Contains(err.Error(), "invalid greeting") {
+		t.Errorf("expected configuration error, got %v", err)
+	}
+	if len(idleConns(rp)) != 0 {
+		t.Error("expected plugin process to be stopped after configuration failure")
+	}
+}
+
+func TestRemotePluginExec_TimeoutAndRestart(t *testing.T) {
+	rp := newHelperExecPlugin(t, 300)
+	if err := rp.Configure(json.RawMessage(`{"greeting":"again"}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	err := rp.ProcessHTML(context.Background(), newTestContext("/slow"), node)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if len(idleConns(rp)) != 0 {
+		t.Fatal("expected timed-out plugin process to be stopped")
+	}
+
+	// The next call restarts the process and re-sends the options
+	if err := rp.ProcessHTML(context.Background(), newTestContext("/page"), node); err != nil {
+		t.Fatalf("expected restarted plugin to succeed, got %v", err)
+	}
+	var buf strings.Builder
+	_ = html.Render(&buf, node)
+	if !strings.Contains(buf.String(), "<!--again ") {
+		t.Errorf("expected options to be re-sent after restart, got %s", buf.String())
+	}
+}
+
+func TestRemotePluginExec_CrashAndRestart(t *testing.T) {
+	rp := newHelperExecPlugin(t, 5000)
+	if err := rp.Configure(json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	err := rp.ProcessHTML(context.Background(), newTestContext("/crash"), node)
+	if err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Fatalf("expected connection lost error, got %v", err)
+	}
+
+	if err := rp.ProcessHTML(context.Background(), newTestContext("/page"), node); err != nil {
+		t.Fatalf("expected restarted plugin to succeed, got %v", err)
+	}
+}
+
+func TestRemotePluginSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "plugin.sock")
+	go func() {
+		_ = xrpremote.ListenAndServe(socketPath, &helperRemotePlugin{})
+	}()
+
+	// Wait for the listener to come up
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("plugin socket was not created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rp := newRemotePlugin(config.PluginConfig{
+		Type: config.PluginTypeSocket,
+		Path: socketPath,
+		Name: "SocketPlugin",
+	})
+	defer func() { _ = rp.Close() }()
+
+	if err := rp.Configure(json.RawMessage(`{"greeting":"socket"}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	if err := rp.ProcessHTML(context.Background(), newTestContext("/page"), node); err != nil {
+		t.Fatalf("ProcessHTML failed: %v", err)
+	}
+	var buf strings.Builder
+	_ = html.Render(&buf, node)
+	if !strings.Contains(buf.String(), "<!--socket ") {
+		t.Errorf("expected socket plugin output, got %s", buf.String())
+	}
+}
+
+// serveRawSocket serves the remote plugin protocol on a Unix socket, answering each
+// request with reply, and returns the socket's path
+func serveRawSocket(t *testing.T, reply func(req *xrpremote.Request) *xrpremote.Response) string {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "raw.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				decoder := json.NewDecoder(conn)
+				encoder := json.NewEncoder(conn)
+				for {
+					var req xrpremote.Request
+					if err := decoder.Decode(&req); err != nil {
+						return
+					}
+					resp := reply(&req)
+					if resp == nil {
+						continue
+					}
+					resp.ID = req.ID
+					if err := encoder.Encode(resp); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return socketPath
+}
+
+func TestRemotePlugin_ReplyWithoutHeaders(t *testing.T) {
+	socketPath := serveRawSocket(t, func(req *xrpremote.Request) *xrpremote.Response {
+		return &xrpremote.Response{Document: req.Document}
+	})
+	rp := newRemotePlugin(config.PluginConfig{Type: config.PluginTypeSocket, Path: socketPath, Name: "RawPlugin"})
+	defer func() { _ = rp.Close() }()
+
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	pctx := newTestContext("/page")
+	if err := rp.ProcessHTML(context.Background(), pctx, node); err != nil {
+		t.Fatalf("ProcessHTML failed: %v", err)
+	}
+	if pctx.ResponseHeader().Get("X-Remove-Me") != "1" {
+		t.Errorf("expected headers to be left unchanged by a reply without headers, got %v", pctx.ResponseHeader())
+	}
+}
+
+func TestRemotePlugin_WaitHonorsContext(t *testing.T) {
+	socketPath := serveRawSocket(t, func(req *xrpremote.Request) *xrpremote.Response {
+		if req.Type == xrpremote.TypeProcess && strings.HasSuffix(req.Request.URL, "/hang") {
+			return nil
+		}
+		return &xrpremote.Response{Document: req.Document}
+	})
+	rp := newRemotePlugin(config.PluginConfig{Type: config.PluginTypeSocket, Path: socketPath, Name: "RawPlugin", TimeoutMS: 1000, Concurrency: 1})
+	defer func() { _ = rp.Close() }()
+	if err := rp.Configure(json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	// The first call holds the plugin's only connection until it times out
+	hung := make(chan error, 1)
+	go func() {
+		node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+		hung <- rp.ProcessHTML(context.Background(), newTestContext("/hang"), node)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	start := time.Now()
+	err := rp.ProcessHTML(ctx, newTestContext("/page"), node)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the waiting call to give up with its context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the waiting call to return when its context expired, took %s", elapsed)
+	}
+
+	select {
+	case err := <-hung:
+		t.Errorf("expected the first call to still be waiting, got %v", err)
+	default:
+	}
+}
+
+func TestRemotePlugin_CallHonorsContext(t *testing.T) {
+	socketPath := serveRawSocket(t, func(req *xrpremote.Request) *xrpremote.Response {
+		if req.Type == xrpremote.TypeProcess && strings.HasSuffix(req.Request.URL, "/hang") {
+			return nil
+		}
+		return &xrpremote.Response{Document: req.Document}
+	})
+	rp := newRemotePlugin(config.PluginConfig{Type: config.PluginTypeSocket, Path: socketPath, Name: "RawPlugin", TimeoutMS: 5000})
+	defer func() { _ = rp.Close() }()
+	if err := rp.Configure(json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	// A call whose context ends while the plugin is working returns right away
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+	start := time.Now()
+	err := rp.ProcessHTML(ctx, newTestContext("/hang"), node)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the call to give up with its context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the call to return when its context expired, took %s", elapsed)
+	}
+
+	// The abandoned connection is replaced for the next call
+	if err := rp.ProcessHTML(context.Background(), newTestContext("/page"), node); err != nil {
+		t.Errorf("expected the next call to succeed, got %v", err)
+	}
+}
+
+func TestRemotePlugin_Concurrency(t *testing.T) {
+	var configures atomic.Int32
+	socketPath := serveRawSocket(t, func(req *xrpremote.Request) *xrpremote.Response {
+		if req.Type == xrpremote.TypeConfigure {
+			configures.Add(1)
+		} else {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return &xrpremote.Response{Document: req.Document}
+	})
+	rp := newRemotePlugin(config.PluginConfig{Type: config.PluginTypeSocket, Path: socketPath, Name: "RawPlugin", Concurrency: 3})
+	defer func() { _ = rp.Close() }()
+
+	// Calls run side by side, each over its own connection
+	process := func(n int) time.Duration {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				node, _ := html.Parse(strings.NewReader("<html><body></body></html>"))
+				if err := rp.ProcessHTML(context.Background(), newTestContext("/page"), node); err != nil {
+					t.Errorf("ProcessHTML failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+	if elapsed := process(3); elapsed > 800*time.Millisecond {
+		t.Errorf("expected 3 calls to run concurrently, took %s", elapsed)
+	}
+	if conns := len(idleConns(rp)); conns != 3 || configures.Load() != 3 {
+		t.Errorf("expected 3 configured connections, got %d with %d configure requests", conns, configures.Load())
+	}
+
+	// Connections are reused, up to the limit
+	if elapsed := process(6); elapsed < 550*time.Millisecond {
+		t.Errorf("expected calls beyond the limit to wait, took %s", elapsed)
+	}
+	if conns := len(idleConns(rp)); conns != 3 {
+		t.Errorf("expected at most 3 connections, got %d", conns)
+	}
+
+	// New options reach every connection before its next call
+	if err := rp.Configure(json.RawMessage(`{"v":2}`)); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	process(3)
+	if configures.Load() != 6 {
+		t.Errorf("expected each connection to be reconfigured once, got %d configure requests", configures.Load())
+	}
+}
+
+func TestLoadedPluginCanReuse(t *testing.T) {
+	goPlugin, _ := newLoadedPlugin("./plugins/a.so", "APlugin", &MockFullPlugin{})
+	remote := newRemotePlugin(config.PluginConfig{Type: config.PluginTypeExec, Path: "./plugins/a", Name: "APlugin", Args: []string{"-v"}})
+	remotePlugin, _ := newLoadedPlugin("./plugins/a", "APlugin", remote)
+
+	if !goPlugin.canReuse(config.PluginConfig{Type: config.PluginTypeGo}) {
+		t.Error("expected Go plugin to be reusable")
+	}
+	if goPlugin.canReuse(config.PluginConfig{Type: config.PluginTypeExec}) {
+		t.Error("expected Go plugin not to be reused for an exec plugin")
+	}
+	if !remotePlugin.canReuse(config.PluginConfig{Type: config.PluginTypeExec, Args: []string{"-v"}, Options: json.RawMessage(`{"a":1}`)}) {
+		t.Error("expected remote plugin to be reusable when only options change")
+	}
+	if remotePlugin.canReuse(config.PluginConfig{Type: config.PluginTypeExec, Args: []string{"-q"}}) {
+		t.Error("expected remote plugin not to be reused when args change")
+	}
+}
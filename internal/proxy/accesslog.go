@@ -0,0 +1,152 @@
+// This file implements the per-request access log. ServeHTTP attaches a requestLog
+// to each request's context; the upstream transport, plugin processing, and size
+// checks fill it in, and it is written to the access log once the response is done.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/accesslog"
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// requestIDHeader carries the request ID, from the client if it sent one, to the backend
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+// requestLogKey is the request context key for the request's requestLog
+type requestLogKey struct{}
+
+// requestLog collects details of a request for the access log. Only the goroutine
+// serving the request writes to it.
+type requestLog struct {
+	start      time.Time
+	requestID  string
+	upstream   time.Duration
+	plugins    []accesslog.PluginTiming
+	sizeBypass bool
+}
+
+// withRequestLog returns r with a new requestLog attached
+func withRequestLog(r *http.Request) (*http.Request, *requestLog) {
+	rl := &requestLog{start: time.Now(), requestID: requestID(r)}
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)), rl
+}
+
+// requestLogFor returns the requestLog attached to req, or nil
+func requestLogFor(req *http.Request) *requestLog {
+	rl, _ := req.Context().Value(requestLogKey{}).(*requestLog)
+	return rl
+}
+
+// requestID returns the client's X-Request-Id if it is usable, or a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardRequestID passes the request ID on to the backend
+func forwardRequestID(req *http.Request) {
+	if rl := requestLogFor(req); rl != nil {
+		req.Header.Set(requestIDHeader, rl.requestID)
+	}
+}
+
+// recordPluginTiming notes how long a plugin ran for req
+func recordPluginTiming(req *http.Request, name string, duration time.Duration) {
+	if rl := requestLogFor(req); rl != nil {
+		rl.plugins = append(rl.plugins, accesslog.PluginTiming{Name: name, Duration: duration})
+	}
+}
+
+// recordSizeBypass notes that a response was streamed through unprocessed
+// because it exceeded the size limit
+func recordSizeBypass(req *http.Request) {
+	metrics.SizeBypassTotal.Inc()
+	if rl := requestLogFor(req); rl != nil {
+		rl.sizeBypass = true
+	}
+}
+
+// logAccess writes the access log entry for a finished request
+func (p *Proxy) logAccess(r *http.Request, mr *metricsRecorder, rl *requestLog) {
+	accessLog := p.snapshotFor(r).accessLog
+	if accessLog == nil {
+		return
+	}
+
+	accessLog.Log(&accesslog.Entry{
+		Time:             rl.start,
+		RequestID:        rl.requestID,
+		Method:           r.Method,
+		Host:             r.Host,
+		Path:             r.URL.Path,
+		Query:            r.URL.RawQuery,
+		Proto:            r.Proto,
+		Status:           mr.statusCode(),
+		Bytes:            mr.bytes,
+		ClientIP:         clientIP(r),
+		Referer:          r.Referer(),
+		UserAgent:        r.UserAgent(),
+		UpstreamDuration: rl.upstream,
+		Duration:         time.Since(rl.start),
+		Cache:            mr.cacheResult,
+		Plugins:          rl.plugins,
+		SizeBypass:       rl.sizeBypass,
+	})
+}
+
+// newAccessLog returns the access logger for cfg, or nil if it is disabled
+func newAccessLog(cfg *config.Config) (*accesslog.Logger, error) {
+	if !cfg.AccessLog.Enabled {
+		return nil, nil
+	}
+	accessLog, err := accesslog.New(cfg.AccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access log: %w", err)
+	}
+	return accessLog, nil
+}
+
+// closeAccessLogger closes accessLog, if it isn't nil
+func closeAccessLogger(accessLog *accesslog.Logger) {
+	if accessLog == nil {
+		return
+	}
+	if err := accessLog.Close(); err != nil {
+		slog.Warn("Failed to close access log", "error", err)
+	}
+}
+
+// ReopenAccessLog reopens the access log file, after it has been rotated
+func (p *Proxy) ReopenAccessLog() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.accessLog == nil {
+		return nil
+	}
+	return p.accessLog.Reopen()
+}
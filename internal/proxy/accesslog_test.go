@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+)
+
+func TestAccessLog(t *testing.T) {
+	var backendRequestID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequestID = r.Header.Get(requestIDHeader)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body>logged</body></html>"))
+	}))
+	defer backend.Close()
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	cfg := &config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+		AccessLog:         config.AccessLogConfig{Enabled: true, Format: config.AccessLogJSON, Path: logPath},
+	}
+
+	proxy, err := New(cfg, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	for _, id := range []string{"client-id-1", ""} {
+		req := httptest.NewRequest("GET", "/page?x=1", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if backendRequestID != "client-id-1" {
+		t.Errorf("expected client request ID to be forwarded, backend got %q", backendRequestID)
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(entries))
+	}
+
+	miss, hit := entries[0], entries[1]
+	if miss["request_id"] != "client-id-1" || miss["cache"] != "MISS" || miss["path"] != "/page" || miss["query"] != "x=1" {
+		t.Errorf("unexpected first entry %v", miss)
+	}
+	if miss["status"] != float64(200) || miss["bytes"] == float64(0) || miss["upstream_ms"] == float64(0) {
+		t.Errorf("expected status, bytes, and upstream latency in first entry %v", miss)
+	}
+	if hit["cache"] != "HIT" || hit["upstream_ms"] != float64(0) {
+		t.Errorf("expected cache hit without upstream latency, got %v", hit)
+	}
+	if id, _ := hit["request_id"].(string); len(id) != 32 {
+		t.Errorf("expected a generated request ID, got %q", id)
+	}
+}
+
+func TestAccessLogPluginTimings(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	for _, path := range []string{"builtin", "other"} {
+		if err := pluginManager.Register(path, "MarkerPlugin", &markerPlugin{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := &Proxy{plugins: pluginManager}
+	req, rl := withRequestLog(httptest.NewRequest("GET", "/test", nil))
+	resp := &http.Response{StatusCode: 200, Header: make(http.Header), Request: req}
+
+	pluginConfigs := []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}, {Path: "other", Name: "MarkerPlugin"}}
+	if _, _, err := proxy.processHTMLResponse(resp, strings.NewReader("<html></html>"), pluginConfigs, config.OnErrorPassthrough); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rl.plugins) != 2 || rl.plugins[0].Name != "builtin/MarkerPlugin" || rl.plugins[1].Name != "other/MarkerPlugin" {
+		t.Errorf("expected a timing for each MarkerPlugin by path, got %v", rl.plugins)
+	}
+}
@@ -0,0 +1,353 @@
+// This file implements response body buffering for XRP.
+//
+// Bodies XRP has to read in full, to process or cache them, are held in pooled
+// memory up to buffering.spill_threshold_kb, and anything beyond that is written to
+// a temporary file, so large documents don't pile up in RAM. Body memory is
+// reserved from a budget shared by all requests: a buffer waits up to
+// buffering.budget_wait_ms for memory before spilling to disk, which holds off
+// reading from the backend meanwhile, and a document waits for memory before it is
+// processed. Documents that can't get the memory in time are handled by their
+// MIME type's on_error policy.
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// bufferChunkSize is how much budget a buffer reserves at a time as it grows
+const bufferChunkSize = 64 * 1024
+
+// errMemoryBudget is returned when a document can't get memory budget in time
+var errMemoryBudget = errors.New("response body memory budget exhausted")
+
+// bufferPool recycles the in-memory part of body buffers
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// memoryBudget hands out a fixed number of bytes to concurrent requests. A
+// capacity of zero means no limit.
+type memoryBudget struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	// waiters holds a *budgetWaiter for each blocked acquire, in arrival order
+	waiters list.List
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newMemoryBudget(capacity int64) *memoryBudget {
+	return &memoryBudget{capacity: capacity}
+}
+
+// acquire reserves n bytes, waiting up to wait for them to be released. Waiters
+// are served in order, so large reservations aren't starved by small ones. It
+// reports whether the bytes were reserved.
+func (mb *memoryBudget) acquire(ctx context.Context, n int64, wait time.Duration) bool {
+	if n <= 0 {
+		return true
+	}
+
+	mb.mu.Lock()
+	if mb.capacity > 0 && n > mb.capacity {
+		mb.mu.Unlock()
+		return false
+	}
+	if mb.capacity <= 0 || (mb.waiters.Len() == 0 && mb.used+n <= mb.capacity) {
+		mb.reserve(n)
+		mb.mu.Unlock()
+		return true
+	}
+	waiter := &budgetWaiter{n: n, ready: make(chan struct{})}
+	elem := mb.waiters.PushBack(waiter)
+	mb.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// Granted while giving up
+		return true
+	default:
+	}
+	mb.waiters.Remove(elem)
+	// Waiters queued behind this one may fit now
+	mb.grant()
+	return false
+}
+
+// release returns n bytes to the budget
+func (mb *memoryBudget) release(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.used -= n
+	metrics.BufferMemoryBytes.Sub(float64(n))
+	mb.grant()
+}
+
+// resize changes the budget's capacity. Bytes already reserved stay reserved, so
+// usage may exceed a smaller capacity until they are released.
+func (mb *memoryBudget) resize(capacity int64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.capacity = capacity
+	mb.grant()
+}
+
+// grant hands released bytes to waiters in order. mb.mu must be held.
+func (mb *memoryBudget) grant() {
+	for elem := mb.waiters.Front(); elem != nil; elem = mb.waiters.Front() {
+		waiter := elem.Value.(*budgetWaiter)
+		if mb.capacity > 0 && mb.used+waiter.n > mb.capacity {
+			return
+		}
+		mb.reserve(waiter.n)
+		mb.waiters.Remove(elem)
+		close(waiter.ready)
+	}
+}
+
+// reserve records n more bytes in use. mb.mu must be held.
+func (mb *memoryBudget) reserve(n int64) {
+	mb.used += n
+	metrics.BufferMemoryBytes.Add(float64(n))
+}
+
+// bodyBuffering holds the buffering settings and the memory budget shared by all
+// requests. Zero settings keep bodies in memory without limit.
+type bodyBuffering struct {
+	budget         *memoryBudget
+	spillThreshold int64
+	spillDir       string
+	wait           time.Duration
+}
+
+func newBodyBuffering(cfg config.BufferingConfig) *bodyBuffering {
+	return &bodyBuffering{
+		budget:         newMemoryBudget(int64(cfg.MemoryBudgetMB) * 1024 * 1024),
+		spillThreshold: int64(cfg.SpillThresholdKB) * 1024,
+		spillDir:       cfg.SpillDir,
+		wait:           time.Duration(cfg.BudgetWaitMS) * time.Millisecond,
+	}
+}
+
+// reconfigured returns buffering with cfg's settings that keeps bb's memory budget,
+// resized to cfg's. Responses in flight when the configuration is reloaded still
+// count against it, so a reload can't double the memory bodies may use.
+func (bb *bodyBuffering) reconfigured(cfg config.BufferingConfig) *bodyBuffering {
+	next := newBodyBuffering(cfg)
+	bb.budget.resize(next.budget.capacity)
+	next.budget = bb.budget
+	return next
+}
+
+// newBuffer returns an empty body buffer. ctx bounds waits for memory budget.
+func (bb *bodyBuffering) newBuffer(ctx context.Context) *bodyBuffer {
+	return &bodyBuffer{buffering: bb, ctx: ctx}
+}
+
+// reserve reserves n bytes of budget for processing a document, returning a
+// function that releases them. The budget the document's buffers already hold
+// counts toward n, so only the difference is acquired; the buffers hand their
+// budget over to the reservation and release none of it when they close. It fails
+// with errMemoryBudget if the budget doesn't free up in time.
+func (bb *bodyBuffering) reserve(ctx context.Context, n int64, buffers ...*bodyBuffer) (release func(), err error) {
+	var held int64
+	for _, buffer := range buffers {
+		held += buffer.reserved
+	}
+	if !bb.budget.acquire(ctx, n-held, bb.wait) {
+		metrics.BufferBudgetExhaustedTotal.Inc()
+		return nil, errMemoryBudget
+	}
+	for _, buffer := range buffers {
+		buffer.reserved = 0
+	}
+	total := max(n, held)
+	var once sync.Once
+	return func() { once.Do(func() { bb.budget.release(total) }) }, nil
+}
+
+// bodyBuffer holds a response body: in pooled memory up to the spill threshold,
+// and in a temporary file once it grows larger or memory budget runs out. It must
+// be closed to release its memory and file.
+type bodyBuffer struct {
+	buffering *bodyBuffering
+	ctx       context.Context
+	mem       *bytes.Buffer
+	// reserved is the budget held for mem
+	reserved int64
+	file     *os.File
+	size     int64
+}
+
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.reserveMemory(int64(len(p))) {
+		if b.mem == nil {
+			b.mem = bufferPool.Get().(*bytes.Buffer)
+		}
+		b.mem.Write(p)
+		b.size += int64(len(p))
+		return len(p), nil
+	}
+
+	if b.file == nil {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// reserveMemory reports whether n more bytes may be kept in memory, reserving
+// budget for them as needed
+func (b *bodyBuffer) reserveMemory(n int64) bool {
+	threshold := b.buffering.spillThreshold
+	needed := b.size + n
+	if threshold > 0 && needed > threshold {
+		return false
+	}
+	if needed <= b.reserved {
+		return true
+	}
+
+	chunk := max(needed-b.reserved, bufferChunkSize)
+	if threshold > 0 {
+		chunk = min(chunk, threshold-b.reserved)
+	}
+	if !b.buffering.budget.acquire(b.ctx, chunk, b.buffering.wait) {
+		return false
+	}
+	b.reserved += chunk
+	return true
+}
+
+// spill moves the buffered body to a temporary file, where the rest of it will be
+// written
+func (b *bodyBuffer) spill() error {
+	file, err := os.CreateTemp(b.buffering.spillDir, "xrp-body-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+	if b.mem != nil {
+		if _, err := file.Write(b.mem.Bytes()); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return fmt.Errorf("failed to write spill file: %w", err)
+		}
+	}
+
+	metrics.BufferSpillsTotal.Inc()
+	b.file = file
+	b.releaseMemory()
+	return nil
+}
+
+// Len returns the number of bytes buffered
+func (b *bodyBuffer) Len() int64 {
+	return b.size
+}
+
+// Spilled reports whether the body was moved to a temporary file
+func (b *bodyBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Reader returns a reader over the whole buffered body. It must not be used after
+// the buffer is closed.
+func (b *bodyBuffer) Reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	if b.mem == nil {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+// Body returns the buffered body as a response body, which closes the buffer when
+// it is closed
+func (b *bodyBuffer) Body() io.ReadCloser {
+	return &bufferedBody{Reader: b.Reader(), closers: []io.Closer{b}}
+}
+
+// Close releases the buffer's memory and removes its temporary file
+func (b *bodyBuffer) Close() error {
+	b.releaseMemory()
+	if b.file == nil {
+		return nil
+	}
+
+	err := b.file.Close()
+	if removeErr := os.Remove(b.file.Name()); err == nil {
+		err = removeErr
+	}
+	b.file = nil
+	return err
+}
+
+func (b *bodyBuffer) releaseMemory() {
+	if b.mem != nil {
+		b.mem.Reset()
+		bufferPool.Put(b.mem)
+		b.mem = nil
+	}
+	b.buffering.budget.release(b.reserved)
+	b.reserved = 0
+}
+
+// bufferedBody is a response body read from Reader that closes each of closers
+// when it is closed
+type bufferedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (bb *bufferedBody) Close() error {
+	var err error
+	for _, closer := range bb.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	bb.closers = nil
+	return err
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+	ctx := context.Background()
+
+	if !budget.acquire(ctx, 60, time.Millisecond) {
+		t.Fatal("expected first reservation to succeed")
+	}
+	if budget.acquire(ctx, 50, 10*time.Millisecond) {
+		t.Fatal("expected reservation beyond capacity to time out")
+	}
+	if budget.acquire(ctx, 101, time.Hour) {
+		t.Fatal("expected reservation larger than capacity to fail immediately")
+	}
+
+	// Waiters are served in order: the small reservation would fit, but must not
+	// overtake the large one queued before it
+	granted := make(chan int64, 2)
+	for _, n := range []int64{80, 10} {
+		go func() {
+			if budget.acquire(ctx, n, time.Second) {
+				granted <- n
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case n := <-granted:
+		t.Fatalf("expected waiters to queue, but %d was granted", n)
+	default:
+	}
+
+	budget.release(60)
+	<-granted
+	<-granted
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if budget.used != 90 {
+		t.Errorf("expected 90 bytes in use, got %d", budget.used)
+	}
+}
+
+func TestMemoryBudgetCanceled(t *testing.T) {
+	budget := newMemoryBudget(10)
+	budget.acquire(context.Background(), 10, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if budget.acquire(ctx, 5, time.Hour) {
+		t.Error("expected canceled reservation to fail")
+	}
+	if budget.waiters.Len() != 0 {
+		t.Error("expected canceled waiter to be removed")
+	}
+}
+
+// TestMemoryBudgetResize tests that growing a budget grants waiters and that
+// shrinking it keeps existing reservations
+func TestMemoryBudgetResize(t *testing.T) {
+	budget := newMemoryBudget(10)
+	ctx := context.Background()
+	budget.acquire(ctx, 10, 0)
+
+	granted := make(chan bool, 1)
+	go func() { granted <- budget.acquire(ctx, 5, time.Second) }()
+	time.Sleep(10 * time.Millisecond)
+	budget.resize(20)
+	if !<-granted {
+		t.Fatal("expected a waiter to be granted once the budget grew")
+	}
+
+	budget.resize(5)
+	if budget.acquire(ctx, 1, 10*time.Millisecond) {
+		t.Error("expected no reservations while usage exceeds the smaller capacity")
+	}
+	budget.release(15)
+	if !budget.acquire(ctx, 5, 0) {
+		t.Error("expected the smaller capacity to be usable once released")
+	}
+}
+
+func TestBodyBufferSpill(t *testing.T) {
+	dir := t.TempDir()
+	buffering := &bodyBuffering{budget: newMemoryBudget(1 << 20), spillThreshold: 16, spillDir: dir}
+
+	buffer := buffering.newBuffer(context.Background())
+	_, _ = buffer.Write([]byte("0123456789"))
+	if buffer.Spilled() {
+		t.Fatal("expected small body to stay in memory")
+	}
+	_, _ = buffer.Write([]byte("abcdefghij"))
+	if !buffer.Spilled() {
+		t.Fatal("expected body past the threshold to spill")
+	}
+	if buffering.budget.used != 0 {
+		t.Errorf("expected spilled buffer to release its budget, %d bytes in use", buffering.budget.used)
+	}
+
+	data, _ := io.ReadAll(buffer.Reader())
+	if string(data) != "0123456789abcdefghij" || buffer.Len() != 20 {
+		t.Errorf("unexpected buffered body %q (length %d)", data, buffer.Len())
+	}
+
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected spill file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestBodyBufferSpillsWithoutBudget(t *testing.T) {
+	buffering := &bodyBuffering{budget: newMemoryBudget(10), spillThreshold: 1 << 20, spillDir: t.TempDir()}
+	buffering.budget.acquire(context.Background(), 10, 0)
+
+	buffer := buffering.newBuffer(context.Background())
+	defer buffer.Close()
+	_, _ = buffer.Write([]byte("hello"))
+	if !buffer.Spilled() {
+		t.Error("expected buffer to spill when memory budget is exhausted")
+	}
+}
+
+func newBufferingTestProxy(buffering *bodyBuffering) *Proxy {
+	return &Proxy{
+		config: &config.Config{
+			MaxResponseSizeMB: 1,
+			MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html", OnError: config.OnErrorPassthrough}},
+		},
+		version:   "test-1.0.0",
+		buffering: buffering,
+	}
+}
+
+// TestModifyResponse_StreamsUnprocessed tests that bodies nothing needs to read
+// are left alone
+func TestModifyResponse_StreamsUnprocessed(t *testing.T) {
+	proxy := newBufferingTestProxy(newBodyBuffering(config.BufferingConfig{}))
+
+	body := io.NopCloser(strings.NewReader("<html></html>"))
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {"text/html"}},
+		Body:          body,
+		ContentLength: -1,
+		Request:       httptest.NewRequest("POST", "/test", nil),
+	}
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+	if resp.Body != body {
+		t.Error("expected unprocessed, uncacheable body to be streamed untouched")
+	}
+}
+
+// TestModifyResponse_OversizedUnknownLength tests that bodies of unknown length
+// past the size limit stream through intact, with the buffered part spilled to disk
+func TestModifyResponse_OversizedUnknownLength(t *testing.T) {
+	dir := t.TempDir()
+	proxy := newBufferingTestProxy(&bodyBuffering{budget: newMemoryBudget(1 << 20), spillThreshold: 1024, spillDir: dir})
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}}
+
+	original := "<html>" + strings.Repeat("x", 2*1024*1024) + "</html>"
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {"text/html"}},
+		Body:          io.NopCloser(strings.NewReader(original)),
+		ContentLength: -1,
+		Request:       httptest.NewRequest("GET", "/big", nil),
+	}
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+
+	data, _ := io.ReadAll(resp.Body)
+	if string(data) != original {
+		t.Errorf("expected oversized body to stream through intact, got %d bytes", len(data))
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected spill file to be removed, found %d files", len(entries))
+	}
+}
+
+// TestModifyResponse_MemoryBudgetExhausted tests that a document that can't get
+// memory to be processed is handled by the on_error policy
+func TestModifyResponse_MemoryBudgetExhausted(t *testing.T) {
+	buffering := &bodyBuffering{budget: newMemoryBudget(100), spillThreshold: 10, spillDir: t.TempDir(), wait: 10 * time.Millisecond}
+	proxy := newBufferingTestProxy(buffering)
+	proxy.config.Cache.Disabled = true
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}}
+
+	original := []byte("<html><body>" + strings.Repeat("x", 200) + "</body></html>")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(bytes.NewReader(original)),
+		Request:    httptest.NewRequest("GET", "/test", nil),
+	}
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+
+	if got := resp.Header.Get("X-XRP-Cache"); got != "BYPASS" {
+		t.Errorf("expected BYPASS, got %q", got)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(data, original) {
+		t.Errorf("expected original body, got %q", data)
+	}
+	_ = resp.Body.Close()
+	if buffering.budget.used != 0 {
+		t.Errorf("expected all budget released, %d bytes in use", buffering.budget.used)
+	}
+}
+
+// TestModifyResponse_ReservationTakesOverBuffers tests that a document's
+// processing reservation reuses the budget its buffer holds rather than counting
+// the body twice
+func TestModifyResponse_ReservationTakesOverBuffers(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffer's first chunk is the whole budget
+	buffering := &bodyBuffering{budget: newMemoryBudget(bufferChunkSize), spillThreshold: 1 << 20, spillDir: t.TempDir(), wait: 10 * time.Millisecond}
+	proxy := newBufferingTestProxy(buffering)
+	proxy.plugins = pluginManager
+	proxy.config.Cache.Disabled = true
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}}
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader("<html><body>" + strings.Repeat("x", 200) + "</body></html>")),
+		Request:    httptest.NewRequest("GET", "/test", nil),
+	}
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+
+	data, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(data), "<!--marker-->") {
+		t.Errorf("expected the document to be processed within the budget, got %q", data)
+	}
+	_ = resp.Body.Close()
+	if buffering.budget.used != 0 {
+		t.Errorf("expected all budget released, %d bytes in use", buffering.budget.used)
+	}
+}
@@ -0,0 +1,186 @@
+// This file implements request coalescing. When several requests miss the cache for
+// the same entry at once, the first becomes the leader and is proxied; the others
+// wait until the leader's response has been cached, or the coalescing timeout passes,
+// and then check the cache again. A follower that still misses (e.g. because the
+// leader's response varies differently) goes to the backend itself. As soon as the
+// leader's response turns out not to be cacheable, its followers are let go, and
+// requests for that entry skip coalescing for uncacheableTTL, so they don't queue
+// for responses that won't be cached. With distributed coalescing, leaders also take
+// a Redis lock so requests wait for fetches by other XRP instances.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/cache"
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// uncacheableTTL is how long requests skip coalescing after a response for their
+// cache entry wasn't cacheable
+const uncacheableTTL = 10 * time.Second
+
+// flightGroup tracks the cache keys currently being fetched by this instance
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]chan struct{}
+	// uncacheable holds when each recently uncacheable key may be coalesced again
+	uncacheable map[string]time.Time
+	// sweepAt is the size of uncacheable at which expired keys are next removed
+	sweepAt int
+}
+
+// join makes the caller the leader for key, returning a function that ends its
+// flight. If another request is already fetching key, join instead waits for it to
+// finish or for ctx to be done.
+func (g *flightGroup) join(ctx context.Context, key string) (done func(), leader bool) {
+	g.mu.Lock()
+	if flight, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-flight:
+		case <-ctx.Done():
+		}
+		return nil, false
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[string]chan struct{})
+	}
+	flight := make(chan struct{})
+	g.flights[key] = flight
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(flight)
+	}, true
+}
+
+// markUncacheable makes requests for key skip coalescing for uncacheableTTL
+func (g *flightGroup) markUncacheable(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if g.uncacheable == nil {
+		g.uncacheable = make(map[string]time.Time)
+	}
+	// Expired keys are removed in batches, as the map doubles in size
+	if len(g.uncacheable) >= g.sweepAt {
+		for k, until := range g.uncacheable {
+			if !now.Before(until) {
+				delete(g.uncacheable, k)
+			}
+		}
+		g.sweepAt = max(2*len(g.uncacheable), 64)
+	}
+	g.uncacheable[key] = now.Add(uncacheableTTL)
+}
+
+// isUncacheable reports whether a response for key recently wasn't cacheable
+func (g *flightGroup) isUncacheable(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.uncacheable[key]
+	return ok && time.Now().Before(until)
+}
+
+// coalescedFetch is a request's part in coalescing: the cache key it fetches, and
+// how to end its flight so requests waiting for it check the cache again
+type coalescedFetch struct {
+	flights *flightGroup
+	key     string
+	end     func()
+	once    sync.Once
+}
+
+// release ends the fetch's flight, if it leads one
+func (f *coalescedFetch) release() {
+	f.once.Do(f.end)
+}
+
+// uncacheable ends the fetch's flight early, once its response turns out not to be
+// cacheable, and has later requests for the key skip coalescing for a while
+func (f *coalescedFetch) uncacheable() {
+	f.flights.markUncacheable(f.key)
+	f.release()
+}
+
+// coalescedFetchKey is the request context key for a request's coalescedFetch
+type coalescedFetchKey struct{}
+
+// withCoalescedFetch returns a shallow copy of req carrying fetch
+func withCoalescedFetch(req *http.Request, fetch *coalescedFetch) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), coalescedFetchKey{}, fetch))
+}
+
+// skipCoalescing tells requests coalesced with req that its response won't be
+// cached, so they needn't wait for it
+func skipCoalescing(req *http.Request) {
+	if fetch, ok := req.Context().Value(coalescedFetchKey{}).(*coalescedFetch); ok {
+		fetch.uncacheable()
+	}
+}
+
+// coalesce waits for any concurrent fetch of the cache entry r would be served from.
+// cached is the expired entry for r, if any. It returns nil if r isn't coalesced.
+// Otherwise the fetch must be released once r's response has been cached; if
+// coalesce returns waited true, the cache should be checked again first.
+func (p *Proxy) coalesce(r *http.Request, site *config.Config, cached *cache.Entry) (fetch *coalescedFetch, waited bool) {
+	// Responses to these requests are never cached, so there is nothing to wait for
+	if r.Header.Get("Authorization") != "" || p.hasDenylistedCookies(r) {
+		return nil, false
+	}
+
+	store := p.snapshotFor(r).cache
+	key := store.Key(r, site)
+	if cached != nil {
+		key = cached.Key
+	}
+	if key == "" || p.flights.isUncacheable(key) {
+		return nil, false
+	}
+
+	fetch = &coalescedFetch{flights: &p.flights, key: key, end: func() {}}
+	timeout := time.Duration(site.Cache.Coalesce.TimeoutMS) * time.Millisecond
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	done, leader := p.flights.join(ctx, key)
+	if !leader {
+		metrics.CoalescedRequestsTotal.Inc()
+		return fetch, true
+	}
+	fetch.end = done
+	if !site.Cache.Coalesce.Distributed {
+		return fetch, false
+	}
+
+	unlock, waited, err := store.Lock(ctx, key, timeout)
+	if err != nil {
+		if errors.Is(err, cache.ErrUnavailable) {
+			return fetch, false
+		}
+		slog.Error("Failed to coalesce request across instances", "url", r.URL.Path, "error", err)
+		return fetch, false
+	}
+	if waited {
+		// Local followers keep waiting on this request while it checks the cache
+		metrics.CoalescedRequestsTotal.Inc()
+		return fetch, true
+	}
+	fetch.end = func() {
+		unlock()
+		done()
+	}
+	return fetch, false
+}
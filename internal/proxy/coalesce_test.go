@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+
+	done, leader := g.join(context.Background(), "key")
+	if !leader {
+		t.Fatal("expected first caller to lead")
+	}
+
+	joined := make(chan bool)
+	go func() {
+		_, leader := g.join(context.Background(), "key")
+		joined <- leader
+	}()
+
+	select {
+	case <-joined:
+		t.Fatal("expected follower to wait for the leader")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	done()
+	if leader := <-joined; leader {
+		t.Error("expected follower not to lead")
+	}
+
+	if _, leader := g.join(context.Background(), "key"); !leader {
+		t.Error("expected a new flight after the previous one finished")
+	}
+}
+
+func TestFlightGroupTimeout(t *testing.T) {
+	var g flightGroup
+	if _, leader := g.join(context.Background(), "key"); !leader {
+		t.Fatal("expected first caller to lead")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, leader := g.join(ctx, "key"); leader {
+		t.Error("expected follower to give up without leading")
+	}
+}
+
+// newCoalescingBackend returns a slow backend counting its requests
+func newCoalescingBackend(calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = fmt.Fprintf(w, "<html><body>Call #%d</body></html>", n)
+	}))
+}
+
+// withCoalescing is a newTestConfig override that coalesces cache misses
+func withCoalescing(distributed bool) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Cache.Coalesce = config.CoalesceConfig{Enabled: true, TimeoutMS: 5000, Distributed: distributed}
+	}
+}
+
+// getConcurrently sends n concurrent requests for /page, spread across proxies
+func getConcurrently(t *testing.T, n int, proxies ...*Proxy) []*httptest.ResponseRecorder {
+	t.Helper()
+	recorders := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			proxies[i%len(proxies)].ServeHTTP(recorders[i], httptest.NewRequest("GET", "/page", nil))
+		}(i)
+	}
+	wg.Wait()
+	return recorders
+}
+
+func TestCoalescing(t *testing.T) {
+	var calls atomic.Int32
+	backend := newCoalescingBackend(&calls)
+	defer backend.Close()
+
+	mr := miniredis.RunT(t)
+	proxy := newTestProxy(t, backend.URL, withRedis(mr.Addr()), withCoalescing(false))
+
+	misses := 0
+	for _, rec := range getConcurrently(t, 10, proxy) {
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Call #1") {
+			t.Errorf("expected every request to get the first response, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("X-XRP-Cache") == "MISS" {
+			misses++
+		}
+	}
+	if calls.Load() != 1 || misses != 1 {
+		t.Errorf("expected 1 backend request and 1 miss, got %d and %d", calls.Load(), misses)
+	}
+}
+
+func TestCoalescingDistributed(t *testing.T) {
+	var calls atomic.Int32
+	backend := newCoalescingBackend(&calls)
+	defer backend.Close()
+
+	mr := miniredis.RunT(t)
+	proxyA := newTestProxy(t, backend.URL, withRedis(mr.Addr()), withCoalescing(true))
+	proxyB := newTestProxy(t, backend.URL, withRedis(mr.Addr()), withCoalescing(true))
+
+	for _, rec := range getConcurrently(t, 10, proxyA, proxyB) {
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Call #1") {
+			t.Errorf("expected every request to get the first response, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 backend request across instances, got %d", calls.Load())
+	}
+}
+
+// TestCoalescingUncacheable tests that requests waiting for a response that won't
+// be cached go to the backend as soon as that is known, and that later requests
+// don't wait at all
+func TestCoalescingUncacheable(t *testing.T) {
+	var calls, overlapping atomic.Int32
+	var leaderActive atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		if calls.Add(1) == 1 {
+			leaderActive.Store(true)
+			defer leaderActive.Store(false)
+			time.Sleep(20 * time.Millisecond)
+			w.(http.Flusher).Flush()
+			// The body is slow; waiting requests shouldn't be held up by it
+			time.Sleep(300 * time.Millisecond)
+		} else if leaderActive.Load() {
+			overlapping.Add(1)
+		}
+		_, _ = w.Write([]byte("<html><body>uncacheable</body></html>"))
+	}))
+	defer backend.Close()
+
+	mr := miniredis.RunT(t)
+	proxy := newTestProxy(t, backend.URL, withRedis(mr.Addr()), withCoalescing(false))
+
+	for _, rec := range getConcurrently(t, 5, proxy) {
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", rec.Code)
+		}
+	}
+	if calls.Load() != 5 || overlapping.Load() != 4 {
+		t.Errorf("expected every request to reach the backend while the first was still sending, got %d calls and %d overlapping",
+			calls.Load(), overlapping.Load())
+	}
+	if len(proxy.flights.uncacheable) != 1 {
+		t.Errorf("expected the uncacheable entry to skip coalescing, got %v", proxy.flights.uncacheable)
+	}
+}
@@ -0,0 +1,329 @@
+// This file contains Content-Encoding handling for XRP.
+// Backend responses are decoded to their identity form before plugin processing,
+// and processed bodies (fresh or cached) are re-encoded according to the client's
+// Accept-Encoding header. The cache always stores the identity form.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// errDecodedTooLarge is returned when a decoded body exceeds the configured size limit
+var errDecodedTooLarge = errors.New("decoded response body exceeds size limit")
+
+// supportedEncodings lists the content codings XRP can produce, in order of preference
+var supportedEncodings = []string{"br", "gzip", "deflate"}
+
+// parseContentEncoding splits a Content-Encoding header into its codings,
+// in the order they were applied. Identity codings are dropped.
+func parseContentEncoding(contentEncoding string) []string {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		codings = append(codings, coding)
+	}
+	return codings
+}
+
+// isSupportedContentEncoding reports whether XRP can decode the given Content-Encoding
+func isSupportedContentEncoding(contentEncoding string) bool {
+	for _, coding := range parseContentEncoding(contentEncoding) {
+		switch coding {
+		case "gzip", "x-gzip", "deflate", "br":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBody removes all content codings from body as it copies it to dst. The
+// decoded size is limited to maxSize bytes; larger bodies cause errDecodedTooLarge.
+func decodeBody(dst io.Writer, body io.Reader, contentEncoding string, maxSize int64) error {
+	decoder := newDecodingReader(body, contentEncoding)
+	defer decoder.Close()
+
+	n, err := io.Copy(dst, io.LimitReader(decoder, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s body: %w", contentEncoding, err)
+	}
+	if n > maxSize {
+		return errDecodedTooLarge
+	}
+	return nil
+}
+
+// decodingReader removes all content codings from a body as it is read. Its
+// decoders are set up on the first read, since they read headers from the body.
+type decodingReader struct {
+	body            io.Reader
+	contentEncoding string
+	reader          io.Reader
+	decoders        []io.Closer
+	err             error
+}
+
+func newDecodingReader(body io.Reader, contentEncoding string) *decodingReader {
+	return &decodingReader{body: body, contentEncoding: contentEncoding}
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	if dr.reader == nil && dr.err == nil {
+		dr.reader = dr.body
+		// Codings are listed in the order they were applied, so undo them in reverse
+		codings := parseContentEncoding(dr.contentEncoding)
+		for i := len(codings) - 1; i >= 0; i-- {
+			decoder, err := newDecoder(codings[i], dr.reader)
+			if err != nil {
+				dr.err = fmt.Errorf("%s: %w", codings[i], err)
+				break
+			}
+			dr.decoders = append(dr.decoders, decoder)
+			dr.reader = decoder
+		}
+	}
+	if dr.err != nil {
+		return 0, dr.err
+	}
+	return dr.reader.Read(p)
+}
+
+// Close closes the decoders. It doesn't close the body.
+func (dr *decodingReader) Close() error {
+	for _, decoder := range dr.decoders {
+		decoder.Close()
+	}
+	dr.decoders = nil
+	return nil
+}
+
+func newDecoder(coding string, body io.Reader) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// "deflate" is specified as zlib-wrapped, but some servers send raw DEFLATE.
+		// Peek at the header to tell them apart without consuming the body.
+		buffered := bufio.NewReader(body)
+		if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", coding)
+	}
+}
+
+// isEncodedAs reports whether a Content-Encoding header amounts to the single
+// coding encoding, or to no coding if encoding is ""
+func isEncodedAs(contentEncoding, encoding string) bool {
+	codings := parseContentEncoding(contentEncoding)
+	if encoding == "" {
+		return len(codings) == 0
+	}
+	return len(codings) == 1 && (codings[0] == encoding || codings[0] == "x-gzip" && encoding == "gzip")
+}
+
+// isZlibHeader reports whether header starts a zlib stream: the DEFLATE method, a
+// window size of at most 32K, and a valid check value (RFC 1950)
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && header[0]>>4 <= 7 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// negotiateEncoding picks the preferred supported encoding from an Accept-Encoding
+// header. It returns "" when the identity encoding should be used.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		qualities[coding] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, coding := range supportedEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// encodeBody applies the given content coding to body. An empty encoding returns body unchanged.
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	writer, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %w", encoding, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %w", encoding, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// flushingWriter is a compressing writer that can flush what it has compressed so far
+type flushingWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, w io.Writer) (flushingWriter, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// encodeFlushSize is how much input an encodingReader compresses before flushing
+// it, so streamed responses don't stall in the compressor
+const encodeFlushSize = 32 * 1024
+
+// encodingReader applies a content coding to a stream as it is read
+type encodingReader struct {
+	src      io.Reader
+	encoding string
+	encoder  flushingWriter
+	buf      bytes.Buffer
+	chunk    []byte
+	// unflushed counts bytes compressed since the last flush
+	unflushed int
+	err       error
+}
+
+// newEncodingReader returns a reader of src encoded with encoding. An empty
+// encoding returns src unchanged.
+func newEncodingReader(src io.Reader, encoding string) (io.Reader, error) {
+	if encoding == "" {
+		return src, nil
+	}
+
+	er := &encodingReader{src: src, encoding: encoding, chunk: make([]byte, 8*1024)}
+	encoder, err := newEncoder(encoding, &er.buf)
+	if err != nil {
+		return nil, err
+	}
+	er.encoder = encoder
+	return er, nil
+}
+
+func (er *encodingReader) Read(p []byte) (int, error) {
+	for er.buf.Len() == 0 && er.err == nil {
+		er.err = er.fill()
+	}
+	if er.buf.Len() > 0 {
+		return er.buf.Read(p)
+	}
+	return 0, er.err
+}
+
+// fill compresses the next chunk of src, returning io.EOF once the stream is
+// complete
+func (er *encodingReader) fill() error {
+	n, err := er.src.Read(er.chunk)
+	if n > 0 {
+		if _, werr := er.encoder.Write(er.chunk[:n]); werr != nil {
+			return fmt.Errorf("failed to encode %s body: %w", er.encoding, werr)
+		}
+		if er.unflushed += n; er.unflushed >= encodeFlushSize {
+			er.unflushed = 0
+			if ferr := er.encoder.Flush(); ferr != nil {
+				return fmt.Errorf("failed to encode %s body: %w", er.encoding, ferr)
+			}
+		}
+	}
+	if err == io.EOF {
+		if cerr := er.encoder.Close(); cerr != nil {
+			return fmt.Errorf("failed to encode %s body: %w", er.encoding, cerr)
+		}
+	}
+	return err
+}
+
+// setEncodingHeaders updates Content-Encoding, ETag, and Vary for a body XRP has
+// re-encoded with encoding. The backend's ETag is weakened, since the bytes sent
+// are no longer the ones it was computed for.
+func setEncodingHeaders(header http.Header, encoding string) {
+	if encoding == "" {
+		header.Del("Content-Encoding")
+	} else {
+		header.Set("Content-Encoding", encoding)
+	}
+	if etag := header.Get("ETag"); etag != "" {
+		header.Set("ETag", weakETag(etag))
+	}
+
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// weakETag returns etag as a weak entity tag (RFC 9110 §8.8.3)
+func weakETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
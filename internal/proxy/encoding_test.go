@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/cdzombak/xrp/internal/cache"
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"x-gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=0", ""},
+		{"zstd", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			result := negotiateEncoding(tt.acceptEncoding)
+			if result != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestIsSupportedContentEncoding(t *testing.T) {
+	tests := []struct {
+		contentEncoding string
+		expected        bool
+	}{
+		{"", true},
+		{"identity", true},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate", true},
+		{"br", true},
+		{"gzip, br", true},
+		{"compress", false},
+		{"zstd", false},
+		{"gzip, zstd", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentEncoding, func(t *testing.T) {
+			result := isSupportedContentEncoding(tt.contentEncoding)
+			if result != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	original := []byte("<html><body>" + strings.Repeat("hello world ", 100) + "</body></html>")
+
+	for _, encoding := range []string{"", "gzip", "deflate", "br"} {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			encoded, err := encodeBody(original, encoding)
+			if err != nil {
+				t.Fatalf("encodeBody failed: %v", err)
+			}
+			if encoding != "" && bytes.Equal(encoded, original) {
+				t.Error("expected encoded body to differ from original")
+			}
+
+			var decoded bytes.Buffer
+			if err := decodeBody(&decoded, bytes.NewReader(encoded), encoding, 1024*1024); err != nil {
+				t.Fatalf("decodeBody failed: %v", err)
+			}
+			if !bytes.Equal(decoded.Bytes(), original) {
+				t.Error("round-tripped body does not match original")
+			}
+		})
+	}
+}
+
+func TestDecodeBody_RawDeflate(t *testing.T) {
+	original := []byte("<html><body>raw deflate</body></html>")
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = fw.Write(original)
+	_ = fw.Close()
+
+	var decoded bytes.Buffer
+	if err := decodeBody(&decoded, &buf, "deflate", 1024); err != nil {
+		t.Fatalf("decodeBody failed: %v", err)
+	}
+	if !bytes.Equal(decoded.Bytes(), original) {
+		t.Errorf("expected %q, got %q", original, decoded.Bytes())
+	}
+}
+
+func TestDecodeBody_MultipleCodings(t *testing.T) {
+	original := []byte("<html><body>layered</body></html>")
+
+	gzipped, _ := encodeBody(original, "gzip")
+	layered, _ := encodeBody(gzipped, "br")
+
+	var decoded bytes.Buffer
+	if err := decodeBody(&decoded, bytes.NewReader(layered), "gzip, br", 1024); err != nil {
+		t.Fatalf("decodeBody failed: %v", err)
+	}
+	if !bytes.Equal(decoded.Bytes(), original) {
+		t.Errorf("expected %q, got %q", original, decoded.Bytes())
+	}
+}
+
+func TestDecodeBody_SizeLimit(t *testing.T) {
+	original := bytes.Repeat([]byte("x"), 10000)
+	encoded, _ := encodeBody(original, "gzip")
+
+	err := decodeBody(io.Discard, bytes.NewReader(encoded), "gzip", 1000)
+	if !errors.Is(err, errDecodedTooLarge) {
+		t.Errorf("expected errDecodedTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeBody_Corrupt(t *testing.T) {
+	if err := decodeBody(io.Discard, strings.NewReader("not gzip"), "gzip", 1024); err == nil {
+		t.Error("expected error decoding corrupt gzip body")
+	}
+}
+
+func TestSetEncodingHeaders(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Content-Encoding", "gzip")
+	setEncodingHeaders(header, "")
+	if header.Get("Content-Encoding") != "" {
+		t.Errorf("expected Content-Encoding to be removed, got %q", header.Get("Content-Encoding"))
+	}
+	if header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", header.Get("Vary"))
+	}
+
+	header = make(http.Header)
+	header.Set("Vary", "Accept-Language, accept-encoding")
+	setEncodingHeaders(header, "br")
+	if header.Get("Content-Encoding") != "br" {
+		t.Errorf("expected Content-Encoding br, got %q", header.Get("Content-Encoding"))
+	}
+	if len(header.Values("Vary")) != 1 {
+		t.Errorf("expected Vary to be left alone, got %v", header.Values("Vary"))
+	}
+
+	header = make(http.Header)
+	header.Set("ETag", `"v1"`)
+	setEncodingHeaders(header, "gzip")
+	if header.Get("ETag") != `W/"v1"` {
+		t.Errorf("expected re-encoded body's ETag to be weakened, got %q", header.Get("ETag"))
+	}
+	setEncodingHeaders(header, "br")
+	if header.Get("ETag") != `W/"v1"` {
+		t.Errorf("expected weak ETag to be left alone, got %q", header.Get("ETag"))
+	}
+}
+
+// TestModifyResponse_CompressedBackend tests that encoded backend bodies are decoded
+// for processing and re-encoded according to the client's Accept-Encoding
+func TestModifyResponse_CompressedBackend(t *testing.T) {
+	cfg := &config.Config{
+		MaxResponseSizeMB: 1,
+		MimeTypes: []config.MimeTypeConfig{
+			{
+				MimeType: "text/html",
+				Plugins:  []config.PluginConfig{},
+			},
+		},
+	}
+
+	proxy := &Proxy{
+		config:    cfg,
+		version:   "test-1.0.0",
+		buffering: newBodyBuffering(config.BufferingConfig{}),
+	}
+
+	original := "<html><head></head><body><p>compressed</p></body></html>"
+
+	tests := []struct {
+		name            string
+		backendEncoding string
+		acceptEncoding  string
+		expectEncoding  string
+	}{
+		{"gzip to identity", "gzip", "", ""},
+		{"gzip to gzip", "gzip", "gzip", "gzip"},
+		{"br to gzip", "br", "gzip", "gzip"},
+		{"deflate to br", "deflate", "br, gzip", "br"},
+		{"identity to br", "", "br", "br"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeBody([]byte(original), tt.backendEncoding)
+			if err != nil {
+				t.Fatalf("failed to encode test body: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/test", nil) // POST avoids caching
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			resp := &http.Response{
+				StatusCode:    200,
+				Header:        make(http.Header),
+				Body:          io.NopCloser(bytes.NewReader(encoded)),
+				ContentLength: int64(len(encoded)),
+				Request:       req,
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			if tt.backendEncoding != "" {
+				resp.Header.Set("Content-Encoding", tt.backendEncoding)
+			}
+
+			if err := proxy.modifyResponse(resp); err != nil {
+				t.Fatalf("modifyResponse failed: %v", err)
+			}
+
+			if got := resp.Header.Get("Content-Encoding"); got != tt.expectEncoding {
+				t.Errorf("expected Content-Encoding %q, got %q", tt.expectEncoding, got)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			decoded := body
+			switch tt.expectEncoding {
+			case "gzip":
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("response is not valid gzip: %v", err)
+				}
+				decoded, _ = io.ReadAll(zr)
+			case "br":
+				decoded, _ = io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+			}
+
+			if !strings.Contains(string(decoded), "<p>compressed</p>") {
+				t.Errorf("expected processed HTML in response, got %q", decoded)
+			}
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("expected ContentLength %d, got %d", len(body), resp.ContentLength)
+			}
+		})
+	}
+}
+
+// TestModifyResponse_UnsupportedEncoding tests that unknown encodings stream through unchanged
+func TestModifyResponse_UnsupportedEncoding(t *testing.T) {
+	proxy := &Proxy{
+		config: &config.Config{
+			MaxResponseSizeMB: 1,
+			MimeTypes: []config.MimeTypeConfig{
+				{MimeType: "text/html", Plugins: []config.PluginConfig{}},
+			},
+		},
+		version:   "test-1.0.0",
+		buffering: newBodyBuffering(config.BufferingConfig{}),
+	}
+
+	body := "opaque zstd bytes"
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       httptest.NewRequest("GET", "/test", nil),
+	}
+	resp.Header.Set("Content-Type", "text/html")
+	resp.Header.Set("Content-Encoding", "zstd")
+
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+
+	result, _ := io.ReadAll(resp.Body)
+	if string(result) != body {
+		t.Errorf("expected body to pass through unchanged, got %q", result)
+	}
+	if resp.Header.Get("Content-Encoding") != "zstd" {
+		t.Errorf("expected Content-Encoding to be preserved")
+	}
+}
+
+// TestServeCachedResponse_Encoding tests that cached identity bodies are encoded per request
+func TestServeCachedResponse_Encoding(t *testing.T) {
+	proxy := &Proxy{version: "1.2.3"}
+
+	entry := &cache.Entry{
+		Body:       []byte("<html><body>cached</body></html>"),
+		Headers:    make(http.Header),
+		StatusCode: 200,
+	}
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	recorder := httptest.NewRecorder()
+	proxy.serveCachedResponse(recorder, req, entry)
+
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip Content-Encoding, got %q", recorder.Header().Get("Content-Encoding"))
+	}
+
+	zr, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("cached response is not valid gzip: %v", err)
+	}
+	decoded, _ := io.ReadAll(zr)
+	if string(decoded) != string(entry.Body) {
+		t.Errorf("expected %q, got %q", entry.Body, decoded)
+	}
+}
@@ -0,0 +1,160 @@
+// This file implements what XRP tells backends about the requests it forwards:
+// the Host header, X-Forwarded-For, X-Forwarded-Proto, and X-Forwarded-Host, and
+// the RFC 7239 Forwarded header, by the site's forwarding settings.
+//
+// Forwarding headers are passed on only from trusted proxies, whose
+// X-Forwarded-For also gives the client IP that is logged, traced, hashed, and
+// passed to plugins. Other clients' forwarding headers are replaced, so clients
+// can't claim another address or scheme.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// clientIPKey is the request context key for the client IP reported by trusted proxies
+type clientIPKey struct{}
+
+// withClientIP records the client IP reported in req's X-Forwarded-For, if XRP's
+// peer is a trusted proxy
+func withClientIP(req *http.Request, forwarding config.ForwardingConfig) *http.Request {
+	if len(forwarding.TrustedProxies) == 0 {
+		return req
+	}
+	if ip := forwardedClientIP(req, forwarding); ip != "" {
+		return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ip))
+	}
+	return req
+}
+
+// forwardedClientIP walks X-Forwarded-For from XRP's peer back past trusted proxies,
+// and returns the first address that isn't one. It returns "" if the peer isn't
+// trusted.
+func forwardedClientIP(req *http.Request, forwarding config.ForwardingConfig) string {
+	peer, ok := peerAddr(req)
+	if !ok || !forwarding.TrustsProxy(peer) {
+		return ""
+	}
+
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(strings.TrimSpace(hops[i]))
+		if !ok {
+			break
+		}
+		client = addr
+		if !forwarding.TrustsProxy(addr) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+// peerAddr returns the address of the client or proxy connected to XRP
+func peerAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// parseHop parses an X-Forwarded-For entry, which some proxies give with a port
+func parseHop(hop string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr, true
+	}
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// forward sets the Host and forwarding headers of req by its site's forwarding
+// settings, and removes the headers it strips. It is part of the reverse proxy's
+// Director, so req is already addressed to the backend, but req.Host is still the
+// client's.
+func (p *Proxy) forward(req *http.Request) {
+	forwarding := p.siteConfig(req).Forwarding
+	peer, ok := peerAddr(req)
+	trusted := ok && forwarding.TrustsProxy(peer)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Host
+
+	if !trusted || forwarding.DisableXForwarded {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+	}
+	if !trusted {
+		req.Header.Del("Forwarded")
+	}
+
+	if forwarding.DisableXForwarded {
+		// A nil X-Forwarded-For stops ReverseProxy from adding one
+		req.Header["X-Forwarded-For"] = nil
+	} else {
+		// ReverseProxy appends the peer's address to X-Forwarded-For
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", host)
+		}
+	}
+
+	if forwarding.Forwarded {
+		node := "unknown"
+		if ok {
+			node = peer.Unmap().String()
+			if peer.Unmap().Is6() {
+				node = "[" + node + "]"
+			}
+		}
+		element := "for=" + forwardedValue(node) + ";host=" + forwardedValue(host) + ";proto=" + proto
+		req.Header.Set("Forwarded", strings.Join(append(req.Header.Values("Forwarded"), element), ", "))
+	}
+
+	for _, header := range forwarding.StripHeaders {
+		req.Header.Del(header)
+		if http.CanonicalHeaderKey(header) == "X-Forwarded-For" {
+			req.Header["X-Forwarded-For"] = nil
+		}
+	}
+
+	switch forwarding.Host {
+	case "", config.HostPreserve:
+	case config.HostBackend:
+		// An empty Host is sent as the host of the upstream the pool picks
+		req.Host = ""
+	default:
+		req.Host = forwarding.Host
+	}
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is an RFC 7230 token
+func forwardedValue(value string) string {
+	isToken := value != "" && !strings.ContainsFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	})
+	if isToken {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestForward(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarding config.ForwardingConfig
+		remoteAddr string
+		tls        bool
+		headers    map[string]string
+		want       map[string]string
+		wantHost   string
+	}{
+		{
+			name:       "defaults",
+			remoteAddr: "192.0.2.1:1234",
+			want:       map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "example.com", "Forwarded": ""},
+			wantHost:   "example.com",
+		},
+		{
+			name:       "TLS",
+			remoteAddr: "192.0.2.1:1234",
+			tls:        true,
+			want:       map[string]string{"X-Forwarded-Proto": "https"},
+			wantHost:   "example.com",
+		},
+		{
+			name:       "untrusted client headers are replaced",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "10.0.0.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example",
+				"Forwarded": "for=10.0.0.1",
+			},
+			want:     map[string]string{"X-Forwarded-For": "", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "example.com", "Forwarded": ""},
+			wantHost: "example.com",
+		},
+		{
+			name:       "trusted proxy headers are kept",
+			forwarding: config.ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8"}, Forwarded: true},
+			remoteAddr: "10.1.2.3:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "www.example.com",
+				"Forwarded": "for=198.51.100.7;proto=https",
+			},
+			want: map[string]string{
+				"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "www.example.com",
+				"Forwarded": "for=198.51.100.7;proto=https, for=10.1.2.3;host=example.com;proto=http",
+			},
+			wantHost: "example.com",
+		},
+		{
+			name:       "Forwarded quoting",
+			forwarding: config.ForwardingConfig{Forwarded: true},
+			remoteAddr: "[2001:db8::1]:1234",
+			want:       map[string]string{"Forwarded": `for="[2001:db8::1]";host=example.com;proto=http`},
+			wantHost:   "example.com",
+		},
+		{
+			name:       "X-Forwarded disabled",
+			forwarding: config.ForwardingConfig{TrustedProxies: []string{"10.0.0.1"}, DisableXForwarded: true},
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-Proto": "https"},
+			want:       map[string]string{"X-Forwarded-Proto": "", "X-Forwarded-Host": ""},
+			wantHost:   "example.com",
+		},
+		{
+			name:       "backend host and stripped headers",
+			forwarding: config.ForwardingConfig{Host: config.HostBackend, StripHeaders: []string{"X-Internal-Token"}},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Internal-Token": "secret", "X-Other": "kept"},
+			want:       map[string]string{"X-Internal-Token": "", "X-Other": "kept"},
+			wantHost:   "",
+		},
+		{
+			name:       "host override",
+			forwarding: config.ForwardingConfig{Host: "app.internal"},
+			remoteAddr: "192.0.2.1:1234",
+			want:       map[string]string{"X-Forwarded-Host": "example.com"},
+			wantHost:   "app.internal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{config: &config.Config{Forwarding: tt.forwarding}}
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			p.forward(req)
+			for key, want := range tt.want {
+				if got := req.Header.Get(key); got != want {
+					t.Errorf("expected %s %q, got %q", key, want, got)
+				}
+			}
+			if req.Host != tt.wantHost {
+				t.Errorf("expected Host %q, got %q", tt.wantHost, req.Host)
+			}
+		})
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	forwarding := config.ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::/32"}}
+
+	tests := []struct {
+		remoteAddr, forwardedFor, want string
+	}{
+		{"192.0.2.1:1234", "198.51.100.7", ""},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"[2001:db8::1]:1234", "198.51.100.7:5555", "198.51.100.7"},
+		{"10.0.0.1:1234", "garbage, 10.0.0.2", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := forwardedClientIP(req, forwarding); got != tt.want {
+			t.Errorf("forwardedClientIP(%s, %q) = %q, want %q", tt.remoteAddr, tt.forwardedFor, got, tt.want)
+		}
+	}
+}
+
+// TestForwarding_Backend tests the headers a backend receives through the proxy
+func TestForwarding_Backend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"host":  r.Host,
+			"for":   r.Header.Get("X-Forwarded-For"),
+			"proto": r.Header.Get("X-Forwarded-Proto"),
+		})
+	}))
+	defer backend.Close()
+
+	proxy, err := New(&config.Config{
+		BackendURL: backend.URL,
+		Forwarding: config.ForwardingConfig{
+			Host:           config.HostBackend,
+			TrustedProxies: []string{"10.0.0.0/8"},
+		},
+		MaxResponseSizeMB: 10,
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+		Cache:             config.CacheConfig{Disabled: true},
+	}, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	req := httptest.NewRequest("GET", "http://blog.example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	var got map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected response %d %q", recorder.Code, recorder.Body.String())
+	}
+	want := map[string]string{
+		"host":  backend.Listener.Addr().String(),
+		"for":   "198.51.100.7, 10.0.0.1",
+		"proto": "https",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("expected backend to see %s %q, got %q", key, value, got[key])
+		}
+	}
+}
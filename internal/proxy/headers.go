@@ -0,0 +1,74 @@
+// This file implements the response header rules stage. Rules are applied as a
+// response's headers are written to the client: after plugins have run, and
+// whether the response came from the backend or the cache. The cache stores the
+// headers as they were before the rules, so rules and their placeholders are
+// applied afresh to every response served from it.
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// headerRewriter is a ResponseWriter that applies a site's response header rules
+// to the final response written through it
+type headerRewriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	site        *config.Config
+	version     string
+	wroteHeader bool
+}
+
+// newHeaderRewriter returns w wrapped to apply site's response header rules to
+// the response to req, or w itself if there are none
+func newHeaderRewriter(w http.ResponseWriter, req *http.Request, site *config.Config, version string) http.ResponseWriter {
+	if site == nil || len(site.ResponseHeaders) == 0 {
+		return w
+	}
+	return &headerRewriter{ResponseWriter: w, req: req, site: site, version: version}
+}
+
+func (hr *headerRewriter) WriteHeader(statusCode int) {
+	// Informational responses are sent as they are
+	if !hr.wroteHeader && statusCode >= http.StatusOK {
+		hr.wroteHeader = true
+		rewriteHeaders(hr.Header(), hr.req, hr.site, hr.version)
+	}
+	hr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (hr *headerRewriter) Write(b []byte) (int, error) {
+	if !hr.wroteHeader {
+		hr.WriteHeader(http.StatusOK)
+	}
+	return hr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. for Flush)
+func (hr *headerRewriter) Unwrap() http.ResponseWriter {
+	return hr.ResponseWriter
+}
+
+// rewriteHeaders applies the site's response header rules for the response's MIME
+// type to header, the headers of the response to req
+func rewriteHeaders(header http.Header, req *http.Request, site *config.Config, version string) {
+	var requestID string
+	if rl := requestLogFor(req); rl != nil {
+		requestID = rl.requestID
+	}
+	vars := map[string]string{
+		config.PlaceholderRequestID:   requestID,
+		config.PlaceholderCacheStatus: header.Get("X-XRP-Cache"),
+		config.PlaceholderRoute:       site.Route,
+		config.PlaceholderVersion:     version,
+	}
+
+	mimeType := extractMimeType(header.Get("Content-Type"))
+	for i := range site.ResponseHeaders {
+		if rule := &site.ResponseHeaders[i]; rule.AppliesTo(mimeType) {
+			rule.Apply(header, vars)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// TestResponseHeaders tests that header rules apply to fresh and cached responses,
+// and that the cache keeps the backend's headers
+func TestResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("X-Powered-By", "PHP/8.3")
+		w.Header().Set("Server", "nginx/1.27.0")
+		_, _ = w.Write([]byte("<html><body>Hello</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy, err := New(&config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+		ResponseHeaders: []config.HeaderRuleConfig{
+			{Action: config.HeaderActionSet, Header: "Strict-Transport-Security", Value: "max-age=63072000"},
+			{Action: config.HeaderActionRemove, Header: "X-Powered-By"},
+			{Action: config.HeaderActionReplace, Header: "Server", Pattern: `/[\d.]+$`},
+			{Action: config.HeaderActionSet, Header: "X-Served", Value: "{cache_status} {request_id}"},
+			{Action: config.HeaderActionSet, Header: "Content-Security-Policy", Value: "default-src 'self'", MimeTypes: []string{"text/html"}},
+		},
+		Routes: []config.RouteConfig{{
+			Name:            "assets",
+			PathPrefix:      "/logo",
+			ResponseHeaders: []config.HeaderRuleConfig{{Action: config.HeaderActionAppend, Header: "X-Route", Value: "{route}"}},
+		}},
+	}, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("X-Request-Id", "req-1")
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, cache := range []string{"MISS", "HIT"} {
+		rec := get("/")
+		want := map[string]string{
+			"Strict-Transport-Security": "max-age=63072000",
+			"X-Powered-By":              "",
+			"Server":                    "nginx",
+			"X-Served":                  cache + " req-1",
+			"Content-Security-Policy":   "default-src 'self'",
+			"X-Route":                   "",
+			"X-XRP-Cache":               cache,
+		}
+		for key, value := range want {
+			if got := rec.Header().Get(key); got != value {
+				t.Errorf("%s: expected %s %q, got %q", cache, key, value, got)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	entry := proxy.cache.Get(req, proxy.config)
+	if entry == nil {
+		t.Fatal("expected the response to be cached")
+	}
+	if entry.Headers.Get("X-Powered-By") == "" || entry.Headers.Get("Strict-Transport-Security") != "" {
+		t.Errorf("expected the cache to keep the backend's headers, got %v", entry.Headers)
+	}
+
+	// Rules limited to other MIME types are skipped, and route rules follow the site's
+	rec := get("/logo.png")
+	if rec.Header().Get("Content-Security-Policy") != "" || rec.Header().Get("X-Powered-By") != "" {
+		t.Errorf("unexpected headers for image: %v", rec.Header())
+	}
+	if got := rec.Header().Get("X-Route"); got != "assets" {
+		t.Errorf("expected route header %q, got %q", "assets", got)
+	}
+}
+
+// TestResponseHeaders_NotModified tests that rules apply to 304 responses from the cache
+func TestResponseHeaders_NotModified(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("<html><body>Hello</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy, err := New(&config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+		ResponseHeaders: []config.HeaderRuleConfig{
+			{Action: config.HeaderActionSet, Header: "Strict-Transport-Security", Value: "max-age=63072000"},
+		},
+	}, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=63072000" {
+		t.Errorf("expected header rule to apply to 304, got %q", got)
+	}
+}
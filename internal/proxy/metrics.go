@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// metricsRecorder captures the status code, MIME type, and cache result of a response
+// as its headers are written, and counts the body bytes written, so ServeHTTP can
+// record request metrics and the access log.
+type metricsRecorder struct {
+	http.ResponseWriter
+	site        *config.Config
+	status      int
+	mimeType    string
+	cacheResult string
+	wroteHeader bool
+	bytes       int64
+}
+
+func (mr *metricsRecorder) WriteHeader(statusCode int) {
+	if !mr.wroteHeader {
+		mr.wroteHeader = true
+		mr.status = statusCode
+		mr.mimeType = extractMimeType(mr.Header().Get("Content-Type"))
+		mr.cacheResult = mr.Header().Get("X-XRP-Cache")
+	}
+	mr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (mr *metricsRecorder) Write(b []byte) (int, error) {
+	if !mr.wroteHeader {
+		mr.WriteHeader(http.StatusOK)
+	}
+	n, err := mr.ResponseWriter.Write(b)
+	mr.bytes += int64(n)
+	return n, err
+}
+
+// statusCode returns the status written, or 200 if none was written explicitly
+func (mr *metricsRecorder) statusCode() int {
+	if !mr.wroteHeader {
+		return http.StatusOK
+	}
+	return mr.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. for Flush)
+func (mr *metricsRecorder) Unwrap() http.ResponseWriter {
+	return mr.ResponseWriter
+}
+
+// recordRequestMetrics records the request and cache result metrics for a finished request.
+// MIME types XRP isn't configured to process are reported as "other" to bound cardinality.
+func (p *Proxy) recordRequestMetrics(mr *metricsRecorder) {
+	status := mr.statusCode()
+
+	cfg := mr.site
+	if cfg == nil {
+		p.mu.RLock()
+		cfg = p.config
+		p.mu.RUnlock()
+	}
+
+	mimeType := mr.mimeType
+	if !cfg.IsHTMLXMLMimeType(mimeType) {
+		mimeType = "other"
+	}
+
+	metrics.RequestsTotal.WithLabelValues(strconv.Itoa(status), mimeType).Inc()
+	if mr.cacheResult != "" {
+		metrics.CacheResultsTotal.WithLabelValues(mr.cacheResult).Inc()
+	}
+}
+
+// upstreamTimer is a RoundTripper that records backend latency, in the upstream
+// latency metric and the request's access log entry, and traces the round trip
+type upstreamTimer struct {
+	transport http.RoundTripper
+}
+
+func (ut *upstreamTimer) RoundTrip(req *http.Request) (*http.Response, error) {
+	outreq, span := traceUpstream(req)
+	start := time.Now()
+	resp, err := ut.transport.RoundTrip(outreq)
+	elapsed := time.Since(start)
+	endUpstreamSpan(span, resp, err)
+	metrics.UpstreamDuration.Observe(elapsed.Seconds())
+	if rl := requestLogFor(req); rl != nil {
+		rl.upstream += elapsed
+	}
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+	"github.com/cdzombak/xrp/internal/plugins"
+)
+
+func TestRecordRequestMetrics(t *testing.T) {
+	p := &Proxy{config: &config.Config{
+		MimeTypes: []config.MimeTypeConfig{{MimeType: "text/html"}},
+	}}
+
+	htmlRequests := metrics.RequestsTotal.WithLabelValues("200", "text/html")
+	otherRequests := metrics.RequestsTotal.WithLabelValues("404", "other")
+	hits := metrics.CacheResultsTotal.WithLabelValues("HIT")
+	htmlBefore, otherBefore, hitsBefore := testutil.ToFloat64(htmlRequests), testutil.ToFloat64(otherRequests), testutil.ToFloat64(hits)
+
+	// A cached HTML response with an implicit 200
+	mr := &metricsRecorder{ResponseWriter: httptest.NewRecorder()}
+	mr.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mr.Header().Set("X-XRP-Cache", "HIT")
+	if _, err := mr.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	p.recordRequestMetrics(mr)
+
+	// An unprocessed MIME type is reported as "other"
+	mr = &metricsRecorder{ResponseWriter: httptest.NewRecorder()}
+	mr.Header().Set("Content-Type", "image/png")
+	mr.WriteHeader(http.StatusNotFound)
+	p.recordRequestMetrics(mr)
+
+	if got := testutil.ToFloat64(htmlRequests) - htmlBefore; got != 1 {
+		t.Errorf("expected 1 text/html request, got %v", got)
+	}
+	if got := testutil.ToFloat64(otherRequests) - otherBefore; got != 1 {
+		t.Errorf("expected 1 other request, got %v", got)
+	}
+	if got := testutil.ToFloat64(hits) - hitsBefore; got != 1 {
+		t.Errorf("expected 1 cache hit, got %v", got)
+	}
+}
+
+func TestPluginErrorReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{errors.New("boom"), metrics.PluginErrorError},
+		{&plugins.PanicError{Plugin: "APlugin", Value: "boom"}, metrics.PluginErrorPanic},
+		{&plugins.TimeoutError{Plugin: "APlugin"}, metrics.PluginErrorTimeout},
+	}
+
+	for _, tt := range tests {
+		if got := pluginErrorReason(tt.err); got != tt.expected {
+			t.Errorf("pluginErrorReason(%v) = %q, expected %q", tt.err, got, tt.expected)
+		}
+	}
+}
+
+// TestPluginMetricsLabels tests that plugins sharing a name get their own series
+func TestPluginMetricsLabels(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("./plugins/failing.so", "GetPlugin", &failingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginManager.Register("./plugins/marker.so", "GetPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+	pluginConfigs := []config.PluginConfig{
+		{Path: "./plugins/failing.so", Name: "GetPlugin"},
+		{Path: "./plugins/marker.so", Name: "GetPlugin"},
+	}
+
+	failingErrors := metrics.PluginErrorsTotal.WithLabelValues("./plugins/failing.so/GetPlugin", metrics.PluginErrorError)
+	markerErrors := metrics.PluginErrorsTotal.WithLabelValues("./plugins/marker.so/GetPlugin", metrics.PluginErrorError)
+	failingBefore, markerBefore := testutil.ToFloat64(failingErrors), testutil.ToFloat64(markerErrors)
+	seriesBefore := testutil.CollectAndCount(metrics.PluginDuration)
+
+	if _, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader("<html></html>"), pluginConfigs, config.OnErrorSkipPlugin); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(failingErrors) - failingBefore; got != 1 {
+		t.Errorf("expected 1 error for the failing plugin, got %v", got)
+	}
+	if got := testutil.ToFloat64(markerErrors) - markerBefore; got != 0 {
+		t.Errorf("expected no errors for the other plugin named GetPlugin, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.PluginDuration) - seriesBefore; got != 2 {
+		t.Errorf("expected a duration series for each plugin, got %d new series", got)
+	}
+}
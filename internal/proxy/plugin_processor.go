@@ -6,76 +6,273 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
+	"runtime/debug"
+	"time"
 
 	"golang.org/x/net/html"
 
 	"github.com/beevik/etree"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
 	"github.com/cdzombak/xrp/internal/plugins"
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
 )
 
 // ProcessorFunc defines a function that processes a document with a plugin
-type ProcessorFunc func(plugin *plugins.LoadedPlugin, ctx context.Context, url *url.URL, document interface{}) error
+type ProcessorFunc func(plugin *plugins.LoadedPlugin, ctx context.Context, pctx *xrpplugin.ProcessingContext, document interface{}) error
 
-// ParserFunc defines a function that parses body bytes into a document
-type ParserFunc func(body []byte) (interface{}, error)
+// ParserFunc defines a function that parses a body into a document as it reads it
+type ParserFunc func(body io.Reader) (interface{}, error)
 
 // RendererFunc defines a function that renders a document back to bytes
 type RendererFunc func(document interface{}) ([]byte, error)
 
-// processWithPlugins is a generic function that processes any document type with plugins
+// CopierFunc defines a function that makes a deep copy of a document
+type CopierFunc func(document interface{}) interface{}
+
+// Document types, used as metric labels
+const (
+	documentHTML = "html"
+	documentXML  = "xml"
+)
+
+// processWithPlugins is a generic function that processes any document type with plugins,
+// run in turn by runPluginChain. skipped reports whether a failing plugin was skipped
+// under the skip_plugin policy, in which case the output lacks that plugin's changes.
 func (p *Proxy) processWithPlugins(
-	body []byte,
-	req *http.Request,
+	body io.Reader,
+	resp *http.Response,
 	pluginConfigs []config.PluginConfig,
+	onError string,
+	documentType string,
 	parser ParserFunc,
 	processor ProcessorFunc,
 	renderer RendererFunc,
-) ([]byte, error) {
+	copier CopierFunc,
+) (output []byte, skipped bool, err error) {
+	req := resp.Request
+	ctx := req.Context()
+
 	// Parse the document
+	_, parseSpan := startStageSpan(ctx, documentType+".parse")
+	parseStart := time.Now()
 	document, err := parser(body)
+	metrics.ParseDuration.WithLabelValues(documentType).Observe(time.Since(parseStart).Seconds())
+	endStageSpan(parseSpan, err)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Process with plugins. Header changes made by plugins go straight to the response.
+	// Under skip_plugin, a failing plugin's partial changes to the document and
+	// headers are undone before the rest of the chain runs.
+	pctx := xrpplugin.NewProcessingContext(req, clientIP(req), resp.StatusCode, resp.Header)
+	skipped, err = p.runPluginChain(req, pluginConfigs, onError,
+		func(ctx context.Context, plugin *plugins.LoadedPlugin, pluginConfig config.PluginConfig) (bool, error) {
+			if onError != config.OnErrorSkipPlugin {
+				return runPlugin(ctx, plugin, pluginConfig, processor, pctx, document)
+			}
+			savedDocument, savedHeader := copier(document), resp.Header.Clone()
+			abandoned, err := runPlugin(ctx, plugin, pluginConfig, processor, pctx, document)
+			if err != nil && !abandoned {
+				document = savedDocument
+				restoreHeader(resp.Header, savedHeader)
+			}
+			return abandoned, err
+		})
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	// Render the document back to bytes
+	_, renderSpan := startStageSpan(ctx, documentType+".render")
+	renderStart := time.Now()
+	output, err = renderer(document)
+	metrics.RenderDuration.WithLabelValues(documentType).Observe(time.Since(renderStart).Seconds())
+	endStageSpan(renderSpan, err)
+	return output, skipped, err
+}
+
+// restoreHeader replaces the contents of header with those of saved, keeping the
+// map that plugins were given
+func restoreHeader(header, saved http.Header) {
+	for key := range header {
+		delete(header, key)
+	}
+	for key, values := range saved {
+		header[key] = values
 	}
+}
 
-	// Process with plugins
+// pluginRunner runs one plugin of a chain; see runPlugin for its results
+type pluginRunner func(ctx context.Context, plugin *plugins.LoadedPlugin, pluginConfig config.PluginConfig) (abandoned bool, err error)
+
+// runPluginChain runs each configured plugin for req in turn with run.
+// Under the skip_plugin error policy, a failing plugin is logged and skipped, and
+// skipped is true; any other policy aborts processing on the first plugin error.
+// Plugins that time out always abort processing, since they may still be modifying
+// the document. Plugins disabled after repeated failures are skipped.
+func (p *Proxy) runPluginChain(req *http.Request, pluginConfigs []config.PluginConfig, onError string, run pluginRunner) (skipped bool, err error) {
 	ctx := req.Context()
 	requestURL := req.URL
 
 	for _, pluginConfig := range pluginConfigs {
 		plugin := p.plugins.GetPlugin(pluginConfig.Path, pluginConfig.Name)
 		if plugin == nil {
-			return nil, fmt.Errorf("plugin not found: %s/%s", pluginConfig.Path, pluginConfig.Name)
+			return false, fmt.Errorf("plugin not found: %s/%s", pluginConfig.Path, pluginConfig.Name)
+		}
+		if plugin.Disabled() {
+			slog.Debug("Skipping disabled plugin", "plugin", pluginConfig.Name, "url", requestURL.Path)
+			continue
+		}
+
+		// Plugins receive the span's context, so they can create child spans
+		pluginCtx, pluginSpan := startStageSpan(ctx, "plugin "+pluginConfig.ID(),
+			attribute.String("xrp.plugin.id", pluginConfig.ID()),
+			attribute.String("xrp.plugin.name", pluginConfig.Name),
+			attribute.String("xrp.plugin.path", pluginConfig.Path))
+		pluginStart := time.Now()
+		abandoned, err := run(pluginCtx, plugin, pluginConfig)
+		pluginDuration := time.Since(pluginStart)
+		endStageSpan(pluginSpan, err)
+		metrics.PluginDuration.WithLabelValues(pluginConfig.ID()).Observe(pluginDuration.Seconds())
+		recordPluginTiming(req, pluginConfig.ID(), pluginDuration)
+		if err == nil {
+			plugin.RecordSuccess()
+			continue
 		}
 
-		if err := processor(plugin, ctx, requestURL, document); err != nil {
-			return nil, fmt.Errorf("plugin %s failed: %w", pluginConfig.Name, err)
+		recordPluginFailure(req, plugin, pluginConfig, err)
+		if onError == config.OnErrorSkipPlugin && !abandoned {
+			slog.Warn("Skipping failed plugin", "plugin", pluginConfig.Name, "url", requestURL.Path, "error", err)
+			skipped = true
+			continue
 		}
+		return false, fmt.Errorf("plugin %s failed: %w", pluginConfig.Name, err)
 	}
+	return skipped, nil
+}
 
-	// Render the document back to bytes
-	return renderer(document)
+// recordPluginFailure counts a plugin failure, logging panics and disabling the
+// plugin once it has failed too many times in a row
+func recordPluginFailure(req *http.Request, plugin *plugins.LoadedPlugin, pluginConfig config.PluginConfig, err error) {
+	metrics.PluginErrorsTotal.WithLabelValues(pluginConfig.ID(), pluginErrorReason(err)).Inc()
+	var panicErr *plugins.PanicError
+	if errors.As(err, &panicErr) {
+		slog.Error("Plugin panicked", "plugin", pluginConfig.Name, "url", req.URL.Path,
+			"panic", fmt.Sprint(panicErr.Value), "stack", string(panicErr.Stack))
+	}
+	if plugin.RecordFailure(pluginConfig.MaxConsecutiveFailures) {
+		slog.Error("Disabling plugin after repeated failures", "plugin", pluginConfig.Name,
+			"failures", pluginConfig.MaxConsecutiveFailures)
+	}
+}
+
+// pluginErrorReason classifies a plugin error for the plugin error metric
+func pluginErrorReason(err error) string {
+	var panicErr *plugins.PanicError
+	var timeoutErr *plugins.TimeoutError
+	switch {
+	case errors.As(err, &panicErr):
+		return metrics.PluginErrorPanic
+	case errors.As(err, &timeoutErr):
+		return metrics.PluginErrorTimeout
+	default:
+		return metrics.PluginErrorError
+	}
+}
+
+// runPlugin runs a single plugin, converting panics into *plugins.PanicError. When the
+// plugin has a timeout, it runs under a context deadline and is abandoned with a
+// *plugins.TimeoutError if it doesn't return in time. abandoned reports whether the
+// plugin may still be running, in which case the document must not be used further.
+// Remote plugins enforce their own timeouts and are never abandoned.
+func runPlugin(
+	ctx context.Context,
+	plugin *plugins.LoadedPlugin,
+	pluginConfig config.PluginConfig,
+	processor ProcessorFunc,
+	pctx *xrpplugin.ProcessingContext,
+	document interface{},
+) (abandoned bool, err error) {
+	call := func(ctx context.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &plugins.PanicError{Plugin: pluginConfig.Name, Value: r, Stack: debug.Stack()}
+			}
+		}()
+		return processor(plugin, ctx, pctx, document)
+	}
+
+	if pluginConfig.TimeoutMS <= 0 {
+		return false, call(ctx)
+	}
+
+	timeout := time.Duration(pluginConfig.TimeoutMS) * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if pluginConfig.IsRemote() {
+		return false, call(ctx)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return true, &plugins.TimeoutError{Plugin: pluginConfig.Name, Timeout: timeout}
+		}
+		return true, ctx.Err()
+	}
 }
 
 // HTML processing functions
-func parseHTML(body []byte) (interface{}, error) {
-	doc, err := html.Parse(bytes.NewReader(body))
+func parseHTML(body io.Reader) (interface{}, error) {
+	doc, err := html.Parse(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse HTML: %w", err)
 	}
 	return doc, nil
 }
 
-func processHTML(plugin *plugins.LoadedPlugin, ctx context.Context, url *url.URL, document interface{}) error {
+func processHTML(plugin *plugins.LoadedPlugin, ctx context.Context, pctx *xrpplugin.ProcessingContext, document interface{}) error {
 	node, ok := document.(*html.Node)
 	if !ok {
 		return fmt.Errorf("invalid document type for HTML processing")
 	}
-	return plugin.ProcessHTMLTree(ctx, url, node)
+	return plugin.ProcessHTML(ctx, pctx, node)
+}
+
+func copyHTML(document interface{}) interface{} {
+	return copyHTMLNode(document.(*html.Node))
+}
+
+// copyHTMLNode returns a deep copy of the tree rooted at n
+func copyHTMLNode(n *html.Node) *html.Node {
+	c := &html.Node{
+		Type:      n.Type,
+		DataAtom:  n.DataAtom,
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      append([]html.Attribute(nil), n.Attr...),
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.AppendChild(copyHTMLNode(child))
+	}
+	return c
 }
 
 func renderHTML(document interface{}) ([]byte, error) {
@@ -92,20 +289,24 @@ func renderHTML(document interface{}) ([]byte, error) {
 }
 
 // XML processing functions
-func parseXML(body []byte) (interface{}, error) {
+func parseXML(body io.Reader) (interface{}, error) {
 	doc := etree.NewDocument()
-	if err := doc.ReadFromBytes(body); err != nil {
+	if _, err := doc.ReadFrom(body); err != nil {
 		return nil, fmt.Errorf("failed to parse XML: %w", err)
 	}
 	return doc, nil
 }
 
-func processXML(plugin *plugins.LoadedPlugin, ctx context.Context, url *url.URL, document interface{}) error {
+func processXML(plugin *plugins.LoadedPlugin, ctx context.Context, pctx *xrpplugin.ProcessingContext, document interface{}) error {
 	doc, ok := document.(*etree.Document)
 	if !ok {
 		return fmt.Errorf("invalid document type for XML processing")
 	}
-	return plugin.ProcessXMLTree(ctx, url, doc)
+	return plugin.ProcessXML(ctx, pctx, doc)
+}
+
+func copyXML(document interface{}) interface{} {
+	return document.(*etree.Document).Copy()
 }
 
 func renderXML(document interface{}) ([]byte, error) {
@@ -1,9 +1,22 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
 
 	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
 )
 
 // TestPluginProcessingCommon tests the common plugin processing logic
@@ -58,3 +71,319 @@ func TestPluginProcessingCommon(t *testing.T) {
 		})
 	}
 }
+
+// markerPlugin appends a marker comment to HTML documents
+type markerPlugin struct{}
+
+func (m *markerPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: "marker"})
+	return nil
+}
+
+func (m *markerPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+// TestProcessWithPlugins_SkipPlugin tests that the skip_plugin policy continues past failing plugins
+func TestProcessWithPlugins_SkipPlugin(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "FailingPlugin", &failingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginManager.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &Proxy{plugins: pluginManager}
+	pluginConfigs := []config.PluginConfig{
+		{Path: "builtin", Name: "FailingPlugin"},
+		{Path: "builtin", Name: "MarkerPlugin"},
+	}
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+		Request:    httptest.NewRequest("GET", "/test", nil),
+	}
+	body := "<html><body></body></html>"
+
+	result, _, err := proxy.processHTMLResponse(resp, strings.NewReader(body), pluginConfigs, config.OnErrorSkipPlugin)
+	if err != nil {
+		t.Fatalf("unexpected error with skip_plugin policy: %v", err)
+	}
+	if !strings.Contains(string(result), "<!--marker-->") {
+		t.Errorf("expected later plugin to run, got %q", result)
+	}
+
+	if _, _, err := proxy.processHTMLResponse(resp, strings.NewReader(body), pluginConfigs, config.OnErrorPassthrough); err == nil {
+		t.Error("expected error with passthrough policy")
+	}
+}
+
+// partialPlugin is a PluginV2 that changes the tree and headers, then fails
+type partialPlugin struct{}
+
+func (p *partialPlugin) ProcessHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, node *html.Node) error {
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: "partial"})
+	pctx.ResponseHeader().Set("X-Partial", "1")
+	pctx.ResponseHeader().Del("X-Original")
+	return errors.New("plugin gave up halfway")
+}
+
+func (p *partialPlugin) ProcessXML(ctx context.Context, pctx *xrpplugin.ProcessingContext, doc *etree.Document) error {
+	doc.SetRoot(etree.NewElement("partial"))
+	return errors.New("plugin gave up halfway")
+}
+
+// TestProcessWithPlugins_SkipPluginRestores tests that the skip_plugin policy undoes
+// a failing plugin's changes before the rest of the chain runs
+func TestProcessWithPlugins_SkipPluginRestores(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "PartialPlugin", &partialPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginManager.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+	pluginConfigs := []config.PluginConfig{
+		{Path: "builtin", Name: "PartialPlugin"},
+		{Path: "builtin", Name: "MarkerPlugin"},
+	}
+
+	resp := newPluginTestResponse()
+	resp.Header.Set("X-Original", "1")
+	result, skipped, err := proxy.processHTMLResponse(resp, strings.NewReader("<html><body></body></html>"), pluginConfigs, config.OnErrorSkipPlugin)
+	if err != nil {
+		t.Fatalf("unexpected error with skip_plugin policy: %v", err)
+	}
+	if !skipped {
+		t.Error("expected the failing plugin to be reported as skipped")
+	}
+	if strings.Contains(string(result), "partial") || !strings.Contains(string(result), "<!--marker-->") {
+		t.Errorf("expected only the later plugin's changes, got %q", result)
+	}
+	if resp.Header.Get("X-Partial") != "" || resp.Header.Get("X-Original") != "1" {
+		t.Errorf("expected the failing plugin's header changes to be undone, got %v", resp.Header)
+	}
+
+	xmlPluginConfigs := []config.PluginConfig{{Path: "builtin", Name: "PartialPlugin"}}
+	result, _, err = proxy.processXMLResponse(newPluginTestResponse(), strings.NewReader("<feed/>"), xmlPluginConfigs, config.OnErrorSkipPlugin)
+	if err != nil {
+		t.Fatalf("unexpected error with skip_plugin policy: %v", err)
+	}
+	if !strings.Contains(string(result), "<feed/>") {
+		t.Errorf("expected the XML document to be restored, got %q", result)
+	}
+}
+
+// TestModifyResponse_SkipPluginNotCached tests that a response served without a
+// skipped plugin's changes isn't cached
+func TestModifyResponse_SkipPluginNotCached(t *testing.T) {
+	var calls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body></body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL, func(cfg *config.Config) {
+		cfg.MimeTypes[0].OnError = config.OnErrorSkipPlugin
+	})
+	if err := proxy.plugins.Register("builtin", "PartialPlugin", &partialPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "PartialPlugin"}}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(proxy, "GET"); rec.Code != http.StatusOK || rec.Header().Get("X-XRP-Cache") != "MISS" {
+			t.Errorf("request %d: expected uncached 200, got %d %s", i+1, rec.Code, rec.Header().Get("X-XRP-Cache"))
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected every request to reach the backend, got %d calls", calls)
+	}
+}
+
+// contextPlugin is a PluginV2 that injects a nonce into both the response headers and the tree
+type contextPlugin struct{}
+
+func (c *contextPlugin) ProcessHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, node *html.Node) error {
+	bucket := "control"
+	if cookie, err := pctx.Cookie("ab"); err == nil {
+		bucket = cookie.Value
+	}
+	pctx.ResponseHeader().Set("Content-Security-Policy", "script-src 'nonce-abc'")
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: "bucket=" + bucket + " ip=" + pctx.ClientIP()})
+	return nil
+}
+
+func (c *contextPlugin) ProcessXML(ctx context.Context, pctx *xrpplugin.ProcessingContext, doc *etree.Document) error {
+	return nil
+}
+
+// TestProcessWithPlugins_ProcessingContext tests that PluginV2 plugins see request data and can set response headers
+func TestProcessWithPlugins_ProcessingContext(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "ContextPlugin", &contextPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	req.AddCookie(&http.Cookie{Name: "ab", Value: "variant"})
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	result, _, err := proxy.processHTMLResponse(resp, strings.NewReader("<html><body></body></html>"),
+		[]config.PluginConfig{{Path: "builtin", Name: "ContextPlugin"}}, config.OnErrorFail)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(result), "<!--bucket=variant ip=192.0.2.10-->") {
+		t.Errorf("expected plugin to see cookie and client IP, got %q", result)
+	}
+	if resp.Header.Get("Content-Security-Policy") != "script-src 'nonce-abc'" {
+		t.Errorf("expected plugin to set response header, got %q", resp.Header.Get("Content-Security-Policy"))
+	}
+}
+
+// panickingPlugin dereferences a nil pointer
+type panickingPlugin struct{}
+
+func (p *panickingPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	var n *html.Node
+	_ = n.Data
+	return nil
+}
+
+func (p *panickingPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+// slowPlugin blocks until its context is done, then keeps modifying the tree
+type slowPlugin struct {
+	finished chan struct{}
+}
+
+func (s *slowPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	<-ctx.Done()
+	close(s.finished)
+	return ctx.Err()
+}
+
+func (s *slowPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+func newPluginTestResponse() *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+		Request:    httptest.NewRequest("GET", "/test", nil),
+	}
+}
+
+// TestProcessWithPlugins_Panic tests that plugin panics become PanicErrors instead of crashing
+func TestProcessWithPlugins_Panic(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "PanickingPlugin", &panickingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginManager.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+	body := "<html><body></body></html>"
+
+	_, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader(body),
+		[]config.PluginConfig{{Path: "builtin", Name: "PanickingPlugin"}}, config.OnErrorFail)
+	var panicErr *plugins.PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("expected PanicError, got %v", err)
+	}
+	if panicErr.Plugin != "PanickingPlugin" {
+		t.Errorf("expected plugin name in PanicError, got %q", panicErr.Plugin)
+	}
+	if !strings.Contains(string(panicErr.Stack), "panickingPlugin") {
+		t.Error("expected PanicError to carry the plugin's stack")
+	}
+
+	// Panics are skippable like any other plugin error
+	result, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader(body), []config.PluginConfig{
+		{Path: "builtin", Name: "PanickingPlugin"},
+		{Path: "builtin", Name: "MarkerPlugin"},
+	}, config.OnErrorSkipPlugin)
+	if err != nil {
+		t.Fatalf("unexpected error with skip_plugin policy: %v", err)
+	}
+	if !strings.Contains(string(result), "<!--marker-->") {
+		t.Errorf("expected later plugin to run, got %q", result)
+	}
+}
+
+// TestProcessWithPlugins_Timeout tests that slow plugins are abandoned at their deadline
+func TestProcessWithPlugins_Timeout(t *testing.T) {
+	slow := &slowPlugin{finished: make(chan struct{})}
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "SlowPlugin", slow); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginManager.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+
+	start := time.Now()
+	_, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader("<html><body></body></html>"), []config.PluginConfig{
+		{Path: "builtin", Name: "SlowPlugin", TimeoutMS: 50},
+		{Path: "builtin", Name: "MarkerPlugin"},
+	}, config.OnErrorSkipPlugin)
+
+	var timeoutErr *plugins.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TimeoutError even under skip_plugin, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected TimeoutError to match context.DeadlineExceeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected processing to stop at the deadline, took %s", elapsed)
+	}
+
+	select {
+	case <-slow.finished:
+	case <-time.After(time.Second):
+		t.Error("expected plugin context to be cancelled at the deadline")
+	}
+}
+
+// TestProcessWithPlugins_DisableAfterFailures tests that repeatedly failing plugins are disabled
+func TestProcessWithPlugins_DisableAfterFailures(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "FailingPlugin", &failingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{plugins: pluginManager}
+	pluginConfigs := []config.PluginConfig{{Path: "builtin", Name: "FailingPlugin", MaxConsecutiveFailures: 2}}
+	body := "<html><body></body></html>"
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader(body), pluginConfigs, config.OnErrorFail); err == nil {
+			t.Fatalf("expected failure %d to be returned", i+1)
+		}
+	}
+
+	if !pluginManager.GetPlugin("builtin", "FailingPlugin").Disabled() {
+		t.Fatal("expected plugin to be disabled after 2 consecutive failures")
+	}
+	if _, _, err := proxy.processHTMLResponse(newPluginTestResponse(), strings.NewReader(body), pluginConfigs, config.OnErrorFail); err != nil {
+		t.Errorf("expected disabled plugin to be skipped, got %v", err)
+	}
+}
@@ -5,9 +5,20 @@
 //
 // - Intelligent Redis-based caching with HTTP compliance
 // - Plugin-based content modification for HTML/XML responses
+// - Streaming HTML rewriting with constant memory, for plugins that support it (see stream.go)
 // - Request/response size validation and security controls
+// - Bounded response buffering: pooled memory, spilling to disk, and a global memory budget (see buffer.go)
 // - Version headers and cache status reporting
+// - Configurable error handling (serve the original response when processing fails)
 // - Configuration hot-reloading and graceful error handling
+// - Virtual hosting: each configured site has its own backend, plugins, and cache settings
+// - Routes that select plugin chains, or skip processing or caching, by path, host, method, query, or header
+// - Response header rules applied to fresh and cached responses alike (see headers.go)
+// - Host header and X-Forwarded-*/Forwarded policy, honoring trusted proxies (see forwarding.go)
+// - Load balancing over a list of upstreams, with health checks and retries (see upstream.go)
+// - Tunable backend connections, with private CAs and client certificates for https upstreams (see transport.go)
+// - A structured access log with cache, plugin, and latency details (see accesslog.go)
+// - OpenTelemetry tracing of requests, cache access, upstream calls, and plugins (see tracing.go)
 //
 // The proxy works by intercepting HTTP responses, checking if they contain
 // HTML or XML content that should be processed, parsing the content into
@@ -24,43 +35,109 @@
 //	http.ListenAndServe(":8080", proxy)
 //
 // The proxy automatically adds X-XRP-Version and X-XRP-Cache headers to
-// all responses to indicate processing status and enable monitoring.
+// all responses to indicate processing status and enable monitoring. Stale cached
+// responses, served while they are refreshed or because the backend failed, are
+// marked X-XRP-Cache: STALE, and expired responses the backend confirmed unchanged
+// with 304 Not Modified are marked REVALIDATED (see stale.go).
+//
+// Each request is matched to a site by its Host header (see config.ResolveSite).
+// Requests for hosts that match no site, when there is no top-level backend_url,
+// are rejected with 421 Misdirected Request.
 package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cdzombak/xrp/internal/accesslog"
 	"github.com/cdzombak/xrp/internal/cache"
 	"github.com/cdzombak/xrp/internal/config"
 	"github.com/cdzombak/xrp/internal/plugins"
 )
 
 type Proxy struct {
-	mu           sync.RWMutex
-	config       *config.Config
-	reverseProxy *httputil.ReverseProxy
-	cache        *cache.Cache
-	plugins      *plugins.Manager
-	version      string
+	mu      sync.RWMutex
+	config  *config.Config
+	cache   *cache.Cache
+	plugins *plugins.Manager
+	version string
+	// accessLog is nil when the access log is disabled
+	accessLog *accesslog.Logger
+	// buffering holds response bodies and limits the memory they use
+	buffering *bodyBuffering
+
+	// reverseProxies holds a reverse proxy per backend
+	reverseProxies map[backendKey]*httputil.ReverseProxy
+	// pools holds each backend's upstreams; it is the Transport of its reverse proxy
+	pools map[backendKey]*upstreamPool
+	// inFlight counts the requests using the current configuration, cache, and
+	// access log, so those replaced by a reload are closed once they are done
+	inFlight *sync.WaitGroup
+	// revalidating holds the cache keys of stale entries being refreshed
+	revalidating sync.Map
+	// flights coalesces concurrent cache misses
+	flights flightGroup
+}
+
+// siteConfigKey is the request context key for the resolved site configuration
+type siteConfigKey struct{}
+
+// snapshot is the configuration, and the components built from it, that a request
+// uses from start to finish. Requests take a snapshot as they arrive, so they don't
+// hold p.mu while they are proxied, and a reload doesn't change them midway.
+type snapshot struct {
+	config         *config.Config
+	cache          *cache.Cache
+	accessLog      *accesslog.Logger
+	buffering      *bodyBuffering
+	reverseProxies map[backendKey]*httputil.ReverseProxy
+	// inFlight is done when the request finishes with the snapshot
+	inFlight *sync.WaitGroup
+}
+
+// snapshotKey is the request context key for the request's snapshot
+type snapshotKey struct{}
+
+// backendKey identifies a backend's reverse proxy. Sites with the same upstreams
+// and load balancing, transport, and upstream TLS settings share one.
+type backendKey struct {
+	urls          string
+	loadBalancing config.LoadBalancingConfig
+	transport     config.TransportConfig
+	tls           config.UpstreamTLSConfig
+}
+
+func keyForBackend(backend config.Backend) backendKey {
+	return backendKey{
+		urls:          strings.Join(backend.URLs, " "),
+		loadBalancing: backend.LoadBalancing,
+		transport:     backend.Transport,
+		tls:           backend.TLS,
+	}
 }
 
 func New(cfg *config.Config, version string) (*Proxy, error) {
-	target, err := url.Parse(cfg.BackendURL)
+	p := &Proxy{version: version, inFlight: new(sync.WaitGroup)}
+
+	reverseProxies, pools, err := p.newReverseProxies(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("invalid backend URL: %w", err)
+		return nil, err
 	}
 
-	cacheClient, err := cache.New(cfg.Redis)
+	cacheClient, err := cache.Open(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cache client: %w", err)
 	}
@@ -74,75 +151,354 @@ func New(cfg *config.Config, version string) (*Proxy, error) {
 		return nil, fmt.Errorf("failed to load plugins: %w", err)
 	}
 
-	rp := httputil.NewSingleHostReverseProxy(target)
-
-	p := &Proxy{
-		config:       cfg,
-		reverseProxy: rp,
-		cache:        cacheClient,
-		plugins:      pluginManager,
-		version:      version,
+	accessLog, err := newAccessLog(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	rp.ModifyResponse = p.modifyResponse
+	p.config = cfg
+	p.accessLog = accessLog
+	p.buffering = newBodyBuffering(cfg.Buffering)
+	p.reverseProxies = reverseProxies
+	p.setPools(pools)
+	p.cache = cacheClient
+	p.plugins = pluginManager
 
 	return p, nil
 }
 
-func (p *Proxy) UpdateConfig(cfg *config.Config) error {
+// newReverseProxies creates a reverse proxy for each distinct backend in cfg, with
+// a new transport and upstream pool. Pools aren't started until they are passed
+// to setPools.
+func (p *Proxy) newReverseProxies(cfg *config.Config) (map[backendKey]*httputil.ReverseProxy, map[backendKey]*upstreamPool, error) {
+	reverseProxies := make(map[backendKey]*httputil.ReverseProxy)
+	pools := make(map[backendKey]*upstreamPool)
+	for _, backend := range cfg.Backends() {
+		key := keyForBackend(backend)
+		transport, err := newTransport(backend)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool, err := newUpstreamPool(backend, transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		pools[key] = pool
+
+		// Requests are mapped onto the first upstream, then sent to the one the
+		// pool picks; upstreams differ only in scheme, host, and port
+		target, err := url.Parse(backend.URLs[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid backend URL: %w", err)
+		}
+
+		rp := httputil.NewSingleHostReverseProxy(target)
+		director := rp.Director
+		rp.Director = func(req *http.Request) {
+			director(req)
+			addValidators(req)
+			forwardRequestID(req)
+			p.forward(req)
+		}
+		rp.Transport = pool
+		rp.ModifyResponse = p.modifyResponse
+		rp.ErrorHandler = p.errorHandler
+		reverseProxies[key] = rp
+	}
+	return reverseProxies, pools, nil
+}
+
+// setPools replaces the proxy's upstream pools. Pools for backends that were
+// already in use keep their upstreams' health.
+func (p *Proxy) setPools(pools map[backendKey]*upstreamPool) {
+	for key, pool := range pools {
+		if previous, ok := p.pools[key]; ok {
+			pool.adopt(previous)
+		}
+	}
+	for _, pool := range p.pools {
+		pool.close()
+	}
+	for _, pool := range pools {
+		pool.start()
+	}
+	p.pools = pools
+}
+
+// UpstreamHealth returns an error naming the upstreams that are left out of
+// rotation, because they failed requests or health checks
+func (p *Proxy) UpstreamHealth() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var problems []string
+	for _, pool := range p.pools {
+		if err := pool.health(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.Sort(problems)
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func (p *Proxy) UpdateConfig(cfg *config.Config) (err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	target, err := url.Parse(cfg.BackendURL)
+	// Everything that can fail is built before anything is replaced, so a failed
+	// reload leaves the proxy as it was
+	reverseProxies, pools, err := p.newReverseProxies(cfg)
 	if err != nil {
-		return fmt.Errorf("invalid backend URL: %w", err)
+		return err
 	}
 
-	// Update cache client if Redis configuration changed
-	if p.config.Redis != cfg.Redis {
-		newCache, err := cache.New(cfg.Redis)
-		if err != nil {
+	// Open a new cache client if the store or Redis configuration changed
+	cacheClient := p.cache
+	if p.config.CacheStore != cfg.CacheStore || p.config.Redis != cfg.Redis {
+		if cacheClient, err = cache.Open(cfg); err != nil {
 			return fmt.Errorf("failed to create new cache client: %w", err)
 		}
-		p.cache = newCache
+		defer func() {
+			if err != nil {
+				if err := cacheClient.Close(); err != nil {
+					slog.Warn("Failed to close new cache", "error", err)
+				}
+			}
+		}()
 	}
 
+	accessLog := p.accessLog
+	if p.config.AccessLog != cfg.AccessLog {
+		if accessLog, err = newAccessLog(cfg); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				closeAccessLogger(accessLog)
+			}
+		}()
+	}
+
+	// Plugins go last, since loading them successfully replaces the running ones
 	if err := p.plugins.LoadPlugins(cfg); err != nil {
 		return fmt.Errorf("failed to reload plugins: %w", err)
 	}
 
-	rp := httputil.NewSingleHostReverseProxy(target)
-	rp.ModifyResponse = p.modifyResponse
+	// Requests in flight keep using the previous cache and access log; they are
+	// closed once those requests are done
+	previous := p.snapshot()
+	p.cache = cacheClient
+	p.accessLog = accessLog
+
+	// The memory budget carries over, since responses in flight still hold memory
+	// reserved from it
+	if p.config.Buffering != cfg.Buffering {
+		p.buffering = p.buffering.reconfigured(cfg.Buffering)
+	}
 
 	p.config = cfg
-	p.reverseProxy = rp
+	p.reverseProxies = reverseProxies
+	p.setPools(pools)
+	p.inFlight = new(sync.WaitGroup)
+
+	go func() {
+		previous.inFlight.Wait()
+		if previous.cache != cacheClient {
+			if err := previous.cache.Close(); err != nil {
+				slog.Warn("Failed to close previous cache", "error", err)
+			}
+		}
+		if previous.accessLog != accessLog {
+			closeAccessLogger(previous.accessLog)
+		}
+	}()
 
 	return nil
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Cache returns the proxy's current cache client
+func (p *Proxy) Cache() *cache.Cache {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.cache
+}
+
+// Close stops any out-of-process plugins and upstream health checks, and closes
+// the cache and access log once requests in flight are done
+func (p *Proxy) Close() {
+	p.mu.RLock()
+	inFlight := p.inFlight
+	p.mu.RUnlock()
+	inFlight.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setPools(nil)
+	p.plugins.Close()
+	closeAccessLogger(p.accessLog)
+	if err := p.cache.Close(); err != nil {
+		slog.Warn("Failed to close cache", "error", err)
+	}
+}
+
+// snapshot returns the proxy's current configuration and components. The caller
+// must hold p.mu.
+func (p *Proxy) snapshot() *snapshot {
+	return &snapshot{
+		config:         p.config,
+		cache:          p.cache,
+		accessLog:      p.accessLog,
+		buffering:      p.buffering,
+		reverseProxies: p.reverseProxies,
+		inFlight:       p.inFlight,
+	}
+}
+
+// acquireSnapshot returns the proxy's current snapshot for a request, which must
+// call its inFlight.Done when it is finished with it
+func (p *Proxy) acquireSnapshot() *snapshot {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if r.Method == http.MethodGet {
-		if cached := p.cache.Get(r, p.config); cached != nil {
-			slog.Info("Serving cached response", "url", r.URL.Path)
-			p.serveCachedResponse(w, cached)
+	s := p.snapshot()
+	s.inFlight.Add(1)
+	return s
+}
+
+// snapshotFor returns the snapshot req was served with, or the proxy's current
+// one if req wasn't routed through ServeHTTP
+func (p *Proxy) snapshotFor(req *http.Request) *snapshot {
+	if s, ok := req.Context().Value(snapshotKey{}).(*snapshot); ok {
+		return s
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.snapshot()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := p.acquireSnapshot()
+	defer s.inFlight.Done()
+	r = r.WithContext(context.WithValue(r.Context(), snapshotKey{}, s))
+
+	site := s.config.ResolveSite(r.Host)
+	if site != nil {
+		site = site.ResolveRoute(r)
+		r = withClientIP(r, site.Forwarding)
+	} else {
+		r = withClientIP(r, s.config.Forwarding)
+	}
+
+	r, rl := withRequestLog(r)
+	r, span := startServerSpan(r)
+	mr := &metricsRecorder{ResponseWriter: newHeaderRewriter(w, r, site, p.version), site: site}
+	defer p.logAccess(r, mr, rl)
+	defer p.recordRequestMetrics(mr)
+	defer endServerSpan(span, mr)
+	w = mr
+
+	if site == nil {
+		slog.Warn("No site configured for host", "host", r.Host, "url", r.URL.Path)
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), siteConfigKey{}, site))
+
+	if r.Method == http.MethodGet && !site.Cache.Disabled {
+		cached := s.cache.Get(r, site)
+		if p.serveFromCache(w, r, cached) {
 			return
 		}
+
+		if site.Cache.Coalesce.Enabled {
+			if fetch, waited := p.coalesce(r, site, cached); fetch != nil {
+				defer fetch.release()
+				if waited {
+					cached = s.cache.Get(r, site)
+					if p.serveFromCache(w, r, cached) {
+						return
+					}
+				}
+				r = withCoalescedFetch(r, fetch)
+			}
+		}
+
+		// Expired entries are revalidated, and served stale if the backend fails
+		if cached != nil {
+			r = withCachedEntry(r, cached)
+		}
 	}
 
-	p.reverseProxy.ServeHTTP(w, r)
+	s.reverseProxies[keyForBackend(site.Backend())].ServeHTTP(w, r)
+}
+
+// serveFromCache serves a fresh cached entry, or a stale one while it is refreshed
+// in the background. It reports whether it served the request.
+func (p *Proxy) serveFromCache(w http.ResponseWriter, r *http.Request, cached *cache.Entry) bool {
+	if cached == nil {
+		return false
+	}
+
+	switch cached.Freshness {
+	case cache.Fresh:
+		slog.Debug("Serving cached response", "url", r.URL.Path)
+		p.serveCachedResponse(w, r, cached)
+		return true
+	case cache.Stale:
+		slog.Debug("Serving stale cached response while revalidating", "url", r.URL.Path)
+		p.revalidate(r, cached)
+		p.serveCachedResponse(w, r, cached)
+		return true
+	default:
+		return false
+	}
+}
+
+// siteConfig returns the configuration of the site req was routed to, or the
+// top-level configuration if req wasn't routed through ServeHTTP
+func (p *Proxy) siteConfig(req *http.Request) *config.Config {
+	if site, ok := req.Context().Value(siteConfigKey{}).(*config.Config); ok {
+		return site
+	}
+	return p.snapshotFor(req).config
 }
 
 func (p *Proxy) modifyResponse(resp *http.Response) error {
 	contentType := resp.Header.Get("Content-Type")
 	mimeType := extractMimeType(contentType)
 
+	if entry := cachedEntry(resp.Request); entry != nil {
+		// The backend confirmed the cached entry is still current
+		if resp.StatusCode == http.StatusNotModified {
+			return p.serveRevalidatedResponse(resp, entry)
+		}
+
+		// Serve the stale entry instead of a backend error
+		if resp.StatusCode >= http.StatusInternalServerError && servableOnError(entry) {
+			if err := resp.Body.Close(); err != nil {
+				slog.Error("Failed to close response body", "error", err)
+			}
+			return backendStatusError(resp.StatusCode)
+		}
+	}
+
 	// Always add version header to any response that goes through XRP
 	resp.Header.Set("X-XRP-Version", p.version)
 
-	if !p.config.IsHTMLXMLMimeType(mimeType) {
+	// Requests waiting for this response needn't once it is known not to be cached
+	cfg := p.siteConfig(resp.Request)
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	if !cfg.IsHTMLXMLMimeType(mimeType) || resp.StatusCode != http.StatusOK ||
+		!isSupportedContentEncoding(contentEncoding) || !p.shouldCache(resp) {
+		skipCoalescing(resp.Request)
+	}
+
+	if !cfg.IsHTMLXMLMimeType(mimeType) {
 		return nil
 	}
 
@@ -150,61 +506,143 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 		return nil
 	}
 
+	// Bodies in an encoding we cannot decode can't be parsed by plugins
+	if !isSupportedContentEncoding(contentEncoding) {
+		slog.Info("Unsupported Content-Encoding, streaming through unchanged",
+			"content_encoding", contentEncoding)
+		return nil
+	}
+
+	// Streaming plugins rewrite the body as it is sent, whatever its size
+	if cfg.GetProcessingModeForMimeType(mimeType) == config.ProcessingStream {
+		return p.streamResponse(resp, mimeType, contentEncoding)
+	}
+
+	// Stream bodies nothing needs to read in full: no plugins run on them, they
+	// won't be cached, and they are already in the encoding the client should get
+	cacheable := resp.Request.Method == http.MethodGet && p.shouldCache(resp)
+	if len(cfg.GetPluginsForMimeType(mimeType)) == 0 && !cacheable &&
+		isEncodedAs(contentEncoding, negotiateEncoding(resp.Request.Header.Get("Accept-Encoding"))) {
+		resp.Header.Set("X-XRP-Cache", "MISS")
+		return nil
+	}
+
 	// Check if response is too large before processing
-	maxSize := int64(p.config.MaxResponseSizeMB * 1024 * 1024)
+	maxSize := int64(cfg.MaxResponseSizeMB * 1024 * 1024)
 	if resp.ContentLength > 0 && resp.ContentLength > maxSize {
 		slog.Info("Response exceeds size limit, streaming through unchanged",
 			"content_length", resp.ContentLength, "max", maxSize)
+		recordSizeBypass(resp.Request)
 		return nil
 	}
 
-	// For responses without Content-Length, we need to peek at the size
-	if resp.ContentLength <= 0 {
-		peekReader := &io.LimitedReader{
-			R: resp.Body,
-			N: maxSize + 1,
-		}
-
-		peekedData, err := io.ReadAll(peekReader)
-		if err != nil {
-			slog.Error("Failed to peek at response size", "error", err)
-			return err
+	// Buffer the body, reading one byte past the limit to catch oversized bodies
+	// of unknown length
+	ctx := resp.Request.Context()
+	buffering := p.snapshotFor(resp.Request).buffering
+	rawBody := buffering.newBuffer(ctx)
+	if _, err := io.CopyN(rawBody, resp.Body, maxSize+1); err != nil && !errors.Is(err, io.EOF) {
+		rawBody.Close()
+		slog.Error("Failed to read response body", "error", err)
+		return err
+	}
+	if rawBody.Len() > maxSize {
+		slog.Info("Response exceeds size limit, streaming through unchanged", "max", maxSize)
+		recordSizeBypass(resp.Request)
+		// Send the buffered start of the body, then the rest from the backend
+		resp.Body = &bufferedBody{
+			Reader:  io.MultiReader(rawBody.Reader(), resp.Body),
+			closers: []io.Closer{rawBody, resp.Body},
 		}
+		return nil
+	}
+	if err := resp.Body.Close(); err != nil {
+		slog.Error("Failed to close response body", "error", err)
+	}
 
-		if int64(len(peekedData)) > maxSize {
-			slog.Info("Response exceeds size limit, streaming through unchanged",
-				"size", len(peekedData), "max", maxSize)
-			// Create a new reader with the peeked data + remaining body
-			resp.Body = io.NopCloser(io.MultiReader(
-				bytes.NewReader(peekedData),
-				resp.Body,
-			))
+	// Keep the original response so it can be served if processing fails
+	originalHeader := resp.Header.Clone()
+	onError := cfg.GetOnErrorPolicyForMimeType(mimeType)
+
+	// Plugins and the cache always operate on the identity-encoded body
+	decodedBody := rawBody
+	if len(parseContentEncoding(contentEncoding)) > 0 {
+		decodedBody = buffering.newBuffer(ctx)
+		defer decodedBody.Close()
+
+		err := decodeBody(decodedBody, rawBody.Reader(), contentEncoding, maxSize)
+		if errors.Is(err, errDecodedTooLarge) {
+			slog.Info("Decoded response exceeds size limit, streaming through unchanged",
+				"content_encoding", contentEncoding, "max", maxSize)
+			recordSizeBypass(resp.Request)
+			resp.Body = rawBody.Body()
 			return nil
 		}
+		if err != nil {
+			slog.Error("Failed to decode response body", "error", err)
+			return p.handleProcessingError(resp, err, onError, originalHeader, rawBody)
+		}
+	}
 
-		// Response is small enough, restore body with peeked data
-		resp.Body = io.NopCloser(io.MultiReader(
-			bytes.NewReader(peekedData),
-			resp.Body,
-		))
+	// Hold memory budget for the document until the processed response is sent,
+	// taking over what its buffers reserved so it isn't counted twice
+	buffers := []*bodyBuffer{rawBody}
+	if decodedBody != rawBody {
+		buffers = append(buffers, decodedBody)
 	}
+	release, err := buffering.reserve(ctx, decodedBody.Len(), buffers...)
+	if err != nil {
+		slog.Warn("Waited too long for memory to process response",
+			"url", resp.Request.URL.Path, "size", decodedBody.Len())
+		return p.handleProcessingError(resp, err, onError, originalHeader, rawBody)
+	}
+
+	resp.Body = io.NopCloser(decodedBody.Reader())
+	resp.Header.Del("Content-Encoding")
 
 	// Add cache MISS header for processed responses
 	resp.Header.Set("X-XRP-Cache", "MISS")
 
 	var body []byte
-	var err error
 
-	if resp.Request.Method == http.MethodGet && p.shouldCache(resp) {
+	if cacheable {
 		body, err = p.processAndCacheResponse(resp, mimeType)
 	} else {
-		body, err = p.processResponse(resp, mimeType)
+		body, _, err = p.processResponse(resp, mimeType)
 	}
 
 	if err != nil {
 		slog.Error("Failed to process response", "error", err)
+		if err := p.handleProcessingError(resp, err, onError, originalHeader, rawBody); err != nil {
+			release()
+			return err
+		}
+		// The original body is still in memory until it is sent
+		resp.Body = &bufferedBody{Reader: resp.Body, closers: []io.Closer{resp.Body, closerFunc(release)}}
+		return nil
+	}
+
+	if err := rawBody.Close(); err != nil {
+		slog.Warn("Failed to release response body buffer", "error", err)
+	}
+	if err := setResponseBody(resp, body); err != nil {
+		release()
+		return err
+	}
+	resp.Body = &bufferedBody{Reader: resp.Body, closers: []io.Closer{closerFunc(release)}}
+	return nil
+}
+
+// setResponseBody replaces resp's body with an identity-encoded body, compressed
+// for the client as its Accept-Encoding allows
+func setResponseBody(resp *http.Response, body []byte) error {
+	encoding := negotiateEncoding(resp.Request.Header.Get("Accept-Encoding"))
+	body, err := encodeBody(body, encoding)
+	if err != nil {
+		slog.Error("Failed to encode response body", "error", err)
 		return err
 	}
+	setEncodingHeaders(resp.Header, encoding)
 
 	resp.Body = io.NopCloser(bytes.NewReader(body))
 	resp.ContentLength = int64(len(body))
@@ -213,36 +651,69 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 	return nil
 }
 
-func (p *Proxy) processResponse(resp *http.Response, mimeType string) ([]byte, error) {
-	// Read the full response body (size already checked in modifyResponse)
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+// handleProcessingError applies the MIME type's on_error policy after a failure to
+// decode, parse, process, or render a response, or to get memory to process it.
+// Under the passthrough policy the original upstream body and headers are restored
+// and the failure is not cached. rawBody is closed, or closed along with the
+// response body it becomes.
+func (p *Proxy) handleProcessingError(resp *http.Response, err error, onError string, originalHeader http.Header, rawBody *bodyBuffer) error {
+	if onError == config.OnErrorFail {
+		rawBody.Close()
+		return err
 	}
 
-	if err := resp.Body.Close(); err != nil {
-		slog.Error("Failed to close response body", "error", err)
-	}
+	slog.Warn("Serving original response after processing failure",
+		"url", resp.Request.URL.Path, "error", err)
+
+	resp.Header = originalHeader
+	resp.Header.Set("X-XRP-Cache", "BYPASS")
+	resp.Body = rawBody.Body()
+	resp.ContentLength = rawBody.Len()
+	resp.Header.Set("Content-Length", strconv.FormatInt(rawBody.Len(), 10))
+
+	return nil
+}
 
-	// Proceed with plugin processing
-	pluginConfigs := p.config.GetPluginsForMimeType(mimeType)
+// processResponse runs the MIME type's plugins on the response body, which is
+// parsed as it is read (size already checked in modifyResponse). skipped reports
+// whether a failing plugin was skipped.
+func (p *Proxy) processResponse(resp *http.Response, mimeType string) (body []byte, skipped bool, err error) {
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("Failed to close response body", "error", err)
+		}
+	}()
+
+	cfg := p.siteConfig(resp.Request)
+	pluginConfigs := cfg.GetPluginsForMimeType(mimeType)
 	if len(pluginConfigs) == 0 {
-		return body, nil
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read response body: %w", err)
+		}
+		return body, false, nil
 	}
 
+	onError := cfg.GetOnErrorPolicyForMimeType(mimeType)
+
 	if isHTMLMimeType(mimeType) {
-		return p.processHTMLResponse(resp.Request, body, pluginConfigs)
+		return p.processHTMLResponse(resp, resp.Body, pluginConfigs, onError)
 	} else {
-		return p.processXMLResponse(resp.Request, body, pluginConfigs)
+		return p.processXMLResponse(resp, resp.Body, pluginConfigs, onError)
 	}
 }
 
 func (p *Proxy) processAndCacheResponse(resp *http.Response, mimeType string) ([]byte, error) {
-	processedBody, err := p.processResponse(resp, mimeType)
+	processedBody, skipped, err := p.processResponse(resp, mimeType)
 	if err != nil {
 		return nil, err
 	}
 
+	// A response missing a failed plugin's changes is served, but not cached
+	if skipped {
+		return processedBody, nil
+	}
+
 	cacheEntry := &cache.Entry{
 		Body:       processedBody,
 		Headers:    resp.Header,
@@ -250,22 +721,26 @@ func (p *Proxy) processAndCacheResponse(resp *http.Response, mimeType string) ([
 		Timestamp:  time.Now(),
 	}
 
-	if err := p.cache.Set(resp.Request, cacheEntry, p.config); err != nil {
+	if err := p.snapshotFor(resp.Request).cache.Set(resp.Request, cacheEntry, p.siteConfig(resp.Request)); err != nil && !errors.Is(err, cache.ErrUnavailable) {
 		slog.Error("Failed to cache response", "error", err)
 	}
 
 	return processedBody, nil
 }
 
-func (p *Proxy) processHTMLResponse(req *http.Request, body []byte, pluginConfigs []config.PluginConfig) ([]byte, error) {
-	return p.processWithPlugins(body, req, pluginConfigs, parseHTML, processHTML, renderHTML)
+func (p *Proxy) processHTMLResponse(resp *http.Response, body io.Reader, pluginConfigs []config.PluginConfig, onError string) ([]byte, bool, error) {
+	return p.processWithPlugins(body, resp, pluginConfigs, onError, documentHTML, parseHTML, processHTML, renderHTML, copyHTML)
 }
 
-func (p *Proxy) processXMLResponse(req *http.Request, body []byte, pluginConfigs []config.PluginConfig) ([]byte, error) {
-	return p.processWithPlugins(body, req, pluginConfigs, parseXML, processXML, renderXML)
+func (p *Proxy) processXMLResponse(resp *http.Response, body io.Reader, pluginConfigs []config.PluginConfig, onError string) ([]byte, bool, error) {
+	return p.processWithPlugins(body, resp, pluginConfigs, onError, documentXML, parseXML, processXML, renderXML, copyXML)
 }
 
 func (p *Proxy) shouldCache(resp *http.Response) bool {
+	if p.siteConfig(resp.Request).Cache.Disabled {
+		return false
+	}
+
 	if resp.Header.Get("Set-Cookie") != "" {
 		return false
 	}
@@ -274,11 +749,11 @@ func (p *Proxy) shouldCache(resp *http.Response) bool {
 		return false
 	}
 
-	return p.cache.IsCacheable(resp)
+	return p.snapshotFor(resp.Request).cache.IsCacheable(resp)
 }
 
 func (p *Proxy) hasDenylistedCookies(req *http.Request) bool {
-	for _, denyName := range p.config.CookieDenylist {
+	for _, denyName := range p.siteConfig(req).CookieDenylist {
 		for _, cookie := range req.Cookies() {
 			if cookie.Name == denyName {
 				return true
@@ -288,26 +763,105 @@ func (p *Proxy) hasDenylistedCookies(req *http.Request) bool {
 	return false
 }
 
-func (p *Proxy) serveCachedResponse(w http.ResponseWriter, entry *cache.Entry) {
+func (p *Proxy) serveCachedResponse(w http.ResponseWriter, r *http.Request, entry *cache.Entry) {
+	cacheResult := "HIT"
+	if entry.Freshness != cache.Fresh {
+		cacheResult = "STALE"
+	}
+
+	// Answer the client's conditional request from the cached ETag, which is
+	// weakened like the full response's since the body is re-encoded
+	if ifNoneMatch := r.Header.Values("If-None-Match"); len(ifNoneMatch) > 0 && etagListMatches(strings.Join(ifNoneMatch, ","), entry.ETag) {
+		etag := entry.ETag
+		if len(entry.Body) > 0 {
+			etag = weakETag(etag)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("X-XRP-Version", p.version)
+		w.Header().Set("X-XRP-Cache", cacheResult)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	for key, values := range entry.Headers {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
 
-	// Update Content-Length to match the actual cached body length
-	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	// Cached bodies are stored in identity form; encode them for this client
+	body := entry.Body
+	if len(body) > 0 {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		encoded, err := encodeBody(body, encoding)
+		if err != nil {
+			slog.Error("Failed to encode cached response body", "error", err)
+			encoding = ""
+			encoded = body
+		}
+		body = encoded
+		setEncodingHeaders(w.Header(), encoding)
+	}
+
+	// Update Content-Length to match the actual body length
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 
 	// Add XRP headers for cached responses
 	w.Header().Set("X-XRP-Version", p.version)
-	w.Header().Set("X-XRP-Cache", "HIT")
+	w.Header().Set("X-XRP-Cache", cacheResult)
 
 	w.WriteHeader(entry.StatusCode)
-	if _, err := w.Write(entry.Body); err != nil {
+	if _, err := w.Write(body); err != nil {
 		slog.Error("Failed to write cached response body", "error", err)
 	}
 }
 
+// etagListMatches evaluates an If-None-Match field value against the cached
+// representation's etag per RFC 9110 §13.1.2: "*" matches any representation, and
+// each listed entity tag is compared weakly
+func etagListMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+		tag := strings.TrimPrefix(list, "W/")
+		if !strings.HasPrefix(tag, `"`) {
+			return false
+		}
+		end := strings.IndexByte(tag[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if tag[:end+2] == opaque {
+			return true
+		}
+		list = tag[end+2:]
+	}
+}
+
+// clientIP returns the IP address of the client that sent req, as reported by
+// trusted proxies if it came through them
+func clientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 func extractMimeType(contentType string) string {
 	if idx := strings.Index(contentType, ";"); idx != -1 {
 		return strings.TrimSpace(contentType[:idx])
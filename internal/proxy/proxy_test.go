@@ -1,15 +1,26 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/beevik/etree"
 
 	"github.com/cdzombak/xrp/internal/cache"
 	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
 )
 
 // TestExtractMimeTypeSimple tests MIME type extraction without complex mocking
@@ -58,6 +69,36 @@ func TestIsHTMLMimeTypeSimple(t *testing.T) {
 	}
 }
 
+// TestEtagListMatches tests If-None-Match evaluation against a cached ETag
+func TestEtagListMatches(t *testing.T) {
+	tests := []struct {
+		list     string
+		etag     string
+		expected bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`"v2"`, `"v1"`, false},
+		{`"a", "v1"`, `"v1"`, true},
+		{`"a","b"`, `"v1"`, false},
+		{`W/"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`"a,b", "v1"`, `"v1"`, true},
+		{`"a,b"`, `"a"`, false},
+		{`*`, `"v1"`, true},
+		{`*`, ``, true},
+		{`"v1"`, ``, false},
+		{`v1`, `"v1"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list+" "+tt.etag, func(t *testing.T) {
+			if result := etagListMatches(tt.list, tt.etag); result != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
 // TestHasDenylistedCookiesSimple tests cookie denylist functionality
 func TestHasDenylistedCookiesSimple(t *testing.T) {
 	cfg := &config.Config{
@@ -131,7 +172,7 @@ func TestVersionHeader(t *testing.T) {
 	}
 
 	recorder := httptest.NewRecorder()
-	proxy.serveCachedResponse(recorder, entry)
+	proxy.serveCachedResponse(recorder, httptest.NewRequest("GET", "/test", nil), entry)
 
 	if recorder.Header().Get("X-XRP-Version") != "1.2.3" {
 		t.Errorf("expected X-XRP-Version header to be '1.2.3', got '%s'",
@@ -146,6 +187,48 @@ func TestVersionHeader(t *testing.T) {
 
 // Integration Tests for the full proxy flow
 
+// newTestConfig returns the configuration of a proxy in front of backendURL that
+// processes HTML and caches in memory, with overrides applied in order
+func newTestConfig(backendURL string, overrides ...func(cfg *config.Config)) *config.Config {
+	cfg := &config.Config{
+		BackendURL:        backendURL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+	}
+	for _, override := range overrides {
+		override(cfg)
+	}
+	return cfg
+}
+
+// newTestProxy returns a proxy with newTestConfig(backendURL, overrides...),
+// which is closed when the test ends
+func newTestProxy(t *testing.T, backendURL string, overrides ...func(cfg *config.Config)) *Proxy {
+	t.Helper()
+	proxy, err := New(newTestConfig(backendURL, overrides...), "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// withRedis is a newTestConfig override that caches in the Redis server at addr
+func withRedis(addr string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.CacheStore = config.StoreConfig{}
+		cfg.Redis = config.RedisConfig{Addr: addr}
+	}
+}
+
+// serve sends a request for /page with method through proxy
+func serve(proxy *Proxy, method string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest(method, "/page", nil))
+	return recorder
+}
+
 // TestProxyIntegration_HTMLResponse tests the complete flow for HTML content
 func TestProxyIntegration_HTMLResponse(t *testing.T) {
 	// Create mock backend server
@@ -386,6 +469,104 @@ func TestProxyIntegration_CacheFlow(t *testing.T) {
 	}
 }
 
+// TestProxyIntegration_Sites tests that requests are routed and cached per Host
+func TestProxyIntegration_Sites(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			_, _ = fmt.Fprintf(w, "<html><body>%s</body></html>", name)
+		}))
+	}
+	blog := newBackend("blog")
+	defer blog.Close()
+	shop := newBackend("shop")
+	defer shop.Close()
+
+	mr := miniredis.RunT(t)
+	cfg := &config.Config{
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		Redis:             config.RedisConfig{Addr: mr.Addr()},
+		Sites: []config.SiteConfig{
+			{Hosts: []string{"blog.example.com"}, BackendURL: blog.URL},
+			{Hosts: []string{"shop.example.com"}, BackendURL: shop.URL, Cache: &config.CacheConfig{Disabled: true}},
+		},
+	}
+
+	proxy, err := New(cfg, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+
+	get := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.Host = host
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, tt := range []struct {
+		host  string
+		body  string
+		cache string
+	}{
+		{"blog.example.com", "blog", "MISS"},
+		{"blog.example.com:8080", "blog", "HIT"},
+		{"shop.example.com", "shop", "MISS"},
+		{"shop.example.com", "shop", "MISS"},
+	} {
+		rec := get(tt.host)
+		if !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: expected %s backend, got %q", tt.host, tt.body, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-XRP-Cache"); got != tt.cache {
+			t.Errorf("%s: expected cache %s, got %s", tt.host, tt.cache, got)
+		}
+	}
+
+	if rec := get("unknown.example.com"); rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("expected 421 for unknown host, got %d", rec.Code)
+	}
+}
+
+// TestProxyIntegration_MemoryStore tests caching without Redis
+func TestProxyIntegration_MemoryStore(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body>cached</body></html>"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+	}
+
+	proxy, err := New(cfg, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", "/page", nil)
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if got := recorder.Header().Get("X-XRP-Cache"); got != expected {
+			t.Errorf("expected cache %s, got %s", expected, got)
+		}
+		if !strings.Contains(recorder.Body.String(), "cached") {
+			t.Errorf("unexpected body %q", recorder.Body.String())
+		}
+	}
+}
+
 // TestProxyIntegration_SizeLimit tests that large responses are streamed through unchanged
 func TestProxyIntegration_SizeLimit(t *testing.T) {
 	// Skip if Redis is not available for integration testing
@@ -406,8 +587,9 @@ func TestModifyResponse_SizeLimit(t *testing.T) {
 
 	// Create a mock cache (won't be used for size limit test)
 	proxy := &Proxy{
-		config:  cfg,
-		version: "test-1.0.0",
+		config:    cfg,
+		version:   "test-1.0.0",
+		buffering: newBodyBuffering(config.BufferingConfig{}),
 	}
 
 	tests := []struct {
@@ -490,7 +672,7 @@ func TestProxyIntegration_WithoutRedis(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	// Create configuration with invalid Redis to force cache creation failure
+	// Unreachable Redis should disable caching, not fail startup
 	cfg := &config.Config{
 		BackendURL:        backend.URL,
 		MaxResponseSizeMB: 10,
@@ -505,12 +687,17 @@ func TestProxyIntegration_WithoutRedis(t *testing.T) {
 		},
 	}
 
-	// Try to create proxy - should fail due to Redis
 	proxy, err := New(cfg, "test-without-redis")
-	if err == nil {
-		// If we somehow succeeded, run the test
-		t.Log("Unexpected Redis connection success, running test anyway")
+	if err != nil {
+		t.Fatalf("expected proxy to start without Redis, got: %v", err)
+	}
+	defer proxy.Close()
 
+	if proxy.Cache().Health() == nil {
+		t.Error("expected cache to report unavailable Redis")
+	}
+
+	for i := 0; i < 2; i++ {
 		req := httptest.NewRequest("GET", "/test", nil)
 		recorder := httptest.NewRecorder()
 		proxy.ServeHTTP(recorder, req)
@@ -518,17 +705,12 @@ func TestProxyIntegration_WithoutRedis(t *testing.T) {
 		if recorder.Code != 200 {
 			t.Errorf("expected status 200, got %d", recorder.Code)
 		}
-
 		if !strings.Contains(recorder.Body.String(), "<title>Test Page</title>") {
 			t.Error("expected HTML content not found in response")
 		}
-	} else {
-		// Expected: Redis connection failed
-		if !strings.Contains(err.Error(), "cache client") {
-			t.Errorf("expected cache client error, got: %v", err)
+		if got := recorder.Header().Get("X-XRP-Cache"); got != "MISS" {
+			t.Errorf("expected cache MISS without Redis, got %s", got)
 		}
-
-		t.Log("Redis unavailable as expected - proxy creation correctly failed")
 	}
 }
 
@@ -560,17 +742,21 @@ func TestProxyIntegration_POST(t *testing.T) {
 		},
 	}
 
-	// Try to create proxy - should fail, which is fine for POST test
-	_, err := New(cfg, "test-post")
+	proxy, err := New(cfg, "test-post")
 	if err != nil {
-		if !strings.Contains(err.Error(), "cache client") {
-			t.Errorf("expected cache client error, got: %v", err)
-		}
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
 
-		// This validates that proxy correctly checks dependencies
-		t.Log("POST test validated proxy creation dependency checking")
-	} else {
-		t.Error("expected proxy creation to fail without Redis")
+	req := httptest.NewRequest("POST", "/submit", strings.NewReader("data"))
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Errorf("expected status 200, got %d", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "POST received") {
+		t.Errorf("unexpected body %q", recorder.Body.String())
 	}
 }
 
@@ -623,7 +809,7 @@ func TestProcessResponse_SizeValidation(t *testing.T) {
 				Request:       httptest.NewRequest("GET", "/test", nil),
 			}
 
-			result, err := proxy.processResponse(resp, "text/html")
+			result, _, err := proxy.processResponse(resp, "text/html")
 
 			if tt.expectError {
 				if err == nil {
@@ -642,3 +828,316 @@ func TestProcessResponse_SizeValidation(t *testing.T) {
 		})
 	}
 }
+
+// failingPlugin is an in-process plugin that always fails
+type failingPlugin struct{}
+
+func (f *failingPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	return errors.New("plugin exploded")
+}
+
+func (f *failingPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return errors.New("plugin exploded")
+}
+
+// TestModifyResponse_OnErrorPolicy tests that processing failures honor the MIME type's on_error policy
+func TestModifyResponse_OnErrorPolicy(t *testing.T) {
+	originalBody := "<html><body><p>original</p></body></html>"
+
+	tests := []struct {
+		name        string
+		onError     string
+		expectError bool
+	}{
+		{"passthrough serves original", config.OnErrorPassthrough, false},
+		{"fail returns error", config.OnErrorFail, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pluginManager, _ := plugins.New()
+			if err := pluginManager.Register("builtin", "FailingPlugin", &failingPlugin{}); err != nil {
+				t.Fatal(err)
+			}
+
+			proxy := &Proxy{
+				config: &config.Config{
+					MaxResponseSizeMB: 1,
+					MimeTypes: []config.MimeTypeConfig{
+						{
+							MimeType: "text/html",
+							OnError:  tt.onError,
+							Plugins:  []config.PluginConfig{{Path: "builtin", Name: "FailingPlugin"}},
+						},
+					},
+				},
+				plugins:   pluginManager,
+				version:   "test-1.0.0",
+				buffering: newBodyBuffering(config.BufferingConfig{}),
+			}
+
+			encoded, _ := encodeBody([]byte(originalBody), "gzip")
+			req := httptest.NewRequest("POST", "/test", nil)
+			req.Header.Set("Accept-Encoding", "br")
+			resp := &http.Response{
+				StatusCode:    200,
+				Header:        make(http.Header),
+				Body:          io.NopCloser(strings.NewReader(string(encoded))),
+				ContentLength: int64(len(encoded)),
+				Request:       req,
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Header.Set("Content-Encoding", "gzip")
+
+			err := proxy.modifyResponse(resp)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.Header.Get("X-XRP-Cache") != "BYPASS" {
+				t.Errorf("expected X-XRP-Cache BYPASS, got %q", resp.Header.Get("X-XRP-Cache"))
+			}
+			if resp.Header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("expected original Content-Encoding to be restored, got %q", resp.Header.Get("Content-Encoding"))
+			}
+			if resp.Header.Get("X-XRP-Version") != "test-1.0.0" {
+				t.Errorf("expected X-XRP-Version header, got %q", resp.Header.Get("X-XRP-Version"))
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != string(encoded) {
+				t.Error("expected original encoded body to be served")
+			}
+		})
+	}
+}
+
+// TestModifyResponse_UnparseableXML tests that XML parse failures fall back to the original response
+func TestModifyResponse_UnparseableXML(t *testing.T) {
+	pluginManager, _ := plugins.New()
+	if err := pluginManager.Register("builtin", "FailingPlugin", &failingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &Proxy{
+		config: &config.Config{
+			MaxResponseSizeMB: 1,
+			MimeTypes: []config.MimeTypeConfig{
+				{
+					MimeType: "application/xml",
+					Plugins:  []config.PluginConfig{{Path: "builtin", Name: "FailingPlugin"}},
+				},
+			},
+		},
+		plugins:   pluginManager,
+		version:   "test-1.0.0",
+		buffering: newBodyBuffering(config.BufferingConfig{}),
+	}
+
+	originalBody := "<rss><channel><item></channel>"
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(originalBody)),
+		ContentLength: int64(len(originalBody)),
+		Request:       httptest.NewRequest("POST", "/feed.xml", nil),
+	}
+	resp.Header.Set("Content-Type", "application/xml")
+
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("expected passthrough by default, got error: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != originalBody {
+		t.Errorf("expected original body, got %q", body)
+	}
+	if resp.Header.Get("X-XRP-Cache") != "BYPASS" {
+		t.Errorf("expected X-XRP-Cache BYPASS, got %q", resp.Header.Get("X-XRP-Cache"))
+	}
+}
+
+// TestProxyIntegration_Routes tests that routes select plugin chains and caching
+func TestProxyIntegration_Routes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = fmt.Fprintf(w, "<html><body>%s</body></html>", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	proxy, err := New(&config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+	}, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+	if err := proxy.plugins.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	marker := []config.MimeTypeConfig{{
+		MimeType: "text/html",
+		Plugins:  []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}},
+	}}
+	proxy.config.Routes = []config.RouteConfig{
+		{PathPrefix: "/admin/", NoCache: true},
+		{Name: "preview", Headers: map[string]string{"X-Preview": ""}, NoProcessing: true},
+		{PathRegex: `^/amp(/|$)`, MimeTypes: marker},
+	}
+
+	get := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, tt := range []struct {
+		path   string
+		header map[string]string
+		marker bool
+		cache  string
+	}{
+		{"/amp/story", nil, true, "MISS"},
+		{"/amp/story", nil, true, "HIT"},
+		// The same URL matching another route is cached separately
+		{"/amp/story", map[string]string{"X-Preview": "1"}, false, "MISS"},
+		{"/amp/story", map[string]string{"X-Preview": "1"}, false, "HIT"},
+		{"/story", nil, false, "MISS"},
+		{"/admin/posts", nil, false, "MISS"},
+		{"/admin/posts", nil, false, "MISS"},
+	} {
+		rec := get(tt.path, tt.header)
+		if got := strings.Contains(rec.Body.String(), "<!--marker-->"); got != tt.marker {
+			t.Errorf("%s %v: expected marker %v, got %q", tt.path, tt.header, tt.marker, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-XRP-Cache"); got != tt.cache {
+			t.Errorf("%s %v: expected cache %s, got %s", tt.path, tt.header, tt.cache, got)
+		}
+	}
+}
+
+// TestUpdateConfig_RequestInFlight tests that a reload doesn't wait for requests
+// in flight, which finish with the configuration they started with
+func TestUpdateConfig_RequestInFlight(t *testing.T) {
+	arrived := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(arrived)
+			<-unblock
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body>Hello</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL)
+	cfg := proxy.config
+
+	slow := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.ServeHTTP(slow, httptest.NewRequest("GET", "/slow", nil))
+	}()
+	<-arrived
+
+	// A new cache store replaces the one the request in flight is using
+	reloaded := *cfg
+	reloaded.CacheStore.MaxSizeMB = 2
+	updated := make(chan error, 1)
+	go func() { updated <- proxy.UpdateConfig(&reloaded) }()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Fatalf("UpdateConfig failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected UpdateConfig not to wait for the request in flight")
+	}
+
+	// New requests are served meanwhile
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/fast", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 during the slow request, got %d", rec.Code)
+	}
+
+	close(unblock)
+	<-done
+	if slow.Code != http.StatusOK || slow.Header().Get("X-XRP-Cache") != "MISS" {
+		t.Errorf("expected the request in flight to finish, got %d %q", slow.Code, slow.Header().Get("X-XRP-Cache"))
+	}
+}
+
+// TestUpdateConfig_KeepsMemoryBudget tests that a reload resizes the memory budget
+// rather than replacing it, so responses in flight still count against it
+func TestUpdateConfig_KeepsMemoryBudget(t *testing.T) {
+	proxy := newTestProxy(t, "http://localhost:8081")
+	budget := proxy.buffering.budget
+
+	reloaded := *proxy.config
+	reloaded.Buffering.MemoryBudgetMB = 512
+	if err := proxy.UpdateConfig(&reloaded); err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+
+	if proxy.buffering.budget != budget {
+		t.Error("expected the reload to keep the memory budget")
+	}
+	if budget.capacity != 512*1024*1024 {
+		t.Errorf("expected the budget resized to 512 MiB, got %d bytes", budget.capacity)
+	}
+}
+
+// TestUpdateConfig_FailedReload tests that a reload that fails leaves the cache and
+// access log in use
+func TestUpdateConfig_FailedReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body>Hello</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL)
+	cfg := proxy.config
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	cacheClient := proxy.Cache()
+
+	// The new cache and access log are built before the plugins fail to load
+	reloaded := *cfg
+	reloaded.CacheStore.MaxSizeMB = 2
+	reloaded.AccessLog = config.AccessLogConfig{Enabled: true, Path: filepath.Join(t.TempDir(), "access.log")}
+	reloaded.MimeTypes = []config.MimeTypeConfig{{
+		MimeType: "text/html",
+		Plugins:  []config.PluginConfig{{Path: "./missing.so", Name: "MissingPlugin"}},
+	}}
+	if err := proxy.UpdateConfig(&reloaded); err == nil {
+		t.Fatal("expected reload with a missing plugin to fail")
+	}
+
+	if proxy.Cache() != cacheClient || proxy.accessLog != nil || proxy.config != cfg {
+		t.Error("expected a failed reload to leave the proxy unchanged")
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("X-XRP-Cache"); got != "HIT" {
+		t.Errorf("expected the cache to keep serving after a failed reload, got %q", got)
+	}
+}
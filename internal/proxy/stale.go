@@ -0,0 +1,193 @@
+// This file handles expired cache entries. Entries within their stale-while-revalidate
+// window are served immediately while one background request per entry refreshes the
+// cache. Other expired entries are held in the request context: entries within their
+// stale-if-error window are served if the backend is unreachable or returns a 5xx
+// status. Requests carrying an entry are sent upstream as conditional requests using
+// its ETag and Last-Modified validators; on 304 Not Modified the entry's already
+// processed body is served and re-cached with fresh metadata, without running plugins.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cdzombak/xrp/internal/cache"
+)
+
+// revalidationTimeout bounds a background refresh of a stale entry
+const revalidationTimeout = 30 * time.Second
+
+// revalidatedHeaders are the headers of a 304 response that update a cached entry
+var revalidatedHeaders = []string{
+	"Cache-Control",
+	"Expires",
+	"ETag",
+	"Last-Modified",
+	"Date",
+	"Surrogate-Key",
+	"Cache-Tag",
+}
+
+// cachedEntryKey is the request context key for the expired cache entry a request
+// revalidates
+type cachedEntryKey struct{}
+
+// cachedEntry returns the cache entry stored in req's context, if any
+func cachedEntry(req *http.Request) *cache.Entry {
+	entry, _ := req.Context().Value(cachedEntryKey{}).(*cache.Entry)
+	return entry
+}
+
+// withCachedEntry returns a shallow copy of req carrying entry, so it can be
+// revalidated, or served if the backend fails
+func withCachedEntry(req *http.Request, entry *cache.Entry) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cachedEntryKey{}, entry))
+}
+
+// servableOnError reports whether entry may be served when the backend fails
+func servableOnError(entry *cache.Entry) bool {
+	return entry != nil && entry.Freshness != cache.Expired
+}
+
+// addValidators makes an outgoing request carrying a cache entry conditional on
+// the entry's validators. The client's own conditional headers are dropped, since
+// a 304 must answer XRP's validators.
+func addValidators(req *http.Request) {
+	entry := cachedEntry(req)
+	if entry == nil {
+		return
+	}
+
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+// serveRevalidatedResponse replaces a 304 Not Modified response to a conditional
+// request with the cached entry, and re-caches the entry with the 304's metadata
+func (p *Proxy) serveRevalidatedResponse(resp *http.Response, entry *cache.Entry) error {
+	if err := resp.Body.Close(); err != nil {
+		slog.Error("Failed to close response body", "error", err)
+	}
+
+	refreshed := &cache.Entry{
+		Body:       entry.Body,
+		Headers:    entry.Headers.Clone(),
+		StatusCode: entry.StatusCode,
+		Timestamp:  time.Now(),
+	}
+	for _, name := range revalidatedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			refreshed.Headers[name] = values
+		}
+	}
+
+	if err := p.snapshotFor(resp.Request).cache.Set(resp.Request, refreshed, p.siteConfig(resp.Request)); err != nil && !errors.Is(err, cache.ErrUnavailable) {
+		slog.Error("Failed to cache revalidated response", "error", err)
+	}
+	slog.Debug("Revalidated cached response", "url", resp.Request.URL.Path)
+
+	resp.StatusCode = refreshed.StatusCode
+	resp.Status = fmt.Sprintf("%d %s", refreshed.StatusCode, http.StatusText(refreshed.StatusCode))
+	resp.Header = refreshed.Headers.Clone()
+	resp.Header.Set("X-XRP-Version", p.version)
+	resp.Header.Set("X-XRP-Cache", "REVALIDATED")
+
+	return setResponseBody(resp, refreshed.Body)
+}
+
+// backendStatusError reports a backend error status replaced by a stale entry
+type backendStatusError int
+
+func (e backendStatusError) Error() string {
+	return fmt.Sprintf("backend returned status %d", int(e))
+}
+
+// errorHandler handles errors reaching the backend or processing its response. It
+// serves the request's stale entry if it has one, and otherwise responds with 502
+// Bad Gateway like httputil.ReverseProxy's default handler.
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if entry := cachedEntry(r); servableOnError(entry) {
+		slog.Warn("Serving stale response after backend failure", "url", r.URL.Path, "error", err)
+		p.serveCachedResponse(w, r, entry)
+		return
+	}
+
+	slog.Error("Proxy error", "url", r.URL.Path, "error", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// revalidate refreshes a stale entry in the background by proxying a conditional
+// copy of r. Only one refresh per cache key runs at a time.
+func (p *Proxy) revalidate(r *http.Request, entry *cache.Entry) {
+	if _, running := p.revalidating.LoadOrStore(entry.Key, struct{}{}); running {
+		return
+	}
+
+	// The copy must outlive the client's request. It gets its own access log
+	// details and span, since the client's are written and ended while it runs.
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req, _ = withRequestLog(req)
+
+	// Counted as in flight before the goroutine starts, so that a reload or
+	// Close waiting on the client's request also waits for the refresh.
+	s := p.acquireSnapshot()
+
+	go func() {
+		defer p.revalidating.Delete(entry.Key)
+		defer s.inFlight.Done()
+
+		var span trace.Span
+		req, span = startRevalidationSpan(req, r)
+		defer span.End()
+
+		site := s.config.ResolveSite(req.Host)
+		if site == nil {
+			return
+		}
+		site = site.ResolveRoute(req)
+
+		ctx, cancel := context.WithTimeout(req.Context(), revalidationTimeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, snapshotKey{}, s)
+		ctx = context.WithValue(ctx, siteConfigKey{}, site)
+		ctx = context.WithValue(ctx, cachedEntryKey{}, entry)
+
+		w := &discardResponseWriter{header: make(http.Header)}
+		s.reverseProxies[keyForBackend(site.Backend())].ServeHTTP(w, req.WithContext(ctx))
+		slog.Debug("Revalidated stale cache entry", "url", req.URL.Path, "status", w.status)
+	}()
+}
+
+// discardResponseWriter is the ResponseWriter for background revalidation requests
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
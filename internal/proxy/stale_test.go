@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/beevik/etree"
+
+	"github.com/cdzombak/xrp/internal/cache"
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = fmt.Fprintf(w, "<html><body>Call #%d</body></html>", n)
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL, withRedis(miniredis.RunT(t).Addr()))
+
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "MISS" {
+		t.Fatalf("expected first request to be a MISS, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	rec := serve(proxy, "GET")
+	if rec.Header().Get("X-XRP-Cache") != "STALE" || !strings.Contains(rec.Body.String(), "Call #1") {
+		t.Fatalf("expected stale first response, got %s: %s", rec.Header().Get("X-XRP-Cache"), rec.Body.String())
+	}
+
+	// The stale response triggers a background refresh
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected one background revalidation, got %d backend calls", calls.Load())
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		rec = serve(proxy, "GET")
+		if strings.Contains(rec.Body.String(), "Call #2") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected refreshed entry to be served, got %s", rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.Header().Get("X-XRP-Cache") != "STALE" {
+		t.Errorf("expected refreshed entry to be served stale, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		_, _ = w.Write([]byte("<html><body>original</body></html>"))
+	}))
+
+	proxy := newTestProxy(t, backend.URL, withRedis(miniredis.RunT(t).Addr()))
+
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "MISS" {
+		t.Fatalf("expected first request to be a MISS, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	// A healthy backend is asked again, since the entry is expired
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "MISS" {
+		t.Errorf("expected expired entry not to be served while the backend is healthy, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	failing.Store(true)
+	rec := serve(proxy, "GET")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-XRP-Cache") != "STALE" || !strings.Contains(rec.Body.String(), "original") {
+		t.Errorf("expected stale response for 5xx backend, got %d %s: %s", rec.Code, rec.Header().Get("X-XRP-Cache"), rec.Body.String())
+	}
+
+	backend.Close()
+	rec = serve(proxy, "GET")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-XRP-Cache") != "STALE" {
+		t.Errorf("expected stale response for unreachable backend, got %d %s", rec.Code, rec.Header().Get("X-XRP-Cache"))
+	}
+}
+
+func TestErrorHandlerWithoutStaleEntry(t *testing.T) {
+	proxy := &Proxy{}
+	recorder := httptest.NewRecorder()
+	proxy.errorHandler(recorder, httptest.NewRequest("GET", "/page", nil), fmt.Errorf("connection refused"))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", recorder.Code)
+	}
+}
+
+// countingPlugin counts the HTML documents it processes
+type countingPlugin struct {
+	calls atomic.Int32
+}
+
+func (c *countingPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	c.calls.Add(1)
+	return nil
+}
+
+func (c *countingPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+func TestConditionalRevalidation(t *testing.T) {
+	var fullResponses, notModified atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		_, _ = w.Write([]byte("<html><body>original</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL, withRedis(miniredis.RunT(t).Addr()))
+	plugin := &countingPlugin{}
+	if err := proxy.plugins.Register("builtin", "CountingPlugin", plugin); err != nil {
+		t.Fatal(err)
+	}
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "CountingPlugin"}}
+
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "MISS" {
+		t.Fatalf("expected first request to be a MISS, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	// The client's own validator must not be forwarded in place of XRP's
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("If-None-Match", `"client"`)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("X-XRP-Cache") != "REVALIDATED" {
+		t.Fatalf("expected revalidated 200, got %d %s", rec.Code, rec.Header().Get("X-XRP-Cache"))
+	}
+	if !strings.Contains(rec.Body.String(), "original") || rec.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("expected cached body and headers, got %q", rec.Body.String())
+	}
+	if fullResponses.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("expected 1 full response and 1 revalidation, got %d and %d", fullResponses.Load(), notModified.Load())
+	}
+	if plugin.calls.Load() != 1 {
+		t.Errorf("expected plugins to run only for the full response, ran %d times", plugin.calls.Load())
+	}
+
+	// The refreshed entry is revalidated again next time
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "REVALIDATED" || notModified.Load() != 2 {
+		t.Errorf("expected refreshed entry to be revalidated, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+}
+
+func TestServeCachedResponseNotModified(t *testing.T) {
+	proxy := &Proxy{version: "1.2.3"}
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	recorder := httptest.NewRecorder()
+	proxy.serveCachedResponse(recorder, req, &cache.Entry{Body: []byte("body"), Headers: make(http.Header), StatusCode: 200, ETag: `"v1"`})
+
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("expected empty 304, got %d with %d bytes", recorder.Code, recorder.Body.Len())
+	}
+	if recorder.Header().Get("X-XRP-Cache") != "HIT" {
+		t.Errorf("expected X-XRP-Cache HIT, got %s", recorder.Header().Get("X-XRP-Cache"))
+	}
+	if recorder.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("expected weak ETag, got %s", recorder.Header().Get("ETag"))
+	}
+
+	// The weak ETag the client was sent matches, alone or in a list
+	req.Header.Set("If-None-Match", `"v0", W/"v1"`)
+	recorder = httptest.NewRecorder()
+	proxy.serveCachedResponse(recorder, req, &cache.Entry{Body: []byte("body"), Headers: make(http.Header), StatusCode: 200, ETag: `"v1"`})
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for an If-None-Match list, got %d", recorder.Code)
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes wait for unblock to be closed
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	unblock <-chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(b)
+}
+
+// TestStaleWhileRevalidate_AccessLog tests that a background refresh doesn't write
+// to the access log details of the request that triggered it (run with -race)
+func TestStaleWhileRevalidate_AccessLog(t *testing.T) {
+	var calls atomic.Int32
+	refreshed := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if n == 2 {
+			defer close(refreshed)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = fmt.Fprintf(w, "<html><body>Call #%d</body></html>", n)
+	}))
+	defer backend.Close()
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	proxy := newTestProxy(t, backend.URL, func(cfg *config.Config) {
+		cfg.AccessLog = config.AccessLogConfig{Enabled: true, Format: config.AccessLogJSON, Path: logPath}
+	})
+	if err := proxy.plugins.Register("builtin", "MarkerPlugin", &markerPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.config.MimeTypes[0].Plugins = []config.PluginConfig{{Path: "builtin", Name: "MarkerPlugin"}}
+
+	serve(proxy, "GET")
+
+	// The stale response is logged once the refresh it triggered has run its
+	// upstream request and plugins
+	unblock := make(chan struct{})
+	go func() {
+		<-refreshed
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+	}()
+	rec := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), unblock: unblock}
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+	if rec.Header().Get("X-XRP-Cache") != "STALE" {
+		t.Fatalf("expected a stale response, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one log line per client request, got %d", len(lines))
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("invalid log line %q: %v", lines[1], err)
+	}
+	if entry["cache"] != "STALE" || entry["upstream_ms"] != float64(0) || entry["plugins"] != nil {
+		t.Errorf("expected stale entry without upstream or plugin details, got %v", entry)
+	}
+}
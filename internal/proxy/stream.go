@@ -0,0 +1,270 @@
+// This file implements stream processing for XRP.
+//
+// HTML MIME types configured with "processing": "stream" aren't buffered and
+// parsed. Instead, each plugin registers element and text handlers on its own
+// xrpplugin.HTMLRewriter, and the body is rewritten as the client reads it:
+// decoded, passed through each plugin's rewriter in turn, and encoded for the
+// client. Memory use doesn't grow with the document, so max_response_size_mb
+// doesn't limit which documents are processed; processed responses that turn out
+// to fit within it are cached.
+//
+// The on_error policy applies while plugins register their handlers, before the
+// response is sent. A handler that fails once the response has started aborts it.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cdzombak/xrp/internal/cache"
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
+)
+
+// streamResponse sets up resp's body to be rewritten by the MIME type's streaming
+// plugins as it is sent
+func (p *Proxy) streamResponse(resp *http.Response, mimeType, contentEncoding string) error {
+	req := resp.Request
+	cfg := p.siteConfig(req)
+	onError := cfg.GetOnErrorPolicyForMimeType(mimeType)
+	originalHeader := resp.Header.Clone()
+
+	// Header changes made by plugins as they register go straight to the response
+	pctx := xrpplugin.NewProcessingContext(req, clientIP(req), resp.StatusCode, resp.Header)
+	var stages []*rewriteStage
+	skipped, err := p.runPluginChain(req, cfg.GetPluginsForMimeType(mimeType), onError,
+		func(ctx context.Context, plugin *plugins.LoadedPlugin, pluginConfig config.PluginConfig) (bool, error) {
+			rw := xrpplugin.NewHTMLRewriter()
+			abandoned, err := runPlugin(ctx, plugin, pluginConfig, rewriteHTML, pctx, rw)
+			if err == nil {
+				stages = append(stages, &rewriteStage{rewriter: rw, plugin: plugin, config: pluginConfig, req: req})
+			}
+			return abandoned, err
+		})
+	if err != nil {
+		slog.Error("Failed to process response", "error", err)
+		if onError == config.OnErrorFail {
+			resp.Body.Close()
+			return err
+		}
+		slog.Warn("Serving original response after processing failure", "url", req.URL.Path, "error", err)
+		resp.Header = originalHeader
+		resp.Header.Set("X-XRP-Cache", "BYPASS")
+		return nil
+	}
+
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Header.Set("X-XRP-Cache", "MISS")
+
+	decoder := newDecodingReader(resp.Body, contentEncoding)
+	var body io.Reader = &streamSource{reader: decoder}
+	for _, stage := range stages {
+		stage.reader = stage.rewriter.Reader(body)
+		body = stage
+	}
+
+	// A response missing a failed plugin's changes is served, but not cached
+	var cacher *streamCacher
+	if req.Method == http.MethodGet && !skipped && p.shouldCache(resp) {
+		cacher = &streamCacher{
+			reader:  body,
+			buffer:  p.snapshotFor(req).buffering.newBuffer(req.Context()),
+			maxSize: int64(cfg.MaxResponseSizeMB * 1024 * 1024),
+			entry:   &cache.Entry{Headers: resp.Header.Clone(), StatusCode: resp.StatusCode},
+			store: func(entry *cache.Entry) {
+				if err := p.snapshotFor(req).cache.Set(req, entry, cfg); err != nil && !errors.Is(err, cache.ErrUnavailable) {
+					slog.Error("Failed to cache response", "error", err)
+				}
+			},
+		}
+		body = cacher
+	}
+
+	body, err = newEncodingReader(body, encoding)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	setEncodingHeaders(resp.Header, encoding)
+
+	_, span := startStageSpan(req.Context(), documentHTML+".rewrite")
+	stream := &streamBody{reader: body, req: req, span: span, closers: []io.Closer{decoder, resp.Body}}
+	if cacher != nil {
+		stream.closers = append(stream.closers, cacher)
+	}
+	resp.Body = stream
+	return nil
+}
+
+func rewriteHTML(plugin *plugins.LoadedPlugin, ctx context.Context, pctx *xrpplugin.ProcessingContext, document interface{}) error {
+	rw, ok := document.(*xrpplugin.HTMLRewriter)
+	if !ok {
+		return fmt.Errorf("invalid document type for HTML rewriting")
+	}
+	return plugin.RewriteHTML(ctx, pctx, rw)
+}
+
+// streamError is an error that aborted a streamed response. plugin names the
+// plugin whose handler failed, and is empty for errors reading the backend.
+type streamError struct {
+	plugin string
+	err    error
+}
+
+func (e *streamError) Error() string {
+	if e.plugin == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("plugin %s failed: %v", e.plugin, e.err)
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+// streamSource reads the decoded backend body at the start of a rewrite chain
+type streamSource struct {
+	reader io.Reader
+}
+
+func (s *streamSource) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &streamError{err: fmt.Errorf("failed to read response body: %w", err)}
+	}
+	return n, err
+}
+
+// rewriteStage reads a plugin's rewrite of the stream before it, attributing
+// handler errors and panics to the plugin
+type rewriteStage struct {
+	reader   io.Reader
+	rewriter *xrpplugin.HTMLRewriter
+	plugin   *plugins.LoadedPlugin
+	config   config.PluginConfig
+	req      *http.Request
+	err      error
+}
+
+func (s *rewriteStage) Read(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &plugins.PanicError{Plugin: s.config.Name, Value: r, Stack: debug.Stack()}
+		}
+		if err == nil || err == io.EOF {
+			return
+		}
+		// Errors from earlier in the chain pass through
+		var streamErr *streamError
+		if !errors.As(err, &streamErr) {
+			recordPluginFailure(s.req, s.plugin, s.config, err)
+			err = &streamError{plugin: s.config.Name, err: err}
+		}
+		s.err = err
+	}()
+	return s.reader.Read(p)
+}
+
+// streamCacher copies a processed stream into a buffer as it is read, and caches
+// it once the stream is complete if it fits within maxSize
+type streamCacher struct {
+	reader  io.Reader
+	buffer  *bodyBuffer
+	maxSize int64
+	entry   *cache.Entry
+	store   func(entry *cache.Entry)
+}
+
+func (c *streamCacher) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if c.buffer == nil {
+		return n, err
+	}
+
+	if c.buffer.Len()+int64(n) > c.maxSize {
+		c.Close()
+		return n, err
+	}
+	if _, werr := c.buffer.Write(p[:n]); werr != nil {
+		slog.Warn("Failed to buffer streamed response for caching", "error", werr)
+		c.Close()
+		return n, err
+	}
+
+	switch {
+	case err == io.EOF:
+		body, readErr := io.ReadAll(c.buffer.Reader())
+		c.Close()
+		if readErr != nil {
+			slog.Warn("Failed to read buffered response for caching", "error", readErr)
+			break
+		}
+		c.entry.Body = body
+		c.entry.Timestamp = time.Now()
+		c.store(c.entry)
+	case err != nil:
+		c.Close()
+	}
+	return n, err
+}
+
+// Close releases the buffer, giving up on caching if the stream isn't complete
+func (c *streamCacher) Close() error {
+	if c.buffer == nil {
+		return nil
+	}
+	err := c.buffer.Close()
+	c.buffer = nil
+	return err
+}
+
+// streamBody is the body of a streamed response. It logs the error that aborts
+// the stream, if any, and records it on the rewrite span when it is closed.
+type streamBody struct {
+	reader  io.Reader
+	req     *http.Request
+	span    trace.Span
+	closers []io.Closer
+	err     error
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+		slog.Error("Aborting streamed response", "url", b.req.URL.Path, "error", err)
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	if b.closers == nil {
+		return nil
+	}
+
+	var err error
+	for _, closer := range b.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	b.closers = nil
+	endStageSpan(b.span, b.err)
+	return err
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cdzombak/xrp/internal/cache"
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
+)
+
+// linkPlugin marks links as external as they stream through
+type linkPlugin struct{}
+
+func (l *linkPlugin) RewriteHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, rw *xrpplugin.HTMLRewriter) error {
+	pctx.ResponseHeader().Set("X-Links", "marked")
+	return rw.OnElement(`a[href^="http"]`, func(el *xrpplugin.Element) error {
+		el.SetAttr("rel", "external")
+		return nil
+	})
+}
+
+// footerPlugin appends a footer to the body, after the links are marked
+type footerPlugin struct{}
+
+func (f *footerPlugin) RewriteHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, rw *xrpplugin.HTMLRewriter) error {
+	return rw.OnElement("body", func(el *xrpplugin.Element) error {
+		el.Append("<footer>streamed</footer>")
+		return nil
+	})
+}
+
+// brokenStreamPlugin fails to register, or fails in its handler
+type brokenStreamPlugin struct {
+	failHandler bool
+}
+
+func (b *brokenStreamPlugin) RewriteHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, rw *xrpplugin.HTMLRewriter) error {
+	if !b.failHandler {
+		return errors.New("no handlers for you")
+	}
+	return rw.OnElement("p", func(el *xrpplugin.Element) error {
+		return errors.New("handler exploded")
+	})
+}
+
+func newStreamingTestProxy(t *testing.T, pluginConfigs []config.PluginConfig, instances map[string]any) *Proxy {
+	t.Helper()
+	pluginManager, _ := plugins.New()
+	for name, instance := range instances {
+		if err := pluginManager.Register("builtin", name, instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Proxy{
+		config: &config.Config{
+			MaxResponseSizeMB: 1,
+			MimeTypes: []config.MimeTypeConfig{{
+				MimeType:   "text/html",
+				OnError:    config.OnErrorPassthrough,
+				Processing: config.ProcessingStream,
+				Plugins:    pluginConfigs,
+			}},
+		},
+		plugins:   pluginManager,
+		cache:     cache.New(cache.NewMemoryStore(1 << 20)),
+		version:   "test-1.0.0",
+		buffering: newBodyBuffering(config.BufferingConfig{}),
+	}
+}
+
+func newStreamingTestResponse(body []byte, header http.Header) *http.Response {
+	req := httptest.NewRequest("GET", "/archive", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	header.Set("Content-Type", "text/html")
+	return &http.Response{
+		StatusCode:    200,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// TestStreamResponse tests that documents past the size limit are rewritten by
+// each streaming plugin in turn, and compressed for the client
+func TestStreamResponse(t *testing.T) {
+	proxy := newStreamingTestProxy(t,
+		[]config.PluginConfig{{Path: "builtin", Name: "LinkPlugin"}, {Path: "builtin", Name: "FooterPlugin"}},
+		map[string]any{"LinkPlugin": &linkPlugin{}, "FooterPlugin": &footerPlugin{}})
+
+	paragraphs := strings.Repeat(`<p><a href="https://example.com/">link</a> <a href="/local">local</a></p>`, 20000)
+	original := "<html><body>" + paragraphs + "</body></html>"
+	encoded, _ := encodeBody([]byte(original), "br")
+	resp := newStreamingTestResponse(encoded, http.Header{"Content-Encoding": {"br"}})
+
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("expected streamed response to have no length")
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("expected gzip for the client, got %q", got)
+	}
+	if got := resp.Header.Get("X-Links"); got != "marked" {
+		t.Errorf("expected header set by plugin, got %q", got)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	var decoded bytes.Buffer
+	if err := decodeBody(&decoded, bytes.NewReader(data), "gzip", 1<<30); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	marked := strings.ReplaceAll(paragraphs, `<a href="https://example.com/">`, `<a href="https://example.com/" rel="external">`)
+	if want := "<html><body>" + marked + "<footer>streamed</footer></body></html>"; decoded.String() != want {
+		t.Errorf("unexpected rewritten document of %d bytes", decoded.Len())
+	}
+
+	// Too large to cache
+	if entry := proxy.cache.Get(resp.Request, proxy.config); entry != nil {
+		t.Error("expected response past the size limit not to be cached")
+	}
+}
+
+// TestStreamResponse_Caches tests that streamed responses within the size limit are cached
+func TestStreamResponse_Caches(t *testing.T) {
+	proxy := newStreamingTestProxy(t, []config.PluginConfig{{Path: "builtin", Name: "LinkPlugin"}},
+		map[string]any{"LinkPlugin": &linkPlugin{}})
+
+	resp := newStreamingTestResponse([]byte(`<p><a href="http://a.test/">a</a></p>`),
+		http.Header{"Cache-Control": {"max-age=3600"}})
+	resp.Request.Header.Del("Accept-Encoding")
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	want := `<p><a href="http://a.test/" rel="external">a</a></p>`
+	if string(data) != want {
+		t.Errorf("unexpected body %q", data)
+	}
+	entry := proxy.cache.Get(resp.Request, proxy.config)
+	if entry == nil {
+		t.Fatal("expected streamed response to be cached")
+	}
+	if string(entry.Body) != want || entry.Headers.Get("X-Links") != "marked" {
+		t.Errorf("unexpected cache entry %q, headers %v", entry.Body, entry.Headers)
+	}
+}
+
+// TestStreamResponse_RegistrationError tests that plugins failing before the
+// response starts are handled by the on_error policy
+func TestStreamResponse_RegistrationError(t *testing.T) {
+	proxy := newStreamingTestProxy(t, []config.PluginConfig{{Path: "builtin", Name: "BrokenPlugin"}},
+		map[string]any{"BrokenPlugin": &brokenStreamPlugin{}})
+
+	original := []byte("<p>original</p>")
+	resp := newStreamingTestResponse(original, http.Header{})
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+	if got := resp.Header.Get("X-XRP-Cache"); got != "BYPASS" {
+		t.Errorf("expected BYPASS, got %q", got)
+	}
+	if data, _ := io.ReadAll(resp.Body); !bytes.Equal(data, original) {
+		t.Errorf("expected original body, got %q", data)
+	}
+
+	proxy.config.MimeTypes[0].OnError = config.OnErrorFail
+	resp = newStreamingTestResponse(original, http.Header{})
+	if err := proxy.modifyResponse(resp); err == nil {
+		t.Error("expected error under the fail policy")
+	}
+}
+
+// TestStreamResponse_HandlerError tests that a handler failing mid-stream aborts
+// the response and counts against its plugin
+func TestStreamResponse_HandlerError(t *testing.T) {
+	proxy := newStreamingTestProxy(t,
+		[]config.PluginConfig{{Path: "builtin", Name: "BrokenPlugin", MaxConsecutiveFailures: 1}, {Path: "builtin", Name: "FooterPlugin"}},
+		map[string]any{"BrokenPlugin": &brokenStreamPlugin{failHandler: true}, "FooterPlugin": &footerPlugin{}})
+
+	resp := newStreamingTestResponse([]byte("<body><p>boom</p></body>"), http.Header{})
+	if err := proxy.modifyResponse(resp); err != nil {
+		t.Fatalf("modifyResponse failed: %v", err)
+	}
+	_, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	var streamErr *streamError
+	if !errors.As(err, &streamErr) || streamErr.plugin != "BrokenPlugin" {
+		t.Fatalf("expected error attributed to BrokenPlugin, got %v", err)
+	}
+	if !proxy.plugins.GetPlugin("builtin", "BrokenPlugin").Disabled() {
+		t.Error("expected handler failure to count against the plugin")
+	}
+	if proxy.plugins.GetPlugin("builtin", "FooterPlugin").Disabled() {
+		t.Error("expected later plugin not to be blamed")
+	}
+}
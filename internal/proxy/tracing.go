@@ -0,0 +1,117 @@
+// This file traces requests through the proxy with OpenTelemetry.
+//
+// Each request gets a server span, continuing the trace from an incoming W3C
+// traceparent header if there is one. The upstream round trip gets a client span,
+// and its context is sent to the backend in the traceparent header. Cache lookups
+// and stores are traced in the cache package, and document parsing, plugins, and
+// rendering in processWithPlugins. A background refresh of a stale entry starts a
+// trace of its own, linked to the request that triggered it. Spans are recorded
+// only when tracing is enabled (see the tracing package); otherwise the caller's
+// trace context is still passed through to the backend.
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cdzombak/xrp/internal/tracing"
+)
+
+// startServerSpan starts the span covering a request in ServeHTTP, as a child of
+// the span described by any incoming traceparent header
+func startServerSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(r.Host),
+			semconv.ClientAddress(clientIP(r)),
+			semconv.UserAgentOriginal(r.UserAgent()),
+		))
+	return r.WithContext(ctx), span
+}
+
+// endServerSpan records the response status and cache result on a request's span
+// and ends it
+func endServerSpan(span trace.Span, mr *metricsRecorder) {
+	status := mr.statusCode()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if mr.cacheResult != "" {
+		span.SetAttributes(attribute.String("xrp.cache", mr.cacheResult))
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startRevalidationSpan starts the root span of a background refresh of a stale
+// entry, linked to the span of the client request r that triggered it, and
+// returns req carrying it
+func startRevalidationSpan(req, r *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "revalidate "+req.Method,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(r.Context())),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ServerAddress(req.Host),
+		))
+	return req.WithContext(ctx), span
+}
+
+// traceUpstream starts the client span covering a backend round trip and returns
+// a copy of req carrying its trace context in the traceparent header
+func traceUpstream(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+			semconv.ServerAddress(req.URL.Host),
+		))
+
+	// Keep the request's own context, so the response passed to modifyResponse
+	// isn't tied to the upstream span
+	outreq := req.Clone(req.Context())
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(outreq.Header))
+	return outreq, span
+}
+
+// endUpstreamSpan records the outcome of a backend round trip and ends its span
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= http.StatusInternalServerError:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	default:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	span.End()
+}
+
+// startStageSpan starts a span covering a stage of document processing
+func startStageSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endStageSpan records err, if any, on a document processing span and ends it
+func endStageSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
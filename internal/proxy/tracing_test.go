@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/html"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/plugins"
+)
+
+// recordSpans installs a tracer provider that records spans for the duration of
+// the test, then goes back to not recording
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return recorder
+}
+
+// spanNamed returns the first ended span with the given name
+func spanNamed(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var backendTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("Traceparent")
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte("<html><body>traced</body></html>"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		MimeTypes:         []config.MimeTypeConfig{{MimeType: "text/html"}},
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+	}
+
+	proxy, err := New(cfg, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	spans := recorder.Ended()
+	server := spanNamed(spans, "GET")
+	if server == nil {
+		t.Fatal("expected a server span")
+	}
+	if server.SpanContext().TraceID().String() != traceID {
+		t.Errorf("server span trace ID = %s, want incoming %s", server.SpanContext().TraceID(), traceID)
+	}
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span kind = %v", server.SpanKind())
+	}
+
+	for _, name := range []string{"cache.get", "upstream GET", "cache.set"} {
+		span := spanNamed(spans, name)
+		if span == nil {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != server.SpanContext().TraceID() {
+			t.Errorf("%s span is in a different trace", name)
+		}
+	}
+
+	upstream := spanNamed(spans, "upstream GET")
+	if upstream == nil {
+		t.FailNow()
+	}
+	if upstream.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("expected the upstream span to be a child of the server span")
+	}
+	want := "00-" + traceID + "-" + upstream.SpanContext().SpanID().String() + "-01"
+	if backendTraceparent != want {
+		t.Errorf("backend traceparent = %q, want %q", backendTraceparent, want)
+	}
+}
+
+func TestTracingWithoutProvider(t *testing.T) {
+	var backendTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("Traceparent")
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		BackendURL:        backend.URL,
+		MaxResponseSizeMB: 10,
+		CacheStore:        config.StoreConfig{Type: config.StoreMemory, MaxSizeMB: 1},
+	}
+
+	proxy, err := New(cfg, "test-1.0.0")
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	// Without tracing, the caller's trace context passes through unchanged
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("Traceparent", traceparent)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	if backendTraceparent != traceparent {
+		t.Errorf("backend traceparent = %q, want %q", backendTraceparent, traceparent)
+	}
+}
+
+// spanPlugin starts a child span from the context it is given
+type spanPlugin struct{}
+
+func (s *spanPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error {
+	_, span := otel.Tracer("test").Start(ctx, "plugin work")
+	span.End()
+	return nil
+}
+
+func (s *spanPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+func TestTracingPluginSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	pluginManager, _ := plugins.New()
+	for _, path := range []string{"builtin", "other"} {
+		if err := pluginManager.Register(path, "SpanPlugin", &spanPlugin{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := &Proxy{plugins: pluginManager}
+	req := httptest.NewRequest("GET", "/test", nil)
+	resp := &http.Response{StatusCode: 200, Header: make(http.Header), Request: req}
+
+	pluginConfigs := []config.PluginConfig{{Path: "builtin", Name: "SpanPlugin"}, {Path: "other", Name: "SpanPlugin"}}
+	if _, _, err := proxy.processHTMLResponse(resp, strings.NewReader("<html></html>"), pluginConfigs, config.OnErrorPassthrough); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	for _, name := range []string{"html.parse", "plugin builtin/SpanPlugin", "plugin other/SpanPlugin", "plugin work", "html.render"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("expected a %q span, got %v", name, names)
+		}
+	}
+
+	pluginSpan, work := spanNamed(spans, "plugin builtin/SpanPlugin"), spanNamed(spans, "plugin work")
+	if pluginSpan != nil && work != nil && work.Parent().SpanID() != pluginSpan.SpanContext().SpanID() {
+		t.Error("expected the plugin's span to be a child of the plugin invocation span")
+	}
+}
+
+// TestTracingRevalidation tests that a background refresh gets a trace of its own,
+// linked to the request that triggered it
+func TestTracingRevalidation(t *testing.T) {
+	recorder := recordSpans(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = w.Write([]byte("<html><body>traced</body></html>"))
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.URL)
+
+	serve(proxy, "GET")
+	if rec := serve(proxy, "GET"); rec.Header().Get("X-XRP-Cache") != "STALE" {
+		t.Fatalf("expected a stale response, got %s", rec.Header().Get("X-XRP-Cache"))
+	}
+
+	var refresh sdktrace.ReadOnlySpan
+	deadline := time.Now().Add(5 * time.Second)
+	for refresh == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a revalidation span")
+		}
+		time.Sleep(10 * time.Millisecond)
+		refresh = spanNamed(recorder.Ended(), "revalidate GET")
+	}
+
+	var client sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "GET" {
+			client = span
+		}
+	}
+	if refresh.Parent().IsValid() || refresh.SpanContext().TraceID() == client.SpanContext().TraceID() {
+		t.Error("expected the revalidation span to start a new trace")
+	}
+	if links := refresh.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != client.SpanContext().SpanID() {
+		t.Errorf("expected the revalidation span to link to the client's, got %v", links)
+	}
+
+	upstream := slices.IndexFunc(recorder.Ended(), func(span sdktrace.ReadOnlySpan) bool {
+		return span.Name() == "upstream GET" && span.Parent().SpanID() == refresh.SpanContext().SpanID()
+	})
+	if upstream == -1 {
+		t.Error("expected the refresh's upstream span to be a child of the revalidation span")
+	}
+}
@@ -0,0 +1,117 @@
+// This file implements the connections XRP makes to backends.
+//
+// Each backend gets its own http.Transport, built from its transport and
+// upstream_tls settings: connection timeouts and pool sizes, HTTP/2, and for https
+// upstreams the CAs to trust, a client certificate, and the server name to verify.
+// Transports are rebuilt on every configuration reload, so renewed CA and client
+// certificates are picked up without a restart.
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// newTransport creates the transport for a backend's upstreams
+func newTransport(backend config.Backend) (*http.Transport, error) {
+	tc := backend.Transport
+	dialer := &net.Dialer{
+		Timeout:   milliseconds(tc.DialTimeoutMS, 30*time.Second),
+		KeepAlive: milliseconds(tc.KeepAliveMS, 30*time.Second),
+	}
+
+	tlsConfig, err := newUpstreamTLSConfig(backend.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   milliseconds(tc.TLSHandshakeTimeoutMS, 10*time.Second),
+		ResponseHeaderTimeout: milliseconds(tc.ResponseHeaderTimeoutMS, 0),
+		ExpectContinueTimeout: time.Second,
+		DisableKeepAlives:     tc.DisableKeepAlives,
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       milliseconds(tc.IdleConnTimeoutMS, 90*time.Second),
+		ForceAttemptHTTP2:     tc.HTTP2 != config.HTTP2Off,
+	}
+	if tc.MaxIdleConns == 0 {
+		transport.MaxIdleConns = 100
+	}
+	if tc.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = 32
+	}
+
+	transport.Protocols = new(http.Protocols)
+	switch tc.HTTP2 {
+	case config.HTTP2Off:
+		transport.Protocols.SetHTTP1(true)
+	case config.HTTP2Cleartext:
+		// Without HTTP/1, http upstreams are sent HTTP/2 with prior knowledge
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+	}
+
+	return transport, nil
+}
+
+// newUpstreamTLSConfig loads the CA and client certificates of an upstream_tls
+// block. It returns nil, for the default TLS configuration, if none is set.
+func newUpstreamTLSConfig(upstreamTLS config.UpstreamTLSConfig) (*tls.Config, error) {
+	if upstreamTLS == (config.UpstreamTLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         upstreamTLS.ServerName,
+		InsecureSkipVerify: upstreamTLS.InsecureSkipVerify,
+	}
+
+	if upstreamTLS.CAFile != "" {
+		pem, err := os.ReadFile(upstreamTLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA certificate: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", upstreamTLS.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if upstreamTLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(upstreamTLS.CertFile, upstreamTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate %s: %w", upstreamTLS.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// milliseconds converts a setting in milliseconds to a duration, using fallback
+// for settings left at zero
+func milliseconds(ms int, fallback time.Duration) time.Duration {
+	if ms <= 0 {
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
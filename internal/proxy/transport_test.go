@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+// writeClientCertificate writes a self-signed client certificate to dir, and
+// returns it with its cert and key files
+func writeClientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "xrp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+// newProtoBackend returns a backend that responds with the protocol of each request
+func newProtoBackend() *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+}
+
+// withTransport is a newTestConfig override that sets the backend transport and
+// upstream TLS settings, without caching
+func withTransport(transport config.TransportConfig, upstreamTLS config.UpstreamTLSConfig) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Transport = transport
+		cfg.UpstreamTLS = upstreamTLS
+		cfg.Cache.Disabled = true
+	}
+}
+
+// TestTransport_UpstreamTLS tests a backend with a private CA that requires a
+// client certificate
+func TestTransport_UpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCertificate(t, dir)
+
+	backend := newProtoBackend()
+	backend.EnableHTTP2 = true
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// httptest's certificate is valid for example.com, not the server's address
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstreamTLS := config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}
+
+	tests := []struct {
+		name        string
+		upstreamTLS config.UpstreamTLSConfig
+		transport   config.TransportConfig
+		wantCode    int
+		wantBody    string
+	}{
+		{name: "mutual TLS over HTTP/2", upstreamTLS: upstreamTLS, wantCode: http.StatusOK, wantBody: "HTTP/2.0"},
+		{
+			name:        "HTTP/2 off",
+			upstreamTLS: upstreamTLS,
+			transport:   config.TransportConfig{HTTP2: config.HTTP2Off},
+			wantCode:    http.StatusOK,
+			wantBody:    "HTTP/1.1",
+		},
+		{
+			name:        "no client certificate",
+			upstreamTLS: config.UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"},
+			wantCode:    http.StatusBadGateway,
+		},
+		{
+			name:        "wrong server name",
+			upstreamTLS: config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "other.example"},
+			wantCode:    http.StatusBadGateway,
+		},
+		{name: "untrusted CA", wantCode: http.StatusBadGateway},
+		{
+			name:        "insecure",
+			upstreamTLS: config.UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true},
+			wantCode:    http.StatusOK,
+			wantBody:    "HTTP/2.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, backend.URL, withTransport(tt.transport, tt.upstreamTLS))
+			recorder := serve(proxy, "GET")
+			if recorder.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d", tt.wantCode, recorder.Code)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("expected %s, got %s", tt.wantBody, recorder.Body.String())
+			}
+		})
+	}
+
+	// Certificate files that can't be loaded fail the configuration
+	if _, err := New(newTestConfig(backend.URL, withTransport(config.TransportConfig{}, config.UpstreamTLSConfig{CAFile: certFile + ".missing"})), "test-1.0.0"); err == nil {
+		t.Error("expected error for a missing CA file")
+	}
+	if _, err := New(newTestConfig(backend.URL, withTransport(config.TransportConfig{}, config.UpstreamTLSConfig{CertFile: keyFile, KeyFile: keyFile})), "test-1.0.0"); err == nil {
+		t.Error("expected error for an invalid client certificate")
+	}
+}
+
+func TestTransport_H2C(t *testing.T) {
+	backend := newProtoBackend()
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	for mode, want := range map[string]string{config.HTTP2Auto: "HTTP/1.1", config.HTTP2Cleartext: "HTTP/2.0"} {
+		proxy := newTestProxy(t, backend.URL, withTransport(config.TransportConfig{HTTP2: mode}, config.UpstreamTLSConfig{}))
+		if got := serve(proxy, "GET").Body.String(); got != want {
+			t.Errorf("expected %s with http2 %s, got %s", want, mode, got)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport, err := newTransport(config.Backend{Transport: config.TransportConfig{
+		ResponseHeaderTimeoutMS: 1500,
+		MaxConnsPerHost:         4,
+		DisableKeepAlives:       true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.ResponseHeaderTimeout != 1500*time.Millisecond || transport.MaxConnsPerHost != 4 || !transport.DisableKeepAlives {
+		t.Errorf("expected settings to be applied: %+v", transport)
+	}
+	// Settings left unset fall back to the defaults
+	if transport.TLSHandshakeTimeout != 10*time.Second || transport.IdleConnTimeout != 90*time.Second ||
+		transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != 32 || transport.TLSClientConfig != nil {
+		t.Errorf("expected defaults: %+v", transport)
+	}
+}
@@ -0,0 +1,501 @@
+// This file implements load balancing over a backend's upstreams.
+//
+// backend_url may list several upstreams. Each backend's reverse proxy sends
+// requests through an upstreamPool, which picks an upstream for each request by
+// the load_balancing policy and leaves out upstreams that are failing:
+//
+// - Passively, once max_fails requests in a row fail with a connection error or a
+// 502, 503, or 504 response. The upstream is ejected for fail_timeout_ms, then
+// tried again. A max_fails of -1 turns this off.
+// - Actively, while health_check.path is set and the upstream fails its checks
+//
+// If every upstream is left out, requests are spread over all of them anyway,
+// since a failing upstream may still serve some requests. Idempotent requests
+// without a body that fail with a connection error are retried on other upstreams.
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// ringReplicas is how many points each upstream has on the consistent hash ring;
+// more points spread keys more evenly
+const ringReplicas = 160
+
+// upstream is one of a backend's upstreams, and its health
+type upstream struct {
+	url *url.URL
+	// inFlight counts requests whose response hasn't been fully read
+	inFlight atomic.Int64
+
+	mu sync.Mutex
+	// fails counts requests that failed in a row
+	fails        int
+	ejectedUntil time.Time
+	// ejected is set from ejection until the upstream recovers or ejectedUntil
+	// passes, when ejectTimer marks it available again
+	ejected    bool
+	ejectTimer *time.Timer
+	// unhealthy is set while the upstream fails its health checks
+	unhealthy   bool
+	checkFails  int
+	checkPasses int
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.unhealthy && !now.Before(u.ejectedUntil)
+}
+
+// status describes why an unavailable upstream is left out, or returns "" if it is available
+func (u *upstream) status(now time.Time) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case u.unhealthy:
+		return "failing health checks"
+	case now.Before(u.ejectedUntil):
+		return "ejected after failed requests"
+	default:
+		return ""
+	}
+}
+
+// eject leaves the upstream out until until. u.mu must be held.
+func (u *upstream) eject(until time.Time) {
+	u.ejected = true
+	u.ejectedUntil = until
+	if u.ejectTimer == nil {
+		u.ejectTimer = time.AfterFunc(time.Until(until), u.endEjection)
+	} else {
+		u.ejectTimer.Reset(time.Until(until))
+	}
+}
+
+// endEjection marks the upstream available once its ejection has run out, unless
+// it is failing health checks
+func (u *upstream) endEjection() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ejected && !time.Now().Before(u.ejectedUntil) {
+		u.ejected = false
+		if !u.unhealthy {
+			u.setAvailable(true)
+		}
+	}
+}
+
+// setAvailable records a change in the upstream's availability
+func (u *upstream) setAvailable(available bool) {
+	value := 0.0
+	if available {
+		value = 1
+	}
+	metrics.UpstreamAvailable.WithLabelValues(u.url.String()).Set(value)
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// upstreamPool is the Transport of a backend's reverse proxy. It sends each
+// request to one of the backend's upstreams.
+type upstreamPool struct {
+	upstreams []*upstream
+	config    config.LoadBalancingConfig
+	// transport sends requests to upstreams
+	transport http.RoundTripper
+	// checkTransport sends health checks, which aren't traced or timed
+	checkTransport http.RoundTripper
+	// ring is the consistent hash ring, for the consistent_hash policy
+	ring []ringPoint
+	next atomic.Uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// adopted is set once the pool replacing this one takes over its upstreams
+	adopted bool
+}
+
+// newUpstreamPool creates a pool for backend's upstreams, connecting to them with
+// transport
+func newUpstreamPool(backend config.Backend, transport http.RoundTripper) (*upstreamPool, error) {
+	pool := &upstreamPool{
+		config:         backend.LoadBalancing,
+		transport:      &upstreamTimer{transport: transport},
+		checkTransport: transport,
+		stop:           make(chan struct{}),
+	}
+
+	for _, backendURL := range backend.URLs {
+		target, err := url.Parse(backendURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend URL: %w", err)
+		}
+		u := &upstream{url: &url.URL{Scheme: target.Scheme, Host: target.Host}}
+		pool.upstreams = append(pool.upstreams, u)
+
+		if pool.config.Policy == config.BalanceConsistentHash {
+			for i := 0; i < ringReplicas; i++ {
+				pool.ring = append(pool.ring, ringPoint{hash: hashString(u.url.String() + "#" + strconv.Itoa(i)), upstream: u})
+			}
+		}
+	}
+	slices.SortFunc(pool.ring, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+
+	return pool, nil
+}
+
+// start begins health checks, if they are configured
+func (p *upstreamPool) start() {
+	for _, u := range p.upstreams {
+		u.setAvailable(u.available(time.Now()))
+	}
+	if p.config.HealthCheck.Path != "" {
+		go p.runHealthChecks()
+	}
+}
+
+// adopt takes over the upstreams of previous, a pool for the same backend that p
+// replaces, so that their health is kept across configuration reloads
+func (p *upstreamPool) adopt(previous *upstreamPool) {
+	replacements := make(map[*upstream]*upstream, len(p.upstreams))
+	for i, u := range p.upstreams {
+		replacements[u] = previous.upstreams[i]
+	}
+	for i := range p.ring {
+		p.ring[i].upstream = replacements[p.ring[i].upstream]
+	}
+	p.upstreams = previous.upstreams
+	previous.adopted = true
+}
+
+// close stops health checks and closes idle connections
+func (p *upstreamPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		if transport, ok := p.checkTransport.(interface{ CloseIdleConnections() }); ok {
+			transport.CloseIdleConnections()
+		}
+		if !p.adopted {
+			for _, u := range p.upstreams {
+				u.mu.Lock()
+				if u.ejectTimer != nil {
+					u.ejectTimer.Stop()
+				}
+				u.mu.Unlock()
+				metrics.UpstreamAvailable.DeleteLabelValues(u.url.String())
+			}
+		}
+	})
+}
+
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make([]*upstream, 0, 1)
+	for {
+		u := p.pick(req, tried)
+		tried = append(tried, u)
+
+		resp, err := p.send(u, req)
+		if err == nil || !retryable(req) || len(tried) > p.config.Retries || len(tried) == len(p.upstreams) {
+			return resp, err
+		}
+		metrics.UpstreamRetriesTotal.Inc()
+		slog.Warn("Retrying request on another upstream", "url", req.URL.Path, "upstream", u.url.String(), "error", err)
+	}
+}
+
+// send sends req to u, recording whether it failed
+func (p *upstreamPool) send(u *upstream, req *http.Request) (*http.Response, error) {
+	outreq := req.WithContext(req.Context())
+	target := *req.URL
+	target.Scheme, target.Host = u.url.Scheme, u.url.Host
+	outreq.URL = &target
+
+	u.inFlight.Add(1)
+	resp, err := p.transport.RoundTrip(outreq)
+
+	switch {
+	case err != nil:
+		u.inFlight.Add(-1)
+		// Requests abandoned by the client say nothing about the upstream
+		if req.Context().Err() == nil {
+			p.recordResult(u, false)
+		}
+		return nil, err
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		// The upgraded connection's body must stay an io.ReadWriteCloser
+		u.inFlight.Add(-1)
+	default:
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, done: func() { u.inFlight.Add(-1) }}
+	}
+
+	p.recordResult(u, resp.StatusCode != http.StatusBadGateway &&
+		resp.StatusCode != http.StatusServiceUnavailable &&
+		resp.StatusCode != http.StatusGatewayTimeout)
+	resp.Request = req
+	return resp, nil
+}
+
+// recordResult counts consecutive failed requests to u, ejecting it at max_fails
+func (p *upstreamPool) recordResult(u *upstream, ok bool) {
+	// Zero is left by pools built without defaults
+	if p.config.MaxFails <= 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ok {
+		if u.fails >= p.config.MaxFails && !u.unhealthy {
+			slog.Info("Upstream recovered", "upstream", u.url.String())
+			u.setAvailable(true)
+		}
+		u.fails = 0
+		u.ejected = false
+		return
+	}
+
+	u.fails++
+	if u.fails >= p.config.MaxFails {
+		if !u.ejected {
+			slog.Warn("Ejecting failing upstream", "upstream", u.url.String(), "failures", u.fails)
+			u.setAvailable(false)
+		}
+		u.eject(time.Now().Add(time.Duration(p.config.FailTimeoutMS) * time.Millisecond))
+	}
+}
+
+// pick selects an upstream for req that hasn't been tried yet
+func (p *upstreamPool) pick(req *http.Request, tried []*upstream) *upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.available(now) && !slices.Contains(tried, u) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		// Every remaining upstream is failing; some may still serve requests
+		for _, u := range p.upstreams {
+			if !slices.Contains(tried, u) {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	switch p.config.Policy {
+	case config.BalanceLeastConn:
+		return leastConn(candidates, p.next.Add(1))
+	case config.BalanceConsistentHash:
+		return p.hashPick(hashKey(req, p.config.HashKey), candidates)
+	default:
+		return candidates[p.next.Add(1)%uint64(len(candidates))]
+	}
+}
+
+// leastConn returns the candidate with the fewest requests in flight, starting
+// the search at offset so that ties are spread evenly
+func leastConn(candidates []*upstream, offset uint64) *upstream {
+	var best *upstream
+	for i := range candidates {
+		u := candidates[(offset+uint64(i))%uint64(len(candidates))]
+		if best == nil || u.inFlight.Load() < best.inFlight.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+// hashPick returns the first candidate at or after key's position on the ring
+func (p *upstreamPool) hashPick(key string, candidates []*upstream) *upstream {
+	hash := hashString(key)
+	start, _ := slices.BinarySearchFunc(p.ring, hash, func(point ringPoint, hash uint64) int {
+		return cmp.Compare(point.hash, hash)
+	})
+	for i := range p.ring {
+		point := p.ring[(start+i)%len(p.ring)]
+		if slices.Contains(candidates, point.upstream) {
+			return point.upstream
+		}
+	}
+	return candidates[0]
+}
+
+// hashKey returns the part of req that the consistent_hash policy hashes
+func hashKey(req *http.Request, key string) string {
+	if name, found := strings.CutPrefix(key, "header:"); found {
+		return req.Header.Get(name)
+	}
+	if name, found := strings.CutPrefix(key, "cookie:"); found {
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	if key == config.HashKeyURL {
+		return req.URL.RequestURI()
+	}
+	return clientIP(req)
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	// FNV alone leaves similar strings, like an upstream's ring points, clustered
+	hash := h.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	return hash
+}
+
+// retryable reports whether req may be sent to another upstream after a connection
+// error: it must be idempotent, have no body to replay, and not be canceled
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return (req.Body == nil || req.Body == http.NoBody) && req.Context().Err() == nil
+}
+
+// upstreamBody is a response body that counts as in flight until it is closed
+type upstreamBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+func (p *upstreamPool) runHealthChecks() {
+	interval := time.Duration(p.config.HealthCheck.IntervalMS) * time.Millisecond
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.checkHealth()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks every upstream once
+func (p *upstreamPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.recordCheck(u, p.probe(u))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe requests the health check path from u
+func (p *upstreamPool) probe(u *upstream) error {
+	hc := p.config.HealthCheck
+	timeout := time.Duration(hc.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path, err := url.Parse(hc.Path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url.ResolveReference(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "xrp-health-check")
+
+	resp, err := p.checkTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordCheck counts consecutive health check results for u, changing its health
+// at the configured thresholds
+func (p *upstreamPool) recordCheck(u *upstream, err error) {
+	hc := p.config.HealthCheck
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.checkPasses = 0
+		u.checkFails++
+		if !u.unhealthy && u.checkFails >= max(hc.UnhealthyThreshold, 1) {
+			slog.Warn("Upstream failed health checks", "upstream", u.url.String(), "error", err)
+			u.unhealthy = true
+			u.setAvailable(false)
+		}
+		return
+	}
+
+	u.checkFails = 0
+	u.checkPasses++
+	if u.unhealthy && u.checkPasses >= max(hc.HealthyThreshold, 1) {
+		slog.Info("Upstream passed health checks", "upstream", u.url.String())
+		u.unhealthy = false
+		u.setAvailable(!time.Now().Before(u.ejectedUntil))
+	}
+}
+
+// health returns an error naming the pool's upstreams that are left out
+func (p *upstreamPool) health() error {
+	now := time.Now()
+	var problems []string
+	for _, u := range p.upstreams {
+		if status := u.status(now); status != "" {
+			problems = append(problems, u.url.String()+" "+status)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cdzombak/xrp/internal/config"
+	"github.com/cdzombak/xrp/internal/metrics"
+)
+
+// newNamedBackend returns a backend that responds with its name, and whose
+// /healthz fails while healthy is false
+func newNamedBackend(name string, healthy *atomic.Bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && healthy != nil && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprint(w, name)
+	}))
+}
+
+// withUpstreams is a newTestConfig override that balances over upstreams with lb,
+// without caching
+func withUpstreams(upstreams []string, lb config.LoadBalancingConfig) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Upstreams = upstreams
+		cfg.LoadBalancing = lb
+		cfg.Cache.Disabled = true
+	}
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	var upstreams []string
+	for _, name := range []string{"a", "b", "c"} {
+		backend := newNamedBackend(name, nil)
+		defer backend.Close()
+		upstreams = append(upstreams, backend.URL)
+	}
+	proxy := newTestProxy(t, upstreams[0], withUpstreams(upstreams, config.LoadBalancingConfig{}))
+
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		recorder := serve(proxy, "GET")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", recorder.Code)
+		}
+		counts[recorder.Body.String()]++
+	}
+	if counts["a"] != 3 || counts["b"] != 3 || counts["c"] != 3 {
+		t.Errorf("expected requests to be spread evenly, got %v", counts)
+	}
+}
+
+// TestUpstreamPool_Failures tests that idempotent requests are retried past an
+// unreachable upstream, which is then ejected
+func TestUpstreamPool_Failures(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := newNamedBackend("live", nil)
+	defer live.Close()
+
+	proxy := newTestProxy(t, dead.URL, withUpstreams([]string{dead.URL, live.URL}, config.LoadBalancingConfig{
+		MaxFails:      2,
+		FailTimeoutMS: 60000,
+		Retries:       1,
+	}))
+
+	for i := 0; i < 4; i++ {
+		if recorder := serve(proxy, "GET"); recorder.Body.String() != "live" {
+			t.Fatalf("expected GET to be retried on the live upstream, got %d %q", recorder.Code, recorder.Body.String())
+		}
+	}
+	err := proxy.UpstreamHealth()
+	if err == nil || !strings.Contains(err.Error(), dead.URL+" ejected") {
+		t.Fatalf("expected dead upstream to be ejected, got %v", err)
+	}
+
+	// Upstream health is kept across configuration reloads
+	if err := proxy.UpdateConfig(proxy.config); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.UpstreamHealth(); err == nil || !strings.Contains(err.Error(), dead.URL+" ejected") {
+		t.Fatalf("expected dead upstream to stay ejected after reload, got %v", err)
+	}
+
+	// Requests that can't be retried avoid the ejected upstream
+	for i := 0; i < 4; i++ {
+		if recorder := serve(proxy, "POST"); recorder.Body.String() != "live" {
+			t.Errorf("expected POST to go to the live upstream, got %d", recorder.Code)
+		}
+	}
+}
+
+// TestUpstreamPool_EjectionEnds tests that an ejected upstream is reported
+// available again once fail_timeout_ms passes, without waiting for a request
+func TestUpstreamPool_EjectionEnds(t *testing.T) {
+	pool, err := newUpstreamPool(config.Backend{
+		URLs:          []string{"http://ejected.test:8080"},
+		LoadBalancing: config.LoadBalancingConfig{MaxFails: 1, FailTimeoutMS: 20},
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.start()
+	defer pool.close()
+	available := metrics.UpstreamAvailable.WithLabelValues("http://ejected.test:8080")
+
+	pool.recordResult(pool.upstreams[0], false)
+	if got := testutil.ToFloat64(available); got != 0 {
+		t.Fatalf("expected the ejected upstream to be unavailable, got %v", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := testutil.ToFloat64(available); got != 1 {
+		t.Errorf("expected the upstream to be available once its ejection ran out, got %v", got)
+	}
+
+	// Failing again after the ejection ran out ejects it again
+	pool.recordResult(pool.upstreams[0], false)
+	if got := testutil.ToFloat64(available); got != 0 {
+		t.Errorf("expected the upstream to be ejected again, got %v", got)
+	}
+}
+
+// TestUpstreamPool_EjectionDisabled tests that max_fails -1 turns passive
+// ejection off
+func TestUpstreamPool_EjectionDisabled(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := newNamedBackend("live", nil)
+	defer live.Close()
+
+	proxy := newTestProxy(t, dead.URL, withUpstreams([]string{dead.URL, live.URL}, config.LoadBalancingConfig{
+		MaxFails: config.MaxFailsDisabled,
+	}))
+	for i := 0; i < 4; i++ {
+		serve(proxy, "POST")
+	}
+	if err := proxy.UpstreamHealth(); err != nil {
+		t.Errorf("expected no upstream to be ejected, got %v", err)
+	}
+}
+
+func TestUpstreamPool_NoRetry(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := newNamedBackend("live", nil)
+	defer live.Close()
+
+	// Without passive ejection, every other request goes to the dead upstream
+	proxy := newTestProxy(t, dead.URL, withUpstreams([]string{dead.URL, live.URL}, config.LoadBalancingConfig{}))
+	var failed int
+	for i := 0; i < 4; i++ {
+		if serve(proxy, "POST").Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("expected POSTs to the dead upstream to fail without retry, got %d failures", failed)
+	}
+}
+
+func TestUpstreamPool_HealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	flaky := newNamedBackend("flaky", &healthy)
+	defer flaky.Close()
+	steady := newNamedBackend("steady", nil)
+	defer steady.Close()
+
+	pool, err := newUpstreamPool(config.Backend{
+		URLs: []string{flaky.URL, steady.URL},
+		LoadBalancing: config.LoadBalancingConfig{
+			HealthCheck: config.HealthCheckConfig{Path: "/healthz", UnhealthyThreshold: 2, HealthyThreshold: 1},
+		},
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flakyUpstream := pool.upstreams[0]
+	req := httptest.NewRequest("GET", "/", nil)
+
+	healthy.Store(false)
+	pool.checkHealth()
+	if pool.health() != nil {
+		t.Error("expected one failed check to be tolerated")
+	}
+	pool.checkHealth()
+	if pool.health() == nil {
+		t.Fatal("expected upstream to be unhealthy after two failed checks")
+	}
+	for i := 0; i < 4; i++ {
+		if pool.pick(req, nil) == flakyUpstream {
+			t.Fatal("expected unhealthy upstream to be left out")
+		}
+	}
+
+	// Every upstream is used when all are left out
+	if pool.pick(req, []*upstream{pool.upstreams[1]}) != flakyUpstream {
+		t.Error("expected an unhealthy upstream to be used when no other is left")
+	}
+
+	healthy.Store(true)
+	pool.checkHealth()
+	if err := pool.health(); err != nil {
+		t.Errorf("expected upstream to recover, got %v", err)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	upstreams := []*upstream{{}, {}, {}}
+	upstreams[0].inFlight.Store(2)
+	upstreams[1].inFlight.Store(1)
+	upstreams[2].inFlight.Store(3)
+
+	for offset := uint64(0); offset < 3; offset++ {
+		if leastConn(upstreams, offset) != upstreams[1] {
+			t.Errorf("expected upstream with fewest requests in flight at offset %d", offset)
+		}
+	}
+
+	upstreams[0].inFlight.Store(1)
+	if leastConn(upstreams, 0) != upstreams[0] || leastConn(upstreams, 1) != upstreams[1] {
+		t.Error("expected ties to be broken by offset")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool, err := newUpstreamPool(config.Backend{
+		URLs:          []string{"http://a:8080", "http://b:8080", "http://c:8080"},
+		LoadBalancing: config.LoadBalancingConfig{Policy: config.BalanceConsistentHash},
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assigned := make(map[string]*upstream)
+	counts := make(map[*upstream]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("192.0.2.%d:%d", i%256, i)
+		u := pool.hashPick(key, pool.upstreams)
+		assigned[key] = u
+		counts[u]++
+		if pool.hashPick(key, pool.upstreams) != u {
+			t.Fatal("expected the same key to map to the same upstream")
+		}
+	}
+	for _, u := range pool.upstreams {
+		if counts[u] < 700 {
+			t.Errorf("expected keys to be spread evenly, got %d for %s", counts[u], u.url)
+		}
+	}
+
+	// Leaving out an upstream moves only its keys
+	remaining := pool.upstreams[1:]
+	for key, u := range assigned {
+		if u != pool.upstreams[0] && pool.hashPick(key, remaining) != u {
+			t.Fatalf("expected key %s to stay on %s", key, u.url)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/page?x=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-User", "alice")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	tests := map[string]string{
+		"":               "192.0.2.1",
+		"client_ip":      "192.0.2.1",
+		"url":            "/page?x=1",
+		"header:X-User":  "alice",
+		"cookie:session": "s1",
+		"cookie:missing": "",
+	}
+	for key, want := range tests {
+		if got := hashKey(req, key); got != want {
+			t.Errorf("hashKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/cdzombak/xrp/internal/config"
+)
+
+func TestSetupDisabled(t *testing.T) {
+	before := otel.GetTracerProvider()
+
+	shutdown, err := Setup(config.TracingConfig{}, "test")
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	if otel.GetTracerProvider() != before {
+		t.Error("disabled tracing replaced the tracer provider")
+	}
+}
+
+func TestSetupFileExporter(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(config.TracingConfig{
+		Enabled:     true,
+		Exporter:    config.TraceExporterFile,
+		Path:        path,
+		SampleRatio: 1,
+		ServiceName: "xrp-test",
+	}, "1.2.3")
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	_, span := Tracer().Start(context.Background(), "test span")
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %v", err)
+	}
+
+	var exported struct {
+		Name     string
+		Resource []struct {
+			Key   string
+			Value struct{ Value any }
+		}
+	}
+	if err := json.NewDecoder(strings.NewReader(string(data))).Decode(&exported); err != nil {
+		t.Fatalf("failed to decode span %q: %v", data, err)
+	}
+	if exported.Name != "test span" {
+		t.Errorf("span name = %q, want %q", exported.Name, "test span")
+	}
+
+	resource := map[string]any{}
+	for _, attr := range exported.Resource {
+		resource[attr.Key] = attr.Value.Value
+	}
+	if resource["service.name"] != "xrp-test" {
+		t.Errorf("service.name = %v, want xrp-test", resource["service.name"])
+	}
+	if resource["service.version"] != "1.2.3" {
+		t.Errorf("service.version = %v, want 1.2.3", resource["service.version"])
+	}
+}
+
+func TestSetupFileExporterBadPath(t *testing.T) {
+	_, err := Setup(config.TracingConfig{
+		Enabled:  true,
+		Exporter: config.TraceExporterFile,
+		Path:     filepath.Join(t.TempDir(), "missing", "traces.json"),
+	}, "test")
+	if err == nil {
+		t.Error("expected error for unwritable trace file")
+	}
+}
@@ -5,15 +5,20 @@ import (
 	"errors"
 	"flag"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/cdzombak/xrp/internal/admin"
+	"github.com/cdzombak/xrp/internal/certs"
 	"github.com/cdzombak/xrp/internal/config"
 	"github.com/cdzombak/xrp/internal/health"
+	"github.com/cdzombak/xrp/internal/metrics"
 	"github.com/cdzombak/xrp/internal/proxy"
+	"github.com/cdzombak/xrp/internal/tracing"
 )
 
 var version string = "<dev>"
@@ -63,6 +68,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Tracing is configured once at startup; changes require a restart
+	shutdownTracing, err := tracing.Setup(cfg.Tracing, version)
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	// Create health server before proxy to handle startup monitoring
 	healthServer := health.New(cfg.HealthPort)
 
@@ -93,6 +105,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Serve the admin API on the health port; it is disabled without a token
+	adminHandler := admin.New(cfg.Admin.Token, func() admin.Cache { return proxyServer.Cache() })
+	healthServer.Handle("/admin/", adminHandler)
+
+	// Report cache store outages; XRP keeps proxying without caching meanwhile
+	healthServer.AddCheck("cache", func() error { return proxyServer.Cache().Health() })
+
+	// Report upstreams left out of rotation; XRP balances over the rest
+	healthServer.AddCheck("upstreams", proxyServer.UpstreamHealth)
+
 	// Mark health server as ready now that proxy is created and plugins loaded
 	healthServer.MarkReady()
 
@@ -101,16 +123,49 @@ func main() {
 		Handler: proxyServer,
 	}
 
+	// TLS is set up once at startup; certificates are reloaded on SIGHUP
+	var certManager *certs.Manager
+	var redirectServer *http.Server
+	if cfg.TLS.Enabled {
+		certManager, err = certs.New(cfg.TLS)
+		if err != nil {
+			slog.Error("Failed to load TLS certificates", "error", err)
+			os.Exit(1)
+		}
+		certManager.Configure(server, cfg.TLS)
+
+		if cfg.TLS.RedirectAddr != "" {
+			_, httpsPort, _ := net.SplitHostPort(addr)
+			redirectServer = &http.Server{
+				Addr:    cfg.TLS.RedirectAddr,
+				Handler: certManager.HTTPHandler(httpsPort),
+			}
+			go func() {
+				slog.Info("Starting HTTP redirect server", "addr", cfg.TLS.RedirectAddr)
+				if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("HTTP redirect server failed", "error", err)
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+
 	go func() {
-		slog.Info("Starting server", "addr", addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Info("Starting server", "addr", addr, "tls", cfg.TLS.Enabled)
+		var err error
+		if cfg.TLS.Enabled {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("Server failed", "error", err)
 			os.Exit(1)
 		}
 	}()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
 	for {
 		sig := <-sigChan
@@ -123,18 +178,41 @@ func main() {
 			newCfg, err := config.Load(configFile)
 			if err != nil {
 				slog.Error("Failed to reload configuration", "error", err)
+				metrics.ConfigReloadsTotal.WithLabelValues(metrics.ReloadFailure).Inc()
 				healthServer.MarkReady() // Restore ready state on error
 				continue
 			}
+			if newCfg.TLS.Enabled != cfg.TLS.Enabled || newCfg.TLS.RedirectAddr != cfg.TLS.RedirectAddr {
+				slog.Warn("Changes to tls.enabled and tls.redirect_addr take effect on restart")
+			}
+			if certManager != nil {
+				if err := certManager.Update(newCfg.TLS); err != nil {
+					slog.Error("Failed to reload TLS certificates", "error", err)
+					metrics.ConfigReloadsTotal.WithLabelValues(metrics.ReloadFailure).Inc()
+					healthServer.MarkReady() // Restore ready state on error
+					continue
+				}
+			}
 			if err := proxyServer.UpdateConfig(newCfg); err != nil {
 				slog.Error("Failed to update proxy configuration", "error", err)
+				metrics.ConfigReloadsTotal.WithLabelValues(metrics.ReloadFailure).Inc()
 				healthServer.MarkReady() // Restore ready state on error
 				continue
 			}
 
+			adminHandler.UpdateToken(newCfg.Admin.Token)
+
 			// Mark ready again after successful reload
+			metrics.ConfigReloadsTotal.WithLabelValues(metrics.ReloadSuccess).Inc()
 			healthServer.MarkReady()
 			slog.Info("Configuration reloaded successfully")
+		case syscall.SIGUSR1:
+			// Release the rotated access log file
+			if err := proxyServer.ReopenAccessLog(); err != nil {
+				slog.Error("Failed to reopen access log", "error", err)
+			} else {
+				slog.Info("Access log reopened")
+			}
 		case syscall.SIGINT, syscall.SIGTERM:
 			slog.Info("Shutting down server")
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -143,9 +221,18 @@ func main() {
 			if err := server.Shutdown(ctx); err != nil {
 				slog.Error("Proxy server shutdown failed", "error", err)
 			}
+			if redirectServer != nil {
+				if err := redirectServer.Shutdown(ctx); err != nil {
+					slog.Error("HTTP redirect server shutdown failed", "error", err)
+				}
+			}
 			if err := healthServer.Stop(); err != nil {
 				slog.Error("Health server shutdown failed", "error", err)
 			}
+			proxyServer.Close()
+			if err := shutdownTracing(ctx); err != nil {
+				slog.Error("Tracing shutdown failed", "error", err)
+			}
 
 			cancel()
 			return
@@ -0,0 +1,38 @@
+package xrpplugin
+
+import (
+	"context"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
+)
+
+// AdaptPlugin wraps a Plugin so it can be used where a PluginV2 is expected.
+// The adapted plugin receives the request URL from the ProcessingContext.
+func AdaptPlugin(p Plugin) PluginV2 {
+	return &pluginAdapter{plugin: p}
+}
+
+type pluginAdapter struct {
+	plugin Plugin
+}
+
+func (a *pluginAdapter) ProcessHTML(ctx context.Context, pctx *ProcessingContext, node *html.Node) error {
+	if htmlPlugin, ok := a.plugin.(HTMLPlugin); ok {
+		return htmlPlugin.ProcessHTMLTree(ctx, pctx.URL(), node)
+	}
+	return a.plugin.ProcessHTMLTree(ctx, pctx.URL(), node)
+}
+
+func (a *pluginAdapter) ProcessXML(ctx context.Context, pctx *ProcessingContext, doc *etree.Document) error {
+	if xmlPlugin, ok := a.plugin.(XMLPlugin); ok {
+		return xmlPlugin.ProcessXMLTree(ctx, pctx.URL(), doc)
+	}
+	return a.plugin.ProcessXMLTree(ctx, pctx.URL(), doc)
+}
+
+// Unwrap returns the adapted Plugin.
+func (a *pluginAdapter) Unwrap() Plugin {
+	return a.plugin
+}
@@ -2,6 +2,7 @@ package xrpplugin
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
 
 	"golang.org/x/net/html"
@@ -32,8 +33,68 @@ type XMLPlugin interface {
 	ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error
 }
 
+// PluginV2 is the richer plugin interface. Instead of just the request URL, its
+// methods receive a ProcessingContext exposing the client request (headers, cookies,
+// client IP) and the upstream response (status code and a mutable header map).
+// Like Plugin, a PluginV2 modifies the document tree in place.
+//
+// Plugins may implement either Plugin or PluginV2; XRP adapts Plugin implementations
+// to PluginV2 internally.
+type PluginV2 interface {
+	// ProcessHTML modifies an HTML tree in place.
+	// It should return an error if processing fails.
+	ProcessHTML(ctx context.Context, pctx *ProcessingContext, node *html.Node) error
+
+	// ProcessXML modifies an XML tree in place.
+	// It should return an error if processing fails.
+	ProcessXML(ctx context.Context, pctx *ProcessingContext, doc *etree.Document) error
+}
+
+// StreamingPlugin is an optional interface for HTML plugins that rewrite documents
+// as they stream through XRP instead of modifying a parsed tree. XRP uses it for
+// MIME types configured with "processing": "stream", which are rewritten with
+// constant memory, whatever their size. Plugins may implement StreamingPlugin
+// alongside Plugin or PluginV2, or on its own.
+type StreamingPlugin interface {
+	// RewriteHTML registers the handlers that rewrite one HTML response on rw. It
+	// is called before the body is read, so it may still change response headers
+	// through pctx; changes made from handlers are not sent.
+	// It should return an error if the response can't be rewritten.
+	RewriteHTML(ctx context.Context, pctx *ProcessingContext, rw *HTMLRewriter) error
+}
+
+// Configurable is an optional interface for plugins that accept configuration.
+// If a plugin implements Configurable, XRP calls Configure with the plugin's
+// "options" object from the configuration file when the plugin is loaded, and
+// again whenever the configuration is reloaded. If no options are configured,
+// Configure receives an empty JSON object.
+// Returning an error fails the plugin load (or the configuration reload).
+//
+// On load, Configure is called before the plugin processes any documents. On
+// reload, it is called on the running instance while requests already in flight
+// may still be processing documents with it, so Configure must be safe to call
+// concurrently with the plugin's processing methods; for example, build the new
+// settings and swap them in atomically. It is called only once every plugin in
+// the new configuration has loaded. If the reload fails after a plugin was
+// reconfigured, Configure is called again with the plugin's previous options.
+type Configurable interface {
+	Configure(options json.RawMessage) error
+}
+
 // GetPlugin is the standard function signature that all plugins should export.
 // This eliminates the need for complex reflection-based plugin loading.
 // Instead of exporting a plugin instance directly, plugins should export:
-//   func GetPlugin() xrpplugin.Plugin { return &MyPlugin{} }
+//
+//	func GetPlugin() xrpplugin.Plugin { return &MyPlugin{} }
 type GetPluginFunc func() Plugin
+
+// GetPluginV2Func is the export signature for plugins implementing PluginV2:
+//
+//	func GetPlugin() xrpplugin.PluginV2 { return &MyPlugin{} }
+type GetPluginV2Func func() PluginV2
+
+// GetStreamingPluginFunc is the export signature for plugins implementing only
+// StreamingPlugin:
+//
+//	func GetPlugin() xrpplugin.StreamingPlugin { return &MyPlugin{} }
+type GetStreamingPluginFunc func() StreamingPlugin
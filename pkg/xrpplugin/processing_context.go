@@ -0,0 +1,104 @@
+package xrpplugin
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// ProcessingContext describes the request and response being processed by a PluginV2.
+//
+// Request data is a read-only snapshot taken before plugins run. The response header
+// map is live: plugins may add, change, or remove response headers, and those changes
+// are sent to the client and stored in the cache along with the processed body.
+type ProcessingContext struct {
+	method         string
+	url            *url.URL
+	host           string
+	requestHeader  http.Header
+	clientIP       string
+	statusCode     int
+	responseHeader http.Header
+}
+
+// NewProcessingContext creates a ProcessingContext for the given request and response.
+// The request is copied; responseHeader is used as-is so plugins can modify it.
+func NewProcessingContext(req *http.Request, clientIP string, statusCode int, responseHeader http.Header) *ProcessingContext {
+	pctx := &ProcessingContext{
+		clientIP:       clientIP,
+		statusCode:     statusCode,
+		responseHeader: responseHeader,
+		requestHeader:  make(http.Header),
+	}
+
+	if req != nil {
+		pctx.method = req.Method
+		pctx.host = req.Host
+		if req.URL != nil {
+			u := *req.URL
+			pctx.url = &u
+		}
+		if req.Header != nil {
+			pctx.requestHeader = req.Header.Clone()
+		}
+	}
+	if pctx.url == nil {
+		pctx.url = &url.URL{}
+	}
+	if pctx.responseHeader == nil {
+		pctx.responseHeader = make(http.Header)
+	}
+
+	return pctx
+}
+
+// Method returns the client request's HTTP method.
+func (pc *ProcessingContext) Method() string {
+	return pc.method
+}
+
+// URL returns a copy of the client request's URL.
+func (pc *ProcessingContext) URL() *url.URL {
+	u := *pc.url
+	return &u
+}
+
+// Host returns the Host the client requested.
+func (pc *ProcessingContext) Host() string {
+	return pc.host
+}
+
+// RequestHeader returns the first value of the named client request header.
+func (pc *ProcessingContext) RequestHeader(name string) string {
+	return pc.requestHeader.Get(name)
+}
+
+// RequestHeaders returns a copy of all client request headers.
+func (pc *ProcessingContext) RequestHeaders() http.Header {
+	return pc.requestHeader.Clone()
+}
+
+// Cookie returns the named cookie from the client request, or http.ErrNoCookie.
+func (pc *ProcessingContext) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: pc.requestHeader}).Cookie(name)
+}
+
+// Cookies returns all cookies sent with the client request.
+func (pc *ProcessingContext) Cookies() []*http.Cookie {
+	return (&http.Request{Header: pc.requestHeader}).Cookies()
+}
+
+// ClientIP returns the IP address of the client.
+func (pc *ProcessingContext) ClientIP() string {
+	return pc.clientIP
+}
+
+// StatusCode returns the upstream response's status code.
+func (pc *ProcessingContext) StatusCode() int {
+	return pc.statusCode
+}
+
+// ResponseHeader returns the response header map. Plugins may modify it.
+// Content-Length and Content-Encoding are managed by XRP and will be overwritten.
+func (pc *ProcessingContext) ResponseHeader() http.Header {
+	return pc.responseHeader
+}
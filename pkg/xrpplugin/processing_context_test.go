@@ -0,0 +1,55 @@
+package xrpplugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProcessingContext(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.com/article?id=7", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(&http.Cookie{Name: "bucket", Value: "b"})
+
+	responseHeader := make(http.Header)
+	pctx := NewProcessingContext(req, "198.51.100.4", 200, responseHeader)
+
+	if pctx.Method() != "GET" || pctx.Host() != "example.com" {
+		t.Errorf("unexpected method/host: %s %s", pctx.Method(), pctx.Host())
+	}
+	if pctx.URL().String() != "https://example.com/article?id=7" {
+		t.Errorf("unexpected URL: %s", pctx.URL())
+	}
+	if pctx.RequestHeader("Accept-Language") != "de" {
+		t.Errorf("expected request header, got %q", pctx.RequestHeader("Accept-Language"))
+	}
+	if cookie, err := pctx.Cookie("bucket"); err != nil || cookie.Value != "b" {
+		t.Errorf("expected bucket cookie, got %v, %v", cookie, err)
+	}
+	if pctx.ClientIP() != "198.51.100.4" || pctx.StatusCode() != 200 {
+		t.Errorf("unexpected client IP/status: %s %d", pctx.ClientIP(), pctx.StatusCode())
+	}
+
+	// Request data is a snapshot; changing it through accessors or the original request has no effect
+	pctx.URL().Path = "/changed"
+	pctx.RequestHeaders().Set("Accept-Language", "fr")
+	req.Header.Set("Accept-Language", "es")
+	if pctx.URL().Path != "/article" || pctx.RequestHeader("Accept-Language") != "de" {
+		t.Error("expected request data to be read-only")
+	}
+
+	// The response header map is live
+	pctx.ResponseHeader().Set("Link", "</style.css>; rel=preload")
+	if responseHeader.Get("Link") == "" {
+		t.Error("expected response header changes to be visible to the caller")
+	}
+}
+
+func TestProcessingContextNilRequest(t *testing.T) {
+	pctx := NewProcessingContext(nil, "", 0, nil)
+	if pctx.URL() == nil || pctx.ResponseHeader() == nil {
+		t.Error("expected non-nil URL and response header for nil request")
+	}
+	if _, err := pctx.Cookie("missing"); err != http.ErrNoCookie {
+		t.Errorf("expected ErrNoCookie, got %v", err)
+	}
+}
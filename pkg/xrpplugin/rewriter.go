@@ -0,0 +1,518 @@
+package xrpplugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// HTMLRewriter rewrites an HTML document as it streams, token by token, calling
+// handlers registered for CSS selectors as matching elements and text go by. It
+// holds only the current token and the chain of open elements, so memory use
+// doesn't grow with the document.
+//
+// Selectors support type and universal selectors, #id, .class, attribute
+// selectors ([attr], [attr=v], [attr~=v], [attr|=v], [attr^=v], [attr$=v],
+// [attr*=v]), the descendant and child combinators, and comma-separated lists.
+// They match elements as they appear in the markup: elements the HTML parser
+// would imply, such as a missing <body>, are not seen.
+//
+// Handlers see each element once, at its start tag, and everything they insert is
+// written as given, so text must be escaped with html.EscapeString. An
+// HTMLRewriter rewrites a single document.
+//
+// To keep memory bounded, a single token (a tag with its attributes, or a run of
+// text) may be at most 4 MiB, and elements may be nested at most 512 deep; a
+// document exceeding either limit fails with ErrTokenTooLarge or ErrNestingTooDeep.
+type HTMLRewriter struct {
+	elementHandlers []elementHandler
+	textHandlers    []textHandler
+}
+
+const (
+	// maxTokenSize limits the bytes the tokenizer buffers for a single token
+	maxTokenSize = 4 << 20
+	// maxNestingDepth limits the number of open elements
+	maxNestingDepth = 512
+)
+
+var (
+	// ErrTokenTooLarge is returned by an HTMLRewriter for a document with a token
+	// larger than it will buffer
+	ErrTokenTooLarge = errors.New("xrpplugin: HTML token too large")
+	// ErrNestingTooDeep is returned by an HTMLRewriter for a document with
+	// elements nested too deeply
+	ErrNestingTooDeep = errors.New("xrpplugin: HTML elements nested too deeply")
+)
+
+type elementHandler struct {
+	selectors []selector
+	handle    func(el *Element) error
+}
+
+type textHandler struct {
+	selectors []selector
+	handle    func(text *Text) error
+}
+
+// NewHTMLRewriter creates an HTMLRewriter with no handlers
+func NewHTMLRewriter() *HTMLRewriter {
+	return &HTMLRewriter{}
+}
+
+// OnElement registers handle to be called for each element matching selector.
+// Handlers for the same element run in the order they were registered.
+func (rw *HTMLRewriter) OnElement(selector string, handle func(el *Element) error) error {
+	selectors, err := parseSelectorList(selector)
+	if err != nil {
+		return err
+	}
+	rw.elementHandlers = append(rw.elementHandlers, elementHandler{selectors: selectors, handle: handle})
+	return nil
+}
+
+// OnText registers handle to be called for each chunk of text directly inside an
+// element matching selector. Text may arrive in several chunks.
+func (rw *HTMLRewriter) OnText(selector string, handle func(text *Text) error) error {
+	selectors, err := parseSelectorList(selector)
+	if err != nil {
+		return err
+	}
+	rw.textHandlers = append(rw.textHandlers, textHandler{selectors: selectors, handle: handle})
+	return nil
+}
+
+// Rewrite copies the HTML document from src to dst, rewriting it. It returns the
+// first error from src, dst, or a handler.
+func (rw *HTMLRewriter) Rewrite(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, rw.Reader(src))
+	return err
+}
+
+// Reader returns a reader of the document from src, rewritten as it is read. A
+// handler error is returned from Read.
+func (rw *HTMLRewriter) Reader(src io.Reader) io.Reader {
+	z := html.NewTokenizer(src)
+	z.SetMaxBuf(maxTokenSize)
+	return &rewriteReader{rw: rw, z: z}
+}
+
+// Element is an element matched by an HTMLRewriter selector. Changes made to it
+// by handlers are applied when the handlers return.
+type Element struct {
+	info elementInfo
+	// void elements have no content or end tag
+	void         bool
+	attrsChanged bool
+
+	before, prepend, append, after strings.Builder
+	inner                          *string
+	replacement                    string
+	removed                        bool
+	keepContent                    bool
+}
+
+// TagName returns the element's lowercase tag name
+func (el *Element) TagName() string {
+	return el.info.tag
+}
+
+// Attr returns the value of the named attribute and whether the element has it
+func (el *Element) Attr(name string) (string, bool) {
+	return el.info.attr(name)
+}
+
+// Attrs returns a copy of the element's attributes
+func (el *Element) Attrs() []html.Attribute {
+	return append([]html.Attribute(nil), el.info.attrs...)
+}
+
+// SetAttr sets the named attribute, adding it if the element doesn't have it
+func (el *Element) SetAttr(name, value string) {
+	el.attrsChanged = true
+	for i, attr := range el.info.attrs {
+		if attr.Namespace == "" && attr.Key == name {
+			el.info.attrs[i].Val = value
+			return
+		}
+	}
+	el.info.attrs = append(el.info.attrs, html.Attribute{Key: name, Val: value})
+}
+
+// RemoveAttr removes the named attribute
+func (el *Element) RemoveAttr(name string) {
+	for i, attr := range el.info.attrs {
+		if attr.Namespace == "" && attr.Key == name {
+			el.info.attrs = append(el.info.attrs[:i], el.info.attrs[i+1:]...)
+			el.attrsChanged = true
+			return
+		}
+	}
+}
+
+// IsVoid reports whether the element has no content or end tag, like <img> or
+// a self-closing tag
+func (el *Element) IsVoid() bool {
+	return el.void
+}
+
+// Before inserts HTML before the element
+func (el *Element) Before(content string) {
+	el.before.WriteString(content)
+}
+
+// After inserts HTML after the element
+func (el *Element) After(content string) {
+	el.after.WriteString(content)
+}
+
+// Prepend inserts HTML at the start of the element's content. It has no effect
+// on void elements.
+func (el *Element) Prepend(content string) {
+	el.prepend.WriteString(content)
+}
+
+// Append inserts HTML at the end of the element's content. It has no effect on
+// void elements.
+func (el *Element) Append(content string) {
+	el.append.WriteString(content)
+}
+
+// SetInnerContent replaces the element's content with HTML. It has no effect on
+// void elements.
+func (el *Element) SetInnerContent(content string) {
+	el.inner = &content
+}
+
+// Replace replaces the element, including its content, with HTML
+func (el *Element) Replace(content string) {
+	el.removed, el.keepContent = true, false
+	el.replacement = content
+}
+
+// Remove removes the element and its content
+func (el *Element) Remove() {
+	el.Replace("")
+}
+
+// RemoveAndKeepContent removes the element's tags, keeping its content
+func (el *Element) RemoveAndKeepContent() {
+	el.removed, el.keepContent = true, true
+	el.replacement = ""
+}
+
+// Text is a chunk of text matched by an HTMLRewriter selector
+type Text struct {
+	text          string
+	before, after strings.Builder
+	replacement   *string
+}
+
+// Text returns the chunk's text, with character references decoded
+func (t *Text) Text() string {
+	return t.text
+}
+
+// Before inserts HTML before the chunk
+func (t *Text) Before(content string) {
+	t.before.WriteString(content)
+}
+
+// After inserts HTML after the chunk
+func (t *Text) After(content string) {
+	t.after.WriteString(content)
+}
+
+// Replace replaces the chunk with HTML
+func (t *Text) Replace(content string) {
+	t.replacement = &content
+}
+
+// Remove removes the chunk
+func (t *Text) Remove() {
+	t.Replace("")
+}
+
+// voidElements have no content or end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "keygen": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// impliedEnds lists, for start tags that end an open element without its end
+// tag, the elements they end
+var impliedEnds = map[string][]string{
+	"li":       {"li"},
+	"dt":       {"dd", "dt"},
+	"dd":       {"dd", "dt"},
+	"option":   {"option"},
+	"optgroup": {"optgroup", "option"},
+	"tr":       {"td", "th", "tr"},
+	"td":       {"td", "th"},
+	"th":       {"td", "th"},
+	"thead":    {"td", "th", "tr", "tbody", "thead", "tfoot"},
+	"tbody":    {"td", "th", "tr", "tbody", "thead", "tfoot"},
+	"tfoot":    {"td", "th", "tr", "tbody", "thead", "tfoot"},
+}
+
+// paragraphEnders are start tags that end an open <p>
+var paragraphEnders = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "details": true,
+	"div": true, "dl": true, "fieldset": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "ul": true,
+}
+
+// openElement is an element whose end tag hasn't been seen yet
+type openElement struct {
+	info *elementInfo
+	// el is nil when no handler matched the element
+	el *Element
+	// dropContent is set when the element's content isn't written
+	dropContent bool
+}
+
+// rewriteReader runs an HTMLRewriter over a token stream, buffering the output of
+// one token at a time
+type rewriteReader struct {
+	rw    *HTMLRewriter
+	z     *html.Tokenizer
+	stack []*openElement
+	// ancestors mirrors stack for selector matching
+	ancestors []*elementInfo
+	// dropping counts open elements whose content isn't written
+	dropping int
+	out      bytes.Buffer
+	err      error
+}
+
+func (r *rewriteReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.err == nil {
+		r.err = r.next()
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+// next rewrites the next token, returning io.EOF at the end of the document
+func (r *rewriteReader) next() error {
+	tt := r.z.Next()
+	switch tt {
+	case html.ErrorToken:
+		err := r.z.Err()
+		switch {
+		case err == io.EOF:
+			for len(r.stack) > 0 {
+				r.pop(nil)
+			}
+		case errors.Is(err, html.ErrBufferExceeded):
+			return ErrTokenTooLarge
+		}
+		return err
+	case html.StartTagToken, html.SelfClosingTagToken:
+		return r.startTag(tt)
+	case html.EndTagToken:
+		r.endTag()
+		return nil
+	case html.TextToken:
+		return r.text()
+	default:
+		r.write(r.z.Raw())
+		return nil
+	}
+}
+
+func (r *rewriteReader) startTag(tt html.TokenType) error {
+	raw := r.z.Raw()
+	token := r.z.Token()
+	info := &elementInfo{tag: token.Data, attrs: token.Attr}
+	void := tt == html.SelfClosingTagToken || voidElements[info.tag]
+
+	r.endImplied(info.tag)
+	if !void && len(r.stack) >= maxNestingDepth {
+		return ErrNestingTooDeep
+	}
+
+	var el *Element
+	if r.dropping == 0 {
+		for _, handler := range r.rw.elementHandlers {
+			if !matchesAny(handler.selectors, info, r.ancestors) {
+				continue
+			}
+			if el == nil {
+				el = &Element{info: *info, void: void}
+				info = &el.info
+			}
+			if err := handler.handle(el); err != nil {
+				return err
+			}
+		}
+	}
+
+	if el == nil {
+		r.write(raw)
+		if !void {
+			r.push(&openElement{info: info})
+		}
+		return nil
+	}
+
+	r.out.WriteString(el.before.String())
+	if el.removed && !el.keepContent {
+		r.out.WriteString(el.replacement)
+		if void {
+			r.out.WriteString(el.after.String())
+		} else {
+			r.push(&openElement{info: info, el: el, dropContent: true})
+		}
+		return nil
+	}
+
+	if !el.removed {
+		if el.attrsChanged {
+			r.out.WriteString(html.Token{Type: tt, Data: el.info.tag, Attr: el.info.attrs}.String())
+		} else {
+			r.out.Write(raw)
+		}
+	}
+	if void {
+		r.out.WriteString(el.after.String())
+		return nil
+	}
+
+	r.out.WriteString(el.prepend.String())
+	if el.inner != nil {
+		r.out.WriteString(*el.inner)
+	}
+	r.push(&openElement{info: info, el: el, dropContent: el.inner != nil})
+	return nil
+}
+
+// endImplied ends open elements that a start tag for tag ends without their end
+// tags, like an open <li> before another <li>
+func (r *rewriteReader) endImplied(tag string) {
+	for len(r.stack) > 0 {
+		open := r.stack[len(r.stack)-1].info.tag
+		if !(open == "p" && paragraphEnders[tag]) && !slices.Contains(impliedEnds[tag], open) {
+			return
+		}
+		r.pop(nil)
+	}
+}
+
+func (r *rewriteReader) endTag() {
+	raw := r.z.Raw()
+	name, _ := r.z.TagName()
+	tag := string(name)
+
+	for i := len(r.stack) - 1; i >= 0; i-- {
+		if r.stack[i].info.tag != tag {
+			continue
+		}
+		// Elements still open inside this one end with it
+		for len(r.stack) > i+1 {
+			r.pop(nil)
+		}
+		r.pop(raw)
+		return
+	}
+
+	// A stray end tag
+	r.write(raw)
+}
+
+func (r *rewriteReader) text() error {
+	raw := r.z.Raw()
+	if r.dropping > 0 || len(r.stack) == 0 || len(r.rw.textHandlers) == 0 {
+		r.write(raw)
+		return nil
+	}
+
+	parent := len(r.ancestors) - 1
+	var text *Text
+	for _, handler := range r.rw.textHandlers {
+		if !matchesAny(handler.selectors, r.ancestors[parent], r.ancestors[:parent]) {
+			continue
+		}
+		if text == nil {
+			text = &Text{text: string(r.z.Text())}
+		}
+		if err := handler.handle(text); err != nil {
+			return err
+		}
+	}
+
+	if text == nil {
+		r.write(raw)
+		return nil
+	}
+	r.out.WriteString(text.before.String())
+	if text.replacement != nil {
+		r.out.WriteString(*text.replacement)
+	} else {
+		r.out.Write(raw)
+	}
+	r.out.WriteString(text.after.String())
+	return nil
+}
+
+// write writes raw markup unless it is inside an element whose content is dropped
+func (r *rewriteReader) write(raw []byte) {
+	if r.dropping == 0 {
+		r.out.Write(raw)
+	}
+}
+
+func (r *rewriteReader) push(open *openElement) {
+	r.stack = append(r.stack, open)
+	r.ancestors = append(r.ancestors, open.info)
+	if open.dropContent {
+		r.dropping++
+	}
+}
+
+// pop ends the innermost open element, with endRaw as its end tag, or none if
+// endRaw is nil
+func (r *rewriteReader) pop(endRaw []byte) {
+	last := len(r.stack) - 1
+	open := r.stack[last]
+	r.stack[last] = nil
+	r.stack = r.stack[:last]
+	r.ancestors = r.ancestors[:last]
+	if open.dropContent {
+		r.dropping--
+	}
+	if r.dropping > 0 {
+		return
+	}
+
+	el := open.el
+	if el == nil {
+		r.out.Write(endRaw)
+		return
+	}
+	if !el.removed || el.keepContent {
+		r.out.WriteString(el.append.String())
+		if !el.removed {
+			r.out.Write(endRaw)
+		}
+	}
+	r.out.WriteString(el.after.String())
+}
+
+func matchesAny(selectors []selector, el *elementInfo, ancestors []*elementInfo) bool {
+	for _, sel := range selectors {
+		if sel.matches(el, ancestors) {
+			return true
+		}
+	}
+	return false
+}
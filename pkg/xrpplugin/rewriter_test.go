@@ -0,0 +1,298 @@
+package xrpplugin
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/net/html"
+)
+
+func rewrite(t *testing.T, rw *HTMLRewriter, input string) string {
+	t.Helper()
+	var out strings.Builder
+	if err := rw.Rewrite(&out, strings.NewReader(input)); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestHTMLRewriterPassthrough(t *testing.T) {
+	// Unmatched markup is copied byte for byte, not normalized
+	input := "<!DOCTYPE html>\n<html><body class=x><p>One &amp; <b>two</b><br>" +
+		"<!-- note --><script>if (a < b) {}</script><li>a<li>b</body></html>"
+
+	rw := NewHTMLRewriter()
+	if err := rw.OnElement("table", func(el *Element) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got := rewrite(t, rw, input); got != input {
+		t.Errorf("expected unchanged document, got %q", got)
+	}
+}
+
+func TestHTMLRewriterElements(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		handle   func(el *Element)
+		input    string
+		want     string
+	}{
+		{
+			name:     "set attribute",
+			selector: `a[href^="http:"]`,
+			handle: func(el *Element) {
+				href, _ := el.Attr("href")
+				el.SetAttr("href", "https:"+strings.TrimPrefix(href, "http:"))
+				el.SetAttr("rel", `no"opener`)
+			},
+			input: `<a href="http://a.example/">a</a> <a href="/b">b</a>`,
+			want:  `<a href="https://a.example/" rel="no&#34;opener">a</a> <a href="/b">b</a>`,
+		},
+		{
+			name:     "remove attribute",
+			selector: "img",
+			handle:   func(el *Element) { el.RemoveAttr("style") },
+			input:    `<img src="a.png" style="x"><img src="b.png">`,
+			want:     `<img src="a.png"><img src="b.png">`,
+		},
+		{
+			name:     "insert around and inside",
+			selector: "#main",
+			handle: func(el *Element) {
+				el.Before("<hr>")
+				el.Prepend("<h1>Title</h1>")
+				el.Append("<footer>End</footer>")
+				el.After("<hr>")
+			},
+			input: `<div id="main"><p>Body</p></div>`,
+			want:  `<hr><div id="main"><h1>Title</h1><p>Body</p><footer>End</footer></div><hr>`,
+		},
+		{
+			name:     "set inner content",
+			selector: "div.ad",
+			handle:   func(el *Element) { el.SetInnerContent("gone") },
+			input:    `<div class="wide ad"><p>Buy <b>now</b></p></div><div>kept</div>`,
+			want:     `<div class="wide ad">gone</div><div>kept</div>`,
+		},
+		{
+			name:     "remove",
+			selector: "aside",
+			handle:   func(el *Element) { el.Remove() },
+			input:    `<main><aside>Side <aside>nested</aside></aside><p>Text</p></main>`,
+			want:     `<main><p>Text</p></main>`,
+		},
+		{
+			name:     "replace",
+			selector: "blink",
+			handle:   func(el *Element) { el.Replace("<em>x</em>") },
+			input:    `a<blink>b</blink>c`,
+			want:     `a<em>x</em>c`,
+		},
+		{
+			name:     "remove and keep content",
+			selector: "font",
+			handle:   func(el *Element) { el.RemoveAndKeepContent() },
+			input:    `<p><font color="red">red <b>bold</b></font></p>`,
+			want:     `<p>red <b>bold</b></p>`,
+		},
+		{
+			name:     "void element",
+			selector: "br",
+			handle:   func(el *Element) { el.Append("ignored"); el.After("\n") },
+			input:    `a<br>b<br/>c`,
+			want:     "a<br>\nb<br/>\nc",
+		},
+		{
+			name:     "child combinator",
+			selector: "ul > li",
+			handle:   func(el *Element) { el.SetAttr("class", "top") },
+			input:    `<ul><li>a<ol><li>b</li></ol></li></ul>`,
+			want:     `<ul><li class="top">a<ol><li>b</li></ol></li></ul>`,
+		},
+		{
+			name:     "descendant combinator",
+			selector: "article p",
+			handle:   func(el *Element) { el.Before("*") },
+			input:    `<p>a</p><article><section><p>b</p></section></article>`,
+			want:     `<p>a</p><article><section>*<p>b</p></section></article>`,
+		},
+		{
+			name:     "implied end tags",
+			selector: "ul li",
+			handle:   func(el *Element) { el.Append("!") },
+			input:    `<ul><li>a<li>b</ul><li>c`,
+			want:     `<ul><li>a!<li>b!</ul><li>c`,
+		},
+		{
+			name:     "unclosed at end of document",
+			selector: "div",
+			handle:   func(el *Element) { el.Append("</div>") },
+			input:    `<div>open`,
+			want:     `<div>open</div>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := NewHTMLRewriter()
+			err := rw.OnElement(tt.selector, func(el *Element) error {
+				tt.handle(el)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rewrite(t, rw, tt.input); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTMLRewriterText(t *testing.T) {
+	rw := NewHTMLRewriter()
+	err := rw.OnText("p.shout", func(text *Text) error {
+		text.Replace(html.EscapeString(strings.ToUpper(text.Text())))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := rewrite(t, rw, `<p class="shout">fish &amp; chips<b>quiet</b></p><p>quiet</p>`)
+	want := `<p class="shout">FISH &amp; CHIPS<b>quiet</b></p><p>quiet</p>`
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestHTMLRewriterHandlerOrder(t *testing.T) {
+	rw := NewHTMLRewriter()
+	_ = rw.OnElement("a", func(el *Element) error {
+		el.SetAttr("class", "marked")
+		return nil
+	})
+	// Later handlers see changes made by earlier ones
+	_ = rw.OnElement("a.marked", func(el *Element) error {
+		el.After("!")
+		return nil
+	})
+
+	if got := rewrite(t, rw, `<a>x</a>`); got != `<a class="marked">x</a>!` {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestHTMLRewriterErrors(t *testing.T) {
+	rw := NewHTMLRewriter()
+	for _, selector := range []string{"", "a:hover", "a + b", "[href", "div,", "#"} {
+		if err := rw.OnElement(selector, func(el *Element) error { return nil }); err == nil {
+			t.Errorf("expected error for selector %q", selector)
+		}
+	}
+
+	handlerErr := errors.New("handler failed")
+	_ = rw.OnElement("b", func(el *Element) error { return handlerErr })
+	if err := rw.Rewrite(io.Discard, strings.NewReader("<p><b>x</b></p>")); !errors.Is(err, handlerErr) {
+		t.Errorf("expected handler error, got %v", err)
+	}
+
+	readErr := errors.New("read failed")
+	rw = NewHTMLRewriter()
+	if err := rw.Rewrite(io.Discard, iotest.ErrReader(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestHTMLRewriterLimits(t *testing.T) {
+	rw := NewHTMLRewriter()
+
+	// A tag too large to buffer
+	huge := `<a href="` + strings.Repeat("x", maxTokenSize) + `">x</a>`
+	if err := rw.Rewrite(io.Discard, strings.NewReader(huge)); !errors.Is(err, ErrTokenTooLarge) {
+		t.Errorf("expected ErrTokenTooLarge, got %v", err)
+	}
+
+	// Elements nested deeper than the limit; void elements don't count
+	deep := strings.Repeat("<div><br>", maxNestingDepth) + "x"
+	if err := rw.Rewrite(io.Discard, strings.NewReader(deep)); err != nil {
+		t.Errorf("unexpected error at the nesting limit: %v", err)
+	}
+	if err := rw.Rewrite(io.Discard, strings.NewReader("<div>"+deep)); !errors.Is(err, ErrNestingTooDeep) {
+		t.Errorf("expected ErrNestingTooDeep, got %v", err)
+	}
+}
+
+func TestHTMLRewriterStreams(t *testing.T) {
+	rw := NewHTMLRewriter()
+	_ = rw.OnElement("p", func(el *Element) error {
+		el.SetAttr("data-seen", "1")
+		return nil
+	})
+
+	// Output is produced as input arrives, one byte at a time
+	input := strings.Repeat("<p>paragraph</p>", 1000)
+	out, err := io.ReadAll(rw.Reader(iotest.OneByteReader(strings.NewReader(input))))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if want := strings.Repeat(`<p data-seen="1">paragraph</p>`, 1000); string(out) != want {
+		t.Errorf("unexpected output of %d bytes", len(out))
+	}
+}
+
+func TestSelectorMatching(t *testing.T) {
+	el := &elementInfo{tag: "a", attrs: attrs("id", "home", "class", "nav  primary", "lang", "en-US", "href", "https://x.test/")}
+	parent := &elementInfo{tag: "nav", attrs: attrs("class", "site")}
+	ancestors := []*elementInfo{{tag: "body"}, parent}
+
+	tests := map[string]bool{
+		"a":                      true,
+		"*":                      true,
+		"A":                      true,
+		"span":                   false,
+		"#home":                  true,
+		"a#other":                false,
+		".nav.primary":           true,
+		".nav.secondary":         false,
+		"[href]":                 true,
+		"[title]":                false,
+		"[class~=primary]":       true,
+		"[lang|=en]":             true,
+		"[href$='/']":            true,
+		`[href*="x.test"]`:       true,
+		"[href^=http]":           true,
+		"[href^=ftp]":            false,
+		"nav > a":                true,
+		"body > a":               false,
+		"body a":                 true,
+		"body nav.site > a.nav":  true,
+		"span, a.primary":        true,
+		"header a":               false,
+		"body > nav > a[href]":   true,
+		"body > nav > a[target]": false,
+	}
+	for source, want := range tests {
+		selectors, err := parseSelectorList(source)
+		if err != nil {
+			t.Errorf("%q: %v", source, err)
+			continue
+		}
+		if got := matchesAny(selectors, el, ancestors); got != want {
+			t.Errorf("%q matched = %v, want %v", source, got, want)
+		}
+	}
+}
+
+// attrs builds attributes from alternating keys and values
+func attrs(kv ...string) []html.Attribute {
+	var result []html.Attribute
+	for i := 0; i < len(kv); i += 2 {
+		result = append(result, html.Attribute{Key: kv[i], Val: kv[i+1]})
+	}
+	return result
+}
@@ -0,0 +1,314 @@
+package xrpplugin
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// selector is a parsed complex selector: compound selectors joined by
+// combinators, leftmost first
+type selector []compoundSelector
+
+// compoundSelector matches a single element
+type compoundSelector struct {
+	// combinator relates this compound to the one before it: ' ' for a descendant,
+	// '>' for a child. It is unused for the first compound.
+	combinator byte
+	tag        string // "" matches any element
+	id         string
+	classes    []string
+	attrs      []attrSelector
+}
+
+// attrSelector matches an attribute: op is "" for presence, or one of =, ~=, |=,
+// ^=, $=, *=
+type attrSelector struct {
+	name  string
+	op    string
+	value string
+}
+
+// elementInfo is what selectors match against: an element's tag name and attributes
+type elementInfo struct {
+	tag   string
+	attrs []html.Attribute
+}
+
+func (e *elementInfo) attr(name string) (string, bool) {
+	for _, attr := range e.attrs {
+		if attr.Namespace == "" && attr.Key == name {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// parseSelectorList parses a comma-separated list of selectors. The supported
+// syntax is type and universal selectors, #id, .class, attribute selectors, and
+// the descendant and child combinators.
+func parseSelectorList(s string) ([]selector, error) {
+	var selectors []selector
+	for _, part := range strings.Split(s, ",") {
+		sel, err := parseSelector(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %w", s, err)
+		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
+
+func parseSelector(s string) (selector, error) {
+	p := &selectorParser{s: strings.TrimSpace(s)}
+	if p.s == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	var sel selector
+	combinator := byte(' ')
+	for {
+		compound, err := p.compound()
+		if err != nil {
+			return nil, err
+		}
+		compound.combinator = combinator
+		sel = append(sel, compound)
+
+		sawSpace := p.skipSpace()
+		if p.done() {
+			return sel, nil
+		}
+		switch p.peek() {
+		case '>':
+			p.pos++
+			p.skipSpace()
+			combinator = '>'
+		case '+', '~':
+			return nil, fmt.Errorf("unsupported combinator %q", p.peek())
+		default:
+			if !sawSpace {
+				return nil, fmt.Errorf("unexpected %q at offset %d", p.peek(), p.pos)
+			}
+			combinator = ' '
+		}
+	}
+}
+
+type selectorParser struct {
+	s   string
+	pos int
+}
+
+func (p *selectorParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *selectorParser) peek() byte {
+	return p.s[p.pos]
+}
+
+func (p *selectorParser) skipSpace() bool {
+	start := p.pos
+	for !p.done() && isSelectorSpace(p.peek()) {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+// compound parses a compound selector, such as a.external[href^="https:"]
+func (p *selectorParser) compound() (compoundSelector, error) {
+	var c compoundSelector
+	start := p.pos
+
+	if !p.done() && p.peek() == '*' {
+		p.pos++
+	} else if name := p.ident(); name != "" {
+		c.tag = strings.ToLower(name)
+	}
+
+	for !p.done() {
+		switch p.peek() {
+		case '#':
+			p.pos++
+			if c.id = p.ident(); c.id == "" {
+				return c, fmt.Errorf("expected an ID at offset %d", p.pos)
+			}
+		case '.':
+			p.pos++
+			class := p.ident()
+			if class == "" {
+				return c, fmt.Errorf("expected a class name at offset %d", p.pos)
+			}
+			c.classes = append(c.classes, class)
+		case '[':
+			p.pos++
+			attr, err := p.attr()
+			if err != nil {
+				return c, err
+			}
+			c.attrs = append(c.attrs, attr)
+		case ':':
+			return c, fmt.Errorf("pseudo-classes are not supported")
+		default:
+			if p.pos == start {
+				return c, fmt.Errorf("unexpected %q at offset %d", p.peek(), p.pos)
+			}
+			return c, nil
+		}
+	}
+	if p.pos == start {
+		return c, fmt.Errorf("expected a selector at offset %d", p.pos)
+	}
+	return c, nil
+}
+
+// attr parses the rest of an attribute selector after its opening bracket
+func (p *selectorParser) attr() (attrSelector, error) {
+	var a attrSelector
+	p.skipSpace()
+	if a.name = strings.ToLower(p.ident()); a.name == "" {
+		return a, fmt.Errorf("expected an attribute name at offset %d", p.pos)
+	}
+	p.skipSpace()
+	if p.done() {
+		return a, fmt.Errorf("unterminated attribute selector")
+	}
+	if p.peek() == ']' {
+		p.pos++
+		return a, nil
+	}
+
+	for _, op := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			a.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if a.op == "" {
+		return a, fmt.Errorf("unexpected %q in attribute selector at offset %d", p.peek(), p.pos)
+	}
+
+	p.skipSpace()
+	if !p.done() && (p.peek() == '"' || p.peek() == '\'') {
+		quote := p.peek()
+		end := strings.IndexByte(p.s[p.pos+1:], quote)
+		if end < 0 {
+			return a, fmt.Errorf("unterminated string in attribute selector")
+		}
+		a.value = p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+	} else if a.value = p.ident(); a.value == "" {
+		return a, fmt.Errorf("expected an attribute value at offset %d", p.pos)
+	}
+
+	p.skipSpace()
+	if p.done() || p.peek() != ']' {
+		return a, fmt.Errorf("unterminated attribute selector")
+	}
+	p.pos++
+	return a, nil
+}
+
+// ident consumes a CSS identifier, returning "" if there isn't one
+func (p *selectorParser) ident() string {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if c == '-' || c == '_' || c >= 0x80 ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos]
+}
+
+func isSelectorSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// matches reports whether the selector matches el, given its open ancestors
+// (outermost first)
+func (s selector) matches(el *elementInfo, ancestors []*elementInfo) bool {
+	return s.matchAt(len(s)-1, el, ancestors)
+}
+
+func (s selector) matchAt(i int, el *elementInfo, ancestors []*elementInfo) bool {
+	if !s[i].matches(el) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+
+	if s[i].combinator == '>' {
+		if len(ancestors) == 0 {
+			return false
+		}
+		last := len(ancestors) - 1
+		return s.matchAt(i-1, ancestors[last], ancestors[:last])
+	}
+	for j := len(ancestors) - 1; j >= 0; j-- {
+		if s.matchAt(i-1, ancestors[j], ancestors[:j]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compoundSelector) matches(el *elementInfo) bool {
+	if c.tag != "" && c.tag != el.tag {
+		return false
+	}
+	if c.id != "" {
+		if id, _ := el.attr("id"); id != c.id {
+			return false
+		}
+	}
+	if len(c.classes) > 0 {
+		class, _ := el.attr("class")
+		classes := strings.Fields(class)
+		for _, want := range c.classes {
+			if !slices.Contains(classes, want) {
+				return false
+			}
+		}
+	}
+	for _, attr := range c.attrs {
+		if !attr.matches(el) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *attrSelector) matches(el *elementInfo) bool {
+	val, ok := el.attr(a.name)
+	if !ok {
+		return false
+	}
+
+	switch a.op {
+	case "":
+		return true
+	case "=":
+		return val == a.value
+	case "~=":
+		return slices.Contains(strings.Fields(val), a.value)
+	case "|=":
+		return val == a.value || strings.HasPrefix(val, a.value+"-")
+	case "^=":
+		return a.value != "" && strings.HasPrefix(val, a.value)
+	case "$=":
+		return a.value != "" && strings.HasSuffix(val, a.value)
+	case "*=":
+		return a.value != "" && strings.Contains(val, a.value)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+// Package xrpremote lets XRP plugins run out of process.
+//
+// Instead of being compiled as a Go plugin (.so) and loaded into the proxy, a remote
+// plugin is an ordinary program. XRP either launches it as a subprocess and talks to it
+// over stdin/stdout ("type": "exec"), or dials a Unix socket it listens on
+// ("type": "socket"). Remote plugins don't need to match XRP's toolchain or
+// dependency versions, can be restarted independently, and can't crash the proxy.
+//
+// Writing a remote plugin in Go is as easy as writing an in-process one:
+//
+//	type MyPlugin struct{}
+//
+//	func (p *MyPlugin) ProcessHTMLTree(ctx context.Context, url *url.URL, node *html.Node) error { ... }
+//	func (p *MyPlugin) ProcessXMLTree(ctx context.Context, url *url.URL, doc *etree.Document) error { ... }
+//
+//	func main() {
+//	    if err := xrpremote.Serve(&MyPlugin{}); err != nil {
+//	        log.Fatal(err)
+//	    }
+//	}
+//
+// Serve accepts implementations of xrpplugin.Plugin or xrpplugin.PluginV2, and calls
+// Configure on plugins implementing xrpplugin.Configurable.
+//
+// # Protocol
+//
+// Plugins written in other languages can implement the protocol directly. XRP sends a
+// stream of JSON-encoded Request values and the plugin replies to each, in order, with
+// a JSON-encoded Response carrying the same ID. A "configure" request is always sent
+// first on every new connection or process. To process several documents at once, XRP
+// runs several processes of an exec plugin, or opens several connections to a socket
+// plugin, each carrying one request at a time. For "process" requests the plugin returns
+// the complete modified document and, optionally, the complete response header map,
+// which replaces the response's headers. If the plugin omits "response_header" (or
+// sends null), the response's headers are left unchanged; to remove every header it
+// sends an empty map.
+package xrpremote
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Request types
+const (
+	// TypeConfigure delivers the plugin's options from the XRP configuration
+	TypeConfigure = "configure"
+	// TypeProcess asks the plugin to process a document
+	TypeProcess = "process"
+)
+
+// Document types
+const (
+	DocumentHTML = "html"
+	DocumentXML  = "xml"
+)
+
+// Request is a message sent from XRP to a remote plugin.
+type Request struct {
+	ID   uint64 `json:"id"`
+	Type string `json:"type"`
+
+	// Options is set for TypeConfigure requests.
+	Options json.RawMessage `json:"options,omitempty"`
+
+	// The remaining fields are set for TypeProcess requests.
+	DocumentType   string           `json:"document_type,omitempty"`
+	Document       string           `json:"document,omitempty"`
+	Request        *RequestMetadata `json:"request,omitempty"`
+	StatusCode     int              `json:"status_code,omitempty"`
+	ResponseHeader http.Header      `json:"response_header,omitempty"`
+}
+
+// RequestMetadata describes the client request a document is being processed for.
+type RequestMetadata struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Header   http.Header `json:"header,omitempty"`
+	ClientIP string      `json:"client_ip,omitempty"`
+}
+
+// Response is a remote plugin's reply to a Request.
+type Response struct {
+	ID uint64 `json:"id"`
+
+	// Error is non-empty if the request failed.
+	Error string `json:"error,omitempty"`
+
+	// Document and ResponseHeader are the processed document and the complete
+	// (possibly modified) response header map, for TypeProcess requests. A nil
+	// ResponseHeader leaves the response's headers unchanged.
+	Document       string      `json:"document,omitempty"`
+	ResponseHeader http.Header `json:"response_header"`
+}
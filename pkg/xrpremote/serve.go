@@ -0,0 +1,179 @@
+package xrpremote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
+
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
+)
+
+// Serve runs plugin as an exec-type remote plugin, reading requests from stdin and
+// writing responses to stdout. It returns nil when XRP closes stdin.
+// Plugins must not write anything else to stdout; use stderr for logging.
+func Serve(plugin any) error {
+	return ServeConn(plugin, os.Stdin, os.Stdout)
+}
+
+// ListenAndServe runs plugin as a socket-type remote plugin listening on the Unix
+// socket at socketPath. Each connection from XRP is served concurrently.
+func ListenAndServe(socketPath string, plugin any) error {
+	if _, err := toPluginV2(plugin); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			_ = ServeConn(plugin, conn, conn)
+		}()
+	}
+}
+
+// ServeConn serves requests read from r, writing responses to w, until r is exhausted.
+func ServeConn(plugin any, r io.Reader, w io.Writer) error {
+	v2, err := toPluginV2(plugin)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(r)
+	encoder := json.NewEncoder(w)
+
+	for {
+		var req Request
+		if err := decoder.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+
+		resp := handleRequest(plugin, v2, &req)
+		if err := encoder.Encode(resp); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+}
+
+func toPluginV2(plugin any) (xrpplugin.PluginV2, error) {
+	switch p := plugin.(type) {
+	case xrpplugin.PluginV2:
+		return p, nil
+	case xrpplugin.Plugin:
+		return xrpplugin.AdaptPlugin(p), nil
+	default:
+		return nil, fmt.Errorf("plugin must implement xrpplugin.Plugin or xrpplugin.PluginV2")
+	}
+}
+
+func handleRequest(plugin any, v2 xrpplugin.PluginV2, req *Request) *Response {
+	resp := &Response{ID: req.ID}
+
+	var err error
+	switch req.Type {
+	case TypeConfigure:
+		if configurable, ok := plugin.(xrpplugin.Configurable); ok {
+			err = configurable.Configure(req.Options)
+		}
+	case TypeProcess:
+		err = process(v2, req, resp)
+	default:
+		err = fmt.Errorf("unknown request type %q", req.Type)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func process(plugin xrpplugin.PluginV2, req *Request, resp *Response) error {
+	pctx, err := NewProcessingContext(req)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch req.DocumentType {
+	case DocumentHTML:
+		node, err := html.Parse(bytes.NewReader([]byte(req.Document)))
+		if err != nil {
+			return fmt.Errorf("failed to parse HTML: %w", err)
+		}
+		if err := plugin.ProcessHTML(ctx, pctx, node); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := html.Render(&buf, node); err != nil {
+			return fmt.Errorf("failed to render HTML: %w", err)
+		}
+		resp.Document = buf.String()
+	case DocumentXML:
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(req.Document); err != nil {
+			return fmt.Errorf("failed to parse XML: %w", err)
+		}
+		if err := plugin.ProcessXML(ctx, pctx, doc); err != nil {
+			return err
+		}
+		output, err := doc.WriteToString()
+		if err != nil {
+			return fmt.Errorf("failed to serialize XML: %w", err)
+		}
+		resp.Document = output
+	default:
+		return fmt.Errorf("unknown document type %q", req.DocumentType)
+	}
+
+	resp.ResponseHeader = pctx.ResponseHeader()
+	return nil
+}
+
+// NewProcessingContext builds the xrpplugin.ProcessingContext described by a process request.
+func NewProcessingContext(req *Request) (*xrpplugin.ProcessingContext, error) {
+	httpReq := &http.Request{Header: make(http.Header)}
+	clientIP := ""
+
+	if req.Request != nil {
+		u, err := url.Parse(req.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request URL: %w", err)
+		}
+		httpReq.Method = req.Request.Method
+		httpReq.URL = u
+		httpReq.Host = req.Request.Host
+		if req.Request.Header != nil {
+			httpReq.Header = req.Request.Header
+		}
+		clientIP = req.Request.ClientIP
+	}
+
+	responseHeader := req.ResponseHeader
+	if responseHeader == nil {
+		responseHeader = make(http.Header)
+	}
+
+	return xrpplugin.NewProcessingContext(httpReq, clientIP, req.StatusCode, responseHeader), nil
+}
@@ -0,0 +1,171 @@
+package xrpremote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"github.com/beevik/etree"
+
+	"github.com/cdzombak/xrp/pkg/xrpplugin"
+)
+
+type testPlugin struct {
+	Suffix string `json:"suffix"`
+}
+
+func (p *testPlugin) Configure(options json.RawMessage) error {
+	return json.Unmarshal(options, p)
+}
+
+func (p *testPlugin) ProcessHTML(ctx context.Context, pctx *xrpplugin.ProcessingContext, node *html.Node) error {
+	if pctx.RequestHeader("X-Fail") != "" {
+		return errors.New("asked to fail")
+	}
+	pctx.ResponseHeader().Set("X-Path", pctx.URL().Path+p.Suffix)
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: pctx.Method() + " " + pctx.ClientIP()})
+	return nil
+}
+
+func (p *testPlugin) ProcessXML(ctx context.Context, pctx *xrpplugin.ProcessingContext, doc *etree.Document) error {
+	doc.Root().CreateAttr("status", http.StatusText(pctx.StatusCode()))
+	return nil
+}
+
+type legacyPlugin struct{}
+
+func (p *legacyPlugin) ProcessHTMLTree(ctx context.Context, u *url.URL, node *html.Node) error {
+	node.AppendChild(&html.Node{Type: html.CommentNode, Data: u.Path})
+	return nil
+}
+
+func (p *legacyPlugin) ProcessXMLTree(ctx context.Context, u *url.URL, doc *etree.Document) error {
+	return nil
+}
+
+func roundTrip(t *testing.T, plugin any, requests ...Request) []Response {
+	t.Helper()
+
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for i := range requests {
+		if err := encoder.Encode(&requests[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var output bytes.Buffer
+	if err := ServeConn(plugin, &input, &output); err != nil {
+		t.Fatalf("ServeConn failed: %v", err)
+	}
+
+	var responses []Response
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var resp Response
+		if err := decoder.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, resp)
+	}
+	if len(responses) != len(requests) {
+		t.Fatalf("expected %d responses, got %d", len(requests), len(responses))
+	}
+	return responses
+}
+
+func TestServeConn(t *testing.T) {
+	responses := roundTrip(t, &testPlugin{},
+		Request{ID: 1, Type: TypeConfigure, Options: json.RawMessage(`{"suffix":"!"}`)},
+		Request{
+			ID:           2,
+			Type:         TypeProcess,
+			DocumentType: DocumentHTML,
+			Document:     "<html><head></head><body><p>hi</p></body></html>",
+			Request: &RequestMetadata{
+				Method:   "GET",
+				URL:      "http://example.com/page?q=1",
+				Host:     "example.com",
+				ClientIP: "192.0.2.1",
+			},
+			StatusCode:     200,
+			ResponseHeader: http.Header{"Content-Type": {"text/html"}},
+		},
+		Request{
+			ID:           3,
+			Type:         TypeProcess,
+			DocumentType: DocumentXML,
+			Document:     "<rss/>",
+			StatusCode:   200,
+		},
+		Request{
+			ID:           4,
+			Type:         TypeProcess,
+			DocumentType: DocumentHTML,
+			Document:     "<html></html>",
+			Request:      &RequestMetadata{URL: "/", Header: http.Header{"X-Fail": {"1"}}},
+		},
+		Request{ID: 5, Type: "bogus"},
+	)
+
+	if responses[0].ID != 1 || responses[0].Error != "" {
+		t.Errorf("unexpected configure response: %+v", responses[0])
+	}
+
+	if responses[1].ID != 2 || responses[1].Error != "" {
+		t.Fatalf("unexpected process response: %+v", responses[1])
+	}
+	if !strings.Contains(responses[1].Document, "<!--GET 192.0.2.1-->") {
+		t.Errorf("expected processed HTML, got %s", responses[1].Document)
+	}
+	if responses[1].ResponseHeader.Get("X-Path") != "/page!" {
+		t.Errorf("expected configured plugin to set X-Path, got %q", responses[1].ResponseHeader.Get("X-Path"))
+	}
+	if responses[1].ResponseHeader.Get("Content-Type") != "text/html" {
+		t.Error("expected existing response headers to be returned")
+	}
+
+	if !strings.Contains(responses[2].Document, `status="OK"`) {
+		t.Errorf("expected processed XML, got %s", responses[2].Document)
+	}
+
+	if responses[3].Error != "asked to fail" {
+		t.Errorf("expected plugin error, got %q", responses[3].Error)
+	}
+	if responses[4].Error == "" {
+		t.Error("expected error for unknown request type")
+	}
+}
+
+func TestServeConn_LegacyPlugin(t *testing.T) {
+	responses := roundTrip(t, &legacyPlugin{},
+		Request{ID: 1, Type: TypeConfigure, Options: json.RawMessage(`{}`)},
+		Request{
+			ID:           2,
+			Type:         TypeProcess,
+			DocumentType: DocumentHTML,
+			Document:     "<html></html>",
+			Request:      &RequestMetadata{URL: "/legacy"},
+		},
+	)
+
+	if responses[0].Error != "" {
+		t.Errorf("expected configure to be a no-op for non-configurable plugins, got %q", responses[0].Error)
+	}
+	if !strings.Contains(responses[1].Document, "<!--/legacy-->") {
+		t.Errorf("expected legacy plugin output, got %s", responses[1].Document)
+	}
+}
+
+func TestServeConn_InvalidPlugin(t *testing.T) {
+	if err := ServeConn("not a plugin", strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Error("expected error for value that isn't a plugin")
+	}
+}